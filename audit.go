@@ -0,0 +1,222 @@
+package dswg
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// A change made to a database, recorded in the same transaction as the
+// change. Before and After hold the changed link, peer, IPAM or Config
+// as JSON, with private and preshared keys redacted.
+type AuditEntry struct {
+	ID        int64           `json:"id"`
+	Time      time.Time       `json:"time"`
+	Actor     string          `json:"actor"`
+	Operation string          `json:"operation"`      // DB method, ex. "UpdatePeer"
+	Link      string          `json:"link,omitempty"` // name the method was called with
+	Peer      string          `json:"peer,omitempty"`
+	Before    json.RawMessage `json:"before,omitempty"` // null when created
+	After     json.RawMessage `json:"after,omitempty"`  // null when removed
+}
+
+// Selects the entries returned by AuditLog, zero fields match every entry.
+type AuditFilter struct {
+	Link      string
+	Peer      string
+	Actor     string
+	Operation string
+	Since     time.Time // entries at or after
+	Until     time.Time // entries before
+}
+
+// Value of the redacted keys in audit entries.
+const redactedKey = "[redacted]"
+
+// Times are stored as text in UTC, with a fixed number of digits so they
+// sort as text.
+const auditTimeFormat = "2006-01-02T15:04:05.000000Z"
+
+// Returns the name of the user running the process, the actor of the
+// changes made by databases that weren't given one.
+func defaultActor() string {
+	current, err := user.Current()
+	if err != nil {
+		return fmt.Sprintf("uid:%v", os.Getuid())
+	}
+	return current.Username
+}
+
+// Returns v as JSON with its keys redacted, nil if v is nil.
+func redactedJSON(v interface{}) (json.RawMessage, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for _, name := range []string{"PrivateKey", "PresharedKey"} {
+		if fields[name] != nil {
+			fields[name] = redactedKey
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// Stores a JSON value as text, NULL if it is empty.
+type auditJSON json.RawMessage
+
+func (j auditJSON) Value() (driver.Value, error) {
+	if len(j) == 0 {
+		return nil, nil
+	}
+	return string(j), nil
+}
+
+// Records a change made by the transaction, before and after being the
+// changed values, nil if there were none.
+func writeAudit(tx sqlx.Ext, actor, op, link, peer string, before, after interface{}) error {
+	beforeJSON, err := redactedJSON(before)
+	if err != nil {
+		return err
+	}
+
+	afterJSON, err := redactedJSON(after)
+	if err != nil {
+		return err
+	}
+
+	const insertStmt = `
+		INSERT INTO audit_log
+		(changed_at, actor, operation, link, peer, before_state, after_state)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err = tx.Exec(tx.Rebind(insertStmt),
+		time.Now().UTC().Format(auditTimeFormat), actor, op, link, peer,
+		auditJSON(beforeJSON), auditJSON(afterJSON))
+	return err
+}
+
+// A row of audit_log, times being read as text from sqlite and as time
+// from postgres.
+type auditRow struct {
+	ID        int64       `db:"id"`
+	Time      interface{} `db:"changed_at"`
+	Actor     string      `db:"actor"`
+	Operation string      `db:"operation"`
+	Link      string      `db:"link"`
+	Peer      string      `db:"peer"`
+	Before    *string     `db:"before_state"`
+	After     *string     `db:"after_state"`
+}
+
+// Lists the entries matching the filter, oldest first. states are the
+// expressions reading the before_state and after_state columns as text.
+func queryAuditLog(db sqlx.Ext, filter AuditFilter, states string) ([]AuditEntry, error) {
+	conds := []string{"1 = 1"}
+	var args []interface{}
+	for _, cond := range []struct {
+		column, value string
+	}{
+		{"link", filter.Link},
+		{"peer", filter.Peer},
+		{"actor", filter.Actor},
+		{"operation", filter.Operation},
+	} {
+		if len(cond.value) > 0 {
+			conds = append(conds, cond.column+" = ?")
+			args = append(args, cond.value)
+		}
+	}
+	if !filter.Since.IsZero() {
+		conds = append(conds, "changed_at >= ?")
+		args = append(args, filter.Since.UTC().Format(auditTimeFormat))
+	}
+	if !filter.Until.IsZero() {
+		conds = append(conds, "changed_at < ?")
+		args = append(args, filter.Until.UTC().Format(auditTimeFormat))
+	}
+
+	query := `
+		SELECT id, changed_at, actor, operation, link, peer, ` + states + `
+		FROM audit_log
+		WHERE ` + strings.Join(conds, " AND ") + `
+		ORDER BY id`
+	var rows []auditRow
+	err := sqlx.Select(db, &rows, db.Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]AuditEntry, len(rows))
+	for i, row := range rows {
+		entry := AuditEntry{
+			ID:        row.ID,
+			Actor:     row.Actor,
+			Operation: row.Operation,
+			Link:      row.Link,
+			Peer:      row.Peer,
+		}
+		switch t := row.Time.(type) {
+		case time.Time:
+			entry.Time = t
+		case string:
+			entry.Time, err = time.Parse(auditTimeFormat, t)
+		case []byte:
+			entry.Time, err = time.Parse(auditTimeFormat, string(t))
+		default:
+			err = fmt.Errorf("Invalid audit log time %v", t)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if row.Before != nil {
+			entry.Before = json.RawMessage(*row.Before)
+		}
+		if row.After != nil {
+			entry.After = json.RawMessage(*row.After)
+		}
+		entries[i] = entry
+	}
+	return entries, nil
+}
+
+// Writes the entries as JSON Lines, one entry per line.
+func ExportAuditLog(w io.Writer, entries []AuditEntry) error {
+	encoder := json.NewEncoder(w)
+	for _, entry := range entries {
+		err := encoder.Encode(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Record the changes made by the client as done by actor instead of the
+// user running the process, see DB.WithActor.
+func WithActor(actor string) ClientOption {
+	return func(c *Client) {
+		c.db = c.db.WithActor(actor)
+	}
+}
+
+// Lists the changes made to the database matching the filter, oldest
+// first.
+func (c *Client) AuditLog(filter AuditFilter) ([]AuditEntry, error) {
+	return c.db.AuditLog(filter)
+}
@@ -0,0 +1,114 @@
+package dswg
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactedJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	testpeer := basePeer()
+	testpeer.PresharedKey = nil
+	data, err := redactedJSON(testpeer)
+	assert.Nil(err)
+
+	var fields map[string]interface{}
+	assert.Nil(json.Unmarshal(data, &fields))
+	assert.Equal(testpeer.Name, fields["Name"])
+	assert.Equal(testpeer.PublicKey.String(), fields["PublicKey"])
+	assert.Nil(fields["PresharedKey"])
+	assert.Nil(fields["PrivateKey"])
+
+	data, err = redactedJSON(baseLink())
+	assert.Nil(err)
+	assert.NotContains(string(data), baseLink().PrivateKey.String())
+	assert.Contains(string(data), `"PrivateKey":"[redacted]"`)
+
+	data, err = redactedJSON(nil)
+	assert.Nil(err)
+	assert.Nil(data)
+}
+
+func TestAuditLogAppendOnly(t *testing.T) {
+	assert := assert.New(t)
+
+	db := setupDB()
+	defer db.Close()
+	db.AddLink(baseLink())
+
+	conn := db.(*sqliteDB).conn
+	_, err := conn.Exec("UPDATE audit_log SET actor = 'nobody'")
+	assert.NotNil(err)
+	_, err = conn.Exec("DELETE FROM audit_log")
+	assert.NotNil(err)
+
+	entries, err := db.AuditLog(AuditFilter{})
+	assert.Nil(err)
+	assert.Len(entries, 1)
+	assert.Equal(defaultActor(), entries[0].Actor)
+}
+
+func TestAuditLogRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	db := setupDB()
+	defer db.Close()
+
+	// Changes are not made if they can't be recorded
+	conn := db.(*sqliteDB).conn
+	_, err := conn.Exec(`
+		CREATE TRIGGER audit_log_fail BEFORE INSERT ON audit_log
+		BEGIN SELECT RAISE(ABORT, 'Audit log is full'); END`)
+	assert.Nil(err)
+
+	err = db.AddLink(baseLink())
+	assert.NotNil(err)
+	_, err = db.GetLink(baseLink().Name)
+	assert.NotNil(err)
+}
+
+func TestExportAuditLog(t *testing.T) {
+	assert := assert.New(t)
+
+	entries := []AuditEntry{
+		{ID: 1, Time: time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC), Actor: "root",
+			Operation: "AddLink", Link: "wg-linko", After: json.RawMessage(`{"Name":"wg-linko"}`)},
+		{ID: 2, Time: time.Date(2020, 5, 1, 12, 30, 0, 0, time.UTC), Actor: "root",
+			Operation: "RemoveLink", Link: "wg-linko", Before: json.RawMessage(`{"Name":"wg-linko"}`)},
+	}
+
+	var buf bytes.Buffer
+	err := ExportAuditLog(&buf, entries)
+	assert.Nil(err)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal([]string{
+		`{"id":1,"time":"2020-05-01T12:00:00Z","actor":"root","operation":"AddLink","link":"wg-linko","after":{"Name":"wg-linko"}}`,
+		`{"id":2,"time":"2020-05-01T12:30:00Z","actor":"root","operation":"RemoveLink","link":"wg-linko","before":{"Name":"wg-linko"}}`,
+	}, lines)
+}
+
+func TestClientWithActor(t *testing.T) {
+	assert := assert.New(t)
+
+	kernel := NewFakeKernel()
+	client, _ := NewClientWithBackends(setupDB(), kernel, kernel, WithActor("api:zoz"))
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+	err = client.AddPeer(testlink.Name, routedPeer())
+	assert.Nil(err)
+
+	entries, err := client.AuditLog(AuditFilter{Actor: "api:zoz"})
+	assert.Nil(err)
+	assert.Len(entries, 2)
+	assert.Equal("AddPeer", entries[1].Operation)
+}
@@ -0,0 +1,75 @@
+package dswg
+
+import (
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Manages network links, their addresses and routes, and routing rules.
+// *netlink.Handle implements it on top of the kernel.
+type LinkManager interface {
+	LinkAdd(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+	LinkByName(name string) (netlink.Link, error)
+	LinkList() ([]netlink.Link, error)
+	LinkSetUp(link netlink.Link) error
+	LinkSetDown(link netlink.Link) error
+	LinkSetMTU(link netlink.Link, mtu int) error
+	LinkSetName(link netlink.Link, name string) error
+	LinkSetNsFd(link netlink.Link, fd int) error
+
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	AddrAdd(link netlink.Link, addr *netlink.Addr) error
+	AddrDel(link netlink.Link, addr *netlink.Addr) error
+
+	RouteAdd(route *netlink.Route) error
+	RouteReplace(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	RouteList(link netlink.Link, family int) ([]netlink.Route, error)
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
+
+	RuleAdd(rule *netlink.Rule) error
+	RuleDel(rule *netlink.Rule) error
+	RuleList(family int) ([]netlink.Rule, error)
+
+	// Releases the resources held by the manager.
+	Delete()
+}
+
+// Configures wireguard devices.
+// *wgctrl.Client implements it on top of the kernel.
+type WireGuardConfigurator interface {
+	Device(name string) (*wgtypes.Device, error)
+	ConfigureDevice(name string, cfg wgtypes.Config) error
+	Close() error
+}
+
+var (
+	_ LinkManager           = &netlink.Handle{}
+	_ WireGuardConfigurator = &wgctrl.Client{}
+)
+
+// Creates a client that manages links through the given backends instead
+// of the kernel of the current network namespace, ex. a FakeKernel.
+func NewClientWithBackends(db DB, links LinkManager, wg WireGuardConfigurator, opts ...ClientOption) (*Client, error) {
+	client := &Client{
+		db:         db,
+		wg:         wg,
+		ns:         links,
+		hooks:      NewHookRunner(),
+		namespaces: make(map[string]*Client),
+		metrics:    newClientMetrics(),
+	}
+
+	for _, opt := range opts {
+		opt(client)
+	}
+
+	// Probing for nftables is skipped if a firewall was given
+	if client.firewall == nil {
+		client.firewall = defaultFirewall()
+	}
+
+	return client, nil
+}
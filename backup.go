@@ -0,0 +1,563 @@
+package dswg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// Version of the backups written by Export. Import reads backups of this
+// version or older.
+const backupVersion = 1
+
+// How Export writes the private and preshared keys.
+type BackupSecrets string
+
+const (
+	SecretsPlain     BackupSecrets = "plain" // base64, like wg(8)
+	SecretsExcluded  BackupSecrets = "excluded"
+	SecretsEncrypted BackupSecrets = "encrypted" // with the master key of ExportOptions.Key
+)
+
+type ExportOptions struct {
+	Secrets BackupSecrets // SecretsPlain if empty
+	Key     KeyProvider   // needed with SecretsEncrypted
+}
+
+// How Import treats the links and peers missing from the backup.
+type ImportMode string
+
+const (
+	// Adds and updates the links and peers of the backup, and keeps the
+	// others.
+	ImportMerge ImportMode = "merge"
+	// Makes the database hold exactly the backup, removing the others.
+	ImportReplace ImportMode = "replace"
+)
+
+type ImportOptions struct {
+	Mode   ImportMode  // ImportMerge if empty
+	DryRun bool        // only reports the changes the import would make
+	Key    KeyProvider // needed for backups with encrypted secrets
+}
+
+// A link, peer, IPAM or Config changed by Import.
+type ImportChange struct {
+	Action DiffAction `json:"action"`
+	Kind   string     `json:"kind"` // "link", "peer", "ipam" or "config"
+	Link   string     `json:"link,omitempty"`
+	Peer   string     `json:"peer,omitempty"`
+}
+
+func (change ImportChange) String() string {
+	str := diffSymbol(change.Action) + " " + change.Kind
+	if len(change.Link) > 0 {
+		str += " " + change.Link
+	}
+	if len(change.Peer) > 0 {
+		str += "/" + change.Peer
+	}
+	return str
+}
+
+// Changes made by Import, in the order they were made, or would be made
+// by a dry run.
+type ImportReport struct {
+	Changes []ImportChange `json:"changes"`
+}
+
+// Indicates whether the database already held the backup.
+func (r *ImportReport) Empty() bool {
+	return len(r.Changes) == 0
+}
+
+// Renders the changes one per line, in the style of Plan.String.
+func (r *ImportReport) String() string {
+	if r.Empty() {
+		return "No changes, the database already holds the backup.\n"
+	}
+
+	var buf bytes.Buffer
+	for _, change := range r.Changes {
+		fmt.Fprintf(&buf, "%v\n", change)
+	}
+	return buf.String()
+}
+
+func (r *ImportReport) add(action DiffAction, kind, link, peer string) {
+	r.Changes = append(r.Changes, ImportChange{Action: action, Kind: kind, Link: link, Peer: peer})
+}
+
+// The document written by Export. The checksum covers the state as
+// compact JSON, so backups can be reindented but not edited.
+type backupDocument struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"` // "sha256:" and the hex digest
+	State    json.RawMessage `json:"state"`
+}
+
+type backupState struct {
+	Created time.Time     `json:"created"`
+	Secrets BackupSecrets `json:"secrets"`
+	// A zero key sealed like the others, telling wrong master keys apart
+	// from corrupted keys.
+	KeyCheck string       `json:"key_check,omitempty"`
+	Config   Config       `json:"config"`
+	Links    []backupLink `json:"links"`
+}
+
+// A link of a backup with its peers. The keys of links and peers are
+// written in plain, sealed like in the database, or left out, shadowing
+// the keys of Link and Peer.
+type backupLink struct {
+	Link
+	PrivateKey string `json:",omitempty"`
+	Peers      []backupPeer
+	IPAM       IPAM
+}
+
+type backupPeer struct {
+	Peer
+	PrivateKey   string `json:",omitempty"`
+	PresharedKey string `json:",omitempty"`
+}
+
+// Writes every link with its peers, allowed IPs and IPAM, and the Config
+// of db as a backup read by importDB.
+func exportDB(db DB, w io.Writer, opts ExportOptions) error {
+	state := backupState{Created: time.Now().UTC(), Secrets: opts.Secrets}
+	if len(state.Secrets) == 0 {
+		state.Secrets = SecretsPlain
+	}
+
+	var cipher *keyCipher
+	switch state.Secrets {
+	case SecretsPlain, SecretsExcluded:
+	case SecretsEncrypted:
+		if opts.Key == nil {
+			return errors.New("A master key is needed to encrypt the backup secrets")
+		}
+
+		var err error
+		cipher, err = masterKeyCipher(opts.Key)
+		if err != nil {
+			return err
+		}
+
+		check, err := cipher.seal(&Key{}, nil)
+		if err != nil {
+			return err
+		}
+		state.KeyCheck = check.String
+	default:
+		return fmt.Errorf("Invalid backup secrets %q", state.Secrets)
+	}
+
+	// Keys are written with seal, and dropped when excluded
+	seal := func(key *Key) (string, error) {
+		if state.Secrets == SecretsExcluded {
+			return "", nil
+		}
+		sealed, err := cipher.seal(key, nil)
+		return sealed.String, err
+	}
+
+	// The export is read in a single transaction, so it is a consistent
+	// snapshot even if other clients change the database meanwhile
+	err := db.Transaction(func(tx DB) error {
+		return state.readFrom(tx, seal)
+	})
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	doc := backupDocument{Version: backupVersion, Checksum: backupChecksum(data), State: data}
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(out, '\n'))
+	return err
+}
+
+// Reads the Config and the links of db into the backup, sealing their keys.
+func (state *backupState) readFrom(db DB, seal func(key *Key) (string, error)) error {
+	config, err := db.GetConfig()
+	if err != nil {
+		return err
+	}
+	state.Config = *config
+
+	links, err := db.ListLinks()
+	if err != nil {
+		return err
+	}
+
+	state.Links = []backupLink{}
+	for _, link := range links {
+		entry := backupLink{Link: link, Peers: []backupPeer{}}
+		entry.PrivateKey, err = seal(&link.PrivateKey)
+		if err != nil {
+			return err
+		}
+
+		peers, err := db.GetLinkPeers(link.Name)
+		if err != nil {
+			return err
+		}
+		for _, peer := range peers {
+			stored := backupPeer{Peer: peer}
+			stored.PrivateKey, err = seal(peer.PrivateKey)
+			if err != nil {
+				return err
+			}
+			stored.PresharedKey, err = seal(peer.PresharedKey)
+			if err != nil {
+				return err
+			}
+			entry.Peers = append(entry.Peers, stored)
+		}
+
+		ipam, err := db.GetIPAM(link.Name)
+		if err != nil {
+			return err
+		}
+		entry.IPAM = *ipam
+
+		state.Links = append(state.Links, entry)
+	}
+
+	return nil
+}
+
+func backupChecksum(state []byte) string {
+	sum := sha256.Sum256(state)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Reads a backup written by exportDB, checking its version and checksum.
+func readBackup(r io.Reader) (*backupState, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc backupDocument
+	err = json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, errorf(ErrInvalidBackup, "Backup isn't a valid dswg backup: %v", err)
+	}
+	if doc.Version < 1 || doc.Version > backupVersion {
+		return nil, errorf(ErrInvalidBackup,
+			"Backup version %v isn't supported, this version of dswg reads versions 1 to %v",
+			doc.Version, backupVersion)
+	}
+
+	var compact bytes.Buffer
+	err = json.Compact(&compact, doc.State)
+	if err != nil {
+		return nil, errorf(ErrInvalidBackup, "Backup isn't a valid dswg backup: %v", err)
+	}
+	if backupChecksum(compact.Bytes()) != doc.Checksum {
+		return nil, errorf(ErrInvalidBackup, "Backup checksum doesn't match, it was modified or corrupted")
+	}
+
+	var state backupState
+	err = json.Unmarshal(compact.Bytes(), &state)
+	if err != nil {
+		return nil, errorf(ErrInvalidBackup, "Backup isn't a valid dswg backup: %v", err)
+	}
+	return &state, nil
+}
+
+// Returns the links and peers of the backup with their keys. Keys left out
+// of the backup are taken from the links and peers of db, links missing
+// from db can't have their key left out.
+func (state *backupState) open(db DB, provider KeyProvider) ([]Link, map[string][]Peer, error) {
+	var cipher *keyCipher
+	switch state.Secrets {
+	case SecretsPlain, SecretsExcluded:
+	case SecretsEncrypted:
+		if provider == nil {
+			return nil, nil, errorf(ErrMasterKeyRequired,
+				"Backup keys are encrypted, a master key is needed to import it")
+		}
+
+		var err error
+		cipher, err = masterKeyCipher(provider)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		_, err = cipher.open(sql.NullString{String: state.KeyCheck, Valid: true}, nil)
+		if err != nil {
+			return nil, nil, errorf(ErrWrongMasterKey,
+				"Master key can't decrypt the backup keys, they were encrypted with another key")
+		}
+	default:
+		return nil, nil, errorf(ErrInvalidBackup, "Invalid backup secrets %q", state.Secrets)
+	}
+
+	open := func(value string) (*Key, error) {
+		return cipher.open(sql.NullString{String: value, Valid: len(value) > 0}, nil)
+	}
+
+	links := make([]Link, len(state.Links))
+	peers := make(map[string][]Peer)
+	for i, entry := range state.Links {
+		link := entry.Link
+		key, err := open(entry.PrivateKey)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		existing, _ := db.GetLink(link.Name)
+		switch {
+		case key != nil:
+			link.PrivateKey = *key
+		case existing != nil:
+			link.PrivateKey = existing.PrivateKey
+		default:
+			return nil, nil, invalid("PrivateKey",
+				"Backup has no private key for link %v, which isn't in the database", link.Name)
+		}
+		links[i] = link
+
+		peers[link.Name] = []Peer{}
+		for _, stored := range entry.Peers {
+			peer := stored.Peer
+			peer.PrivateKey, err = open(stored.PrivateKey)
+			if err != nil {
+				return nil, nil, err
+			}
+			peer.PresharedKey, err = open(stored.PresharedKey)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			if state.Secrets == SecretsExcluded && existing != nil {
+				if old, _ := db.GetPeer(link.Name, peer.Name); old != nil {
+					peer.PrivateKey, peer.PresharedKey = old.PrivateKey, old.PresharedKey
+				}
+			}
+			peers[link.Name] = append(peers[link.Name], peer)
+		}
+	}
+
+	return links, peers, nil
+}
+
+// Applies a backup written by exportDB to db, reporting the changes made.
+// The changes are made in a single transaction, so a failed import
+// changes nothing and reports no changes.
+func importDB(db DB, r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	switch opts.Mode {
+	case "":
+		opts.Mode = ImportMerge
+	case ImportMerge, ImportReplace:
+	default:
+		return nil, fmt.Errorf("Invalid import mode %q", opts.Mode)
+	}
+
+	state, err := readBackup(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// The import is made in a single transaction, so a failing step
+	// leaves the database as it was
+	var report *ImportReport
+	err = db.Transaction(func(tx DB) error {
+		report, err = state.importInto(tx, opts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Makes the changes importing the backup into db, unless it is a dry run,
+// and reports them.
+func (state *backupState) importInto(db DB, opts ImportOptions) (*ImportReport, error) {
+	links, peers, err := state.open(db, opts.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	// The changes are listed first, then made unless it is a dry run
+	report := &ImportReport{}
+	var steps []func() error
+	step := func(action DiffAction, kind, link, peer string, do func() error) {
+		report.add(action, kind, link, peer)
+		steps = append(steps, do)
+	}
+
+	config, err := db.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	if !sameJSON(*config, state.Config) {
+		step(DiffChanged, "config", "", "", func() error {
+			return db.SetConfig(state.Config)
+		})
+	}
+
+	inBackup := make(map[string]bool)
+	for _, link := range links {
+		inBackup[link.Name] = true
+	}
+
+	if opts.Mode == ImportReplace {
+		existing, err := db.ListLinks()
+		if err != nil {
+			return nil, err
+		}
+		for _, link := range existing {
+			if !inBackup[link.Name] {
+				name := link.Name
+				step(DiffRemoved, "link", name, "", func() error {
+					return db.RemoveLink(name)
+				})
+			}
+		}
+	}
+
+	for i := range links {
+		link := links[i]
+		ipam := state.Links[i].IPAM
+		linkPeers := peers[link.Name]
+
+		existing, _ := db.GetLink(link.Name)
+		if existing == nil {
+			step(DiffAdded, "link", link.Name, "", func() error {
+				return db.AddLink(link)
+			})
+			for j := range linkPeers {
+				peer := linkPeers[j]
+				step(DiffAdded, "peer", link.Name, peer.Name, func() error {
+					return db.AddPeer(link.Name, peer)
+				})
+			}
+			if !sameJSON(ipam, IPAM{}) {
+				step(DiffChanged, "ipam", link.Name, "", func() error {
+					return db.SetIPAM(link.Name, ipam)
+				})
+			}
+			continue
+		}
+
+		if !sameJSON(*existing, link) {
+			step(DiffChanged, "link", link.Name, "", func() error {
+				return db.UpdateLink(link.Name, link)
+			})
+		}
+
+		oldPeers, err := db.GetLinkPeers(link.Name)
+		if err != nil {
+			return nil, err
+		}
+		diffPeers(link.Name, oldPeers, linkPeers, opts.Mode, db, step)
+
+		oldIPAM, err := db.GetIPAM(link.Name)
+		if err != nil {
+			return nil, err
+		}
+		if !sameJSON(*oldIPAM, ipam) {
+			step(DiffChanged, "ipam", link.Name, "", func() error {
+				return db.SetIPAM(link.Name, ipam)
+			})
+		}
+	}
+
+	if opts.DryRun {
+		return report, nil
+	}
+
+	for _, do := range steps {
+		if err := do(); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// Adds the steps changing the peers of an existing link from old to
+// peers. Peers are removed first and added last, so the ones added can
+// take the keys and allowed IPs of the ones removed.
+func diffPeers(linkName string, old, peers []Peer, mode ImportMode, db DB,
+	step func(action DiffAction, kind, link, peer string, do func() error)) {
+	current := make(map[string]Peer)
+	for _, peer := range old {
+		current[peer.Name] = peer
+	}
+	inBackup := make(map[string]bool)
+	for _, peer := range peers {
+		inBackup[peer.Name] = true
+	}
+
+	if mode == ImportReplace {
+		for _, peer := range old {
+			if !inBackup[peer.Name] {
+				name := peer.Name
+				step(DiffRemoved, "peer", linkName, name, func() error {
+					return db.RemovePeer(linkName, name)
+				})
+			}
+		}
+	}
+
+	var added []Peer
+	for i := range peers {
+		peer := peers[i]
+		existing, ok := current[peer.Name]
+		if !ok {
+			added = append(added, peer)
+			continue
+		}
+		if !sameJSON(existing, peer) {
+			step(DiffChanged, "peer", linkName, peer.Name, func() error {
+				return db.UpdatePeer(linkName, peer.Name, peer)
+			})
+		}
+	}
+
+	for i := range added {
+		peer := added[i]
+		step(DiffAdded, "peer", linkName, peer.Name, func() error {
+			return db.AddPeer(linkName, peer)
+		})
+	}
+}
+
+// Compares values by their JSON, so addresses parsed in different ways
+// compare equal.
+func sameJSON(a, b interface{}) bool {
+	dataA, errA := json.Marshal(a)
+	dataB, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(dataA, dataB)
+}
+
+// Writes a backup of the database, see DB.Export.
+func (c *Client) Export(w io.Writer, opts ExportOptions) error {
+	return c.db.Export(w, opts)
+}
+
+// Imports a backup into the database, see DB.Import. The kernel is left
+// as it is, Reconcile applies the imported links to it.
+func (c *Client) Import(r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	return c.db.Import(r, opts)
+}
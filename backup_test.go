@@ -0,0 +1,340 @@
+package dswg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Fills the database with links, peers with and without keys, IPAM and
+// Config to back up.
+func setupBackup(db DB) {
+	setupListPeers(db)
+
+	key, _ := wgtypes.GeneratePrivateKey()
+	testpeer := secondPeer()
+	testpeer.PrivateKey = &Key{key}
+	testpeer.PublicKey = Key{key.PublicKey()}
+	db.AddPeer("link1", testpeer)
+
+	ip, _ := ParseIP("10.6.6.9")
+	db.SetIPAM("link2", IPAM{Reservations: []IPReservation{{IP: *ip, PeerName: "tablet"}}})
+	db.SetConfig(Config{Enable: true, NATEnable: true, NATLink: "eth0"})
+}
+
+// Asserts both databases hold the same links, peers, IPAM and Config.
+func assertSameState(assert *assert.Assertions, expected, actual DB) {
+	expectedLinks, _ := expected.ListLinks()
+	actualLinks, err := actual.ListLinks()
+	assert.Nil(err)
+	assert.Equal(expectedLinks, actualLinks)
+
+	for _, link := range expectedLinks {
+		expectedPeers, _ := expected.GetLinkPeers(link.Name)
+		actualPeers, err := actual.GetLinkPeers(link.Name)
+		assert.Nil(err)
+		assert.Equal(expectedPeers, actualPeers)
+
+		expectedIPAM, _ := expected.GetIPAM(link.Name)
+		actualIPAM, err := actual.GetIPAM(link.Name)
+		assert.Nil(err)
+		assert.Equal(expectedIPAM, actualIPAM)
+	}
+
+	expectedConfig, _ := expected.GetConfig()
+	actualConfig, err := actual.GetConfig()
+	assert.Nil(err)
+	assert.Equal(expectedConfig, actualConfig)
+}
+
+func TestExportImport(t *testing.T) {
+	assert := assert.New(t)
+
+	source := setupDB()
+	defer source.Close()
+	setupBackup(source)
+
+	var backup bytes.Buffer
+	err := source.Export(&backup, ExportOptions{})
+	assert.Nil(err)
+
+	var doc backupDocument
+	assert.Nil(json.Unmarshal(backup.Bytes(), &doc))
+	assert.Equal(backupVersion, doc.Version)
+	assert.True(strings.HasPrefix(doc.Checksum, "sha256:"))
+
+	target := setupDB()
+	defer target.Close()
+	report, err := target.Import(bytes.NewReader(backup.Bytes()), ImportOptions{})
+	assert.Nil(err)
+	assert.Equal([]string{
+		"~ config", "+ link link1", "+ peer link1/phone", "+ peer link1/laptop",
+		"+ peer link1/second", "+ link link2", "+ peer link2/phone",
+		"+ peer link2/laptop", "~ ipam link2",
+	}, strings.Split(strings.TrimSpace(report.String()), "\n"))
+	assertSameState(assert, source, target)
+
+	// Importing the backup again changes nothing
+	report, err = target.Import(bytes.NewReader(backup.Bytes()), ImportOptions{})
+	assert.Nil(err)
+	assert.True(report.Empty(), report.String())
+}
+
+// Fails the reads made outside of a transaction.
+type transactionOnlyDB struct {
+	DB
+}
+
+var errOutsideTransaction = errors.New("Read outside of a transaction")
+
+func (db transactionOnlyDB) GetConfig() (*Config, error) {
+	return nil, errOutsideTransaction
+}
+
+func (db transactionOnlyDB) ListLinks() ([]Link, error) {
+	return nil, errOutsideTransaction
+}
+
+func TestExportTransaction(t *testing.T) {
+	assert := assert.New(t)
+
+	source := setupDB()
+	defer source.Close()
+	setupBackup(source)
+
+	// The whole export is read in the transaction
+	var backup bytes.Buffer
+	err := exportDB(transactionOnlyDB{source}, &backup, ExportOptions{})
+	assert.Nil(err)
+
+	target := setupDB()
+	defer target.Close()
+	_, err = target.Import(bytes.NewReader(backup.Bytes()), ImportOptions{})
+	assert.Nil(err)
+	assertSameState(assert, source, target)
+}
+
+func TestImportInvalidBackup(t *testing.T) {
+	assert := assert.New(t)
+
+	source := setupDB()
+	defer source.Close()
+	setupBackup(source)
+
+	var backup bytes.Buffer
+	source.Export(&backup, ExportOptions{})
+
+	target := setupDB()
+	defer target.Close()
+
+	// Backups can be reformatted, but not edited
+	var indented bytes.Buffer
+	json.Indent(&indented, backup.Bytes(), "", "\t")
+	report, err := target.Import(&indented, ImportOptions{DryRun: true})
+	assert.Nil(err)
+	assert.False(report.Empty())
+
+	edited := strings.Replace(backup.String(), "link2", "link3", 1)
+	_, err = target.Import(strings.NewReader(edited), ImportOptions{})
+	assert.True(errors.Is(err, ErrInvalidBackup))
+
+	newer := strings.Replace(backup.String(), `"version": 1`, `"version": 2`, 1)
+	_, err = target.Import(strings.NewReader(newer), ImportOptions{})
+	assert.True(errors.Is(err, ErrInvalidBackup))
+	assert.Contains(err.Error(), "version 2")
+
+	_, err = target.Import(strings.NewReader("[]"), ImportOptions{})
+	assert.True(errors.Is(err, ErrInvalidBackup))
+
+	_, err = target.Import(&backup, ImportOptions{Mode: "overwrite"})
+	assert.NotNil(err)
+
+	links, _ := target.ListLinks()
+	assert.Len(links, 0)
+}
+
+func TestImportReplace(t *testing.T) {
+	assert := assert.New(t)
+
+	source := setupDB()
+	defer source.Close()
+	setupBackup(source)
+
+	var backup bytes.Buffer
+	source.Export(&backup, ExportOptions{})
+
+	target := setupDB()
+	defer target.Close()
+	setupListPeers(target)
+	target.AddLink(baseLink())
+	updated, _ := target.GetPeer("link1", "phone")
+	updated.Endpoint = nil
+	target.UpdatePeer("link1", "phone", *updated)
+	target.RemovePeer("link2", "laptop")
+
+	// Merging keeps the links missing from the backup
+	report, err := target.Import(bytes.NewReader(backup.Bytes()), ImportOptions{DryRun: true})
+	assert.Nil(err)
+	assert.Equal([]string{
+		"~ config", "~ peer link1/phone", "+ peer link1/second",
+		"+ peer link2/laptop", "~ ipam link2",
+	}, strings.Split(strings.TrimSpace(report.String()), "\n"))
+
+	report, err = target.Import(bytes.NewReader(backup.Bytes()), ImportOptions{
+		Mode:   ImportReplace,
+		DryRun: true,
+	})
+	assert.Nil(err)
+	assert.Equal(ImportChange{Action: DiffRemoved, Kind: "link", Link: "wg-linko"}, report.Changes[1])
+
+	// Dry runs change nothing
+	_, err = target.GetLink("wg-linko")
+	assert.Nil(err)
+	_, err = target.GetPeer("link2", "laptop")
+	assert.True(errors.Is(err, ErrPeerNotFound))
+
+	report, err = target.Import(bytes.NewReader(backup.Bytes()), ImportOptions{Mode: ImportReplace})
+	assert.Nil(err)
+	assert.Len(report.Changes, 6)
+	assertSameState(assert, source, target)
+	_, err = target.GetLink("wg-linko")
+	assert.True(errors.Is(err, ErrLinkNotFound))
+}
+
+func TestImportFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	source := setupDB()
+	defer source.Close()
+	setupBackup(source)
+
+	var backup bytes.Buffer
+	source.Export(&backup, ExportOptions{})
+
+	setupTarget := func() DB {
+		db := setupDB()
+		setupListPeers(db)
+		db.AddLink(baseLink())
+		db.RemovePeer("link2", "laptop")
+		return db
+	}
+	target := setupTarget()
+	defer target.Close()
+	expected := setupTarget()
+	defer expected.Close()
+
+	// The IPAM is set last, after the config, links and peers changed
+	conn := target.(*sqliteDB).conn
+	_, err := conn.Exec(`
+		CREATE TRIGGER ipam_fail BEFORE INSERT ON ipam_reservations
+		BEGIN SELECT RAISE(ABORT, 'Database is full'); END`)
+	assert.Nil(err)
+
+	report, err := target.Import(bytes.NewReader(backup.Bytes()), ImportOptions{Mode: ImportReplace})
+	assert.NotNil(err)
+	assert.Nil(report)
+	assertSameState(assert, expected, target)
+	_, err = target.GetLink("wg-linko")
+	assert.Nil(err)
+	entries, err := target.AuditLog(AuditFilter{Operation: "RemoveLink"})
+	assert.Nil(err)
+	assert.Len(entries, 0)
+}
+
+func TestExportSecretsExcluded(t *testing.T) {
+	assert := assert.New(t)
+
+	source := setupDB()
+	defer source.Close()
+	setupBackup(source)
+
+	var backup bytes.Buffer
+	err := source.Export(&backup, ExportOptions{Secrets: SecretsExcluded})
+	assert.Nil(err)
+
+	sourcePeer, _ := source.GetPeer("link1", "second")
+	assert.NotContains(backup.String(), baseLink().PrivateKey.String())
+	assert.NotContains(backup.String(), basePeer().PresharedKey.String())
+	assert.NotContains(backup.String(), sourcePeer.PrivateKey.String())
+
+	// Links need their private key
+	target := setupDB()
+	defer target.Close()
+	_, err = target.Import(bytes.NewReader(backup.Bytes()), ImportOptions{})
+	var validationErr *ValidationError
+	assert.True(errors.As(err, &validationErr))
+	assert.Equal("PrivateKey", validationErr.Field)
+
+	// Existing links and peers keep theirs
+	setupListPeers(target)
+	_, err = target.Import(bytes.NewReader(backup.Bytes()), ImportOptions{})
+	assert.Nil(err)
+
+	dblink, _ := target.GetLink("link1")
+	assert.Equal(baseLink().PrivateKey, dblink.PrivateKey)
+	dbpeer, _ := target.GetPeer("link1", "phone")
+	assert.Equal(basePeer().PresharedKey, dbpeer.PresharedKey)
+	dbpeer, _ = target.GetPeer("link1", "second")
+	assert.Nil(dbpeer.PrivateKey)
+	assert.Nil(dbpeer.PresharedKey)
+}
+
+func TestExportSecretsEncrypted(t *testing.T) {
+	assert := assert.New(t)
+
+	source := setupDB()
+	defer source.Close()
+	setupBackup(source)
+
+	err := source.Export(&bytes.Buffer{}, ExportOptions{Secrets: SecretsEncrypted})
+	assert.NotNil(err)
+
+	master := testMasterKey()
+	var backup bytes.Buffer
+	err = source.Export(&backup, ExportOptions{Secrets: SecretsEncrypted, Key: master})
+	assert.Nil(err)
+	assert.NotContains(backup.String(), baseLink().PrivateKey.String())
+	assert.NotContains(backup.String(), basePeer().PresharedKey.String())
+	assert.Contains(backup.String(), sealedKeyPrefix)
+
+	target := setupDB()
+	defer target.Close()
+	_, err = target.Import(bytes.NewReader(backup.Bytes()), ImportOptions{})
+	assert.True(errors.Is(err, ErrMasterKeyRequired))
+	_, err = target.Import(bytes.NewReader(backup.Bytes()), ImportOptions{Key: testMasterKey()})
+	assert.True(errors.Is(err, ErrWrongMasterKey))
+
+	_, err = target.Import(bytes.NewReader(backup.Bytes()), ImportOptions{Key: master})
+	assert.Nil(err)
+	assertSameState(assert, source, target)
+}
+
+func TestClientExportImport(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+	err := client.AddLink(baseLink())
+	assert.Nil(err)
+
+	var backup bytes.Buffer
+	err = client.Export(&backup, ExportOptions{})
+	assert.Nil(err)
+
+	// Imports only change the database
+	standby := baseClient()
+	defer standby.Close()
+	report, err := standby.Import(&backup, ImportOptions{})
+	assert.Nil(err)
+	assert.Len(report.Changes, 1)
+
+	plan, err := standby.Plan()
+	assert.Nil(err)
+	assert.Len(plan.Links, 1)
+	assert.Equal(DiffAdded, plan.Links[0].Action)
+}
@@ -2,31 +2,56 @@ package dswg
 
 
 import (
-	"fmt"
 	"net"
 	"time"
 	"errors"
 	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
 	"golang.zx2c4.com/wireguard/wgctrl"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 type Client struct {
-	db	DB
-	wg	*wgctrl.Client
-	ns	*netlink.Handle
+	db		DB
+	wg		WireGuardConfigurator
+	ns		LinkManager
+	hooks	*HookRunner
+	firewall	Firewall
+	netns	netns.NsHandle // zero for the current namespace
+
+	// Clients of the link namespaces, by Link.Namespace
+	namespaces	map[string]*Client
+
+	// Latency and errors of the operations, nil for namespace clients
+	metrics	*clientMetrics
+}
+
+// Configures optional Client behaviour in NewClient.
+type ClientOption func(*Client)
+
+// Use the given runner to execute link PostUp/PostDown commands.
+func WithHookRunner(hooks *HookRunner) ClientOption {
+	return func(c *Client) {
+		c.hooks = hooks
+	}
 }
 
 
 // Adds link to database.
-// If link.Enable is set we try to activate the link
+// If link.Enable is set we try to activate the link, the link is only
+// stored if activating it succeeds.
 func (c *Client) AddLink(link Link) error {
 	if ln, _ := c.db.GetLink(link.Name); ln != nil {
-		return fmt.Errorf("Link name \"%v\" already exists in database", link.Name)
+		return errorf(ErrDuplicateName, "Link name \"%v\" already exists in database", link.Name)
+	}
+
+	lc, err := c.linkClient(link.Namespace)
+	if err != nil {
+		return err
 	}
 
-	if ln, _ := c.ns.LinkByName(link.Name); ln != nil {
-		return fmt.Errorf(
+	if ln, _ := lc.ns.LinkByName(link.Name); ln != nil {
+		return errorf(ErrDuplicateName,
 			"Link name already exists in the kernel, " +
 			"please delete it first using `ip link delete %v`", link.Name)
 	}
@@ -35,82 +60,144 @@ func (c *Client) AddLink(link Link) error {
 		return err
 	}
 
-	err := c.db.AddLink(link)
-	if err != nil {
-		return err
-	}
-
-	if link.Enable {
-		err := c.ActivateLink(link.Name)
-		if err != nil {
-			return err
+	return c.transact("AddLink", func(tx *transaction) error {
+		if link.Enable {
+			err := c.activateLink(tx, lc, nil, link, nil)
+			if err != nil {
+				return err
+			}
 		}
-	}
 
-	return nil
+		return tx.do("add link " + link.Name + " to database", func() error {
+			return c.db.AddLink(link)
+		}, nil)
+	})
 }
 
 // Removes the link from the kernel and the database with all its peers.
 // The link must exist in the database.
 func (c *Client) RemoveLink(name string) error {
-	link, err := c.db.GetLink(name)
+	link, lc, err := c.getLink(name)
 	if err != nil {
 		return err
 	}
 
-	if c.isLoaded(name) {
-		err = c.ns.LinkDel(*link)
-		if err != nil {
-			return err
-		}
-	}
-
-	// link cascades its deletion to its peers
-	err = c.db.RemoveLink(name)
+	peers, err := c.db.GetLinkPeers(name)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return c.transact("RemoveLink", func(tx *transaction) error {
+		if lc.isLoaded(name) {
+			err := c.unloadLink(tx, lc, *link, peers)
+			if err != nil {
+				return err
+			}
+		} else {
+			err := tx.do("tear down forwarding of link " + name, func() error {
+				return lc.teardownForwarding(*link)
+			}, nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		// link cascades its deletion to its peers
+		return tx.do("remove link " + name + " from database", func() error {
+			return c.db.RemoveLink(name)
+		}, nil)
+	})
 }
 
 // Activates link and applies wireguard configurations (including adding peers).
 // If link is not loaded in the kernel, it gets loaded first.
 // The link must exist in the database.
 func (c *Client) ActivateLink(name string) error {
-	link, err := c.db.GetLink(name)
+	link, lc, err := c.getLink(name)
 	if err != nil {
 		return err
 	}
 
-	if !c.isLoaded(name) {
-		err := c.ns.LinkAdd(link)
+	peers, err := c.db.GetLinkPeers(name)
+	if err != nil {
+		return err
+	}
+
+	active := *link
+	active.Enable = true
+	return c.transact("ActivateLink", func(tx *transaction) error {
+		err := c.activateLink(tx, lc, link, active, peers)
 		if err != nil {
 			return err
 		}
-	}
 
+		return tx.do("update link " + name + " in database", func() error {
+			return c.db.UpdateLink(name, active)
+		}, nil)
+	})
+}
+
+// Loads the link in the namespace of lc if it isn't loaded, configures
+// it, brings it up and loads its enabled peers. prev is the link as it is
+// stored, nil if it isn't.
+func (c *Client) activateLink(tx *transaction, lc *Client, prev *Link, link Link, peers []Peer) error {
 	link.Enable = true
-	err = c.setLinkSystemConfig(link.Name, *link)
-	if err != nil {
-		return err
+	name := link.Name
+
+	if lc.isLoaded(name) && prev != nil {
+		// The link is configured again, even if it fails halfway
+		restored := *prev
+		restored.Enable = lc.isUp(name)
+		tx.onRollback("restore link " + name, func() error {
+			return lc.configureLink(name, link, restored, peers)
+		})
+	} else {
+		err := tx.do("create link " + name, func() error {
+			return c.createLink(link, lc)
+		}, func() error {
+			return lc.ns.LinkDel(link)
+		})
+		if err != nil {
+			return err
+		}
 	}
 
-	// TODO: Execute PostUp commands here
-
-	err = c.db.UpdateLink(link.Name, *link)
+	wasUp := lc.isUp(name)
+	err := tx.do("configure link " + name, func() error {
+		return lc.setLinkSystemConfig(name, link)
+	}, nil)
 	if err != nil {
 		return err
 	}
 
-	peers, err := c.db.GetLinkPeers(link.Name)
+	var teardown func() error
+	if !wasUp {
+		teardown = func() error {
+			return lc.teardownForwarding(link)
+		}
+	}
+	err = tx.do("set up forwarding of link " + name, func() error {
+		return lc.setupForwarding(link)
+	}, teardown)
 	if err != nil {
 		return err
 	}
 
+	// PostUp only runs when the link goes from down to up
+	if !wasUp {
+		err := tx.do("run PostUp of link " + name, func() error {
+			return lc.runHooks(name, link.PostUp)
+		}, func() error {
+			return lc.runHooks(name, link.PostDown)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
 	for _, peer := range peers {
 		if peer.Enable {
-			err := c.ActivatePeer(link.Name, peer.Name)
+			err := lc.activatePeer(tx, link, peer)
 			if err != nil {
 				return err
 			}
@@ -124,25 +211,67 @@ func (c *Client) ActivateLink(name string) error {
 // Equivalent to `ip link set {name} down`.
 // The link must exist in the database.
 func (c *Client) DeactivateLink(name string) error {
-	link, err := c.db.GetLink(name)
+	link, lc, err := c.getLink(name)
+	if err != nil {
+		return err
+	}
+
+	peers, err := c.db.GetLinkPeers(name)
 	if err != nil {
 		return err
 	}
 
-	if c.isLoaded(name) {
-		err = c.ns.LinkSetDown(*link)
+	return c.transact("DeactivateLink", func(tx *transaction) error {
+		if lc.isLoaded(name) && lc.isUp(name) {
+			err := lc.deactivateLink(tx, *link, peers)
+			if err != nil {
+				return err
+			}
+		}
+
+		inactive := *link
+		inactive.Enable = false
+		return tx.do("update link " + name + " in database", func() error {
+			return c.db.UpdateLink(name, inactive)
+		}, nil)
+	})
+}
+
+// Brings the link down, running its PostDown commands, and removes its
+// forwarding. The link must be up.
+func (c *Client) deactivateLink(tx *transaction, link Link, peers []Peer) error {
+	err := tx.do("bring link " + link.Name + " down", func() error {
+		// The kernel flushes the routes of the link once it is down
+		err := c.ns.LinkSetDown(link)
 		if err != nil {
 			return err
 		}
+		return c.removeRules(link)
+	}, func() error {
+		err := c.ns.LinkSetUp(link)
+		if err != nil {
+			return err
+		}
+		return c.routeLinkPeers(link, peers)
+	})
+	if err != nil {
+		return err
 	}
 
-	link.Enable = false
-	err = c.db.UpdateLink(link.Name, *link)
+	err = tx.do("run PostDown of link " + link.Name, func() error {
+		return c.runHooks(link.Name, link.PostDown)
+	}, func() error {
+		return c.runHooks(link.Name, link.PostUp)
+	})
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return tx.do("tear down forwarding of link " + link.Name, func() error {
+		return c.teardownForwarding(link)
+	}, func() error {
+		return c.setupForwarding(link)
+	})
 }
 
 // Updates link in database and updates link system
@@ -152,25 +281,134 @@ func (c *Client) UpdateLink(name string, link Link) error {
 		return err
 	}
 
-	err := c.db.UpdateLink(name, link)
+	old, oldlc, err := c.getLink(name)
+	if err != nil {
+		return err
+	}
+
+	lc, err := c.linkClient(link.Namespace)
+	if err != nil {
+		return err
+	}
+
+	peers, err := c.db.GetLinkPeers(name)
 	if err != nil {
 		return err
 	}
 
-	if c.isLoaded(name) {
-		err := c.setLinkSystemConfig(name, link)
+	return c.transact("UpdateLink", func(tx *transaction) error {
+		// Links can only be created in the client namespace, so a link
+		// changing namespaces is deleted and created again
+		if old.Namespace != link.Namespace && oldlc.isLoaded(name) {
+			err := c.unloadLink(tx, oldlc, *old, peers)
+			if err != nil {
+				return err
+			}
+		}
+
+		if lc.isLoaded(name) {
+			err := lc.reconfigureLink(tx, *old, link, peers)
+			if err != nil {
+				return err
+			}
+		} else if link.Enable {
+			err := c.activateLink(tx, lc, old, link, peers)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.do("update link " + name + " in database", func() error {
+			return c.db.UpdateLink(name, link)
+		}, nil)
+	})
+}
+
+// Applies the changes of a loaded link, bringing it up or down as
+// link.Enable says.
+func (c *Client) reconfigureLink(tx *transaction, old, link Link, peers []Peer) error {
+	wasUp := c.isUp(old.Name)
+	restored := old
+	restored.Enable = wasUp
+
+	// The link is configured again, even if it fails halfway, and it may
+	// have been renamed already
+	tx.onRollback("restore link " + old.Name, func() error {
+		name := link.Name
+		if !c.isLoaded(name) {
+			name = old.Name
+		}
+		return c.configureLink(name, link, restored, peers)
+	})
+	tx.onRollback("restore forwarding of link " + old.Name, func() error {
+		err := c.teardownForwarding(link)
+		if err != nil || !wasUp {
+			return err
+		}
+		return c.setupForwarding(old)
+	})
+
+	err := tx.do("configure link " + old.Name, func() error {
+		return c.configureLink(old.Name, old, link, peers)
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	if old.Name != link.Name || !link.Enable || !link.Forward {
+		err := tx.do("tear down forwarding of link " + old.Name, func() error {
+			return c.teardownForwarding(old)
+		}, nil)
 		if err != nil {
 			return err
 		}
 	}
-	
-	if !c.isLoaded(name) && link.Enable {
-		err := c.ActivateLink(link.Name)
+	if link.Enable {
+		err := tx.do("set up forwarding of link " + link.Name, func() error {
+			return c.setupForwarding(link)
+		}, nil)
 		if err != nil {
 			return err
 		}
 	}
 
+	if !wasUp && link.Enable {
+		return tx.do("run PostUp of link " + link.Name, func() error {
+			return c.runHooks(link.Name, link.PostUp)
+		}, func() error {
+			return c.runHooks(link.Name, link.PostDown)
+		})
+	} else if wasUp && !link.Enable {
+		return tx.do("run PostDown of link " + link.Name, func() error {
+			return c.runHooks(link.Name, link.PostDown)
+		}, func() error {
+			return c.runHooks(link.Name, link.PostUp)
+		})
+	}
+
+	return nil
+}
+
+// Applies the link configuration to the kernel link named name, which
+// was configured as prev, and routes the enabled peers if the link is up.
+func (c *Client) configureLink(name string, prev, link Link, peers []Peer) error {
+	// Rules follow the fwmark, table and priority of the link, which may
+	// not have been renamed yet
+	prev.Name = name
+	err := c.removeRules(prev)
+	if err != nil {
+		return err
+	}
+
+	err = c.setLinkSystemConfig(name, link)
+	if err != nil {
+		return err
+	}
+
+	// The link was brought down, flushing the routes of its peers
+	if link.Enable {
+		return c.routeLinkPeers(link, peers)
+	}
 	return nil
 }
 
@@ -184,7 +422,7 @@ func (c *Client) setLinkSystemConfig(name string, link Link) error {
 
 	netInterface, err := c.ns.LinkByName(name)
 	if err != nil {
-		return fmt.Errorf("Couldn't find link %v in the kernel", link.Name)
+		return errorf(ErrLinkNotLoaded, "Couldn't find link %v in the kernel", link.Name)
 	}
 
 	if netInterface.Type() != "wireguard" {
@@ -197,11 +435,14 @@ func (c *Client) setLinkSystemConfig(name string, link Link) error {
 		return err
 	}
 
-	// Override wireguard configuration
+	// Override wireguard configuration, links with Table auto get their
+	// fwmark when their default routes are added
 	devConfig := wgtypes.Config{
 		PrivateKey: &link.PrivateKey.Key,
 		ListenPort: &link.ListenPort,
-		FirewallMark: &link.FirewallMark,
+	}
+	if !autoMarked(link) {
+		devConfig.FirewallMark = &link.FirewallMark
 	}
 	err = c.wg.ConfigureDevice(name, devConfig)
 	if err != nil {
@@ -242,9 +483,12 @@ func (c *Client) setLinkSystemConfig(name string, link Link) error {
 		}
 	}
 	
-	err = c.ns.LinkSetMTU(netInterface, link.MTU)
-	if err != nil {
-		return err
+	// Zero MTU leaves the kernel default
+	if link.MTU != 0 {
+		err = c.ns.LinkSetMTU(netInterface, link.MTU)
+		if err != nil {
+			return err
+		}
 	}
 
 	err = c.ns.LinkSetName(netInterface, link.Name)
@@ -262,140 +506,277 @@ func (c *Client) setLinkSystemConfig(name string, link Link) error {
 	return nil
 }
 
-func (c *Client) AddPeer(linkName string, peer Peer) error {
-	if p, _ := c.db.GetPeer(linkName, peer.Name); p != nil {
-		return fmt.Errorf("Peer name \"%v\" already exists in database", peer.Name)
-	}
+// Configures optional AddPeer behaviour, given the client and the name of
+// the link the peer is added to.
+type PeerOption func(c *Client, linkName string, peer *Peer) error
 
-	if err := validPeer(peer); err != nil {
-		return err
-	}
-
-	err := c.db.AddPeer(linkName, peer)
-	if err != nil {
-		return err
+// Generate the peer keypair and store the private key in the database,
+// so that complete peer configurations can be produced later.
+// The private key can be purged with PurgePeerPrivateKey once delivered.
+func WithGeneratedKeys() PeerOption {
+	return func(c *Client, linkName string, peer *Peer) error {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return err
+		}
+		peer.PrivateKey = &Key{key}
+		peer.PublicKey = Key{key.PublicKey()}
+		return nil
 	}
+}
 
-	if c.isLoaded(linkName) && peer.Enable {
-		err = c.ActivatePeer(linkName, peer.Name)
+// Generate a preshared key for the peer.
+func WithGeneratedPresharedKey() PeerOption {
+	return func(c *Client, linkName string, peer *Peer) error {
+		key, err := wgtypes.GenerateKey()
 		if err != nil {
 			return err
 		}
+		peer.PresharedKey = &Key{key}
+		return nil
 	}
-
-	return nil
 }
 
-func (c *Client) RemovePeer(linkName, peerName string) error {
-	if c.isLoaded(linkName) {
-		err := c.DeactivatePeer(linkName, peerName)
+// Assign a peer without allowed IPs the next free addresses of the link
+// subnets, see IPAM. Fails if a subnet has no free address left, ex. a /32.
+func WithAllocatedIPs() PeerOption {
+	return func(c *Client, linkName string, peer *Peer) error {
+		if len(peer.AllowedIPs) > 0 {
+			return nil
+		}
+
+		ips, err := c.AllocatePeerIPs(linkName, peer.Name)
 		if err != nil {
 			return err
 		}
+		peer.AllowedIPs = ips
+		return nil
 	}
+}
 
-	err := c.db.RemovePeer(linkName, peerName)
+// Adds peer to the link in database.
+// If the peer has a private key its public key is derived from it.
+// If peer.Enable is set and the link is loaded we try to activate the peer,
+// the peer is only stored if activating it succeeds.
+func (c *Client) AddPeer(linkName string, peer Peer, opts ...PeerOption) error {
+	peer, err := c.preparePeer(linkName, peer, opts)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return c.transact("AddPeer", func(tx *transaction) error {
+		if c.isLinkLoaded(linkName) && peer.Enable {
+			link, lc, err := c.getLink(linkName)
+			if err != nil {
+				return err
+			}
+
+			err = lc.activatePeer(tx, *link, peer)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.do("add peer " + peer.Name + " to database", func() error {
+			return c.db.AddPeer(linkName, peer)
+		}, nil)
+	})
 }
 
-func (c *Client) ActivatePeer(linkName, peerName string) error {
-	if !c.isLoaded(linkName) {
-		return fmt.Errorf("Couldn't find wireguard link %v in the kernel", linkName)
+// Applies the options to a peer about to be added to the link and
+// validates it, the same way for AddPeer and DryRun.AddPeer.
+func (c *Client) preparePeer(linkName string, peer Peer, opts []PeerOption) (Peer, error) {
+	if p, _ := c.db.GetPeer(linkName, peer.Name); p != nil {
+		return peer, errorf(ErrDuplicateName, "Peer name \"%v\" already exists in database", peer.Name)
 	}
 
-	peer, err := c.db.GetPeer(linkName, peerName)
+	for _, opt := range opts {
+		if err := opt(c, linkName, &peer); err != nil {
+			return peer, err
+		}
+	}
+
+	if peer.PrivateKey != nil && peer.PublicKey == (Key{}) {
+		peer.PublicKey = Key{peer.PrivateKey.PublicKey()}
+	}
+
+	if err := validPeer(peer); err != nil {
+		return peer, err
+	}
+
+	return peer, c.checkPeerConflicts(linkName, peer.Name, peer)
+}
+
+func (c *Client) RemovePeer(linkName, peerName string) error {
+	return c.transact("RemovePeer", func(tx *transaction) error {
+		if c.isLinkLoaded(linkName) {
+			link, lc, peer, err := c.getLinkPeer(linkName, peerName)
+			if err != nil {
+				return err
+			}
+
+			err = lc.deactivatePeer(tx, *link, *peer)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.do("remove peer " + peerName + " from database", func() error {
+			return c.db.RemovePeer(linkName, peerName)
+		}, nil)
+	})
+}
+
+func (c *Client) ActivatePeer(linkName, peerName string) error {
+	link, lc, peer, err := c.getLinkPeer(linkName, peerName)
 	if err != nil {
 		return err
 	}
 
-	var preshared *wgtypes.Key
-	if peer.PresharedKey != nil {
-		preshared = &peer.PresharedKey.Key
-	}
-	keepalive := time.Duration(peer.PersistentKeepalive)
-	allowedIPs := make([]net.IPNet, len(peer.AllowedIPs))
-	for i := range peer.AllowedIPs {
-		allowedIPs[i] = peer.AllowedIPs[i].IPNet
+	if !lc.isLoaded(linkName) {
+		return linkNotLoaded(linkName)
 	}
-	peerConfig := wgtypes.PeerConfig{
-		PublicKey: peer.PublicKey.Key,
-		PresharedKey: preshared,
-		Endpoint: &peer.Endpoint.UDPAddr,
-		PersistentKeepaliveInterval: &keepalive,
-		ReplaceAllowedIPs: true,
-		AllowedIPs: allowedIPs,
+
+	peer.Enable = true
+	return c.transact("ActivatePeer", func(tx *transaction) error {
+		err := lc.activatePeer(tx, *link, *peer)
+		if err != nil {
+			return err
+		}
+
+		return tx.do("update peer " + peerName + " in database", func() error {
+			return c.db.UpdatePeer(linkName, peerName, *peer)
+		}, nil)
+	})
+}
+
+// Loads the peer in the kernel link and routes its allowed IPs.
+func (c *Client) activatePeer(tx *transaction, link Link, peer Peer) error {
+	old, err := c.kernelPeer(link.Name, peer.PublicKey.Key)
+	if err != nil {
+		return err
 	}
 
-	devConfig := wgtypes.Config{
-		Peers: []wgtypes.PeerConfig{peerConfig},
+	err = tx.do("add peer " + peer.Name, func() error {
+		return c.wg.ConfigureDevice(link.Name, wgtypes.Config{
+			Peers: []wgtypes.PeerConfig{peerConfig(peer)},
+		})
+	}, func() error {
+		return c.restorePeer(link.Name, peer.PublicKey.Key, old)
+	})
+	if err != nil {
+		return err
 	}
 
-	err = c.wg.ConfigureDevice(linkName, devConfig)
+	netInterface, err := c.ns.LinkByName(link.Name)
 	if err != nil {
 		return err
 	}
 
-	netInterface, err := c.ns.LinkByName(linkName)
+	// Routes the link had before are left in place on rollback
+	routes, err := c.linkRoutes(netInterface)
 	if err != nil {
 		return err
 	}
-	for _, ip := range allowedIPs {
-		route := &netlink.Route{
-			LinkIndex: netInterface.Attrs().Index,
-			Scope: netlink.SCOPE_LINK,
-			Dst: &ip,
+	var existing []linkRoute
+	for _, route := range routes {
+		if route.Dst != nil {
+			existing = append(existing, linkRoute{dst: *route.Dst, table: route.Table})
 		}
+	}
+	added := make(map[string]bool)
 
-		err := c.ns.RouteAdd(route)
+	return tx.do("route peer " + peer.Name, func() error {
+		// The table of default routes is only known once picked
+		marked, err := c.routedLink(netInterface, link, peerAllowedIPs(peer))
 		if err != nil {
 			return err
 		}
-	}
+		for _, route := range missingRoutes(peerRoutes(marked, peer), existing) {
+			added[route.String()] = true
+		}
+		return c.addRoutes(netInterface, link, peerAllowedIPs(peer))
+	}, func() error {
+		return c.removeRoutesFunc(netInterface, link, func(route linkRoute) bool {
+			return added[route.String()]
+		})
+	})
+}
 
-	peer.Enable = true
-	err = c.db.UpdatePeer(linkName, peerName, *peer)
+func (c *Client) DeactivatePeer(linkName, peerName string) error {
+	link, lc, peer, err := c.getLinkPeer(linkName, peerName)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func (c *Client) DeactivatePeer(linkName, peerName string) error {
-	if !c.isLoaded(linkName) {
-		return fmt.Errorf("Couldn't find wireguard link %v in the kernel", linkName)
+	if !lc.isLoaded(linkName) {
+		return linkNotLoaded(linkName)
 	}
 
-	peer, err := c.db.GetPeer(linkName, peerName)
+	peer.Enable = false
+	return c.transact("DeactivatePeer", func(tx *transaction) error {
+		err := lc.deactivatePeer(tx, *link, *peer)
+		if err != nil {
+			return err
+		}
+
+		return tx.do("update peer " + peerName + " in database", func() error {
+			return c.db.UpdatePeer(linkName, peerName, *peer)
+		}, nil)
+	})
+}
+
+// Removes the peer from the kernel link and deletes the routes of its
+// allowed IPs.
+func (c *Client) deactivatePeer(tx *transaction, link Link, peer Peer) error {
+	old, err := c.kernelPeer(link.Name, peer.PublicKey.Key)
 	if err != nil {
 		return err
 	}
 
-	peerConfig := wgtypes.PeerConfig{
-		PublicKey: peer.PublicKey.Key,
-		Remove: true,
-	}
-
-	devConfig := wgtypes.Config{
-		Peers: []wgtypes.PeerConfig{peerConfig},
+	err = tx.do("remove peer " + peer.Name, func() error {
+		return c.wg.ConfigureDevice(link.Name, wgtypes.Config{
+			Peers: []wgtypes.PeerConfig{{PublicKey: peer.PublicKey.Key, Remove: true}},
+		})
+	}, func() error {
+		return c.restorePeer(link.Name, peer.PublicKey.Key, old)
+	})
+	if err != nil {
+		return err
 	}
 
-	err = c.wg.ConfigureDevice(linkName, devConfig)
+	netInterface, err := c.ns.LinkByName(link.Name)
 	if err != nil {
 		return err
 	}
 
-	peer.Enable = false
-	err = c.db.UpdatePeer(linkName, peerName, *peer)
+	// Kept to add the deleted routes back on rollback
+	owned, err := c.ownedRoutes(netInterface)
 	if err != nil {
 		return err
 	}
+	remove := make(map[string]bool)
+	for _, ip := range peerAllowedIPs(peer) {
+		remove[canonicalIPNet(ip)] = true
+	}
+	var removed []netlink.Route
+	for _, route := range owned {
+		if remove[canonicalIPNet(*route.Dst)] {
+			removed = append(removed, route)
+		}
+	}
 
-	return nil
+	return tx.do("unroute peer " + peer.Name, func() error {
+		return c.removeRoutes(netInterface, link, peerAllowedIPs(peer))
+	}, func() error {
+		return c.restoreRoutes(netInterface, link, removed)
+	})
+}
+
+// Deletes the stored private key of the peer, ex. after its configuration
+// has been delivered. Generated configurations will no longer include it.
+func (c *Client) PurgePeerPrivateKey(linkName, peerName string) error {
+	return c.db.PurgePeerPrivateKey(linkName, peerName)
 }
 
 func (c *Client) UpdatePeer(linkName, peerName string, peer Peer) error {
@@ -403,35 +784,138 @@ func (c *Client) UpdatePeer(linkName, peerName string, peer Peer) error {
 		return err
 	}
 
-	if c.isLoaded(linkName) {
-		err := c.DeactivatePeer(linkName, peerName)
-		if err != nil {
-			return err
-		}
+	err := c.checkPeerConflicts(linkName, peerName, peer)
+	if err != nil {
+		return err
 	}
-	
-	err := c.db.UpdatePeer(linkName, peerName, peer)
+
+	return c.transact("UpdatePeer", func(tx *transaction) error {
+		if c.isLinkLoaded(linkName) {
+			link, lc, old, err := c.getLinkPeer(linkName, peerName)
+			if err != nil {
+				return err
+			}
+
+			err = lc.deactivatePeer(tx, *link, *old)
+			if err != nil {
+				return err
+			}
+
+			if peer.Enable {
+				err := lc.activatePeer(tx, *link, peer)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return tx.do("update peer " + peerName + " in database", func() error {
+			return c.db.UpdatePeer(linkName, peerName, peer)
+		}, nil)
+	})
+}
+
+// Checks that no other peer of the link has the name, public key or
+// allowed IPs of the peer stored as peerName, since the kernel would move
+// them over to it before the database refuses them.
+func (c *Client) checkPeerConflicts(linkName, peerName string, peer Peer) error {
+	peers, err := c.db.GetLinkPeers(linkName)
 	if err != nil {
 		return err
 	}
 
-	if c.isLoaded(linkName) && peer.Enable {
-		err = c.ActivatePeer(linkName, peer.Name)
-		if err != nil {
-			return err
+	for _, other := range peers {
+		if other.Name == peerName {
+			continue
+		}
+
+		if other.Name == peer.Name {
+			return errorf(ErrDuplicateName, "Peer name \"%v\" already exists in database", peer.Name)
+		}
+
+		if other.PublicKey == peer.PublicKey {
+			return errorf(ErrDuplicatePublicKey,
+				"Peer public key %v already belongs to peer \"%v\"", peer.PublicKey, other.Name)
+		}
+
+		for _, ip := range peer.AllowedIPs {
+			for _, otherIP := range other.AllowedIPs {
+				if canonicalIPNet(ip.IPNet) == canonicalIPNet(otherIP.IPNet) {
+					return errorf(ErrAllowedIPConflict,
+						"Allowed IP %v already belongs to peer \"%v\"", ip, other.Name)
+				}
+			}
 		}
 	}
 
 	return nil
 }
 
+// Same as getLink, also returning the peer of the link.
+func (c *Client) getLinkPeer(linkName, peerName string) (*Link, *Client, *Peer, error) {
+	link, lc, err := c.getLink(linkName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	peer, err := c.db.GetPeer(linkName, peerName)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return link, lc, peer, nil
+}
+
+// Builds the wireguard configuration that loads the peer in the kernel.
+func peerConfig(peer Peer) wgtypes.PeerConfig {
+	var preshared *wgtypes.Key
+	if peer.PresharedKey != nil {
+		preshared = &peer.PresharedKey.Key
+	}
+	var endpoint *net.UDPAddr
+	if peer.Endpoint != nil {
+		endpoint = &peer.Endpoint.UDPAddr
+	}
+	keepalive := peerKeepalive(peer)
+	return wgtypes.PeerConfig{
+		PublicKey: peer.PublicKey.Key,
+		PresharedKey: preshared,
+		Endpoint: endpoint,
+		PersistentKeepaliveInterval: &keepalive,
+		ReplaceAllowedIPs: true,
+		AllowedIPs: peerAllowedIPs(peer),
+	}
+}
+
+// PersistentKeepalive is stored in seconds, like in wg(8).
+func peerKeepalive(peer Peer) time.Duration {
+	return time.Duration(peer.PersistentKeepalive) * time.Second
+}
+
+func peerAllowedIPs(peer Peer) []net.IPNet {
+	allowedIPs := make([]net.IPNet, len(peer.AllowedIPs))
+	for i := range peer.AllowedIPs {
+		allowedIPs[i] = peer.AllowedIPs[i].IPNet
+	}
+	return allowedIPs
+}
+
 func validLink(link Link) error {
 	if len(link.Name) == 0 {
-		return errors.New("Link name cannot be empty")
+		return invalid("Name", "Link name cannot be empty")
 	}
 
 	if link.AddressIPv4 == nil && link.AddressIPv6 == nil {
-		return errors.New("Link must be assigned at least one address address")
+		return invalid("AddressIPv4", "Link must be assigned at least one address address")
+	}
+
+	if _, err := parseTable(link.Table); err != nil {
+		return invalid("Table", "%v", err)
+	}
+
+	// Both rules must come before the main table rule
+	if link.RulePriority < 0 || link.RulePriority+1 >= mainRulePriority {
+		return invalid("RulePriority", "Link rule priority must be between 0 and %v", mainRulePriority-2)
 	}
 
 	return nil
@@ -439,19 +923,120 @@ func validLink(link Link) error {
 
 func validPeer(peer Peer) error {
 	if len(peer.Name) == 0 {
-		return errors.New("Peer name cannot be empty")
+		return invalid("Name", "Peer name cannot be empty")
+	}
+
+	if peer.PrivateKey != nil && peer.PrivateKey.PublicKey() != peer.PublicKey.Key {
+		return invalid("PublicKey", "Peer public key doesn't match its private key")
+	}
+
+	return nil
+}
+
+// Creates the link in the client namespace and moves it to the namespace
+// of lc. The wireguard socket stays where the link was created, so
+// traffic to peers goes through the client namespace.
+func (c *Client) createLink(link Link, lc *Client) error {
+	err := c.ns.LinkAdd(link)
+	if err != nil {
+		return err
+	}
+
+	if lc == c {
+		return nil
+	}
+
+	err = c.ns.LinkSetNsFd(link, int(lc.netns))
+	if err != nil {
+		c.ns.LinkDel(link)
+		return err
 	}
 
 	return nil
 }
 
+// Brings the link down, running its PostDown commands if it was up,
+// removes its forwarding and deletes it from the namespace of lc.
+func (c *Client) unloadLink(tx *transaction, lc *Client, link Link, peers []Peer) error {
+	if lc.isUp(link.Name) {
+		err := lc.deactivateLink(tx, link, peers)
+		if err != nil {
+			return err
+		}
+	} else {
+		err := tx.do("tear down forwarding of link " + link.Name, func() error {
+			return lc.teardownForwarding(link)
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.do("delete link " + link.Name, func() error {
+		err := lc.removeRules(link)
+		if err != nil {
+			return err
+		}
+		return lc.ns.LinkDel(link)
+	}, func() error {
+		return c.reloadLink(lc, link, peers)
+	})
+}
+
+// Loads the link back in the namespace of lc, down, with its enabled
+// peers, ex. when deleting it is rolled back.
+func (c *Client) reloadLink(lc *Client, link Link, peers []Peer) error {
+	err := c.createLink(link, lc)
+	if err != nil {
+		return err
+	}
+
+	link.Enable = false
+	err = lc.setLinkSystemConfig(link.Name, link)
+	if err != nil {
+		return err
+	}
+
+	var configs []wgtypes.PeerConfig
+	for _, peer := range peers {
+		if peer.Enable {
+			configs = append(configs, peerConfig(peer))
+		}
+	}
+	return lc.wg.ConfigureDevice(link.Name, wgtypes.Config{Peers: configs})
+}
+
+// Runs link hooks inside the namespace of the client.
+func (c *Client) runHooks(name string, cmds []string) error {
+	return inNamespace(c.netns, func() error {
+		_, err := c.hooks.Run(name, cmds)
+		return err
+	})
+}
+
+// Indicates whether the link is loaded in the kernel and is up.
+func (c *Client) isUp(name string) bool {
+	netInterface, _ := c.ns.LinkByName(name)
+	return netInterface != nil && netInterface.Attrs().Flags&net.FlagUp != 0
+}
+
 // Indicates whether the link is added to the kernel or not.
 func (c *Client) isLoaded(name string) bool {
 	netInterface, _ := c.ns.LinkByName(name)
 	return netInterface != nil && netInterface.Type() == "wireguard"
 }
 
+// Same as isLoaded, looking the link up in its own namespace.
+func (c *Client) isLinkLoaded(name string) bool {
+	_, lc, err := c.getLink(name)
+	return err == nil && lc.isLoaded(name)
+}
+
 func (c *Client) Close() error {
+	for _, lc := range c.namespaces {
+		lc.closeHandles()
+	}
+
 	if c.db != nil {
 		err := c.db.Close()
 		if err != nil {
@@ -459,21 +1044,27 @@ func (c *Client) Close() error {
 		}
 	}
 
-	if c.wg != nil {
-		err := c.wg.Close()
-		if err != nil {
-			return err
-		}
+	return c.closeHandles()
+}
+
+// Closes the kernel handles of the client, but not its database.
+func (c *Client) closeHandles() error {
+	if c.netns > 0 {
+		defer c.netns.Close()
 	}
 
 	if c.ns != nil {
-		c.ns.Delete()
+		defer c.ns.Delete()
+	}
+
+	if c.wg != nil {
+		return c.wg.Close()
 	}
 
 	return nil
 }
 
-func NewClient(db DB) (*Client, error) {
+func NewClient(db DB, opts ...ClientOption) (*Client, error) {
 	// Use current network namespace
 	handle, err := netlink.NewHandle()
 	if err != nil {
@@ -485,11 +1076,5 @@ func NewClient(db DB) (*Client, error) {
 		return nil, err
 	}
 
-	client := &Client{
-		db: db,
-		wg: wg,
-		ns: handle,
-	}
-
-	return client, nil
+	return NewClientWithBackends(db, handle, wg, opts...)
 }
\ No newline at end of file
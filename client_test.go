@@ -1,28 +1,25 @@
 package dswg
 
 import (
+	"os"
+	"errors"
+	"context"
 	"net"
+	"log"
+	"time"
 	"testing"
+	"io/ioutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/vishvananda/netlink"
-	"github.com/vishvananda/netns"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-// TODO: Use better error types, and update tests to assert for those types
-
-// Tests that modify the network are preceded by creating
-// a new network namespace to avoid corrupting the current
-// machine network configuration 
-// 		netns, _ := netns.New()
-// 		defer netns.Close()
+// Clients are backed by a FakeKernel, so tests that modify the
+// network don't need root or the wireguard kernel module
 
 func TestNewClientValid(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	db, _ := OpenSqliteDB(":memory:")
 	defer db.Close()
 
@@ -39,10 +36,6 @@ func TestNewClientValid(t *testing.T) {
 func TestClientAddLinkValidNotEnabled(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 	
@@ -63,10 +56,6 @@ func TestClientAddLinkValidNotEnabled(t *testing.T) {
 func TestClientAddLinkValidEnabled(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 	
@@ -85,10 +74,6 @@ func TestClientAddLinkValidEnabled(t *testing.T) {
 func TestClientAddLinkDuplicateDBName(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 	
@@ -97,16 +82,12 @@ func TestClientAddLinkDuplicateDBName(t *testing.T) {
 	assert.Nil(err)
 
 	err = client.AddLink(testlink)
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrDuplicateName))
 }
 
 func TestClientAddLinkExistInKernel(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 	
@@ -115,16 +96,12 @@ func TestClientAddLinkExistInKernel(t *testing.T) {
 	assert.Nil(err)
 
 	err = client.AddLink(testlink)
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrDuplicateName))
 }
 
 func TestClientAddLinkEmptyName(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 	
@@ -133,16 +110,12 @@ func TestClientAddLinkEmptyName(t *testing.T) {
 	testlink.Name = ""
 
 	err := client.AddLink(testlink)
-	assert.NotNil(err)
+	assertInvalid(assert, err, "Name")
 }
 
 func TestClientAddLinkNoIPs(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -152,16 +125,12 @@ func TestClientAddLinkNoIPs(t *testing.T) {
 	testlink.AddressIPv6 = nil
 
 	err := client.AddLink(testlink)
-	assert.NotNil(err)
+	assertInvalid(assert, err, "AddressIPv4")
 }
 
 func TestClientRemoveLinkLoaded(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 	
@@ -190,10 +159,6 @@ func TestClientRemoveLinkLoaded(t *testing.T) {
 func TestClientRemoveLinkPeers(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 	
@@ -217,38 +182,26 @@ func TestClientRemoveLinkPeers(t *testing.T) {
 func TestClientRemoveLinkNotExist(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
 	err := client.RemoveLink("non-existo-linko")
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrLinkNotFound))
 }
 
 func TestClientActivateLinkNotExist(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
 	err := client.ActivateLink("no-existo")
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrLinkNotFound))
 }
 
 func TestClientActivateLinkNotLoaded(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 	
@@ -284,10 +237,6 @@ func TestClientActivateLinkNotLoaded(t *testing.T) {
 func TestClientActivateLinkPeersActivated(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 	
@@ -327,29 +276,90 @@ func TestClientActivateLinkPeersActivated(t *testing.T) {
 	assert.True(wgpeers[testpeer2.PublicKey.String()])
 }
 
-// TODO: Test executed commands when link is activated
+func TestClientActivateLinkPostUp(t *testing.T) {
+	assert := assert.New(t)
 
-func TestClientDeactivateLinkNotExist(t *testing.T) {
+	client := baseClient()
+	defer client.Close()
+
+	out, _ := ioutil.TempFile("", "dswg-hook")
+	defer os.Remove(out.Name())
+
+	testlink := baseLink()
+	testlink.Enable = false
+	testlink.PostUp = []string{"echo %i >> " + out.Name()}
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	err = client.ActivateLink(testlink.Name)
+	assert.Nil(err)
+
+	content, _ := ioutil.ReadFile(out.Name())
+	assert.Equal(testlink.Name + "\n", string(content))
+}
+
+func TestClientActivateLinkPostUpAbort(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = false
+	testlink.PostUp = []string{"exit 1"}
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	err = client.ActivateLink(testlink.Name)
+	assert.NotNil(err)
+
+	// Assert that the link activation is rolled back
+	netInterface, _ := client.ns.LinkByName(testlink.Name)
+	assert.Nil(netInterface)
+
+	dblink, err := client.db.GetLink(testlink.Name)
+	assert.Nil(err)
+	assert.False(dblink.Enable)
+}
+
+func TestClientActivateLinkPostUpWarn(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
+	db, _ := OpenSqliteDB(":memory:")
+	hooks := NewHookRunner()
+	hooks.Policy = HookWarn
+	hooks.Logger = log.New(ioutil.Discard, "", 0)
+	kernel := NewFakeKernel()
+	client, _ := NewClientWithBackends(db, kernel, kernel, WithHookRunner(hooks))
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = false
+	testlink.PostUp = []string{"exit 1"}
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	err = client.ActivateLink(testlink.Name)
+	assert.Nil(err)
+
+	netInterface, _ := client.ns.LinkByName(testlink.Name)
+	assert.NotNil(netInterface)
+	assert.Equal(netInterface.Attrs().Flags & net.FlagUp, net.FlagUp)
+}
+
+func TestClientDeactivateLinkNotExist(t *testing.T) {
+	assert := assert.New(t)
 
 	client := baseClient()
 	defer client.Close()
 
 	err := client.DeactivateLink("no-existo")
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrLinkNotFound))
 }
 
 func TestClientDeactivateLinkActivated(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -371,12 +381,30 @@ func TestClientDeactivateLinkActivated(t *testing.T) {
 	assert.False(dblink.Enable)
 }
 
-func TestClientDeactivateLinkNotLoaded(t *testing.T) {
+func TestClientDeactivateLinkPostDown(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
+	client := baseClient()
+	defer client.Close()
+
+	out, _ := ioutil.TempFile("", "dswg-hook")
+	defer os.Remove(out.Name())
+
+	testlink := baseLink()
+	testlink.Enable = true
+	testlink.PostDown = []string{"echo %i >> " + out.Name()}
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	err = client.DeactivateLink(testlink.Name)
+	assert.Nil(err)
+
+	content, _ := ioutil.ReadFile(out.Name())
+	assert.Equal(testlink.Name + "\n", string(content))
+}
+
+func TestClientDeactivateLinkNotLoaded(t *testing.T) {
+	assert := assert.New(t)
 
 	client := baseClient()
 	defer client.Close()
@@ -394,10 +422,6 @@ func TestClientDeactivateLinkNotLoaded(t *testing.T) {
 func TestClientUpdateLinkValidEnabled(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -428,10 +452,6 @@ func TestClientUpdateLinkValidEnabled(t *testing.T) {
 func TestClientUpdateLinkValidLoaded(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -461,10 +481,6 @@ func TestClientUpdateLinkValidLoaded(t *testing.T) {
 func TestClientUpdateLinkInvalid(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -481,16 +497,12 @@ func TestClientUpdateLinkInvalid(t *testing.T) {
 	assert.Nil(err)
 
 	err = client.UpdateLink(testlink1.Name, testlink2)
-	assert.NotNil(err)
+	assertInvalid(assert, err, "AddressIPv4")
 }
 
 func TestClientAddPeerDuplicateName(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -507,16 +519,12 @@ func TestClientAddPeerDuplicateName(t *testing.T) {
 	key, _ := ParseKey("CHG+ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=")
 	testpeer.PublicKey = *key
 	err = client.AddPeer(testlink.Name, testpeer)
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrDuplicateName))
 }
 
 func TestClientAddPeerDuplicatePublicKey(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -532,15 +540,40 @@ func TestClientAddPeerDuplicatePublicKey(t *testing.T) {
 	// Change name
 	testpeer.Name = "new-name"
 	err = client.AddPeer(testlink.Name, testpeer)
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrDuplicatePublicKey))
 }
 
-func TestClientAddPeerEmptyName(t *testing.T) {
+func TestClientAddPeerAllowedIPConflict(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer1 := basePeer()
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	testpeer1.AllowedIPs = []IPNet{*addr}
+	err = client.AddPeer(testlink.Name, testpeer1)
+	assert.Nil(err)
+
+	testpeer2 := testpeer1
+	testpeer2.Name = "peer2"
+	key, _ := ParseKey("CHG+ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=")
+	testpeer2.PublicKey = *key
+	err = client.AddPeer(testlink.Name, testpeer2)
+	assert.True(errors.Is(err, ErrAllowedIPConflict))
+
+	// The kernel never moved the allowed IP to the new peer
+	device, _ := client.wg.Device(testlink.Name)
+	assert.Len(device.Peers, 1)
+	assert.Equal("10.6.6.2/32", device.Peers[0].AllowedIPs[0].String())
+}
+
+func TestClientAddPeerEmptyName(t *testing.T) {
+	assert := assert.New(t)
 
 	client := baseClient()
 	defer client.Close()
@@ -553,16 +586,12 @@ func TestClientAddPeerEmptyName(t *testing.T) {
 	testpeer := basePeer()
 	testpeer.Name = ""
 	err = client.AddPeer(testlink.Name, testpeer)
-	assert.NotNil(err)
+	assertInvalid(assert, err, "Name")
 }
 
 func TestClientAddPeerValid(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -581,12 +610,87 @@ func TestClientAddPeerValid(t *testing.T) {
 	assert.Equal(testpeer, *dbpeer)
 }
 
-func TestClientAddPeerEnabledLinkLoaded(t *testing.T) {
+func TestClientAddPeerGeneratedKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = false
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer := basePeer()
+	testpeer.Enable = false
+	testpeer.PresharedKey = nil
+	err = client.AddPeer(testlink.Name, testpeer,
+		WithGeneratedKeys(), WithGeneratedPresharedKey())
+	assert.Nil(err)
+
+	dbpeer, err := client.db.GetPeer(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.NotNil(dbpeer.PrivateKey)
+	assert.NotNil(dbpeer.PresharedKey)
+	assert.Equal(dbpeer.PrivateKey.PublicKey(), dbpeer.PublicKey.Key)
+	assert.NotEqual(testpeer.PublicKey, dbpeer.PublicKey)
+
+	rc, err := client.PeerConfig(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Equal(dbpeer.PrivateKey, rc.Interface.PrivateKey)
+
+	err = client.PurgePeerPrivateKey(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+
+	rc, err = client.PeerConfig(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Nil(rc.Interface.PrivateKey)
+}
+
+func TestClientAddPeerDerivedPublicKey(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = false
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	privateKey, _ := ParseKey("SBVTnnEBNe7ZKFGbkz96dvf9oq9evSkYrM/Hs7k6W18=")
+	testpeer := basePeer()
+	testpeer.Enable = false
+	testpeer.PublicKey = Key{}
+	testpeer.PrivateKey = privateKey
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	dbpeer, err := client.db.GetPeer(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Equal(privateKey.PublicKey(), dbpeer.PublicKey.Key)
+}
+
+func TestClientAddPeerMismatchedKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = false
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	privateKey, _ := ParseKey("SBVTnnEBNe7ZKFGbkz96dvf9oq9evSkYrM/Hs7k6W18=")
+	testpeer := basePeer()
+	testpeer.PrivateKey = privateKey
+	err = client.AddPeer(testlink.Name, testpeer)
+	assertInvalid(assert, err, "PublicKey")
+}
+
+func TestClientAddPeerEnabledLinkLoaded(t *testing.T) {
+	assert := assert.New(t)
 
 	client := baseClient()
 	defer client.Close()
@@ -598,6 +702,8 @@ func TestClientAddPeerEnabledLinkLoaded(t *testing.T) {
 
 	testpeer := basePeer()
 	testpeer.Enable = true
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	testpeer.AllowedIPs = []IPNet{*addr}
 	err = client.AddPeer(testlink.Name, testpeer)
 	assert.Nil(err)
 
@@ -611,7 +717,7 @@ func TestClientAddPeerEnabledLinkLoaded(t *testing.T) {
 	assert.Equal(testpeer.PublicKey.Key, wgpeer.PublicKey)
 	assert.Equal(testpeer.PresharedKey.Key, wgpeer.PresharedKey)
 	assert.Equal(testpeer.Endpoint.UDPAddr.Port, wgpeer.Endpoint.Port)
-	assert.Equal(testpeer.PersistentKeepalive, int64(wgpeer.PersistentKeepaliveInterval))
+	assert.Equal(testpeer.PersistentKeepalive, int64(wgpeer.PersistentKeepaliveInterval / time.Second))
 
 	wgallowed := make(map[string]bool)
 	for _, ip := range wgpeer.AllowedIPs {
@@ -623,12 +729,40 @@ func TestClientAddPeerEnabledLinkLoaded(t *testing.T) {
 	}
 }
 
-func TestClientRemovePeerValid(t *testing.T) {
+func TestClientAddPeerNoEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = true
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer := basePeer()
+	testpeer.Enable = true
+	testpeer.Endpoint = nil
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	wglink, err := client.wg.Device(testlink.Name)
+	assert.Nil(err)
+	assert.Equal(1, len(wglink.Peers))
+	assert.Nil(wglink.Peers[0].Endpoint)
+}
+
+func TestPeerKeepaliveSeconds(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
+	testpeer := basePeer()
+	testpeer.PersistentKeepalive = 25
+	config := peerConfig(testpeer)
+	assert.Equal(25*time.Second, *config.PersistentKeepaliveInterval)
+}
+
+func TestClientRemovePeerValid(t *testing.T) {
+	assert := assert.New(t)
 
 	client := baseClient()
 	defer client.Close()
@@ -639,6 +773,8 @@ func TestClientRemovePeerValid(t *testing.T) {
 	assert.Nil(err)
 
 	testpeer := basePeer()
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	testpeer.AllowedIPs = []IPNet{*addr}
 	err = client.AddPeer(testlink.Name, testpeer)
 	assert.Nil(err)
 
@@ -657,10 +793,6 @@ func TestClientRemovePeerValid(t *testing.T) {
 func TestClientRemovePeerEnabledLinkLoaded(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -671,6 +803,8 @@ func TestClientRemovePeerEnabledLinkLoaded(t *testing.T) {
 
 	testpeer := basePeer()
 	testpeer.Enable = true
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	testpeer.AllowedIPs = []IPNet{*addr}
 	err = client.AddPeer(testlink.Name, testpeer)
 	assert.Nil(err)
 
@@ -693,10 +827,6 @@ func TestClientRemovePeerEnabledLinkLoaded(t *testing.T) {
 func TestClientRemovePeerNotExist(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -706,16 +836,12 @@ func TestClientRemovePeerNotExist(t *testing.T) {
 	assert.Nil(err)
 
 	err = client.RemovePeer(testlink.Name, "no-peero")
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrPeerNotFound))
 }
 
 func TestClientActivatePeerLinkNotLoaded(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -730,16 +856,12 @@ func TestClientActivatePeerLinkNotLoaded(t *testing.T) {
 	assert.Nil(err)
 
 	err = client.ActivatePeer(testlink.Name, testpeer.Name)
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrLinkNotLoaded))
 }
 
 func TestClientActivatePeerNotExist(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -749,16 +871,12 @@ func TestClientActivatePeerNotExist(t *testing.T) {
 	assert.Nil(err)
 
 	err = client.ActivatePeer(testlink.Name, "no-peer")
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrPeerNotFound))
 }
 
 func TestClientActivatePeerValid(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -799,10 +917,6 @@ func TestClientActivatePeerValid(t *testing.T) {
 func TestClientDeactivatePeerLinkNotLoaded(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -817,16 +931,12 @@ func TestClientDeactivatePeerLinkNotLoaded(t *testing.T) {
 	assert.Nil(err)
 
 	err = client.DeactivatePeer(testlink.Name, testpeer.Name)
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrLinkNotLoaded))
 }
 
 func TestClientDeactivatePeerNotExist(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -836,16 +946,12 @@ func TestClientDeactivatePeerNotExist(t *testing.T) {
 	assert.Nil(err)
 
 	err = client.DeactivatePeer(testlink.Name, "no-peer")
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrPeerNotFound))
 }
 
 func TestClientDeactivatePeerValid(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -875,10 +981,6 @@ func TestClientDeactivatePeerValid(t *testing.T) {
 func TestClientUpdatePeerInvalid(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -889,13 +991,15 @@ func TestClientUpdatePeerInvalid(t *testing.T) {
 
 	testpeer1 := basePeer()
 	testpeer1.Enable = false
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	testpeer1.AllowedIPs = []IPNet{*addr}
 	err = client.AddPeer(testlink.Name, testpeer1)
 	assert.Nil(err)
 
 	testpeer2 := basePeer()
 	testpeer2.Name = ""
 	err = client.UpdatePeer(testlink.Name, testpeer1.Name, testpeer2)
-	assert.NotNil(err)
+	assertInvalid(assert, err, "Name")
 
 	dbpeer, _ := client.db.GetPeer(testlink.Name, testpeer1.Name)
 	assert.Equal(testpeer1, *dbpeer)
@@ -904,10 +1008,6 @@ func TestClientUpdatePeerInvalid(t *testing.T) {
 func TestClientUpdatePeerDuplicateName(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -919,11 +1019,15 @@ func TestClientUpdatePeerDuplicateName(t *testing.T) {
 	testpeer1 := basePeer()
 	testpeer1.Enable = false
 	testpeer1.Name = "peer1"
+	addr1, _ := ParseIPNet("10.6.6.2/32")
+	testpeer1.AllowedIPs = []IPNet{*addr1}
 	err = client.AddPeer(testlink.Name, testpeer1)
 	assert.Nil(err)
 
 	testpeer2 := basePeer()
 	testpeer2.Name = "peer2"
+	addr2, _ := ParseIPNet("10.6.6.3/32")
+	testpeer2.AllowedIPs = []IPNet{*addr2}
 	testpeer1.Enable = false
 	// Change public key
 	key, _ := ParseKey("CHG+ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=")
@@ -932,7 +1036,7 @@ func TestClientUpdatePeerDuplicateName(t *testing.T) {
 	assert.Nil(err)
 
 	err = client.UpdatePeer(testlink.Name, testpeer1.Name, testpeer2)
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrDuplicateName))
 
 	dbpeer, _ := client.db.GetPeer(testlink.Name, testpeer1.Name)
 	assert.Equal(testpeer1, *dbpeer)
@@ -944,10 +1048,6 @@ func TestClientUpdatePeerDuplicateName(t *testing.T) {
 func TestClientUpdatePeerLinkLoadedEnable(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -978,10 +1078,6 @@ func TestClientUpdatePeerLinkLoadedEnable(t *testing.T) {
 func TestClientUpdatePeerLinkNotLoaded(t *testing.T) {
 	assert := assert.New(t)
 
-	// Create a new network namespace 
-	netns, _ := netns.New()
-	defer netns.Close()
-
 	client := baseClient()
 	defer client.Close()
 
@@ -1000,4 +1096,389 @@ func TestClientUpdatePeerLinkNotLoaded(t *testing.T) {
 
 	dbpeer, _ := client.db.GetPeer(testlink.Name, testpeer.Name)
 	assert.Equal(testpeer, *dbpeer)
-}
\ No newline at end of file
+}
+func TestClientReconcileInSync(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = true
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer := basePeer()
+	testpeer.Enable = true
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	report, err := client.Reconcile(context.Background(), ReconcileOptions{})
+	assert.Nil(err)
+	assert.Equal(0, len(report.Links))
+}
+
+func TestClientReconcileLinkDeleted(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = true
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer := basePeer()
+	testpeer.Enable = true
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	// Delete the link behind the client's back
+	err = client.ns.LinkDel(testlink)
+	assert.Nil(err)
+
+	report, err := client.Reconcile(context.Background(), ReconcileOptions{})
+	assert.Nil(err)
+	assert.Equal(1, len(report.Links))
+	assert.Equal(DiffAdded, report.Links[0].Action)
+
+	wglink, err := client.wg.Device(testlink.Name)
+	assert.Nil(err)
+	assert.Equal(1, len(wglink.Peers))
+
+	// The link is loaded again without an ActivateLink of its own
+	metrics := scrapeMetrics(assert, &client)
+	assert.NotContains(metrics, `operation="ActivateLink"`)
+	entries, err := client.db.AuditLog(AuditFilter{Operation: "UpdateLink"})
+	assert.Nil(err)
+	assert.Len(entries, 0)
+}
+
+func TestClientReconcileDrift(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = true
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer := basePeer()
+	testpeer.Enable = true
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	// Change the kernel state behind the client's back
+	netInterface, _ := client.ns.LinkByName(testlink.Name)
+	err = client.ns.LinkSetMTU(netInterface, 1280)
+	assert.Nil(err)
+	err = client.wg.ConfigureDevice(testlink.Name, wgtypes.Config{ReplacePeers: true})
+	assert.Nil(err)
+
+	unknownLink := baseLink()
+	unknownLink.Name = "wg-unknown"
+	err = client.ns.LinkAdd(unknownLink)
+	assert.Nil(err)
+
+	report, err := client.Reconcile(context.Background(), ReconcileOptions{PruneUnmanaged: true})
+	assert.Nil(err)
+	assert.Equal(2, len(report.Links))
+	assert.Equal(0, len(report.Unmanaged))
+
+	netInterface, _ = client.ns.LinkByName(testlink.Name)
+	assert.Equal(testlink.MTU, netInterface.Attrs().MTU)
+
+	wglink, err := client.wg.Device(testlink.Name)
+	assert.Nil(err)
+	assert.Equal(1, len(wglink.Peers))
+
+	netInterface, _ = client.ns.LinkByName(unknownLink.Name)
+	assert.Nil(netInterface)
+}
+
+func TestClientReconcileUnmanagedKept(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = true
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	// A link configured outside dswg, ex. by wg-quick
+	unknownLink := baseLink()
+	unknownLink.Name = "wg-unknown"
+	err = client.ns.LinkAdd(unknownLink)
+	assert.Nil(err)
+
+	plan, err := client.Plan()
+	assert.Nil(err)
+	assert.True(plan.Empty())
+	assert.Equal([]string{unknownLink.Name}, plan.Unmanaged)
+
+	report, err := client.Reconcile(context.Background(), ReconcileOptions{})
+	assert.Nil(err)
+	assert.Equal(0, len(report.Links))
+	assert.Equal([]string{unknownLink.Name}, report.Unmanaged)
+
+	netInterface, _ := client.ns.LinkByName(unknownLink.Name)
+	assert.NotNil(netInterface)
+}
+
+func TestClientPlanDoesNotApply(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = true
+	err := client.db.AddLink(testlink)
+	assert.Nil(err)
+
+	plan, err := client.Plan()
+	assert.Nil(err)
+	assert.Equal(1, len(plan.Links))
+	assert.Equal(DiffAdded, plan.Links[0].Action)
+	assert.Equal("LinkAdd", plan.Operations[0].Call)
+
+	// Assert that the kernel is left untouched
+	netInterface, _ := client.ns.LinkByName(testlink.Name)
+	assert.Nil(netInterface)
+}
+
+func TestClientDryRunAddLink(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = true
+	plan, err := client.DryRun().AddLink(testlink)
+	assert.Nil(err)
+	assert.Equal(1, len(plan.Links))
+	assert.Equal(DiffAdded, plan.Links[0].Action)
+
+	netInterface, _ := client.ns.LinkByName(testlink.Name)
+	assert.Nil(netInterface)
+
+	dblink, err := client.db.GetLink(testlink.Name)
+	assert.NotNil(err)
+	assert.Nil(dblink)
+}
+
+func TestClientDryRunActivatePeer(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = true
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer := basePeer()
+	testpeer.Enable = false
+	addr, _ := ParseIPNet("10.9.6.2/32")
+	testpeer.AllowedIPs = []IPNet{*addr}
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	plan, err := client.DryRun().ActivatePeer(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Equal(1, len(plan.Links))
+	assert.Equal(1, len(plan.Links[0].Peers))
+	assert.Equal(DiffAdded, plan.Links[0].Peers[0].Action)
+	assert.Equal(2, len(plan.Operations))
+
+	wglink, _ := client.wg.Device(testlink.Name)
+	assert.Equal(0, len(wglink.Peers))
+
+	dbpeer, _ := client.db.GetPeer(testlink.Name, testpeer.Name)
+	assert.False(dbpeer.Enable)
+}
+
+func TestClientDryRunUpdateLink(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = true
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	updated := testlink
+	updated.MTU = 1280
+	plan, err := client.DryRun().UpdateLink(testlink.Name, updated)
+	assert.Nil(err)
+	assert.Equal([]Operation{{
+		Backend: "netlink",
+		Call: "LinkSetMTU",
+		Link: testlink.Name,
+		Args: "1280",
+	}}, plan.Operations)
+
+	netInterface, _ := client.ns.LinkByName(testlink.Name)
+	assert.Equal(testlink.MTU, netInterface.Attrs().MTU)
+}
+
+func TestClientDryRunAddPeer(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = true
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	err = client.AddPeer(testlink.Name, basePeer())
+	assert.Nil(err)
+
+	// The public key is derived from the private key, like AddPeer does
+	privateKey, _ := ParseKey("SBVTnnEBNe7ZKFGbkz96dvf9oq9evSkYrM/Hs7k6W18=")
+	testpeer := basePeer()
+	testpeer.Name = "derived"
+	testpeer.PublicKey = Key{}
+	testpeer.PrivateKey = privateKey
+	addr, _ := ParseIPNet("10.6.6.3/32")
+	testpeer.AllowedIPs = []IPNet{*addr}
+	plan, err := client.DryRun().AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+	assert.Equal(1, len(plan.Links))
+	assert.Equal(1, len(plan.Links[0].Peers))
+	assert.Equal(privateKey.PublicKey().String(), plan.Links[0].Peers[0].PublicKey)
+
+	// Conflicts with other peers are rejected, like AddPeer does
+	testpeer = basePeer()
+	testpeer.Name = "duplicate"
+	plan, err = client.DryRun().AddPeer(testlink.Name, testpeer)
+	assert.True(errors.Is(err, ErrDuplicatePublicKey))
+	assert.Nil(plan)
+}
+
+func TestClientDryRunUpdateLinkNamespace(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	// The client of the other namespace is a fake kernel too
+	kernel := NewFakeKernel()
+	lc, _ := NewClientWithBackends(client.db, kernel, kernel)
+	client.namespaces = map[string]*Client{"/run/netns/other": lc}
+
+	testlink := baseLink()
+	testlink.Enable = true
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	updated := testlink
+	updated.Namespace = "/run/netns/other"
+	plan, err := client.DryRun().UpdateLink(testlink.Name, updated)
+	assert.Nil(err)
+	assert.Equal(2, len(plan.Links))
+	assert.Equal(DiffRemoved, plan.Links[0].Action)
+	assert.Equal(DiffAdded, plan.Links[1].Action)
+	assert.Equal("LinkDel", plan.Operations[0].Call)
+	assert.Equal("LinkAdd", plan.Operations[1].Call)
+
+	// The kernel is left untouched
+	netInterface, _ := client.ns.LinkByName(testlink.Name)
+	assert.NotNil(netInterface)
+	netInterface, _ = lc.ns.LinkByName(testlink.Name)
+	assert.Nil(netInterface)
+}
+
+func TestClientImportLinkValid(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	// Configure a link directly in the kernel, like wg-quick does
+	testlink := baseLink()
+	testpeer := basePeer()
+	testpeer.PersistentKeepalive = 25
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	testpeer.AllowedIPs = []IPNet{*addr}
+	err := client.ns.LinkAdd(testlink)
+	assert.Nil(err)
+	err = client.setLinkSystemConfig(testlink.Name, testlink)
+	assert.Nil(err)
+	err = client.wg.ConfigureDevice(testlink.Name, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{peerConfig(testpeer)},
+	})
+	assert.Nil(err)
+	netInterface, _ := client.ns.LinkByName(testlink.Name)
+	err = client.ns.RouteAdd(&netlink.Route{LinkIndex: netInterface.Attrs().Index, Dst: &addr.IPNet})
+	assert.Nil(err)
+
+	err = client.ImportLink(testlink.Name)
+	assert.Nil(err)
+
+	dblink, err := client.db.GetLink(testlink.Name)
+	assert.Nil(err)
+	assert.True(dblink.Enable)
+	assert.Equal(testlink.PrivateKey, dblink.PrivateKey)
+	assert.Equal(testlink.ListenPort, dblink.ListenPort)
+	assert.Equal(testlink.FirewallMark, dblink.FirewallMark)
+	assert.Equal(testlink.MTU, dblink.MTU)
+	assert.Equal(testlink.AddressIPv4, dblink.AddressIPv4)
+
+	dbpeers, err := client.db.GetLinkPeers(testlink.Name)
+	assert.Nil(err)
+	assert.Equal(1, len(dbpeers))
+	assert.Equal(testpeer.PublicKey, dbpeers[0].PublicKey)
+	assert.Equal(testpeer.PresharedKey, dbpeers[0].PresharedKey)
+	assert.Equal(testpeer.AllowedIPs, dbpeers[0].AllowedIPs)
+	assert.Equal(testpeer.PersistentKeepalive, dbpeers[0].PersistentKeepalive)
+
+	// Assert that the imported link is in sync with the kernel
+	plan, err := client.Plan()
+	assert.Nil(err)
+	assert.True(plan.Empty())
+}
+
+func TestClientImportLinkNotLoaded(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	err := client.ImportLink("no-existo")
+	assert.True(errors.Is(err, ErrLinkNotLoaded))
+}
+
+func TestClientImportLinkExistInDB(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.db.AddLink(testlink)
+	assert.Nil(err)
+	err = client.ns.LinkAdd(testlink)
+	assert.Nil(err)
+
+	err = client.ImportLink(testlink.Name)
+	assert.True(errors.Is(err, ErrDuplicateName))
+}
+
+func assertInvalid(assert *assert.Assertions, err error, field string) {
+	var invalid *ValidationError
+	if assert.True(errors.As(err, &invalid), "%v", err) {
+		assert.Equal(field, invalid.Field)
+	}
+}
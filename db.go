@@ -1,9 +1,19 @@
 package dswg
 
+import (
+	"database/sql"
+	"io"
+
+	"github.com/jmoiron/sqlx"
+)
+
 type DB interface {
 	AddLink(link Link) error
 	GetLink(name string) (*Link, error)
+	ListLinks() ([]Link, error)
 	GetLinkPeers(name string) ([]Peer, error)
+	ListPeers(filter PeerFilter) ([]LinkPeer, error)
+	FindPeerByPublicKey(linkName string, key Key) (*Peer, error)
 	UpdateLink(name string, link Link) error
 	RemoveLink(name string) error
 
@@ -11,6 +21,111 @@ type DB interface {
 	GetPeer(linkName, peerName string) (*Peer, error)
 	UpdatePeer(linkName, peerName string, peer Peer) error
 	RemovePeer(linkName, peerName string) error
+	PurgePeerPrivateKey(linkName, peerName string) error
+
+	GetIPAM(linkName string) (*IPAM, error)
+	SetIPAM(linkName string, ipam IPAM) error
+
+	GetConfig() (*Config, error)
+	SetConfig(config Config) error
+
+	// Encrypts the stored keys with a new data key, sealed by the master
+	// key of the provider, or stores them in plain if it is nil.
+	Rekey(provider KeyProvider) error
+
+	// Lists the changes recorded by the database matching the filter,
+	// oldest first.
+	AuditLog(filter AuditFilter) ([]AuditEntry, error)
+	// Returns the database recording the changes made through it as done
+	// by actor, ex. the user of an API request. Both share the connection.
+	WithActor(actor string) DB
+
+	// Writes every link, peer and IPAM and the Config as a versioned JSON
+	// backup, which Import reads.
+	Export(w io.Writer, opts ExportOptions) error
+	// Adds and updates the links and peers of a backup, removing the
+	// others with ImportReplace, and reports the changes.
+	Import(r io.Reader, opts ImportOptions) (*ImportReport, error)
+
+	// Runs fn with a database whose changes are committed together when
+	// fn returns nil, and rolled back when it returns an error. The
+	// database passed to fn must not be used after fn returns.
+	Transaction(fn func(tx DB) error) error
 
 	Close()	error
+}
+
+// Queries of a single DB method, committed or rolled back together.
+type dbTx interface {
+	sqlx.Ext
+	Get(dest interface{}, query string, args ...interface{}) error
+	Select(dest interface{}, query string, args ...interface{}) error
+	Commit() error
+	Rollback() error
+}
+
+// Begins the transaction of a DB method. Methods of a database in a
+// DB.Transaction run in a savepoint of its transaction instead, so a
+// failing method is still undone as a whole.
+func beginTx(conn *sqlx.DB, outer *sqlx.Tx) (dbTx, error) {
+	if outer == nil {
+		return conn.Beginx()
+	}
+
+	_, err := outer.Exec("SAVEPOINT dswg")
+	if err != nil {
+		return nil, err
+	}
+	return &savepoint{Tx: outer}, nil
+}
+
+// Runs fn in a transaction of its own, or in a savepoint of outer, with
+// the transaction the database passed to DB.Transaction uses.
+func runTransaction(conn *sqlx.DB, outer *sqlx.Tx, fn func(tx *sqlx.Tx) error) error {
+	tx, err := beginTx(conn, outer)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	inner := outer
+	if inner == nil {
+		inner = tx.(*sqlx.Tx)
+	}
+	err = fn(inner)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// A savepoint of an outer transaction, released on commit. Savepoints of
+// the same name nest, each release or rollback ending the latest one.
+type savepoint struct {
+	*sqlx.Tx
+	done bool
+}
+
+func (sp *savepoint) Commit() error {
+	if sp.done {
+		return sql.ErrTxDone
+	}
+	sp.done = true
+
+	_, err := sp.Exec("RELEASE SAVEPOINT dswg")
+	return err
+}
+
+func (sp *savepoint) Rollback() error {
+	if sp.done {
+		return sql.ErrTxDone
+	}
+	sp.done = true
+
+	_, err := sp.Exec("ROLLBACK TO SAVEPOINT dswg")
+	if err != nil {
+		return err
+	}
+	_, err = sp.Exec("RELEASE SAVEPOINT dswg")
+	return err
 }
\ No newline at end of file
@@ -0,0 +1,576 @@
+package dswg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Behaviour every DB implementation shares, run against each of them by
+// testDBConformance.
+var dbConformanceTests = []struct {
+	name string
+	test func(assert *assert.Assertions, db DB)
+}{
+	{"LinkRoundTrip", func(assert *assert.Assertions, db DB) {
+		testlink := baseLink()
+		testlink.Namespace = "blue"
+		testlink.Table = "100"
+		testlink.RulePriority = 1000
+		err := db.AddLink(testlink)
+		assert.Nil(err)
+
+		dblink, err := db.GetLink(testlink.Name)
+		assert.Nil(err)
+		assert.Equal(testlink, *dblink)
+
+		_, err = db.GetLink("wg-none")
+		assert.True(errors.Is(err, ErrLinkNotFound))
+	}},
+	{"LinkDuplicateName", func(assert *assert.Assertions, db DB) {
+		err := db.AddLink(baseLink())
+		assert.Nil(err)
+
+		err = db.AddLink(baseLink())
+		assert.True(errors.Is(err, ErrDuplicateName))
+	}},
+	{"ListLinks", func(assert *assert.Assertions, db DB) {
+		links, err := db.ListLinks()
+		assert.Nil(err)
+		assert.Len(links, 0)
+
+		for _, name := range []string{"wg-b", "wg-a", "Wg-c"} {
+			testlink := baseLink()
+			testlink.Name = name
+			db.AddLink(testlink)
+		}
+
+		links, err = db.ListLinks()
+		assert.Nil(err)
+		assert.Len(links, 3)
+		assert.Equal("Wg-c", links[0].Name)
+		assert.Equal("wg-a", links[1].Name)
+		assert.Equal(baseLink().DefaultAllowedIPs, links[2].DefaultAllowedIPs)
+	}},
+	{"UpdateLink", func(assert *assert.Assertions, db DB) {
+		testlink := baseLink()
+		db.AddLink(testlink)
+		db.AddPeer(testlink.Name, routedPeer())
+
+		updated := baseLink()
+		updated.Name = "wg-renamed"
+		updated.AddressIPv6 = nil
+		updated.PostUp = []string{"true"}
+		addr, _ := ParseIPNet("10.7.0.0/16")
+		updated.DefaultAllowedIPs = []IPNet{*addr}
+		err := db.UpdateLink(testlink.Name, updated)
+		assert.Nil(err)
+
+		dblink, err := db.GetLink(updated.Name)
+		assert.Nil(err)
+		assert.Equal(updated, *dblink)
+
+		// Peers follow the renamed link
+		peers, err := db.GetLinkPeers(updated.Name)
+		assert.Nil(err)
+		assert.Len(peers, 1)
+
+		err = db.UpdateLink(testlink.Name, updated)
+		assert.True(errors.Is(err, ErrLinkNotFound))
+	}},
+	{"RemoveLink", func(assert *assert.Assertions, db DB) {
+		testlink := baseLink()
+		db.AddLink(testlink)
+		db.AddPeer(testlink.Name, routedPeer())
+
+		err := db.RemoveLink(testlink.Name)
+		assert.Nil(err)
+
+		// The peers of the link are removed with it
+		peers, err := db.ListPeers(PeerFilter{})
+		assert.Nil(err)
+		assert.Len(peers, 0)
+
+		err = db.RemoveLink(testlink.Name)
+		assert.True(errors.Is(err, ErrLinkNotFound))
+	}},
+	{"PeerRoundTrip", func(assert *assert.Assertions, db DB) {
+		testlink := baseLink()
+		db.AddLink(testlink)
+
+		testpeer := routedPeer()
+		addr, _ := ParseIPNet("fd00::2/128")
+		testpeer.AllowedIPs = append(testpeer.AllowedIPs, *addr)
+		testpeer.PersistentKeepalive = 25
+		err := db.AddPeer(testlink.Name, testpeer)
+		assert.Nil(err)
+
+		// Peers without endpoint or preshared key
+		testpeer2 := secondPeer()
+		testpeer2.Endpoint = nil
+		err = db.AddPeer(testlink.Name, testpeer2)
+		assert.Nil(err)
+
+		dbpeer, err := db.GetPeer(testlink.Name, testpeer.Name)
+		assert.Nil(err)
+		assert.Equal(testpeer, *dbpeer)
+
+		peers, err := db.GetLinkPeers(testlink.Name)
+		assert.Nil(err)
+		assert.Equal([]Peer{testpeer, testpeer2}, peers)
+
+		_, err = db.GetPeer(testlink.Name, "none")
+		assert.True(errors.Is(err, ErrPeerNotFound))
+		_, err = db.GetLinkPeers("wg-none")
+		assert.True(errors.Is(err, ErrLinkNotFound))
+		err = db.AddPeer("wg-none", testpeer)
+		assert.True(errors.Is(err, ErrLinkNotFound))
+	}},
+	{"PeerConflicts", func(assert *assert.Assertions, db DB) {
+		testlink := baseLink()
+		db.AddLink(testlink)
+		testpeer := routedPeer()
+		db.AddPeer(testlink.Name, testpeer)
+
+		duplicate := secondPeer()
+		duplicate.Name = testpeer.Name
+		err := db.AddPeer(testlink.Name, duplicate)
+		assert.True(errors.Is(err, ErrDuplicateName))
+
+		duplicate = secondPeer()
+		duplicate.PublicKey = testpeer.PublicKey
+		err = db.AddPeer(testlink.Name, duplicate)
+		assert.True(errors.Is(err, ErrDuplicatePublicKey))
+
+		duplicate = secondPeer()
+		duplicate.AllowedIPs = testpeer.AllowedIPs
+		err = db.AddPeer(testlink.Name, duplicate)
+		assert.True(errors.Is(err, ErrAllowedIPConflict))
+
+		// Nothing of the failed additions is kept
+		peers, _ := db.GetLinkPeers(testlink.Name)
+		assert.Len(peers, 1)
+
+		// Peers of other links are not conflicts
+		otherlink := baseLink()
+		otherlink.Name = "wg-other"
+		db.AddLink(otherlink)
+		err = db.AddPeer(otherlink.Name, testpeer)
+		assert.Nil(err)
+	}},
+	// Postgres rejects allowed IPs overlapping those of other peers of the
+	// link with the peer_allowed_ips_overlap constraint, while sqlite, like
+	// the client, only rejects identical allowed IPs
+	{"OverlappingAllowedIPs", func(assert *assert.Assertions, db DB) {
+		_, rejectsOverlaps := db.(*postgresDB)
+
+		testlink := baseLink()
+		db.AddLink(testlink)
+		testpeer := routedPeer()
+		addr, _ := ParseIPNet("10.7.0.0/16")
+		testpeer.AllowedIPs = append(testpeer.AllowedIPs, *addr)
+		err := db.AddPeer(testlink.Name, testpeer)
+		assert.Nil(err)
+
+		addOverlapping := func(peer Peer) {
+			err := db.AddPeer(testlink.Name, peer)
+			if rejectsOverlaps {
+				assert.True(errors.Is(err, ErrAllowedIPConflict))
+				return
+			}
+			assert.Nil(err)
+			db.RemovePeer(testlink.Name, peer.Name)
+		}
+
+		testpeer2 := secondPeer()
+		addr, _ = ParseIPNet("10.7.1.0/24")
+		testpeer2.AllowedIPs = []IPNet{*addr}
+		addOverlapping(testpeer2)
+
+		addr, _ = ParseIPNet("0.0.0.0/0")
+		testpeer2.AllowedIPs = []IPNet{*addr}
+		addOverlapping(testpeer2)
+
+		// Allowed IPs of a peer may overlap each other
+		addr, _ = ParseIPNet("10.7.1.0/24")
+		testpeer.AllowedIPs = append(testpeer.AllowedIPs, *addr)
+		err = db.UpdatePeer(testlink.Name, testpeer.Name, testpeer)
+		assert.Nil(err)
+
+		// A peer may not list the same allowed IP twice
+		duplicate := secondPeer()
+		duplicate.AllowedIPs = append(duplicate.AllowedIPs, duplicate.AllowedIPs[0])
+		err = db.AddPeer(testlink.Name, duplicate)
+		assert.True(errors.Is(err, ErrAllowedIPConflict))
+
+		// Networks of other families don't overlap
+		addr, _ = ParseIPNet("::/0")
+		testpeer2.AllowedIPs = []IPNet{*addr}
+		err = db.AddPeer(testlink.Name, testpeer2)
+		assert.Nil(err)
+
+		addr, _ = ParseIPNet("10.6.0.0/16")
+		testpeer2.AllowedIPs = append(testpeer2.AllowedIPs, *addr)
+		err = db.UpdatePeer(testlink.Name, testpeer2.Name, testpeer2)
+		assert.Equal(rejectsOverlaps, errors.Is(err, ErrAllowedIPConflict))
+
+		// Nothing of the failed changes is kept
+		peers, _ := db.GetLinkPeers(testlink.Name)
+		assert.Len(peers, 2)
+		if rejectsOverlaps {
+			assert.Len(peers[1].AllowedIPs, 1)
+		}
+	}},
+	{"UpdatePeer", func(assert *assert.Assertions, db DB) {
+		testlink := baseLink()
+		db.AddLink(testlink)
+		testpeer := routedPeer()
+		db.AddPeer(testlink.Name, testpeer)
+		db.AddPeer(testlink.Name, secondPeer())
+
+		updated := routedPeer()
+		updated.Name = "renamed"
+		updated.Enable = false
+		updated.DNS1 = nil
+		addr, _ := ParseIPNet("10.6.6.4/32")
+		updated.AllowedIPs = []IPNet{*addr}
+		err := db.UpdatePeer(testlink.Name, testpeer.Name, updated)
+		assert.Nil(err)
+
+		dbpeer, err := db.GetPeer(testlink.Name, updated.Name)
+		assert.Nil(err)
+		assert.Equal(updated, *dbpeer)
+
+		renamed := updated
+		renamed.Name = secondPeer().Name
+		err = db.UpdatePeer(testlink.Name, updated.Name, renamed)
+		assert.True(errors.Is(err, ErrDuplicateName))
+
+		err = db.UpdatePeer(testlink.Name, testpeer.Name, updated)
+		assert.True(errors.Is(err, ErrPeerNotFound))
+
+		err = db.RemovePeer(testlink.Name, updated.Name)
+		assert.Nil(err)
+		err = db.RemovePeer(testlink.Name, updated.Name)
+		assert.True(errors.Is(err, ErrPeerNotFound))
+	}},
+	{"ListPeers", func(assert *assert.Assertions, db DB) {
+		setupListPeers(db)
+
+		peers, err := db.ListPeers(PeerFilter{})
+		assert.Nil(err)
+		assert.Len(peers, 4)
+		assert.Equal("link1", peers[0].Link)
+		assert.Equal("phone", peers[0].Name)
+		assert.Equal("10.6.1.2/32", peers[0].AllowedIPs[0].String())
+
+		enabled := false
+		peers, err = db.ListPeers(PeerFilter{Link: "link2", Enabled: &enabled, NamePrefix: "lap"})
+		assert.Nil(err)
+		assert.Len(peers, 1)
+		assert.Equal("laptop", peers[0].Name)
+
+		ip, _ := ParseIP("10.7.1.42")
+		peers, err = db.ListPeers(PeerFilter{AllowedIP: ip.IP})
+		assert.Nil(err)
+		assert.Len(peers, 2)
+
+		_, err = db.ListPeers(PeerFilter{Link: "wg-none"})
+		assert.True(errors.Is(err, ErrLinkNotFound))
+
+		key, _ := ParseKey("RND3ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=")
+		peer, err := db.FindPeerByPublicKey("link1", *key)
+		assert.Nil(err)
+		assert.Equal("laptop", peer.Name)
+		_, err = db.FindPeerByPublicKey("link2", *key)
+		assert.True(errors.Is(err, ErrPeerNotFound))
+	}},
+	{"PurgePeerPrivateKey", func(assert *assert.Assertions, db DB) {
+		testlink := baseLink()
+		db.AddLink(testlink)
+		testpeer := routedPeer()
+		testpeer.PrivateKey = &testlink.PrivateKey
+		db.AddPeer(testlink.Name, testpeer)
+
+		dbpeer, _ := db.GetPeer(testlink.Name, testpeer.Name)
+		assert.Equal(testpeer.PrivateKey, dbpeer.PrivateKey)
+
+		err := db.PurgePeerPrivateKey(testlink.Name, testpeer.Name)
+		assert.Nil(err)
+		dbpeer, _ = db.GetPeer(testlink.Name, testpeer.Name)
+		assert.Nil(dbpeer.PrivateKey)
+	}},
+	{"Rekey", func(assert *assert.Assertions, db DB) {
+		testlink := baseLink()
+		db.AddLink(testlink)
+		testpeer := routedPeer()
+		testpeer.PrivateKey = &testlink.PrivateKey
+		db.AddPeer(testlink.Name, testpeer)
+
+		master := make([]byte, 32)
+		for _, provider := range []KeyProvider{StaticKeyProvider(master), nil} {
+			err := db.Rekey(provider)
+			assert.Nil(err)
+
+			dblink, err := db.GetLink(testlink.Name)
+			assert.Nil(err)
+			assert.Equal(testlink.PrivateKey, dblink.PrivateKey)
+			dbpeer, err := db.GetPeer(testlink.Name, testpeer.Name)
+			assert.Nil(err)
+			assert.Equal(testpeer, *dbpeer)
+		}
+
+		err := db.Rekey(StaticKeyProvider(master[:16]))
+		assert.NotNil(err)
+	}},
+	{"IPAM", func(assert *assert.Assertions, db DB) {
+		testlink := baseLink()
+		db.AddLink(testlink)
+
+		ipam, err := db.GetIPAM(testlink.Name)
+		assert.Nil(err)
+		assert.Len(ipam.Reservations, 0)
+
+		ip, _ := ParseIP("10.6.6.9")
+		excluded, _ := ParseIPNet("10.6.6.128/25")
+		testipam := IPAM{
+			Reservations: []IPReservation{{IP: *ip, PeerName: "zoz-phone"}},
+			Exclusions:   []IPNet{*excluded},
+		}
+		err = db.SetIPAM(testlink.Name, testipam)
+		assert.Nil(err)
+
+		ipam, err = db.GetIPAM(testlink.Name)
+		assert.Nil(err)
+		assert.Equal(testipam, *ipam)
+
+		err = db.SetIPAM("wg-none", testipam)
+		assert.True(errors.Is(err, ErrLinkNotFound))
+	}},
+	{"Config", func(assert *assert.Assertions, db DB) {
+		config, err := db.GetConfig()
+		assert.Nil(err)
+		assert.Equal(defaultConfig(), *config)
+
+		testconfig := Config{Enable: true, ForwardIPv4: true, NATEnable: true, NATLink: "eth0"}
+		err = db.SetConfig(testconfig)
+		assert.Nil(err)
+		err = db.SetConfig(testconfig)
+		assert.Nil(err)
+
+		config, err = db.GetConfig()
+		assert.Nil(err)
+		assert.Equal(testconfig, *config)
+	}},
+	{"AuditLog", func(assert *assert.Assertions, db DB) {
+		start := time.Now()
+		testlink, testpeer := baseLink(), routedPeer()
+		err := db.AddLink(testlink)
+		assert.Nil(err)
+
+		admin := db.WithActor("admin")
+		err = admin.AddPeer(testlink.Name, testpeer)
+		assert.Nil(err)
+		updated := testpeer
+		updated.Enable = false
+		err = admin.UpdatePeer(testlink.Name, testpeer.Name, updated)
+		assert.Nil(err)
+
+		// Failed changes are not recorded
+		err = db.AddLink(testlink)
+		assert.True(errors.Is(err, ErrDuplicateName))
+		err = db.RemovePeer(testlink.Name, "none")
+		assert.True(errors.Is(err, ErrPeerNotFound))
+
+		err = db.RemovePeer(testlink.Name, testpeer.Name)
+		assert.Nil(err)
+		renamed := testlink
+		renamed.Name = "wg-renamed"
+		err = db.UpdateLink(testlink.Name, renamed)
+		assert.Nil(err)
+		err = db.RemoveLink(renamed.Name)
+		assert.Nil(err)
+
+		entries, err := db.AuditLog(AuditFilter{})
+		assert.Nil(err)
+		var ops []string
+		for _, entry := range entries {
+			ops = append(ops, entry.Operation+" "+entry.Link+" "+entry.Peer)
+		}
+		assert.Equal([]string{
+			"AddLink wg-linko ", "AddPeer wg-linko zoz-pc", "UpdatePeer wg-linko zoz-pc",
+			"RemovePeer wg-linko zoz-pc", "UpdateLink wg-linko ", "RemoveLink wg-renamed ",
+		}, ops)
+		assert.Equal(defaultActor(), entries[0].Actor)
+		assert.Equal("admin", entries[1].Actor)
+		assert.False(entries[0].Time.Before(start.Truncate(time.Microsecond)))
+
+		var before, after map[string]interface{}
+		assert.Nil(entries[1].Before)
+		assert.Nil(json.Unmarshal(entries[2].Before, &before))
+		assert.Nil(json.Unmarshal(entries[2].After, &after))
+		assert.Equal(true, before["Enable"])
+		assert.Equal(false, after["Enable"])
+		assert.Equal(redactedKey, after["PresharedKey"])
+		assert.Nil(entries[3].After)
+		assert.Nil(json.Unmarshal(entries[4].After, &after))
+		assert.Equal(redactedKey, after["PrivateKey"])
+		assert.Equal("wg-renamed", after["Name"])
+
+		entries, err = db.AuditLog(AuditFilter{Link: testlink.Name, Peer: testpeer.Name, Actor: "admin"})
+		assert.Nil(err)
+		assert.Len(entries, 2)
+		entries, err = db.AuditLog(AuditFilter{Operation: "RemoveLink", Since: start})
+		assert.Nil(err)
+		assert.Len(entries, 1)
+		entries, err = db.AuditLog(AuditFilter{Until: start})
+		assert.Nil(err)
+		assert.Len(entries, 0)
+	}},
+	{"AuditLogSettings", func(assert *assert.Assertions, db DB) {
+		testlink, testpeer := baseLink(), routedPeer()
+		testpeer.PrivateKey = &testlink.PrivateKey
+		db.AddLink(testlink)
+		db.AddPeer(testlink.Name, testpeer)
+
+		testconfig := Config{Enable: true, ForwardIPv4: true}
+		err := db.SetConfig(testconfig)
+		assert.Nil(err)
+		excluded, _ := ParseIPNet("10.6.6.128/25")
+		err = db.SetIPAM(testlink.Name, IPAM{Exclusions: []IPNet{*excluded}})
+		assert.Nil(err)
+		err = db.PurgePeerPrivateKey(testlink.Name, testpeer.Name)
+		assert.Nil(err)
+
+		entries, err := db.AuditLog(AuditFilter{})
+		assert.Nil(err)
+		var ops []string
+		for _, entry := range entries[2:] {
+			ops = append(ops, entry.Operation+" "+entry.Link+" "+entry.Peer)
+		}
+		assert.Equal([]string{
+			"SetConfig  ", "SetIPAM wg-linko ", "PurgePeerPrivateKey wg-linko zoz-pc",
+		}, ops)
+
+		var before, after map[string]interface{}
+		assert.Nil(json.Unmarshal(entries[2].Before, &before))
+		assert.Nil(json.Unmarshal(entries[2].After, &after))
+		assert.Equal(true, before["ForwardIPv6"])
+		assert.Equal(false, after["ForwardIPv6"])
+		assert.Nil(json.Unmarshal(entries[3].After, &after))
+		assert.Equal([]interface{}{"10.6.6.128/25"}, after["Exclusions"])
+		assert.Nil(json.Unmarshal(entries[4].Before, &before))
+		assert.Nil(json.Unmarshal(entries[4].After, &after))
+		assert.Equal(redactedKey, before["PrivateKey"])
+		assert.Nil(after["PrivateKey"])
+
+		// Changes made by an import are recorded like any other
+		var backup bytes.Buffer
+		err = db.Export(&backup, ExportOptions{})
+		assert.Nil(err)
+		other := setupDB()
+		defer other.Close()
+		_, err = other.WithActor("restore").Import(&backup, ImportOptions{})
+		assert.Nil(err)
+
+		entries, err = other.AuditLog(AuditFilter{Actor: "restore"})
+		assert.Nil(err)
+		ops = nil
+		for _, entry := range entries {
+			ops = append(ops, entry.Operation)
+		}
+		assert.Equal([]string{"SetConfig", "AddLink", "AddPeer", "SetIPAM"}, ops)
+	}},
+	{"ExportImport", func(assert *assert.Assertions, db DB) {
+		setupBackup(db)
+
+		var backup bytes.Buffer
+		err := db.Export(&backup, ExportOptions{})
+		assert.Nil(err)
+
+		// Backups are portable between databases
+		other := setupDB()
+		defer other.Close()
+		_, err = other.Import(bytes.NewReader(backup.Bytes()), ImportOptions{})
+		assert.Nil(err)
+		assertSameState(assert, db, other)
+
+		report, err := db.Import(bytes.NewReader(backup.Bytes()), ImportOptions{Mode: ImportReplace})
+		assert.Nil(err)
+		assert.True(report.Empty(), report.String())
+	}},
+	{"TransactionCommit", func(assert *assert.Assertions, db DB) {
+		testlink := baseLink()
+		err := db.Transaction(func(tx DB) error {
+			err := tx.AddLink(testlink)
+			if err != nil {
+				return err
+			}
+
+			// Changes are visible inside the transaction
+			_, err = tx.GetLink(testlink.Name)
+			if err != nil {
+				return err
+			}
+			return tx.AddPeer(testlink.Name, routedPeer())
+		})
+		assert.Nil(err)
+
+		peers, err := db.GetLinkPeers(testlink.Name)
+		assert.Nil(err)
+		assert.Len(peers, 1)
+	}},
+	{"TransactionRollback", func(assert *assert.Assertions, db DB) {
+		testlink := baseLink()
+		err := db.Transaction(func(tx DB) error {
+			err := tx.AddLink(testlink)
+			if err != nil {
+				return err
+			}
+
+			// A failing method is undone on its own, so the
+			// transaction can go on
+			err = tx.AddLink(testlink)
+			if !errors.Is(err, ErrDuplicateName) {
+				return errors.New("Expected a duplicate link name")
+			}
+			err = tx.AddPeer(testlink.Name, routedPeer())
+			if err != nil {
+				return err
+			}
+			return errDBWrite
+		})
+		assert.Equal(errDBWrite, err)
+
+		_, err = db.GetLink(testlink.Name)
+		assert.True(errors.Is(err, ErrLinkNotFound))
+		peers, err := db.ListPeers(PeerFilter{})
+		assert.Nil(err)
+		assert.Len(peers, 0)
+		entries, err := db.AuditLog(AuditFilter{})
+		assert.Nil(err)
+		assert.Len(entries, 0)
+	}},
+}
+
+// Runs the conformance tests, each on an empty database opened by open.
+func testDBConformance(t *testing.T, open func(t *testing.T) DB) {
+	for _, test := range dbConformanceTests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			db := open(t)
+			defer db.Close()
+			test.test(assert.New(t), db)
+		})
+	}
+}
+
+func TestSqliteDBConformance(t *testing.T) {
+	testDBConformance(t, func(t *testing.T) DB {
+		return setupDB()
+	})
+}
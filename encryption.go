@@ -0,0 +1,485 @@
+package dswg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Supplies the master key of a database storing its keys encrypted, see
+// OpenSqliteDBWithKey. The master key encrypts a data key kept in the
+// database, which encrypts the private and preshared keys.
+type KeyProvider interface {
+	// Returns the 32 bytes of the master key.
+	MasterKey() ([]byte, error)
+}
+
+// Reads the master key from a file, encoded in base64 like wireguard keys,
+// ex. a key made by `wg genkey`.
+type FileKeyProvider string
+
+func (path FileKeyProvider) MasterKey() ([]byte, error) {
+	encoded, err := ioutil.ReadFile(string(path))
+	if err != nil {
+		return nil, err
+	}
+	return decodeMasterKey(string(encoded))
+}
+
+// Reads the master key from an environment variable, encoded in base64.
+type EnvKeyProvider string
+
+func (name EnvKeyProvider) MasterKey() ([]byte, error) {
+	encoded, ok := os.LookupEnv(string(name))
+	if !ok {
+		return nil, fmt.Errorf("Environment variable %v holding the master key is not set", name)
+	}
+	return decodeMasterKey(encoded)
+}
+
+// A master key held in memory.
+type StaticKeyProvider []byte
+
+func (key StaticKeyProvider) MasterKey() ([]byte, error) {
+	return key, nil
+}
+
+func decodeMasterKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Master key must be 32 bytes encoded in base64")
+	}
+	return key, nil
+}
+
+// Prefix of the stored keys encrypted by a keyCipher. Keys stored in plain
+// are in base64, which has no colon.
+const sealedKeyPrefix = "sealed:"
+
+// Additional data of the data key encrypted by the master key.
+var dataKeyAD = []byte("dswg data key")
+
+// Additional data of a key stored in the database, naming the table, column
+// and id of its row, so a sealed key copied to another row or column
+// doesn't decrypt.
+func keyAD(table, column string, id int64) []byte {
+	return []byte(fmt.Sprintf("dswg %v.%v %v", table, column, id))
+}
+
+// Encrypts the keys stored in a database with AES-256-GCM. A nil keyCipher
+// stores keys in plain.
+type keyCipher struct {
+	aead cipher.AEAD
+}
+
+func newKeyCipher(key []byte) (*keyCipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Encryption keys must be 32 bytes, got %v", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &keyCipher{aead: aead}, nil
+}
+
+// Encrypts data with a random nonce, which is prepended to the result.
+func (c *keyCipher) encrypt(data, ad []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(data)+c.aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, data, ad), nil
+}
+
+func (c *keyCipher) decrypt(data, ad []byte) ([]byte, error) {
+	if len(data) < c.aead.NonceSize() {
+		return nil, fmt.Errorf("Encrypted data is too short")
+	}
+
+	nonce := data[:c.aead.NonceSize()]
+	return c.aead.Open(nil, nonce, data[c.aead.NonceSize():], ad)
+}
+
+// Returns the key as stored in the database, NULL if it is nil. ad is the
+// keyAD of its row.
+func (c *keyCipher) seal(key *Key, ad []byte) (sql.NullString, error) {
+	if key == nil {
+		return sql.NullString{}, nil
+	}
+	if c == nil {
+		return sql.NullString{String: key.String(), Valid: true}, nil
+	}
+
+	sealed, err := c.encrypt(key.Key[:], ad)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+
+	value := sealedKeyPrefix + base64.StdEncoding.EncodeToString(sealed)
+	return sql.NullString{String: value, Valid: true}, nil
+}
+
+// Returns the key stored in the database, nil if it is NULL.
+func (c *keyCipher) open(value sql.NullString, ad []byte) (*Key, error) {
+	if !value.Valid {
+		return nil, nil
+	}
+	if !strings.HasPrefix(value.String, sealedKeyPrefix) {
+		return ParseKey(value.String)
+	}
+	if c == nil {
+		return nil, errorf(ErrMasterKeyRequired, "Database keys are encrypted, a master key is needed to read them")
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value.String, sealedKeyPrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := c.decrypt(sealed, ad)
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't decrypt key stored in database: %v", err)
+	}
+
+	var key Key
+	copy(key.Key[:], data)
+	return &key, nil
+}
+
+// A link with its private key as stored in the database. Statements
+// bind the stored key as :stored_private_key, sqlx mapping private_key
+// to the key of the link.
+type storedLink struct {
+	Link
+	PrivateKey string `db:"stored_private_key"`
+}
+
+// Seals the keys of the link stored in the row id. Links being inserted
+// are sealed for row 0, and sealed again with sealInsertedLink.
+func (c *keyCipher) sealLink(link Link, id int64) (*storedLink, error) {
+	privateKey, err := c.seal(&link.PrivateKey, keyAD("links", "private_key", id))
+	if err != nil {
+		return nil, err
+	}
+	return &storedLink{Link: link, PrivateKey: privateKey.String}, nil
+}
+
+// Seals the keys of the link inserted as row id, once its id is known.
+func (c *keyCipher) sealInsertedLink(tx sqlx.Ext, link Link, id int64) error {
+	if c == nil {
+		return nil
+	}
+
+	stored, err := c.sealLink(link, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(tx.Rebind("UPDATE links SET private_key = ? WHERE id = ?"), stored.PrivateKey, id)
+	return err
+}
+
+// A peer with its keys as stored in the database, bound and selected as
+// stored_private_key and stored_preshared_key like storedLink.
+type storedPeer struct {
+	Peer
+	PrivateKey   sql.NullString `db:"stored_private_key"`
+	PresharedKey sql.NullString `db:"stored_preshared_key"`
+}
+
+// Same as sealLink, for peers.
+func (c *keyCipher) sealPeer(peer Peer, id int64) (*storedPeer, error) {
+	privateKey, err := c.seal(peer.PrivateKey, keyAD("peers", "private_key", id))
+	if err != nil {
+		return nil, err
+	}
+
+	presharedKey, err := c.seal(peer.PresharedKey, keyAD("peers", "preshared_key", id))
+	if err != nil {
+		return nil, err
+	}
+
+	return &storedPeer{Peer: peer, PrivateKey: privateKey, PresharedKey: presharedKey}, nil
+}
+
+// Same as sealInsertedLink, for peers.
+func (c *keyCipher) sealInsertedPeer(tx sqlx.Ext, peer Peer, id int64) error {
+	if c == nil {
+		return nil
+	}
+
+	stored, err := c.sealPeer(peer, id)
+	if err != nil {
+		return err
+	}
+
+	const updateStmt = "UPDATE peers SET private_key = ?, preshared_key = ? WHERE id = ?"
+	_, err = tx.Exec(tx.Rebind(updateStmt), stored.PrivateKey, stored.PresharedKey, id)
+	return err
+}
+
+func (c *keyCipher) openPeer(stored storedPeer, id int64) (*Peer, error) {
+	peer := stored.Peer
+	var err error
+	peer.PrivateKey, err = c.open(stored.PrivateKey, keyAD("peers", "private_key", id))
+	if err != nil {
+		return nil, err
+	}
+
+	peer.PresharedKey, err = c.open(stored.PresharedKey, keyAD("peers", "preshared_key", id))
+	if err != nil {
+		return nil, err
+	}
+	return &peer, nil
+}
+
+// Cipher of the keys stored in a database, shared by the copies of a DB
+// made by WithActor and Transaction, so a rekey through any of them is
+// seen by all. The data key is reloaded whenever another process rekeys
+// the database.
+type dbKeys struct {
+	mu       sync.Mutex
+	provider KeyProvider
+	wrapped  string     // data key as stored, empty if keys are stored in plain
+	cipher   *keyCipher // nil if keys are stored in plain
+}
+
+// Loads the cipher of the keys stored in the database with the master key
+// of the provider. Keys of databases opened with a master key for the
+// first time are encrypted.
+func openDBKeys(db *sqlx.DB, provider KeyProvider) (*dbKeys, error) {
+	keys := &dbKeys{provider: provider}
+	wrapped, err := storedDataKey(db)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) == 0 {
+		if provider == nil {
+			return keys, nil
+		}
+		return keys, keys.rekey(db, provider)
+	}
+
+	if provider == nil {
+		return nil, errorf(ErrMasterKeyRequired, "Database keys are encrypted, a master key is needed to open it")
+	}
+	_, err = keys.load(db)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Returns the cipher of the keys stored in the database, nil if they are
+// stored in plain. q should be the transaction the keys are read or
+// written in, so they are sealed with the data key they are stored with.
+func (k *dbKeys) load(q sqlx.Queryer) (*keyCipher, error) {
+	wrapped, err := storedDataKey(q)
+	if err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if wrapped == k.wrapped {
+		return k.cipher, nil
+	}
+
+	cipher, err := unwrapDataKey(wrapped, k.provider)
+	if err != nil {
+		return nil, err
+	}
+	k.wrapped = wrapped
+	k.cipher = cipher
+	return cipher, nil
+}
+
+// Encrypts the keys of the database with a new data key, itself encrypted
+// with the master key of the provider. A nil provider decrypts the keys,
+// storing them in plain.
+func (k *dbKeys) rekey(db *sqlx.DB, provider KeyProvider) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	wrapped, cipher, err := rekeyDB(db, k.provider, provider)
+	if err != nil {
+		return err
+	}
+	k.provider = provider
+	k.wrapped = wrapped
+	k.cipher = cipher
+	return nil
+}
+
+// Returns the data key as stored in the database, empty if it has none.
+func storedDataKey(q sqlx.Queryer) (string, error) {
+	var wrapped string
+	err := sqlx.Get(q, &wrapped, "SELECT data_key FROM encryption")
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return wrapped, err
+}
+
+// Decrypts the stored data key with the master key of the provider and
+// returns its cipher, nil if the database has no data key.
+func unwrapDataKey(wrapped string, provider KeyProvider) (*keyCipher, error) {
+	if len(wrapped) == 0 {
+		return nil, nil
+	}
+	if provider == nil {
+		return nil, errorf(ErrMasterKeyRequired, "Database keys are encrypted, a master key is needed to read them")
+	}
+
+	master, err := masterKeyCipher(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := master.decrypt(sealed, dataKeyAD)
+	if err != nil {
+		return nil, errorf(ErrWrongMasterKey,
+			"Master key can't decrypt the database keys, they were encrypted with another key")
+	}
+	return newKeyCipher(dataKey)
+}
+
+func masterKeyCipher(provider KeyProvider) (*keyCipher, error) {
+	key, err := provider.MasterKey()
+	if err != nil {
+		return nil, fmt.Errorf("Couldn't get master key: %v", err)
+	}
+	return newKeyCipher(key)
+}
+
+// Columns holding keys, encrypted when the database has a master key.
+var keyColumns = []struct {
+	table, column string
+}{
+	{"links", "private_key"},
+	{"peers", "private_key"},
+	{"peers", "preshared_key"},
+}
+
+// Encrypts the keys of the database with a new data key, itself encrypted
+// with the master key of the provider, and returns the stored data key
+// and its cipher. The keys are decrypted with the data key stored in the
+// same transaction, opened with the master key of old.
+func rekeyDB(db *sqlx.DB, old, provider KeyProvider) (string, *keyCipher, error) {
+	var wrapped string
+	var next *keyCipher
+	if provider != nil {
+		master, err := masterKeyCipher(provider)
+		if err != nil {
+			return "", nil, err
+		}
+
+		dataKey := make([]byte, 32)
+		_, err = io.ReadFull(rand.Reader, dataKey)
+		if err != nil {
+			return "", nil, err
+		}
+
+		sealed, err := master.encrypt(dataKey, dataKeyAD)
+		if err != nil {
+			return "", nil, err
+		}
+		wrapped = base64.StdEncoding.EncodeToString(sealed)
+
+		next, err = newKeyCipher(dataKey)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback()
+
+	current, err := storedDataKey(tx)
+	if err != nil {
+		return "", nil, err
+	}
+	cipher, err := unwrapDataKey(current, old)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, column := range keyColumns {
+		err := reencryptColumn(tx, column.table, column.column, cipher, next)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM encryption")
+	if err != nil {
+		return "", nil, err
+	}
+	if next != nil {
+		_, err = tx.Exec(tx.Rebind("INSERT INTO encryption (data_key) VALUES (?)"), wrapped)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	return wrapped, next, tx.Commit()
+}
+
+func reencryptColumn(tx *sqlx.Tx, table, column string, old, next *keyCipher) error {
+	var rows []struct {
+		ID    int64          `db:"id"`
+		Value sql.NullString `db:"value"`
+	}
+	query := fmt.Sprintf("SELECT id, %v AS value FROM %v WHERE %v IS NOT NULL", column, table, column)
+	err := tx.Select(&rows, query)
+	if err != nil {
+		return err
+	}
+
+	update := tx.Rebind(fmt.Sprintf("UPDATE %v SET %v = ? WHERE id = ?", table, column))
+	for _, row := range rows {
+		ad := keyAD(table, column, row.ID)
+		key, err := old.open(row.Value, ad)
+		if err != nil {
+			return err
+		}
+
+		value, err := next.seal(key, ad)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(update, value, row.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package dswg
+
+import (
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+func testMasterKey() StaticKeyProvider {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return StaticKeyProvider(key)
+}
+
+// Returns the values of the key columns as stored in the database file.
+func storedKeys(t *testing.T, path string) []string {
+	db, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var keys []string
+	err = db.Select(&keys, `
+		SELECT private_key FROM links UNION ALL
+		SELECT private_key FROM peers WHERE private_key IS NOT NULL UNION ALL
+		SELECT preshared_key FROM peers WHERE preshared_key IS NOT NULL`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// Adds a link with a peer having every key to the database.
+func setupKeys(db DB) (Link, Peer) {
+	testlink := baseLink()
+	db.AddLink(testlink)
+	testpeer := routedPeer()
+	testpeer.PrivateKey = &testlink.PrivateKey
+	db.AddPeer(testlink.Name, testpeer)
+	return testlink, testpeer
+}
+
+func assertKeys(assert *assert.Assertions, db DB, testlink Link, testpeer Peer) {
+	dblink, err := db.GetLink(testlink.Name)
+	assert.Nil(err)
+	assert.Equal(testlink.PrivateKey, dblink.PrivateKey)
+
+	dbpeer, err := db.GetPeer(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Equal(testpeer.PrivateKey, dbpeer.PrivateKey)
+	assert.Equal(testpeer.PresharedKey, dbpeer.PresharedKey)
+
+	peers, err := db.ListPeers(PeerFilter{})
+	assert.Nil(err)
+	assert.Equal(testpeer.PresharedKey, peers[0].PresharedKey)
+}
+
+func tempDBPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "dswg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "db.sqlite"), func() { os.RemoveAll(dir) }
+}
+
+func TestKeyProviders(t *testing.T) {
+	assert := assert.New(t)
+
+	path, cleanup := tempDBPath(t)
+	defer cleanup()
+
+	// Keys are read like wireguard keys, ex. made by `wg genkey`
+	encoded := "4AQ6d+dvykkl4j6VG03e7VcciDbgn5mBEJFXMjn1pnU="
+	ioutil.WriteFile(path, []byte(encoded+"\n"), 0600)
+	key, err := FileKeyProvider(path).MasterKey()
+	assert.Nil(err)
+	assert.Len(key, 32)
+
+	_, err = FileKeyProvider(path + ".none").MasterKey()
+	assert.True(os.IsNotExist(err))
+
+	os.Setenv("DSWG_TEST_MASTER_KEY", encoded)
+	defer os.Unsetenv("DSWG_TEST_MASTER_KEY")
+	envKey, err := EnvKeyProvider("DSWG_TEST_MASTER_KEY").MasterKey()
+	assert.Nil(err)
+	assert.Equal(key, envKey)
+
+	_, err = EnvKeyProvider("DSWG_TEST_NO_MASTER_KEY").MasterKey()
+	assert.NotNil(err)
+
+	os.Setenv("DSWG_TEST_MASTER_KEY", "c2hvcnQ=")
+	_, err = EnvKeyProvider("DSWG_TEST_MASTER_KEY").MasterKey()
+	assert.Equal("Master key must be 32 bytes encoded in base64", err.Error())
+}
+
+func TestEncryptedDB(t *testing.T) {
+	assert := assert.New(t)
+
+	path, cleanup := tempDBPath(t)
+	defer cleanup()
+
+	master := testMasterKey()
+	db, err := OpenSqliteDBWithKey(path, master)
+	assert.Nil(err)
+	testlink, testpeer := setupKeys(db)
+	assertKeys(assert, db, testlink, testpeer)
+	db.Close()
+
+	keys := storedKeys(t, path)
+	assert.Len(keys, 3)
+	for _, key := range keys {
+		assert.True(strings.HasPrefix(key, sealedKeyPrefix), key)
+		assert.NotContains(key, testlink.PrivateKey.String())
+	}
+
+	_, err = OpenSqliteDB(path)
+	assert.True(errors.Is(err, ErrMasterKeyRequired))
+
+	_, err = OpenSqliteDBWithKey(path, testMasterKey())
+	assert.True(errors.Is(err, ErrWrongMasterKey))
+
+	db, err = OpenSqliteDBWithKey(path, master)
+	assert.Nil(err)
+	defer db.Close()
+	assertKeys(assert, db, testlink, testpeer)
+}
+
+func TestEncryptExistingDB(t *testing.T) {
+	assert := assert.New(t)
+
+	path, cleanup := tempDBPath(t)
+	defer cleanup()
+
+	db, err := OpenSqliteDB(path)
+	assert.Nil(err)
+	testlink, testpeer := setupKeys(db)
+	db.Close()
+	assert.Contains(storedKeys(t, path), testlink.PrivateKey.String())
+
+	// Keys are encrypted the first time the database is opened with a key
+	db, err = OpenSqliteDBWithKey(path, testMasterKey())
+	assert.Nil(err)
+	defer db.Close()
+	assertKeys(assert, db, testlink, testpeer)
+
+	for _, key := range storedKeys(t, path) {
+		assert.True(strings.HasPrefix(key, sealedKeyPrefix), key)
+	}
+}
+
+func TestDBRekey(t *testing.T) {
+	assert := assert.New(t)
+
+	path, cleanup := tempDBPath(t)
+	defer cleanup()
+
+	oldMaster, newMaster := testMasterKey(), testMasterKey()
+	db, err := OpenSqliteDBWithKey(path, oldMaster)
+	assert.Nil(err)
+	testlink, testpeer := setupKeys(db)
+	oldKeys := storedKeys(t, path)
+
+	err = db.Rekey(newMaster)
+	assert.Nil(err)
+	assertKeys(assert, db, testlink, testpeer)
+	db.Close()
+
+	// Keys are encrypted with a new data key too
+	for i, key := range storedKeys(t, path) {
+		assert.NotEqual(oldKeys[i], key)
+	}
+
+	_, err = OpenSqliteDBWithKey(path, oldMaster)
+	assert.True(errors.Is(err, ErrWrongMasterKey))
+
+	db, err = OpenSqliteDBWithKey(path, newMaster)
+	assert.Nil(err)
+	assertKeys(assert, db, testlink, testpeer)
+
+	// Rekeying without a master key stores the keys in plain
+	err = db.Rekey(nil)
+	assert.Nil(err)
+	db.Close()
+
+	db, err = OpenSqliteDB(path)
+	assert.Nil(err)
+	defer db.Close()
+	assertKeys(assert, db, testlink, testpeer)
+}
+
+func TestDBRekeySharedHandles(t *testing.T) {
+	assert := assert.New(t)
+
+	path, cleanup := tempDBPath(t)
+	defer cleanup()
+
+	master := testMasterKey()
+	db, err := OpenSqliteDBWithKey(path, master)
+	assert.Nil(err)
+	defer db.Close()
+	testlink, testpeer := setupKeys(db)
+
+	// A handle opened by another process sharing the database
+	other, err := OpenSqliteDBWithKey(path, master)
+	assert.Nil(err)
+	defer other.Close()
+
+	// Rekeying through a copy changes the data key of the original too
+	newMaster := testMasterKey()
+	err = db.WithActor("admin").Rekey(newMaster)
+	assert.Nil(err)
+	assertKeys(assert, db, testlink, testpeer)
+
+	testlink2 := baseLink()
+	testlink2.Name = "wg1"
+	testlink2.ListenPort = 51821
+	assert.Nil(db.AddLink(testlink2))
+
+	// The other handle can't read keys sealed with a data key it can't open
+	_, err = other.GetLink(testlink.Name)
+	assert.True(errors.Is(err, ErrWrongMasterKey))
+
+	// Until the data key is rotated under the master key it was opened with
+	err = db.Rekey(master)
+	assert.Nil(err)
+	assertKeys(assert, other, testlink, testpeer)
+	dblink, err := other.GetLink(testlink2.Name)
+	assert.Nil(err)
+	assert.Equal(testlink2.PrivateKey, dblink.PrivateKey)
+}
+
+func TestDBKeysBoundToRows(t *testing.T) {
+	assert := assert.New(t)
+
+	path, cleanup := tempDBPath(t)
+	defer cleanup()
+
+	db, err := OpenSqliteDBWithKey(path, testMasterKey())
+	assert.Nil(err)
+	defer db.Close()
+	testlink, testpeer := setupKeys(db)
+	testlink2 := baseLink()
+	testlink2.Name = "wg1"
+	testlink2.ListenPort = 51821
+	assert.Nil(db.AddLink(testlink2))
+
+	conn, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// A sealed key copied to another row or column doesn't decrypt
+	_, err = conn.Exec(`
+		UPDATE links SET private_key = (
+			SELECT private_key FROM links WHERE name = ?)
+		WHERE name = ?`, testlink.Name, testlink2.Name)
+	assert.Nil(err)
+	_, err = db.GetLink(testlink2.Name)
+	assert.NotNil(err)
+
+	_, err = conn.Exec(`
+		UPDATE peers SET preshared_key = private_key
+		WHERE name = ?`, testpeer.Name)
+	assert.Nil(err)
+	_, err = db.GetPeer(testlink.Name, testpeer.Name)
+	assert.NotNil(err)
+
+	dblink, err := db.GetLink(testlink.Name)
+	assert.Nil(err)
+	assert.Equal(testlink.PrivateKey, dblink.PrivateKey)
+}
@@ -0,0 +1,71 @@
+package dswg
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by DB and Client operations, matched with errors.Is.
+// The errors returned carry more details, ex. the name of the link.
+var (
+	ErrLinkNotFound       = errors.New("Link does not exist")
+	ErrPeerNotFound       = errors.New("Peer does not exist")
+	ErrDuplicateName      = errors.New("Name already exists")
+	ErrDuplicatePublicKey = errors.New("Public key already belongs to a peer of the link")
+	ErrAllowedIPConflict  = errors.New("Allowed IP already belongs to a peer of the link")
+	ErrLinkNotLoaded      = errors.New("Link is not loaded in the kernel")
+	ErrSchemaTooNew       = errors.New("Database schema is newer than supported")
+	ErrMasterKeyRequired  = errors.New("Database keys are encrypted")
+	ErrWrongMasterKey     = errors.New("Master key doesn't match the database")
+	ErrInvalidBackup      = errors.New("Backup is invalid or corrupted")
+)
+
+// Returned when a link or peer field has an invalid value, matched with
+// errors.As.
+type ValidationError struct {
+	Field string // name of the Link or Peer field, ex. "RulePriority"
+	Msg   string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Msg
+}
+
+func invalid(field, format string, args ...interface{}) error {
+	return &ValidationError{Field: field, Msg: fmt.Sprintf(format, args...)}
+}
+
+// An error with a detailed message, matching one of the errors above.
+type detailedError struct {
+	err error
+	msg string
+}
+
+func (e *detailedError) Error() string {
+	return e.msg
+}
+
+func (e *detailedError) Unwrap() error {
+	return e.err
+}
+
+// Returns an error matching err, described by the formatted message.
+func errorf(err error, format string, args ...interface{}) error {
+	return &detailedError{err: err, msg: fmt.Sprintf(format, args...)}
+}
+
+func linkNotFound(name string) error {
+	return errorf(ErrLinkNotFound, "Link \"%v\" does not exist in database", name)
+}
+
+func peerNotFound(name string) error {
+	return errorf(ErrPeerNotFound, "Peer \"%v\" does not exist in database", name)
+}
+
+func peerKeyNotFound(linkName string, key Key) error {
+	return errorf(ErrPeerNotFound, "Link \"%v\" has no peer with public key %v", linkName, key)
+}
+
+func linkNotLoaded(name string) error {
+	return errorf(ErrLinkNotLoaded, "Couldn't find wireguard link %v in the kernel", name)
+}
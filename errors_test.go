@@ -0,0 +1,55 @@
+package dswg
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetailedError(t *testing.T) {
+	assert := assert.New(t)
+
+	err := linkNotFound("wg-linko")
+	assert.Equal(`Link "wg-linko" does not exist in database`, err.Error())
+	assert.True(errors.Is(err, ErrLinkNotFound))
+	assert.False(errors.Is(err, ErrPeerNotFound))
+
+	// Errors stay matchable through the steps of Client operations
+	err = &StepError{Op: "AddPeer", Step: "add peer zoz-pc to database", Err: err}
+	assert.True(errors.Is(err, ErrLinkNotFound))
+}
+
+func TestValidationError(t *testing.T) {
+	assert := assert.New(t)
+
+	link := baseLink()
+	link.RulePriority = mainRulePriority
+	err := validLink(link)
+
+	var invalid *ValidationError
+	assert.True(errors.As(err, &invalid))
+	assert.Equal("RulePriority", invalid.Field)
+	assert.Equal("Link rule priority must be between 0 and 32764", err.Error())
+}
+
+func TestSqliteError(t *testing.T) {
+	assert := assert.New(t)
+
+	db := setupDB()
+	defer db.Close()
+
+	testlink := baseLink()
+	err := db.AddLink(testlink)
+	assert.Nil(err)
+
+	// Allowed IPs of a peer conflict with themselves as well
+	testpeer := basePeer()
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	testpeer.AllowedIPs = []IPNet{*addr, *addr}
+	err = db.AddPeer(testlink.Name, testpeer)
+	assert.True(errors.Is(err, ErrAllowedIPConflict))
+
+	// Other errors are passed through
+	assert.Equal(ErrLinkNotLoaded, sqliteError(ErrLinkNotLoaded))
+}
@@ -0,0 +1,679 @@
+package dswg
+
+import (
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// An in-memory LinkManager and WireGuardConfigurator, modelling a freshly
+// created network namespace with wireguard support. It lets clients run
+// without root or a wireguard kernel module, ex. in tests:
+//
+//	kernel := NewFakeKernel()
+//	client, _ := NewClientWithBackends(db, kernel, kernel)
+//
+// Errors are the ones the kernel returns, and, like the kernel, bringing
+// a link down flushes its routes. Addresses don't add prefix routes, and
+// the default policy routing rules are left out.
+type FakeKernel struct {
+	mu        sync.Mutex
+	links     map[int]*fakeLink
+	nextIndex int
+	routes    []netlink.Route
+	rules     []netlink.Rule
+}
+
+type fakeLink struct {
+	attrs    netlink.LinkAttrs
+	linkType string
+	addrs    []net.IPNet
+	device   *wgtypes.Device // nil unless linkType is wireguard
+}
+
+func NewFakeKernel() *FakeKernel {
+	lo := netlink.NewLinkAttrs()
+	lo.Name = "lo"
+	lo.Index = 1
+	lo.MTU = 65536
+	lo.Flags = net.FlagLoopback
+
+	return &FakeKernel{
+		links:     map[int]*fakeLink{1: {attrs: lo, linkType: "device"}},
+		nextIndex: 2,
+	}
+}
+
+// Finds a link by index, or by name if the index isn't set.
+// The lock must be held.
+func (k *FakeKernel) find(link netlink.Link) (*fakeLink, error) {
+	attrs := link.Attrs()
+	if attrs.Index > 0 {
+		if l, ok := k.links[attrs.Index]; ok {
+			return l, nil
+		}
+		return nil, syscall.ENODEV
+	}
+
+	if l := k.findName(attrs.Name); l != nil {
+		return l, nil
+	}
+	return nil, syscall.ENODEV
+}
+
+func (k *FakeKernel) findName(name string) *fakeLink {
+	for _, l := range k.links {
+		if l.attrs.Name == name {
+			return l
+		}
+	}
+	return nil
+}
+
+// Returns a copy of the link, so callers can't change the fake state.
+func (l *fakeLink) netlinkLink() netlink.Link {
+	attrs := l.attrs
+	return &netlink.GenericLink{LinkAttrs: attrs, LinkType: l.linkType}
+}
+
+func (k *FakeKernel) LinkAdd(link netlink.Link) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	attrs := *link.Attrs()
+	if len(attrs.Name) == 0 {
+		return syscall.EINVAL
+	}
+	if k.findName(attrs.Name) != nil {
+		return syscall.EEXIST
+	}
+
+	l := &fakeLink{linkType: link.Type()}
+	l.attrs = netlink.NewLinkAttrs()
+	l.attrs.Name = attrs.Name
+	l.attrs.Index = k.nextIndex
+	l.attrs.MTU = attrs.MTU
+	l.attrs.Flags = attrs.Flags &^ net.FlagUp
+	if l.attrs.MTU == 0 {
+		l.attrs.MTU = 1500
+		if l.linkType == "wireguard" {
+			l.attrs.MTU = 1420
+		}
+	}
+	if l.linkType == "wireguard" {
+		l.device = &wgtypes.Device{Name: attrs.Name, Type: wgtypes.LinuxKernel}
+	}
+
+	k.links[l.attrs.Index] = l
+	k.nextIndex++
+	return nil
+}
+
+func (k *FakeKernel) LinkDel(link netlink.Link) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.find(link)
+	if err != nil {
+		return err
+	}
+
+	k.remove(l)
+	return nil
+}
+
+// Drops the link together with its routes. The lock must be held.
+func (k *FakeKernel) remove(l *fakeLink) {
+	k.flushRoutes(l.attrs.Index)
+	delete(k.links, l.attrs.Index)
+}
+
+func (k *FakeKernel) flushRoutes(index int) {
+	routes := k.routes[:0]
+	for _, route := range k.routes {
+		if route.LinkIndex != index {
+			routes = append(routes, route)
+		}
+	}
+	k.routes = routes
+}
+
+func (k *FakeKernel) LinkByName(name string) (netlink.Link, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l := k.findName(name)
+	if l == nil {
+		return nil, syscall.ENODEV
+	}
+	return l.netlinkLink(), nil
+}
+
+func (k *FakeKernel) LinkList() ([]netlink.Link, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	links := make([]netlink.Link, 0, len(k.links))
+	for index := 1; index < k.nextIndex; index++ {
+		if l, ok := k.links[index]; ok {
+			links = append(links, l.netlinkLink())
+		}
+	}
+	return links, nil
+}
+
+func (k *FakeKernel) LinkSetUp(link netlink.Link) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.find(link)
+	if err != nil {
+		return err
+	}
+
+	l.attrs.Flags |= net.FlagUp
+	l.attrs.OperState = netlink.OperUnknown
+	return nil
+}
+
+func (k *FakeKernel) LinkSetDown(link netlink.Link) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.find(link)
+	if err != nil {
+		return err
+	}
+
+	l.attrs.Flags &^= net.FlagUp
+	l.attrs.OperState = netlink.OperDown
+	k.flushRoutes(l.attrs.Index)
+	return nil
+}
+
+func (k *FakeKernel) LinkSetMTU(link netlink.Link, mtu int) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.find(link)
+	if err != nil {
+		return err
+	}
+
+	if mtu <= 0 {
+		return syscall.EINVAL
+	}
+	l.attrs.MTU = mtu
+	return nil
+}
+
+func (k *FakeKernel) LinkSetName(link netlink.Link, name string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.find(link)
+	if err != nil {
+		return err
+	}
+
+	if l.attrs.Name == name {
+		return nil
+	}
+	if k.findName(name) != nil {
+		return syscall.EEXIST
+	}
+	if l.attrs.Flags&net.FlagUp != 0 {
+		return syscall.EBUSY
+	}
+
+	l.attrs.Name = name
+	if l.device != nil {
+		l.device.Name = name
+	}
+	return nil
+}
+
+// Moving a link to another namespace removes it from the fake.
+func (k *FakeKernel) LinkSetNsFd(link netlink.Link, fd int) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.find(link)
+	if err != nil {
+		return err
+	}
+
+	if fd < 0 {
+		return syscall.EBADF
+	}
+	k.remove(l)
+	return nil
+}
+
+func (k *FakeKernel) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var links []*fakeLink
+	if link == nil {
+		for _, l := range k.links {
+			links = append(links, l)
+		}
+	} else {
+		l, err := k.find(link)
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+
+	var addrs []netlink.Addr
+	for _, l := range links {
+		for i := range l.addrs {
+			ipnet := l.addrs[i]
+			if !matchFamily(ipnet.IP, family) {
+				continue
+			}
+			addrs = append(addrs, netlink.Addr{
+				IPNet: &ipnet,
+				Label: l.attrs.Name,
+			})
+		}
+	}
+	return addrs, nil
+}
+
+func (k *FakeKernel) AddrAdd(link netlink.Link, addr *netlink.Addr) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.find(link)
+	if err != nil {
+		return err
+	}
+
+	if addr.IPNet == nil {
+		return syscall.EINVAL
+	}
+	for _, ipnet := range l.addrs {
+		if ipnet.IP.Equal(addr.IP) {
+			return syscall.EEXIST
+		}
+	}
+
+	ipnet := net.IPNet{IP: copyIP(addr.IP), Mask: addr.Mask}
+	l.addrs = append(l.addrs, ipnet)
+	return nil
+}
+
+func (k *FakeKernel) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, err := k.find(link)
+	if err != nil {
+		return err
+	}
+
+	for i, ipnet := range l.addrs {
+		if addr.IPNet != nil && ipnet.IP.Equal(addr.IP) {
+			l.addrs = append(l.addrs[:i], l.addrs[i+1:]...)
+			return nil
+		}
+	}
+	return syscall.EADDRNOTAVAIL
+}
+
+func (k *FakeKernel) RouteAdd(route *netlink.Route) error {
+	return k.addRoute(route, false)
+}
+
+// Adds the route, or replaces the route to the same destination.
+func (k *FakeKernel) RouteReplace(route *netlink.Route) error {
+	return k.addRoute(route, true)
+}
+
+func (k *FakeKernel) addRoute(route *netlink.Route, replace bool) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l, ok := k.links[route.LinkIndex]
+	if !ok {
+		return syscall.ENODEV
+	}
+	if l.attrs.Flags&net.FlagUp == 0 {
+		return syscall.ENETDOWN
+	}
+	if route.Dst == nil {
+		return syscall.EINVAL
+	}
+
+	r := *route
+	r.Dst = &net.IPNet{IP: copyIP(route.Dst.IP), Mask: route.Dst.Mask}
+	if r.Table == 0 {
+		r.Table = mainRouteTable
+	}
+
+	for i, existing := range k.routes {
+		if existing.Table == r.Table && existing.Priority == r.Priority &&
+			existing.Dst.String() == r.Dst.String() {
+			if !replace {
+				return syscall.EEXIST
+			}
+			k.routes[i] = r
+			return nil
+		}
+	}
+
+	k.routes = append(k.routes, r)
+	return nil
+}
+
+// Deletes the first route to the destination. Like the kernel, the link,
+// protocol and priority of the route only have to match when set.
+func (k *FakeKernel) RouteDel(route *netlink.Route) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if route.Dst == nil {
+		return syscall.EINVAL
+	}
+	table := route.Table
+	if table == 0 {
+		table = mainRouteTable
+	}
+
+	for i, existing := range k.routes {
+		switch {
+		case existing.Table != table || existing.Dst.String() != route.Dst.String():
+		case route.LinkIndex != 0 && existing.LinkIndex != route.LinkIndex:
+		case route.Protocol != 0 && existing.Protocol != route.Protocol:
+		case route.Priority != 0 && existing.Priority != route.Priority:
+		default:
+			k.routes = append(k.routes[:i], k.routes[i+1:]...)
+			return nil
+		}
+	}
+	return syscall.ESRCH
+}
+
+// Lists the main table routes of the link, or of every link if it is nil.
+func (k *FakeKernel) RouteList(link netlink.Link, family int) ([]netlink.Route, error) {
+	filter := &netlink.Route{}
+	var filterMask uint64
+	if link != nil {
+		k.mu.Lock()
+		l, err := k.find(link)
+		k.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		filter.LinkIndex = l.attrs.Index
+		filterMask = netlink.RT_FILTER_OIF
+	}
+	return k.RouteListFiltered(family, filter, filterMask)
+}
+
+// Supports the link, table and protocol filters. Like netlink, only the
+// main table is listed unless the table is filtered, and filtering on
+// table 0 lists every table.
+func (k *FakeKernel) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var routes []netlink.Route
+	for _, route := range k.routes {
+		switch {
+		case !matchFamily(route.Dst.IP, family):
+			continue
+		case filterMask&netlink.RT_FILTER_TABLE == 0 && route.Table != mainRouteTable:
+			continue
+		case filterMask&netlink.RT_FILTER_TABLE != 0 && filter.Table != 0 && route.Table != filter.Table:
+			continue
+		case filterMask&netlink.RT_FILTER_OIF != 0 && route.LinkIndex != filter.LinkIndex:
+			continue
+		case filterMask&netlink.RT_FILTER_PROTOCOL != 0 && route.Protocol != filter.Protocol:
+			continue
+		}
+		r := route
+		r.Dst = &net.IPNet{IP: copyIP(route.Dst.IP), Mask: route.Dst.Mask}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+func (k *FakeKernel) RuleAdd(rule *netlink.Rule) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	r := *rule
+	if r.Family == 0 {
+		r.Family = netlink.FAMILY_V4
+	}
+	if k.findRule(r) >= 0 {
+		return syscall.EEXIST
+	}
+	k.rules = append(k.rules, r)
+	return nil
+}
+
+func (k *FakeKernel) RuleDel(rule *netlink.Rule) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	r := *rule
+	if r.Family == 0 {
+		r.Family = netlink.FAMILY_V4
+	}
+	i := k.findRule(r)
+	if i < 0 {
+		return syscall.ENOENT
+	}
+	k.rules = append(k.rules[:i], k.rules[i+1:]...)
+	return nil
+}
+
+func (k *FakeKernel) RuleList(family int) ([]netlink.Rule, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var rules []netlink.Rule
+	for _, rule := range k.rules {
+		if family == netlink.FAMILY_ALL || rule.Family == family {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// The lock must be held.
+func (k *FakeKernel) findRule(rule netlink.Rule) int {
+	for i, r := range k.rules {
+		if sameRule(r, rule) && r.Family == rule.Family {
+			return i
+		}
+	}
+	return -1
+}
+
+func (k *FakeKernel) Delete() {}
+
+func (k *FakeKernel) Device(name string) (*wgtypes.Device, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l := k.findName(name)
+	if l == nil || l.device == nil {
+		return nil, os.ErrNotExist
+	}
+
+	device := *l.device
+	device.Peers = make([]wgtypes.Peer, len(l.device.Peers))
+	for i, peer := range l.device.Peers {
+		device.Peers[i] = copyWGPeer(peer)
+	}
+	return &device, nil
+}
+
+func (k *FakeKernel) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l := k.findName(name)
+	if l == nil || l.device == nil {
+		return os.ErrNotExist
+	}
+	device := l.device
+
+	if cfg.PrivateKey != nil {
+		device.PrivateKey = *cfg.PrivateKey
+		device.PublicKey = cfg.PrivateKey.PublicKey()
+		if *cfg.PrivateKey == (wgtypes.Key{}) {
+			device.PublicKey = wgtypes.Key{}
+		}
+	}
+	if cfg.ListenPort != nil {
+		device.ListenPort = *cfg.ListenPort
+	}
+	if cfg.FirewallMark != nil {
+		device.FirewallMark = *cfg.FirewallMark
+	}
+	if cfg.ReplacePeers {
+		device.Peers = nil
+	}
+
+	for _, pc := range cfg.Peers {
+		i := findWGPeer(device.Peers, pc.PublicKey)
+		if pc.Remove {
+			if i >= 0 {
+				device.Peers = append(device.Peers[:i], device.Peers[i+1:]...)
+			}
+			continue
+		}
+		if i < 0 {
+			if pc.UpdateOnly {
+				continue
+			}
+			device.Peers = append(device.Peers, wgtypes.Peer{
+				PublicKey:       pc.PublicKey,
+				ProtocolVersion: 1,
+			})
+			i = len(device.Peers) - 1
+		}
+
+		peer := &device.Peers[i]
+		if pc.PresharedKey != nil {
+			peer.PresharedKey = *pc.PresharedKey
+		}
+		if pc.Endpoint != nil {
+			endpoint := *pc.Endpoint
+			endpoint.IP = copyIP(pc.Endpoint.IP)
+			peer.Endpoint = &endpoint
+		}
+		if pc.PersistentKeepaliveInterval != nil {
+			peer.PersistentKeepaliveInterval = *pc.PersistentKeepaliveInterval
+		}
+		if pc.ReplaceAllowedIPs {
+			peer.AllowedIPs = nil
+		}
+
+		// An allowed IP belongs to a single peer of the device
+		for _, ip := range pc.AllowedIPs {
+			ipnet := net.IPNet{IP: ip.IP.Mask(ip.Mask), Mask: ip.Mask}
+			for j := range device.Peers {
+				device.Peers[j].AllowedIPs = withoutIPNet(device.Peers[j].AllowedIPs, ipnet)
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, ipnet)
+		}
+	}
+
+	return nil
+}
+
+// Traffic of a peer, as the kernel reports it in wgtypes.Peer.
+type FakePeerStats struct {
+	LastHandshake time.Time
+	Endpoint      *net.UDPAddr // the peer roamed to, kept as it is if nil
+	ReceiveBytes  int64
+	TransmitBytes int64
+}
+
+// Sets the traffic of a peer of the link, as if it connected, since the
+// fake doesn't send packets.
+func (k *FakeKernel) SetPeerStats(name string, key wgtypes.Key, stats FakePeerStats) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	l := k.findName(name)
+	if l == nil || l.device == nil {
+		return os.ErrNotExist
+	}
+
+	i := findWGPeer(l.device.Peers, key)
+	if i < 0 {
+		return os.ErrNotExist
+	}
+
+	peer := &l.device.Peers[i]
+	peer.LastHandshakeTime = stats.LastHandshake
+	peer.ReceiveBytes = stats.ReceiveBytes
+	peer.TransmitBytes = stats.TransmitBytes
+	if stats.Endpoint != nil {
+		endpoint := *stats.Endpoint
+		endpoint.IP = copyIP(stats.Endpoint.IP)
+		peer.Endpoint = &endpoint
+	}
+	return nil
+}
+
+func (k *FakeKernel) Close() error {
+	return nil
+}
+
+func findWGPeer(peers []wgtypes.Peer, key wgtypes.Key) int {
+	for i := range peers {
+		if peers[i].PublicKey == key {
+			return i
+		}
+	}
+	return -1
+}
+
+func withoutIPNet(ipnets []net.IPNet, ipnet net.IPNet) []net.IPNet {
+	var kept []net.IPNet
+	for _, n := range ipnets {
+		if n.String() != ipnet.String() {
+			kept = append(kept, n)
+		}
+	}
+	return kept
+}
+
+func copyWGPeer(peer wgtypes.Peer) wgtypes.Peer {
+	if peer.Endpoint != nil {
+		endpoint := *peer.Endpoint
+		peer.Endpoint = &endpoint
+	}
+	peer.AllowedIPs = append([]net.IPNet(nil), peer.AllowedIPs...)
+	return peer
+}
+
+func copyIP(ip net.IP) net.IP {
+	return append(net.IP(nil), ip...)
+}
+
+func matchFamily(ip net.IP, family int) bool {
+	switch family {
+	case netlink.FAMILY_V4:
+		return ip.To4() != nil
+	case netlink.FAMILY_V6:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
@@ -0,0 +1,314 @@
+package dswg
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestFakeKernelLinkAdd(t *testing.T) {
+	assert := assert.New(t)
+
+	kernel := NewFakeKernel()
+	testlink := baseLink()
+	err := kernel.LinkAdd(testlink)
+	assert.Nil(err)
+
+	err = kernel.LinkAdd(testlink)
+	assert.Equal(syscall.EEXIST, err)
+
+	netInterface, err := kernel.LinkByName(testlink.Name)
+	assert.Nil(err)
+	assert.Equal("wireguard", netInterface.Type())
+	assert.Equal(1420, netInterface.Attrs().MTU)
+	assert.Equal(net.Flags(0), netInterface.Attrs().Flags&net.FlagUp)
+
+	links, err := kernel.LinkList()
+	assert.Nil(err)
+	assert.Len(links, 2)
+	assert.Equal("lo", links[0].Attrs().Name)
+
+	device, err := kernel.Device(testlink.Name)
+	assert.Nil(err)
+	assert.Equal(testlink.Name, device.Name)
+}
+
+func TestFakeKernelLinkDel(t *testing.T) {
+	assert := assert.New(t)
+
+	kernel := NewFakeKernel()
+	testlink := baseLink()
+	err := kernel.LinkDel(testlink)
+	assert.Equal(syscall.ENODEV, err)
+
+	kernel.LinkAdd(testlink)
+	err = kernel.LinkDel(testlink)
+	assert.Nil(err)
+
+	_, err = kernel.LinkByName(testlink.Name)
+	assert.NotNil(err)
+	_, err = kernel.Device(testlink.Name)
+	assert.Equal(os.ErrNotExist, err)
+}
+
+func TestFakeKernelLinkSetName(t *testing.T) {
+	assert := assert.New(t)
+
+	kernel := NewFakeKernel()
+	testlink := baseLink()
+	kernel.LinkAdd(testlink)
+	netInterface, _ := kernel.LinkByName(testlink.Name)
+
+	// Like the kernel, up links can't be renamed
+	kernel.LinkSetUp(netInterface)
+	err := kernel.LinkSetName(netInterface, "wg-renamed")
+	assert.Equal(syscall.EBUSY, err)
+
+	kernel.LinkSetDown(netInterface)
+	err = kernel.LinkSetName(netInterface, "wg-renamed")
+	assert.Nil(err)
+
+	_, err = kernel.LinkByName(testlink.Name)
+	assert.NotNil(err)
+	_, err = kernel.Device("wg-renamed")
+	assert.Nil(err)
+}
+
+func TestFakeKernelAddrs(t *testing.T) {
+	assert := assert.New(t)
+
+	kernel := NewFakeKernel()
+	testlink := baseLink()
+	kernel.LinkAdd(testlink)
+
+	err := kernel.AddrAdd(testlink, &netlink.Addr{IPNet: &testlink.AddressIPv4.IPNet})
+	assert.Nil(err)
+	err = kernel.AddrAdd(testlink, &netlink.Addr{IPNet: &testlink.AddressIPv6.IPNet})
+	assert.Nil(err)
+	err = kernel.AddrAdd(testlink, &netlink.Addr{IPNet: &testlink.AddressIPv4.IPNet})
+	assert.Equal(syscall.EEXIST, err)
+
+	addrs, err := kernel.AddrList(testlink, netlink.FAMILY_V4)
+	assert.Nil(err)
+	assert.Len(addrs, 1)
+	assert.Equal(testlink.AddressIPv4.String(), addrs[0].IPNet.String())
+
+	addrs, err = kernel.AddrList(testlink, netlink.FAMILY_ALL)
+	assert.Nil(err)
+	assert.Len(addrs, 2)
+
+	err = kernel.AddrDel(testlink, &netlink.Addr{IPNet: &testlink.AddressIPv4.IPNet})
+	assert.Nil(err)
+	err = kernel.AddrDel(testlink, &netlink.Addr{IPNet: &testlink.AddressIPv4.IPNet})
+	assert.Equal(syscall.EADDRNOTAVAIL, err)
+}
+
+func TestFakeKernelRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	kernel := NewFakeKernel()
+	testlink := baseLink()
+	kernel.LinkAdd(testlink)
+	netInterface, _ := kernel.LinkByName(testlink.Name)
+
+	dst, _ := ParseIPNet("10.6.6.2/32")
+	route := &netlink.Route{LinkIndex: netInterface.Attrs().Index, Dst: &dst.IPNet}
+
+	err := kernel.RouteAdd(route)
+	assert.Equal(syscall.ENETDOWN, err)
+
+	kernel.LinkSetUp(netInterface)
+	err = kernel.RouteAdd(route)
+	assert.Nil(err)
+	err = kernel.RouteAdd(route)
+	assert.Equal(syscall.EEXIST, err)
+
+	routes, err := kernel.RouteList(netInterface, netlink.FAMILY_ALL)
+	assert.Nil(err)
+	assert.Len(routes, 1)
+	assert.Equal("10.6.6.2/32", routes[0].Dst.String())
+
+	// Bringing the link down flushes its routes
+	kernel.LinkSetDown(netInterface)
+	routes, err = kernel.RouteList(netInterface, netlink.FAMILY_ALL)
+	assert.Nil(err)
+	assert.Len(routes, 0)
+}
+
+func TestFakeKernelRouteReplaceDel(t *testing.T) {
+	assert := assert.New(t)
+
+	kernel := NewFakeKernel()
+	testlink := baseLink()
+	kernel.LinkAdd(testlink)
+	netInterface, _ := kernel.LinkByName(testlink.Name)
+	kernel.LinkSetUp(netInterface)
+
+	dst, _ := ParseIPNet("10.6.6.2/32")
+	route := &netlink.Route{LinkIndex: netInterface.Attrs().Index, Dst: &dst.IPNet}
+	kernel.RouteAdd(route)
+
+	route.Protocol = RouteProtocol
+	err := kernel.RouteReplace(route)
+	assert.Nil(err)
+
+	routes, _ := kernel.RouteList(netInterface, netlink.FAMILY_ALL)
+	assert.Len(routes, 1)
+	assert.Equal(RouteProtocol, routes[0].Protocol)
+
+	err = kernel.RouteDel(&netlink.Route{Dst: &dst.IPNet, Protocol: RouteProtocol + 1})
+	assert.Equal(syscall.ESRCH, err)
+	err = kernel.RouteDel(&netlink.Route{Dst: &dst.IPNet, Protocol: RouteProtocol})
+	assert.Nil(err)
+	err = kernel.RouteDel(&netlink.Route{Dst: &dst.IPNet})
+	assert.Equal(syscall.ESRCH, err)
+
+	routes, _ = kernel.RouteList(netInterface, netlink.FAMILY_ALL)
+	assert.Len(routes, 0)
+}
+
+func TestFakeKernelRouteTables(t *testing.T) {
+	assert := assert.New(t)
+
+	kernel := NewFakeKernel()
+	testlink := baseLink()
+	kernel.LinkAdd(testlink)
+	netInterface, _ := kernel.LinkByName(testlink.Name)
+	kernel.LinkSetUp(netInterface)
+
+	dst, _ := ParseIPNet("0.0.0.0/0")
+	index := netInterface.Attrs().Index
+	kernel.RouteAdd(&netlink.Route{LinkIndex: index, Dst: &dst.IPNet, Table: 100})
+
+	routes, _ := kernel.RouteList(netInterface, netlink.FAMILY_ALL)
+	assert.Len(routes, 0)
+
+	filter := &netlink.Route{LinkIndex: index}
+	routes, _ = kernel.RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	assert.Len(routes, 1)
+	assert.Equal(100, routes[0].Table)
+
+	filter.Table = 101
+	routes, _ = kernel.RouteListFiltered(netlink.FAMILY_ALL, filter, netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+	assert.Len(routes, 0)
+}
+
+func TestFakeKernelRules(t *testing.T) {
+	assert := assert.New(t)
+
+	kernel := NewFakeKernel()
+	rule := netlink.NewRule()
+	rule.Family = netlink.FAMILY_V6
+	rule.Table = 100
+
+	err := kernel.RuleAdd(rule)
+	assert.Nil(err)
+	err = kernel.RuleAdd(rule)
+	assert.Equal(syscall.EEXIST, err)
+
+	rules, _ := kernel.RuleList(netlink.FAMILY_V4)
+	assert.Len(rules, 0)
+	rules, _ = kernel.RuleList(netlink.FAMILY_V6)
+	assert.Len(rules, 1)
+
+	err = kernel.RuleDel(rule)
+	assert.Nil(err)
+	err = kernel.RuleDel(rule)
+	assert.Equal(syscall.ENOENT, err)
+}
+
+func TestFakeKernelConfigureDevice(t *testing.T) {
+	assert := assert.New(t)
+
+	kernel := NewFakeKernel()
+	testlink := baseLink()
+	err := kernel.ConfigureDevice(testlink.Name, wgtypes.Config{})
+	assert.Equal(os.ErrNotExist, err)
+
+	kernel.LinkAdd(testlink)
+	err = kernel.ConfigureDevice(testlink.Name, wgtypes.Config{
+		PrivateKey:   &testlink.PrivateKey.Key,
+		ListenPort:   &testlink.ListenPort,
+		FirewallMark: &testlink.FirewallMark,
+	})
+	assert.Nil(err)
+
+	testpeer1 := basePeer()
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	testpeer1.AllowedIPs = []IPNet{*addr}
+	testpeer2 := basePeer()
+	key, _ := wgtypes.GeneratePrivateKey()
+	testpeer2.PublicKey = Key{key.PublicKey()}
+	testpeer2.AllowedIPs = []IPNet{*addr}
+
+	// Allowed IPs move to the last peer configured with them
+	err = kernel.ConfigureDevice(testlink.Name, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{peerConfig(testpeer1), peerConfig(testpeer2)},
+	})
+	assert.Nil(err)
+
+	device, err := kernel.Device(testlink.Name)
+	assert.Nil(err)
+	assert.Equal(testlink.PrivateKey.Key, device.PrivateKey)
+	assert.Equal(testlink.PrivateKey.PublicKey(), device.PublicKey)
+	assert.Equal(testlink.ListenPort, device.ListenPort)
+	assert.Equal(testlink.FirewallMark, device.FirewallMark)
+	assert.Len(device.Peers, 2)
+	assert.Len(device.Peers[0].AllowedIPs, 0)
+	assert.Equal("10.6.6.2/32", device.Peers[1].AllowedIPs[0].String())
+	assert.Equal(testpeer1.PresharedKey.Key, device.Peers[0].PresharedKey)
+	assert.Equal(testpeer1.Endpoint.String(), device.Peers[0].Endpoint.String())
+
+	err = kernel.ConfigureDevice(testlink.Name, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{PublicKey: testpeer1.PublicKey.Key, Remove: true}},
+	})
+	assert.Nil(err)
+
+	device, _ = kernel.Device(testlink.Name)
+	assert.Len(device.Peers, 1)
+	assert.Equal(testpeer2.PublicKey.Key, device.Peers[0].PublicKey)
+
+	err = kernel.ConfigureDevice(testlink.Name, wgtypes.Config{ReplacePeers: true})
+	assert.Nil(err)
+	device, _ = kernel.Device(testlink.Name)
+	assert.Len(device.Peers, 0)
+}
+
+func TestFakeKernelSetPeerStats(t *testing.T) {
+	assert := assert.New(t)
+
+	kernel := NewFakeKernel()
+	testlink, testpeer := baseLink(), basePeer()
+	err := kernel.SetPeerStats(testlink.Name, testpeer.PublicKey.Key, FakePeerStats{})
+	assert.Equal(os.ErrNotExist, err)
+
+	kernel.LinkAdd(testlink)
+	err = kernel.SetPeerStats(testlink.Name, testpeer.PublicKey.Key, FakePeerStats{})
+	assert.Equal(os.ErrNotExist, err)
+
+	kernel.ConfigureDevice(testlink.Name, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{peerConfig(testpeer)},
+	})
+	handshake := time.Unix(1589000000, 0)
+	roamed := &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51820}
+	err = kernel.SetPeerStats(testlink.Name, testpeer.PublicKey.Key, FakePeerStats{
+		LastHandshake: handshake,
+		Endpoint:      roamed,
+		ReceiveBytes:  100,
+		TransmitBytes: 200,
+	})
+	assert.Nil(err)
+
+	device, _ := kernel.Device(testlink.Name)
+	peer := device.Peers[0]
+	assert.Equal(handshake, peer.LastHandshakeTime)
+	assert.Equal(roamed.String(), peer.Endpoint.String())
+	assert.Equal(int64(100), peer.ReceiveBytes)
+	assert.Equal(int64(200), peer.TransmitBytes)
+}
@@ -0,0 +1,409 @@
+package dswg
+
+import (
+	"bytes"
+	"net"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/vishvananda/netns"
+)
+
+// Installs the NAT rules of forwarding links.
+// Rules are grouped per link so they can be removed as a whole.
+type Firewall interface {
+	// Masquerades traffic from subnets leaving through the egress link,
+	// replacing any rules previously installed for link.
+	AddMasquerade(link string, subnets []net.IPNet, egress string) error
+	// Removes the rules installed for link, if any. Address families the
+	// host has no NAT for have no rules to remove.
+	RemoveMasquerade(link string) error
+	// Returns the subnets masqueraded by the rules installed for link and
+	// their egress link, none if it has no rules.
+	Masquerade(link string) ([]net.IPNet, string, error)
+}
+
+// Name of the nftables tables holding the rules, one per address family.
+const nftTableName = "dswg"
+
+type nftFirewall struct{}
+
+// Returns a Firewall that talks to nftables over netlink.
+// Each link gets a postrouting NAT chain named after it in the
+// "dswg" ip and ip6 tables.
+func NewNFTablesFirewall() Firewall {
+	return &nftFirewall{}
+}
+
+func (fw *nftFirewall) AddMasquerade(link string, subnets []net.IPNet, egress string) error {
+	// Drops the chains of address families the link no longer has
+	err := fw.RemoveMasquerade(link)
+	if err != nil {
+		return err
+	}
+
+	conn, ns, err := nftConn()
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	chains := make(map[nftables.TableFamily]*nftables.Chain)
+	for _, subnet := range subnets {
+		family := nftables.TableFamilyIPv6
+		if subnet.IP.To4() != nil {
+			family = nftables.TableFamilyIPv4
+		}
+
+		chain, ok := chains[family]
+		if !ok {
+			table := conn.AddTable(&nftables.Table{Name: nftTableName, Family: family})
+			chain = conn.AddChain(&nftables.Chain{
+				Name:     link,
+				Table:    table,
+				Type:     nftables.ChainTypeNAT,
+				Hooknum:  nftables.ChainHookPostrouting,
+				Priority: nftables.ChainPriorityNATSource,
+			})
+			conn.FlushChain(chain)
+			chains[family] = chain
+		}
+
+		conn.AddRule(&nftables.Rule{
+			Table: chain.Table,
+			Chain: chain,
+			Exprs: masqueradeExprs(subnet, egress),
+		})
+	}
+
+	return conn.Flush()
+}
+
+func (fw *nftFirewall) RemoveMasquerade(link string) error {
+	conn, ns, err := nftConn()
+	if err != nil {
+		return err
+	}
+	defer ns.Close()
+
+	chains, err := conn.ListChains()
+	if err != nil {
+		return err
+	}
+
+	// Tables are deleted along with their last chain
+	tables := make(map[nftables.TableFamily]*nftables.Table)
+	remaining := make(map[nftables.TableFamily]int)
+	for _, chain := range chains {
+		if chain.Table.Name != nftTableName {
+			continue
+		}
+
+		tables[chain.Table.Family] = chain.Table
+		if chain.Name == link {
+			conn.FlushChain(chain)
+			conn.DelChain(chain)
+		} else {
+			remaining[chain.Table.Family]++
+		}
+	}
+	for family, table := range tables {
+		if remaining[family] == 0 {
+			conn.DelTable(table)
+		}
+	}
+
+	return conn.Flush()
+}
+
+func (fw *nftFirewall) Masquerade(link string) ([]net.IPNet, string, error) {
+	conn, ns, err := nftConn()
+	if err != nil {
+		return nil, "", err
+	}
+	defer ns.Close()
+
+	chains, err := conn.ListChains()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var subnets []net.IPNet
+	var egress string
+	for _, chain := range chains {
+		if chain.Table.Name != nftTableName || chain.Name != link {
+			continue
+		}
+
+		rules, err := conn.GetRule(chain.Table, chain)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, rule := range rules {
+			subnet, out, ok := parseMasqueradeExprs(rule.Exprs)
+			if ok {
+				subnets = append(subnets, subnet)
+				egress = out
+			}
+		}
+	}
+
+	return subnets, egress, nil
+}
+
+// Opens an nftables connection in the namespace of the calling thread.
+// Without an explicit namespace nftables doesn't lock its netlink socket
+// to a thread, so it could end up in the namespace of any thread.
+func nftConn() (*nftables.Conn, netns.NsHandle, error) {
+	ns, err := netns.Get()
+	if err != nil {
+		return nil, ns, err
+	}
+	return &nftables.Conn{NetNS: int(ns)}, ns, nil
+}
+
+// Builds `ip(6) saddr <subnet> oifname <egress> masquerade`.
+func masqueradeExprs(subnet net.IPNet, egress string) []expr.Any {
+	// Source address offset in the IPv4 and IPv6 headers
+	offset, ip, mask := uint32(12), subnet.IP.To4(), subnet.Mask
+	if ip == nil {
+		offset, ip = 8, subnet.IP.To16()
+	}
+	if len(mask) != len(ip) {
+		ones, _ := mask.Size()
+		mask = net.CIDRMask(ones, len(ip)*8)
+	}
+
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       offset,
+			Len:          uint32(len(ip)),
+		},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            uint32(len(ip)),
+			Mask:           mask,
+			Xor:            make([]byte, len(ip)),
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ip.Mask(mask)},
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(egress)},
+		&expr.Masq{},
+	}
+}
+
+// Reads the subnet and egress link back from the expressions built by
+// masqueradeExprs.
+func parseMasqueradeExprs(exprs []expr.Any) (net.IPNet, string, bool) {
+	var subnet net.IPNet
+	var egress string
+	oifname := false
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Bitwise:
+			subnet.Mask = e.Mask
+		case *expr.Meta:
+			oifname = e.Key == expr.MetaKeyOIFNAME
+		case *expr.Cmp:
+			if oifname {
+				egress = string(bytes.TrimRight(e.Data, "\x00"))
+			} else {
+				subnet.IP = e.Data
+			}
+		}
+	}
+
+	ok := len(subnet.IP) > 0 && len(subnet.IP) == len(subnet.Mask) && len(egress) > 0
+	return subnet, egress, ok
+}
+
+// Interface names are compared as NUL padded IFNAMSIZ byte strings.
+func ifname(name string) []byte {
+	b := make([]byte, 16)
+	copy(b, name)
+	return b
+}
+
+type iptablesFirewall struct{}
+
+// Returns a Firewall that runs iptables and ip6tables, for hosts
+// without nftables. Each link gets a "DSWG-<link>" chain in the nat
+// table that POSTROUTING jumps to. Hosts without ip6tables, or without
+// the nat table of a family, only fail when rules of that family are
+// added.
+func NewIPTablesFirewall() Firewall {
+	return &iptablesFirewall{}
+}
+
+func iptablesChain(link string) string {
+	return "DSWG-" + link
+}
+
+func (fw *iptablesFirewall) AddMasquerade(link string, subnets []net.IPNet, egress string) error {
+	err := fw.RemoveMasquerade(link)
+	if err != nil {
+		return err
+	}
+
+	chain := iptablesChain(link)
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		var rules [][]string
+		for _, subnet := range subnets {
+			isIPv4 := subnet.IP.To4() != nil
+			if isIPv4 != (proto == iptables.ProtocolIPv4) {
+				continue
+			}
+
+			masked := net.IPNet{IP: subnet.IP.Mask(subnet.Mask), Mask: subnet.Mask}
+			rules = append(rules, []string{
+				"-s", masked.String(), "-o", egress, "-j", "MASQUERADE",
+			})
+		}
+		if len(rules) == 0 {
+			continue
+		}
+
+		ipt, _, err := iptablesNAT(proto)
+		if err != nil {
+			return err
+		}
+
+		err = ipt.NewChain("nat", chain)
+		if err != nil {
+			return err
+		}
+
+		for _, rule := range rules {
+			err := ipt.Append("nat", chain, rule...)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = ipt.AppendUnique("nat", "POSTROUTING", "-j", chain)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fw *iptablesFirewall) RemoveMasquerade(link string) error {
+	chain := iptablesChain(link)
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt, chains, err := iptablesNAT(proto)
+		if err != nil || !containsString(chains, chain) {
+			continue
+		}
+
+		err = ipt.Delete("nat", "POSTROUTING", "-j", chain)
+		if err != nil {
+			if e, ok := err.(*iptables.Error); !ok || !e.IsNotExist() {
+				return err
+			}
+		}
+
+		err = ipt.ClearChain("nat", chain)
+		if err != nil {
+			return err
+		}
+
+		err = ipt.DeleteChain("nat", chain)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fw *iptablesFirewall) Masquerade(link string) ([]net.IPNet, string, error) {
+	chain := iptablesChain(link)
+	var subnets []net.IPNet
+	var egress string
+	for _, proto := range []iptables.Protocol{iptables.ProtocolIPv4, iptables.ProtocolIPv6} {
+		ipt, chains, err := iptablesNAT(proto)
+		if err != nil || !containsString(chains, chain) {
+			continue
+		}
+
+		rules, err := ipt.List("nat", chain)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, rule := range rules {
+			subnet, out, ok := parseMasqueradeRule(rule)
+			if ok {
+				subnets = append(subnets, subnet)
+				egress = out
+			}
+		}
+	}
+
+	return subnets, egress, nil
+}
+
+// Returns the iptables command of the protocol and the chains of its nat
+// table, or an error if either is unavailable on the host.
+func iptablesNAT(proto iptables.Protocol) (*iptables.IPTables, []string, error) {
+	ipt, err := iptables.NewWithProtocol(proto)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	chains, err := ipt.ListChains("nat")
+	if err != nil {
+		return nil, nil, err
+	}
+	return ipt, chains, nil
+}
+
+// Reads the subnet and egress link back from a rule listed by iptables,
+// ex. "-A DSWG-wg0 -s 10.6.6.0/24 -o eth0 -j MASQUERADE".
+func parseMasqueradeRule(rule string) (net.IPNet, string, bool) {
+	var subnet *net.IPNet
+	var egress string
+	fields := strings.Fields(rule)
+	for i := 0; i+1 < len(fields); i++ {
+		switch fields[i] {
+		case "-s":
+			_, subnet, _ = net.ParseCIDR(fields[i+1])
+		case "-o":
+			egress = fields[i+1]
+		}
+	}
+
+	if subnet == nil || len(egress) == 0 {
+		return net.IPNet{}, "", false
+	}
+	return *subnet, egress, true
+}
+
+func containsString(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Uses nftables if the kernel supports it, and iptables otherwise.
+func defaultFirewall() Firewall {
+	conn, ns, err := nftConn()
+	if err != nil {
+		return NewIPTablesFirewall()
+	}
+	defer ns.Close()
+
+	if _, err := conn.ListTables(); err == nil {
+		return NewNFTablesFirewall()
+	}
+	return NewIPTablesFirewall()
+}
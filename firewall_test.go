@@ -0,0 +1,140 @@
+package dswg
+
+import (
+	"net"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netns"
+)
+
+func TestMasqueradeExprsIPv4(t *testing.T) {
+	assert := assert.New(t)
+
+	subnet, _ := ParseIPNet("10.6.6.0/24")
+	exprs := masqueradeExprs(subnet.IPNet, "eth0")
+	assert.Equal([]expr.Any{
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseNetworkHeader,
+			Offset:       12,
+			Len:          4,
+		},
+		&expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            4,
+			Mask:           []byte{255, 255, 255, 0},
+			Xor:            []byte{0, 0, 0, 0},
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{10, 6, 6, 0}},
+		&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname("eth0")},
+		&expr.Masq{},
+	}, exprs)
+}
+
+func TestMasqueradeExprsIPv6(t *testing.T) {
+	assert := assert.New(t)
+
+	_, subnet, _ := net.ParseCIDR("2001::/32")
+	exprs := masqueradeExprs(*subnet, "eth0")
+
+	payload := exprs[0].(*expr.Payload)
+	assert.Equal(uint32(8), payload.Offset)
+	assert.Equal(uint32(16), payload.Len)
+
+	bitwise := exprs[1].(*expr.Bitwise)
+	assert.Equal([]byte(net.CIDRMask(32, 128)), bitwise.Mask)
+
+	cmp := exprs[2].(*expr.Cmp)
+	assert.Equal([]byte(net.ParseIP("2001::")), cmp.Data)
+}
+
+func TestIfname(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]byte("eth0\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), ifname("eth0"))
+}
+
+func TestNFTablesFirewall(t *testing.T) {
+	assert := assert.New(t)
+
+	// The thread is left locked so it exits with the test instead of
+	// going back to the pool in the new namespace
+	runtime.LockOSThread()
+
+	// Create a new network namespace
+	ns, _ := netns.New()
+	defer ns.Close()
+
+	conn := &nftables.Conn{NetNS: int(ns)}
+	if _, err := conn.ListTables(); err != nil {
+		t.Skip("nftables is not supported:", err)
+	}
+
+	fw := NewNFTablesFirewall()
+	subnet4, _ := ParseIPNet("10.6.6.0/24")
+	subnet6, _ := ParseIPNet("2001::/32")
+	err := fw.AddMasquerade("wg0", []net.IPNet{subnet4.IPNet, subnet6.IPNet}, "eth0")
+	assert.Nil(err)
+
+	subnets, egress, err := fw.Masquerade("wg0")
+	assert.Nil(err)
+	assert.Equal("10.6.6.0/24, 2001::/32", formatIPNets(subnets, true))
+	assert.Equal("eth0", egress)
+
+	// Re-adding replaces the rules, and drops the IPv6 chain
+	err = fw.AddMasquerade("wg0", []net.IPNet{subnet4.IPNet}, "eth0")
+	assert.Nil(err)
+
+	chains, err := conn.ListChains()
+	assert.Nil(err)
+	assert.Len(chains, 1)
+	assert.Equal("wg0", chains[0].Name)
+	assert.Equal(nftables.TableFamilyIPv4, chains[0].Table.Family)
+
+	rules, err := conn.GetRule(chains[0].Table, chains[0])
+	assert.Nil(err)
+	assert.Len(rules, 1)
+
+	err = fw.RemoveMasquerade("wg0")
+	assert.Nil(err)
+
+	// The table goes away with its last chain
+	chains, err = conn.ListChains()
+	assert.Nil(err)
+	assert.Len(chains, 0)
+	tables, err := conn.ListTables()
+	assert.Nil(err)
+	assert.Len(tables, 0)
+
+	// Removing rules that don't exist is fine
+	err = fw.RemoveMasquerade("wg0")
+	assert.Nil(err)
+}
+
+func TestIPTablesFirewallUnavailable(t *testing.T) {
+	assert := assert.New(t)
+
+	if _, err := exec.LookPath("ip6tables"); err == nil {
+		t.Skip("ip6tables is available")
+	}
+
+	// Nothing has to be removed nor added for IPv6
+	fw := NewIPTablesFirewall()
+	err := fw.RemoveMasquerade("wg0")
+	assert.Nil(err)
+
+	subnets, _, err := fw.Masquerade("wg0")
+	assert.Nil(err)
+	assert.Len(subnets, 0)
+
+	subnet6, _ := ParseIPNet("2001::/32")
+	err = fw.AddMasquerade("wg0", []net.IPNet{subnet6.IPNet}, "eth0")
+	assert.NotNil(err)
+}
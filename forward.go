@@ -0,0 +1,189 @@
+package dswg
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Host wide forwarding and NAT settings, applied to links with Forward set.
+type Config struct {
+	Enable      bool   `db:"enable"`
+	ForwardIPv4 bool   `db:"forward_ipv4"` // enable net.ipv4.ip_forward
+	ForwardIPv6 bool   `db:"forward_ipv6"` // enable net.ipv6.conf.all.forwarding
+	NATEnable   bool   `db:"nat_enable"`
+	NATLink     string `db:"nat_link"` // egress link traffic is masqueraded to
+}
+
+// Configuration used until one is stored: forward without NAT.
+func defaultConfig() Config {
+	return Config{
+		Enable:      true,
+		ForwardIPv4: true,
+		ForwardIPv6: true,
+	}
+}
+
+// Root of the sysctl tree, changed by tests.
+var sysctlDir = "/proc/sys"
+
+// Use the given firewall to install NAT rules instead of picking
+// nftables or iptables based on what the host supports.
+func WithFirewall(firewall Firewall) ClientOption {
+	return func(c *Client) {
+		c.firewall = firewall
+	}
+}
+
+// Returns the forwarding and NAT configuration.
+func (c *Client) GetConfig() (*Config, error) {
+	return c.db.GetConfig()
+}
+
+// Stores the forwarding and NAT configuration.
+// It is applied to forwarding links next time they are activated.
+func (c *Client) SetConfig(config Config) error {
+	return c.db.SetConfig(config)
+}
+
+// Enables forwarding and installs the NAT rules of the link if
+// link.Forward is set, in the namespace of the client.
+// Forwarding is never disabled, since other services may rely on it.
+func (c *Client) setupForwarding(link Link) error {
+	if !link.Forward {
+		return nil
+	}
+
+	return inNamespace(c.netns, func() error {
+		return c.setupForwardingHere(link)
+	})
+}
+
+func (c *Client) setupForwardingHere(link Link) error {
+	config, err := c.db.GetConfig()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range forwardSysctls(link, *config) {
+		err := writeSysctl(key, "1")
+		if err != nil {
+			return err
+		}
+	}
+
+	subnets, egress := masqueradedSubnets(link, *config)
+	if len(subnets) == 0 {
+		return c.firewall.RemoveMasquerade(link.Name)
+	}
+	return c.firewall.AddMasquerade(link.Name, subnets, egress)
+}
+
+// Returns the sysctls setupForwarding enables for the forwarding link.
+func forwardSysctls(link Link, config Config) []string {
+	if !config.Enable {
+		return nil
+	}
+
+	var keys []string
+	if config.ForwardIPv4 && link.AddressIPv4 != nil {
+		keys = append(keys, "net/ipv4/ip_forward")
+	}
+	if config.ForwardIPv6 && link.AddressIPv6 != nil {
+		keys = append(keys, "net/ipv6/conf/all/forwarding")
+	}
+	return keys
+}
+
+// Returns the subnets setupForwarding masquerades for the forwarding link
+// and their egress link, none without NAT.
+func masqueradedSubnets(link Link, config Config) ([]net.IPNet, string) {
+	if !config.Enable || !config.NATEnable || len(config.NATLink) == 0 {
+		return nil, ""
+	}
+
+	var subnets []net.IPNet
+	for _, addr := range linkAddrs(link) {
+		subnets = append(subnets, net.IPNet{IP: addr.IP.Mask(addr.Mask), Mask: addr.Mask})
+	}
+	return subnets, config.NATLink
+}
+
+// Renders the forwarding of a link compared by Reconcile, ex.
+// "net/ipv4/ip_forward, nat 10.6.6.0/24 -> eth0".
+func formatForwarding(sysctls []string, subnets []net.IPNet, egress string) string {
+	items := append([]string{}, sysctls...)
+	for _, subnet := range subnets {
+		items = append(items, "nat "+canonicalIPNet(subnet)+" -> "+egress)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ", ")
+}
+
+// Returns the forwarding the link has in the namespace of the client and
+// the one it should have, rendered by formatForwarding. Sysctls are only
+// reported for the families an enabled link forwards, since they are
+// never disabled. Links without Forward set never have any forwarding,
+// so the firewall isn't read.
+func (c *Client) linkForwarding(link Link) (string, string, error) {
+	if !link.Forward {
+		return "", "", nil
+	}
+
+	config, err := c.db.GetConfig()
+	if err != nil {
+		return "", "", err
+	}
+
+	var sysctls []string
+	var wanted string
+	if link.Enable {
+		sysctls = forwardSysctls(link, *config)
+		subnets, egress := masqueradedSubnets(link, *config)
+		wanted = formatForwarding(sysctls, subnets, egress)
+	}
+
+	var current string
+	err = inNamespace(c.netns, func() error {
+		var enabled []string
+		for _, key := range sysctls {
+			value, err := ioutil.ReadFile(filepath.Join(sysctlDir, key))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if strings.TrimSpace(string(value)) == "1" {
+				enabled = append(enabled, key)
+			}
+		}
+
+		subnets, egress, err := c.firewall.Masquerade(link.Name)
+		if err != nil {
+			return err
+		}
+		current = formatForwarding(enabled, subnets, egress)
+		return nil
+	})
+	return current, wanted, err
+}
+
+// Removes the NAT rules of the link.
+// Links without Forward set never have any, so the firewall isn't touched.
+func (c *Client) teardownForwarding(link Link) error {
+	if !link.Forward {
+		return nil
+	}
+
+	return inNamespace(c.netns, func() error {
+		return c.firewall.RemoveMasquerade(link.Name)
+	})
+}
+
+func writeSysctl(key, value string) error {
+	return ioutil.WriteFile(filepath.Join(sysctlDir, key), []byte(value), 0644)
+}
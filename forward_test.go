@@ -0,0 +1,216 @@
+package dswg
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Records the rules it is asked to install.
+type recordingFirewall struct {
+	rules map[string][]string
+}
+
+func (fw *recordingFirewall) AddMasquerade(link string, subnets []net.IPNet, egress string) error {
+	var rules []string
+	for _, subnet := range subnets {
+		rules = append(rules, subnet.String()+" -> "+egress)
+	}
+	fw.rules[link] = rules
+	return nil
+}
+
+func (fw *recordingFirewall) RemoveMasquerade(link string) error {
+	delete(fw.rules, link)
+	return nil
+}
+
+func (fw *recordingFirewall) Masquerade(link string) ([]net.IPNet, string, error) {
+	var subnets []net.IPNet
+	var egress string
+	for _, rule := range fw.rules[link] {
+		parts := strings.Split(rule, " -> ")
+		_, subnet, err := net.ParseCIDR(parts[0])
+		if err != nil {
+			return nil, "", err
+		}
+		subnets = append(subnets, *subnet)
+		egress = parts[1]
+	}
+	return subnets, egress, nil
+}
+
+// Points sysctlDir to a temporary directory for the duration of a test.
+func setupSysctlDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "dswg-sysctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"net/ipv4", "net/ipv6/conf/all"} {
+		os.MkdirAll(filepath.Join(dir, d), 0755)
+	}
+
+	old := sysctlDir
+	sysctlDir = dir
+	return func() {
+		sysctlDir = old
+		os.RemoveAll(dir)
+	}
+}
+
+func readSysctl(key string) string {
+	value, _ := ioutil.ReadFile(filepath.Join(sysctlDir, key))
+	return string(value)
+}
+
+func TestSetupForwardingNAT(t *testing.T) {
+	assert := assert.New(t)
+
+	defer setupSysctlDir(t)()
+	fw := &recordingFirewall{rules: make(map[string][]string)}
+	client := &Client{db: setupDB(), firewall: fw}
+	defer client.db.Close()
+
+	config := defaultConfig()
+	config.NATEnable = true
+	config.NATLink = "eth0"
+	err := client.SetConfig(config)
+	assert.Nil(err)
+
+	testlink := baseLink()
+	testlink.Forward = true
+	err = client.setupForwarding(testlink)
+	assert.Nil(err)
+	assert.Equal("1", readSysctl("net/ipv4/ip_forward"))
+	assert.Equal("1", readSysctl("net/ipv6/conf/all/forwarding"))
+	assert.Equal(map[string][]string{
+		testlink.Name: {"10.6.6.0/24 -> eth0", "2001::/32 -> eth0"},
+	}, fw.rules)
+
+	err = client.teardownForwarding(testlink)
+	assert.Nil(err)
+	assert.Empty(fw.rules)
+}
+
+func TestSetupForwardingNoNAT(t *testing.T) {
+	assert := assert.New(t)
+
+	defer setupSysctlDir(t)()
+	fw := &recordingFirewall{rules: make(map[string][]string)}
+	client := &Client{db: setupDB(), firewall: fw}
+	defer client.db.Close()
+
+	config := defaultConfig()
+	config.ForwardIPv6 = false
+	err := client.SetConfig(config)
+	assert.Nil(err)
+
+	testlink := baseLink()
+	testlink.Forward = true
+	fw.rules[testlink.Name] = []string{"stale"}
+	err = client.setupForwarding(testlink)
+	assert.Nil(err)
+	assert.Equal("1", readSysctl("net/ipv4/ip_forward"))
+	assert.Equal("", readSysctl("net/ipv6/conf/all/forwarding"))
+	assert.Empty(fw.rules)
+}
+
+func TestSetupForwardingDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	defer setupSysctlDir(t)()
+	fw := &recordingFirewall{rules: make(map[string][]string)}
+	client := &Client{db: setupDB(), firewall: fw}
+	defer client.db.Close()
+
+	// Links without Forward are left alone
+	testlink := baseLink()
+	testlink.Forward = false
+	fw.rules[testlink.Name] = []string{"unrelated"}
+	err := client.setupForwarding(testlink)
+	assert.Nil(err)
+	assert.Equal("", readSysctl("net/ipv4/ip_forward"))
+
+	err = client.teardownForwarding(testlink)
+	assert.Nil(err)
+	assert.Equal([]string{"unrelated"}, fw.rules[testlink.Name])
+
+	// So are links when the config is disabled
+	config := defaultConfig()
+	config.Enable = false
+	err = client.SetConfig(config)
+	assert.Nil(err)
+
+	testlink.Forward = true
+	err = client.setupForwarding(testlink)
+	assert.Nil(err)
+	assert.Equal("", readSysctl("net/ipv4/ip_forward"))
+	assert.Empty(fw.rules)
+}
+
+func TestClientReconcileForwarding(t *testing.T) {
+	assert := assert.New(t)
+
+	defer setupSysctlDir(t)()
+	client := baseClient()
+	defer client.Close()
+	fw := &recordingFirewall{rules: make(map[string][]string)}
+	client.firewall = fw
+
+	config := defaultConfig()
+	config.NATEnable = true
+	config.NATLink = "eth0"
+	err := client.SetConfig(config)
+	assert.Nil(err)
+
+	testlink := baseLink()
+	testlink.Forward = true
+	err = client.AddLink(testlink)
+	assert.Nil(err)
+
+	plan, err := client.Plan()
+	assert.Nil(err)
+	assert.True(plan.Empty(), plan.String())
+
+	// Forwarding and NAT are disabled behind the back of the client
+	err = writeSysctl("net/ipv4/ip_forward", "0")
+	assert.Nil(err)
+	fw.rules = make(map[string][]string)
+
+	plan, err = client.Plan()
+	assert.Nil(err)
+	assert.Equal([]FieldDiff{{
+		"forwarding",
+		"net/ipv6/conf/all/forwarding",
+		"nat 10.6.6.0/24 -> eth0, nat 2001::/32 -> eth0, net/ipv4/ip_forward, net/ipv6/conf/all/forwarding",
+	}}, plan.Links[0].Fields)
+	text := plan.String()
+	assert.Contains(text, "sysctl Write wg-linko net/ipv4/ip_forward=1")
+	assert.NotContains(text, "net/ipv6/conf/all/forwarding=1")
+	assert.Contains(text, "firewall AddMasquerade wg-linko 10.6.6.0/24 -> eth0, 2001::/32 -> eth0")
+
+	_, err = client.Reconcile(context.Background(), ReconcileOptions{})
+	assert.Nil(err)
+	assert.Equal("1", readSysctl("net/ipv4/ip_forward"))
+	assert.Equal(map[string][]string{
+		testlink.Name: {"10.6.6.0/24 -> eth0", "2001::/32 -> eth0"},
+	}, fw.rules)
+
+	// The rules of a disabled link are removed
+	testlink.Enable = false
+	client.db.UpdateLink(testlink.Name, testlink)
+	fw.rules[testlink.Name] = []string{"10.6.6.0/24 -> eth0"}
+	_, err = client.Reconcile(context.Background(), ReconcileOptions{})
+	assert.Nil(err)
+	assert.Empty(fw.rules)
+
+	plan, err = client.Plan()
+	assert.Nil(err)
+	assert.True(plan.Empty(), plan.String())
+}
@@ -0,0 +1,151 @@
+package dswg
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Decides what happens when a PostUp/PostDown command fails.
+type HookPolicy int
+
+const (
+	// Stop at the first failing command and roll back the link change.
+	HookAbort HookPolicy = iota
+	// Log the failing command and keep executing the rest.
+	HookWarn
+)
+
+const (
+	defaultHookShell   = "/bin/sh"
+	defaultHookTimeout = 30 * time.Second
+)
+
+// Result of executing a single hook command.
+type HookResult struct {
+	Command string
+	Output  string // combined stdout and stderr
+	Err     error
+}
+
+// Returned when a hook command fails under HookAbort.
+type HookError struct {
+	Interface string
+	HookResult
+}
+
+func (e *HookError) Error() string {
+	msg := fmt.Sprintf("Hook command `%v` failed for link %v: %v",
+		e.Command, e.Interface, e.Err)
+	if output := strings.TrimSpace(e.Output); len(output) > 0 {
+		msg += ": " + output
+	}
+	return msg
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// Executes link PostUp/PostDown commands through a shell.
+// Every `%i` in a command is replaced by the interface name,
+// the same way wg-quick does.
+type HookRunner struct {
+	Shell   string
+	Timeout time.Duration // per command, zero means no timeout
+	Policy  HookPolicy
+	Logger  *log.Logger // receives failures under HookWarn
+}
+
+func NewHookRunner() *HookRunner {
+	return &HookRunner{
+		Shell:   defaultHookShell,
+		Timeout: defaultHookTimeout,
+		Policy:  HookAbort,
+		Logger:  log.New(os.Stderr, "dswg: ", log.LstdFlags),
+	}
+}
+
+// Executes the commands in order for the given interface.
+// Empty commands are skipped. Under HookAbort execution stops at the
+// first failing command and a *HookError is returned, under HookWarn
+// the failure is logged and the remaining commands still run.
+func (r *HookRunner) Run(iface string, cmds []string) ([]HookResult, error) {
+	var results []HookResult
+	for _, cmd := range cmds {
+		if len(strings.TrimSpace(cmd)) == 0 {
+			continue
+		}
+
+		result := r.exec(iface, cmd)
+		results = append(results, result)
+		if result.Err == nil {
+			continue
+		}
+
+		if r.Policy == HookAbort {
+			return results, &HookError{Interface: iface, HookResult: result}
+		}
+
+		if r.Logger != nil {
+			r.Logger.Printf("%v", &HookError{Interface: iface, HookResult: result})
+		}
+	}
+
+	return results, nil
+}
+
+func (r *HookRunner) exec(iface, cmd string) HookResult {
+	cmd = strings.ReplaceAll(cmd, "%i", iface)
+
+	shell := r.Shell
+	if len(shell) == 0 {
+		shell = defaultHookShell
+	}
+
+	var output bytes.Buffer
+	proc := exec.Command(shell, "-c", cmd)
+	proc.Stdout = &output
+	proc.Stderr = &output
+	// Run in its own process group so that a timeout also
+	// kills any children spawned by the shell.
+	proc.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err := proc.Start()
+	if err == nil {
+		err = r.wait(proc)
+	}
+
+	return HookResult{
+		Command: cmd,
+		Output:  output.String(),
+		Err:     err,
+	}
+}
+
+func (r *HookRunner) wait(proc *exec.Cmd) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- proc.Wait()
+	}()
+
+	if r.Timeout <= 0 {
+		return <-done
+	}
+
+	timer := time.NewTimer(r.Timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		syscall.Kill(-proc.Process.Pid, syscall.SIGKILL)
+		<-done
+		return fmt.Errorf("timed out after %v", r.Timeout)
+	}
+}
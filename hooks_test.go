@@ -0,0 +1,73 @@
+package dswg
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHookRunnerSubstituteInterface(t *testing.T) {
+	assert := assert.New(t)
+
+	runner := NewHookRunner()
+	results, err := runner.Run("wg-linko", []string{"echo up %i"})
+	assert.Nil(err)
+	assert.Equal(1, len(results))
+	assert.Equal("echo up wg-linko", results[0].Command)
+	assert.Equal("up wg-linko\n", results[0].Output)
+}
+
+func TestHookRunnerInOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	runner := NewHookRunner()
+	results, err := runner.Run("wg0", []string{"echo 1", "", "echo 2 >&2"})
+	assert.Nil(err)
+	assert.Equal(2, len(results))
+	assert.Equal("1\n", results[0].Output)
+	assert.Equal("2\n", results[1].Output)
+}
+
+func TestHookRunnerAbort(t *testing.T) {
+	assert := assert.New(t)
+
+	runner := NewHookRunner()
+	runner.Policy = HookAbort
+	results, err := runner.Run("wg0", []string{"echo oops; exit 3", "echo never"})
+	assert.NotNil(err)
+	assert.Equal(1, len(results))
+
+	var hookErr *HookError
+	assert.True(errors.As(err, &hookErr))
+	assert.Equal("wg0", hookErr.Interface)
+	assert.Equal("oops\n", hookErr.Output)
+}
+
+func TestHookRunnerWarn(t *testing.T) {
+	assert := assert.New(t)
+
+	runner := NewHookRunner()
+	runner.Policy = HookWarn
+	runner.Logger = log.New(ioutil.Discard, "", 0)
+	results, err := runner.Run("wg0", []string{"exit 1", "echo after"})
+	assert.Nil(err)
+	assert.Equal(2, len(results))
+	assert.NotNil(results[0].Err)
+	assert.Nil(results[1].Err)
+	assert.Equal("after\n", results[1].Output)
+}
+
+func TestHookRunnerTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	runner := NewHookRunner()
+	runner.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	_, err := runner.Run("wg0", []string{"sleep 5"})
+	assert.NotNil(err)
+	assert.True(time.Since(start) < 5*time.Second)
+}
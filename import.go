@@ -0,0 +1,137 @@
+package dswg
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Imports a wireguard link that already exists in the kernel (ex. one
+// created by wg-quick) into the database, together with its peers.
+// The kernel is only read, so traffic through the link is not disrupted.
+// Peers are named peer1, peer2, ... ordered by their public keys.
+func (c *Client) ImportLink(name string) error {
+	if ln, _ := c.db.GetLink(name); ln != nil {
+		return errorf(ErrDuplicateName, "Link name \"%v\" already exists in database", name)
+	}
+
+	if !c.isLoaded(name) {
+		return linkNotLoaded(name)
+	}
+
+	netInterface, err := c.ns.LinkByName(name)
+	if err != nil {
+		return err
+	}
+
+	device, err := c.wg.Device(name)
+	if err != nil {
+		return err
+	}
+
+	addrList, err := c.ns.AddrList(netInterface, netlink.FAMILY_ALL)
+	if err != nil {
+		return err
+	}
+
+	link, err := importedLink(netInterface, device, addrList)
+	if err != nil {
+		return err
+	}
+
+	// Don't leave a partially imported link behind
+	return c.db.Transaction(func(tx DB) error {
+		err := tx.AddLink(*link)
+		if err != nil {
+			return err
+		}
+
+		for _, peer := range importedPeers(device) {
+			err := tx.AddPeer(name, peer)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func importedLink(netInterface netlink.Link, device *wgtypes.Device, addrList []netlink.Addr) (*Link, error) {
+	attrs := netInterface.Attrs()
+	link := &Link{
+		Name:         attrs.Name,
+		MTU:          attrs.MTU,
+		Enable:       attrs.Flags&net.FlagUp != 0,
+		PrivateKey:   Key{device.PrivateKey},
+		ListenPort:   device.ListenPort,
+		FirewallMark: device.FirewallMark,
+	}
+
+	for _, addr := range addrList {
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		ip := &IPNet{*addr.IPNet}
+		if addr.IP.To4() != nil {
+			if link.AddressIPv4 != nil {
+				return nil, fmt.Errorf(
+					"Link %v has more than one IPv4 address, only one is supported",
+					link.Name)
+			}
+			link.AddressIPv4 = ip
+		} else {
+			if link.AddressIPv6 != nil {
+				return nil, fmt.Errorf(
+					"Link %v has more than one IPv6 address, only one is supported",
+					link.Name)
+			}
+			link.AddressIPv6 = ip
+		}
+	}
+
+	if err := validLink(*link); err != nil {
+		return nil, err
+	}
+
+	return link, nil
+}
+
+func importedPeers(device *wgtypes.Device) []Peer {
+	wgpeers := make([]wgtypes.Peer, len(device.Peers))
+	copy(wgpeers, device.Peers)
+	sort.Slice(wgpeers, func(i, j int) bool {
+		return bytes.Compare(wgpeers[i].PublicKey[:], wgpeers[j].PublicKey[:]) < 0
+	})
+
+	peers := make([]Peer, len(wgpeers))
+	for i, wgpeer := range wgpeers {
+		peer := Peer{
+			Name:                fmt.Sprintf("peer%d", i+1),
+			Enable:              true,
+			PublicKey:           Key{wgpeer.PublicKey},
+			PersistentKeepalive: int64(wgpeer.PersistentKeepaliveInterval / time.Second),
+		}
+
+		if wgpeer.PresharedKey != (wgtypes.Key{}) {
+			peer.PresharedKey = &Key{wgpeer.PresharedKey}
+		}
+
+		if wgpeer.Endpoint != nil {
+			peer.Endpoint = &UDPAddr{*wgpeer.Endpoint}
+		}
+
+		for _, ip := range wgpeer.AllowedIPs {
+			peer.AllowedIPs = append(peer.AllowedIPs, IPNet{ip})
+		}
+
+		peers[i] = peer
+	}
+
+	return peers
+}
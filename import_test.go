@@ -0,0 +1,113 @@
+package dswg
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestImportedLinkValid(t *testing.T) {
+	assert := assert.New(t)
+
+	testlink := baseLink()
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = testlink.Name
+	attrs.MTU = testlink.MTU
+	attrs.Flags = net.FlagUp
+	netInterface := &netlink.GenericLink{LinkAttrs: attrs, LinkType: "wireguard"}
+	device := &wgtypes.Device{
+		Name:         testlink.Name,
+		PrivateKey:   testlink.PrivateKey.Key,
+		ListenPort:   testlink.ListenPort,
+		FirewallMark: testlink.FirewallMark,
+	}
+	linkLocal, _ := netlink.ParseIPNet("fe80::1/64")
+	addrList := []netlink.Addr{
+		{IPNet: &testlink.AddressIPv4.IPNet},
+		{IPNet: &testlink.AddressIPv6.IPNet},
+		{IPNet: linkLocal},
+	}
+
+	link, err := importedLink(netInterface, device, addrList)
+	assert.Nil(err)
+	assert.Equal(Link{
+		Name:         testlink.Name,
+		MTU:          testlink.MTU,
+		Enable:       true,
+		PrivateKey:   testlink.PrivateKey,
+		ListenPort:   testlink.ListenPort,
+		FirewallMark: testlink.FirewallMark,
+		AddressIPv4:  testlink.AddressIPv4,
+		AddressIPv6:  testlink.AddressIPv6,
+	}, *link)
+}
+
+func TestImportedLinkMultipleAddresses(t *testing.T) {
+	assert := assert.New(t)
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = "wg0"
+	netInterface := &netlink.GenericLink{LinkAttrs: attrs, LinkType: "wireguard"}
+	addr1, _ := netlink.ParseIPNet("10.0.0.1/24")
+	addr2, _ := netlink.ParseIPNet("10.1.0.1/24")
+	addrList := []netlink.Addr{{IPNet: addr1}, {IPNet: addr2}}
+
+	_, err := importedLink(netInterface, &wgtypes.Device{}, addrList)
+	assert.NotNil(err)
+}
+
+func TestImportedLinkNoAddresses(t *testing.T) {
+	assert := assert.New(t)
+
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = "wg0"
+	netInterface := &netlink.GenericLink{LinkAttrs: attrs, LinkType: "wireguard"}
+
+	_, err := importedLink(netInterface, &wgtypes.Device{}, nil)
+	assert.NotNil(err)
+}
+
+func TestImportedPeers(t *testing.T) {
+	assert := assert.New(t)
+
+	key1, _ := ParseKey("RND1ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=")
+	key2, _ := ParseKey("ABC1ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=")
+	endpoint, _ := ParseUDP("192.168.0.1:42064")
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	device := &wgtypes.Device{
+		Peers: []wgtypes.Peer{
+			{
+				PublicKey:                   key1.Key,
+				PresharedKey:                key2.Key,
+				Endpoint:                    &endpoint.UDPAddr,
+				PersistentKeepaliveInterval: 25 * time.Second,
+				AllowedIPs:                  []net.IPNet{addr.IPNet},
+			},
+			{
+				PublicKey: key2.Key,
+			},
+		},
+	}
+
+	peers := importedPeers(device)
+	assert.Equal([]Peer{
+		{
+			Name:      "peer1",
+			Enable:    true,
+			PublicKey: *key2,
+		},
+		{
+			Name:                "peer2",
+			Enable:              true,
+			PublicKey:           *key1,
+			PresharedKey:        key2,
+			Endpoint:            endpoint,
+			AllowedIPs:          []IPNet{*addr},
+			PersistentKeepalive: 25,
+		},
+	}, peers)
+}
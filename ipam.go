@@ -0,0 +1,172 @@
+package dswg
+
+import (
+	"fmt"
+	"net"
+)
+
+// IP address management of a link. Peers added WithAllocatedIPs and
+// without allowed IPs get the next free host address (/32 for IPv4, /128 for IPv6) of each of the
+// link subnets, so addresses freed by removed peers are handed out again.
+type IPAM struct {
+	Reservations []IPReservation
+	Exclusions   []IPNet // never handed out
+}
+
+// An address that is only handed out to the peer named PeerName,
+// or to no peer at all if PeerName is empty.
+type IPReservation struct {
+	IP       IP     `db:"ip"`
+	PeerName string `db:"peer_name"`
+}
+
+// Returns the IP address management configuration of the link.
+func (c *Client) GetIPAM(linkName string) (*IPAM, error) {
+	return c.db.GetIPAM(linkName)
+}
+
+// Replaces the IP address management configuration of the link.
+// Addresses already assigned to peers are left as they are.
+func (c *Client) SetIPAM(linkName string, ipam IPAM) error {
+	seen := make(map[string]bool)
+	for _, r := range ipam.Reservations {
+		if seen[r.IP.String()] {
+			return invalid("Reservations", "IP %v is reserved more than once", r.IP)
+		}
+		seen[r.IP.String()] = true
+	}
+
+	return c.db.SetIPAM(linkName, ipam)
+}
+
+// Picks the addresses a peer named peerName gets if it is added to the link
+// WithAllocatedIPs, one from each of the link subnets. Nothing is stored.
+func (c *Client) AllocatePeerIPs(linkName, peerName string) ([]IPNet, error) {
+	link, err := c.db.GetLink(linkName)
+	if err != nil {
+		return nil, err
+	}
+
+	peers, err := c.db.GetLinkPeers(linkName)
+	if err != nil {
+		return nil, err
+	}
+
+	ipam, err := c.db.GetIPAM(linkName)
+	if err != nil {
+		return nil, err
+	}
+
+	var used []IPNet
+	for _, peer := range peers {
+		used = append(used, peer.AllowedIPs...)
+	}
+
+	var ips []IPNet
+	for _, subnet := range linkAddrs(*link) {
+		ip, err := allocateIP(subnet, used, *ipam, peerName)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, *ip)
+	}
+
+	return ips, nil
+}
+
+// Returns the host address reserved for peerName in subnet if there is one
+// and no used network contains it, otherwise the lowest host address of
+// subnet that is not the subnet address, the broadcast address, the link's
+// own address, excluded, reserved or contained in any of the used networks.
+func allocateIP(subnet net.IPNet, used []IPNet, ipam IPAM, peerName string) (*IPNet, error) {
+	ones, bits := subnet.Mask.Size()
+	hostMask := net.CIDRMask(bits, bits)
+	if ones == bits {
+		return nil, fmt.Errorf("No assignable addresses in %v, the link has the only one", subnet.String())
+	}
+
+	// A reservation already held by another peer isn't handed out twice
+	for _, r := range ipam.Reservations {
+		if len(peerName) > 0 && r.PeerName == peerName && subnet.Contains(r.IP.IP) &&
+			containingNet(used, r.IP.IP) == nil {
+			return &IPNet{net.IPNet{IP: r.IP.To16(), Mask: hostMask}}, nil
+		}
+	}
+
+	first := subnet.IP.Mask(subnet.Mask)
+	broadcast := lastIP(net.IPNet{IP: first, Mask: subnet.Mask})
+	isBroadcast := func(ip net.IP) bool {
+		return bits == 32 && ones < 31 && ip.Equal(broadcast)
+	}
+
+	for ip := nextIP(first); subnet.Contains(ip) && !isBroadcast(ip); ip = nextIP(ip) {
+		if ip.Equal(subnet.IP) {
+			continue
+		}
+
+		if n := containingNet(ipam.Exclusions, ip); n != nil {
+			ip = lastIP(n.IPNet)
+			continue
+		}
+
+		if n := containingNet(used, ip); n != nil {
+			ip = lastIP(n.IPNet)
+			continue
+		}
+
+		if isReserved(ipam.Reservations, ip) {
+			continue
+		}
+
+		return &IPNet{net.IPNet{IP: ip.To16(), Mask: hostMask}}, nil
+	}
+
+	return nil, fmt.Errorf("No free addresses left in %v", subnet.String())
+}
+
+func containingNet(nets []IPNet, ip net.IP) *IPNet {
+	for i := range nets {
+		if nets[i].Contains(ip) {
+			return &nets[i]
+		}
+	}
+	return nil
+}
+
+func isReserved(reservations []IPReservation, ip net.IP) bool {
+	for _, r := range reservations {
+		if r.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the address following ip, wrapping around to zero.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// Returns the highest address of the network.
+func lastIP(n net.IPNet) net.IP {
+	ip := n.IP
+	if len(n.Mask) == net.IPv4len {
+		ip = ip.To4()
+	} else {
+		ip = ip.To16()
+	}
+
+	last := make(net.IP, len(ip))
+	for i := range ip {
+		last[i] = ip[i] | ^n.Mask[i]
+	}
+	return last
+}
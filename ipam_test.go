@@ -0,0 +1,258 @@
+package dswg
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func parseIPNets(cidrs ...string) []IPNet {
+	ips := make([]IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		ip, _ := ParseIPNet(cidr)
+		ips[i] = *ip
+	}
+	return ips
+}
+
+func mustAllocateIP(t *testing.T, subnet string, used []IPNet, ipam IPAM, peerName string) string {
+	ip, err := ParseIPNet(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allocated, err := allocateIP(ip.IPNet, used, ipam, peerName)
+	if err != nil {
+		return err.Error()
+	}
+	return allocated.String()
+}
+
+func TestAllocateIPFirst(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("10.6.6.2/32", mustAllocateIP(t, "10.6.6.1/24", nil, IPAM{}, "peer"))
+	assert.Equal("10.6.6.1/32", mustAllocateIP(t, "10.6.6.254/24", nil, IPAM{}, "peer"))
+	assert.Equal("2001::1/128", mustAllocateIP(t, "2001::/32", nil, IPAM{}, "peer"))
+	assert.Equal("2001::2/128", mustAllocateIP(t, "2001::1/64", nil, IPAM{}, "peer"))
+}
+
+func TestAllocateIPReuseFreed(t *testing.T) {
+	assert := assert.New(t)
+
+	// 10.6.6.3 belonged to a removed peer
+	used := parseIPNets("10.6.6.2/32", "10.6.6.4/32", "2001::1/128")
+	assert.Equal("10.6.6.3/32", mustAllocateIP(t, "10.6.6.1/24", used, IPAM{}, "peer"))
+	assert.Equal("2001::2/128", mustAllocateIP(t, "2001::/32", used, IPAM{}, "peer"))
+}
+
+func TestAllocateIPUsedNetwork(t *testing.T) {
+	assert := assert.New(t)
+
+	used := parseIPNets("10.6.6.0/25", "192.168.0.0/16")
+	assert.Equal("10.6.6.128/32", mustAllocateIP(t, "10.6.6.1/24", used, IPAM{}, "peer"))
+}
+
+func TestAllocateIPExclusions(t *testing.T) {
+	assert := assert.New(t)
+
+	ipam := IPAM{Exclusions: parseIPNets("10.6.6.0/28", "10.6.6.16/32", "2001::/120")}
+	assert.Equal("10.6.6.17/32", mustAllocateIP(t, "10.6.6.1/24", nil, ipam, "peer"))
+	assert.Equal("2001::100/128", mustAllocateIP(t, "2001::/32", nil, ipam, "peer"))
+}
+
+func TestAllocateIPReservations(t *testing.T) {
+	assert := assert.New(t)
+
+	ip1, _ := ParseIP("10.6.6.2")
+	ip2, _ := ParseIP("10.6.6.3")
+	ip3, _ := ParseIP("10.6.6.100")
+	ipam := IPAM{Reservations: []IPReservation{
+		{IP: *ip1},
+		{IP: *ip2, PeerName: "other"},
+		{IP: *ip3, PeerName: "peer"},
+	}}
+	assert.Equal("10.6.6.100/32", mustAllocateIP(t, "10.6.6.1/24", nil, ipam, "peer"))
+	assert.Equal("10.6.6.3/32", mustAllocateIP(t, "10.6.6.1/24", nil, ipam, "other"))
+	assert.Equal("10.6.6.4/32", mustAllocateIP(t, "10.6.6.1/24", nil, ipam, "new"))
+	assert.Equal("10.6.6.4/32", mustAllocateIP(t, "10.6.6.1/24", nil, ipam, ""))
+
+	// Reservations outside the subnet don't apply
+	assert.Equal("2001::1/128", mustAllocateIP(t, "2001::/32", nil, ipam, "peer"))
+
+	// Reserved addresses another peer holds are not handed out again
+	used := parseIPNets("10.6.6.100/32")
+	assert.Equal("10.6.6.4/32", mustAllocateIP(t, "10.6.6.1/24", used, ipam, "peer"))
+}
+
+func TestAllocateIPExhausted(t *testing.T) {
+	assert := assert.New(t)
+
+	// Only 10.6.6.1 and 10.6.6.2 are host addresses, and 10.6.6.1 is the link's
+	used := parseIPNets("10.6.6.2/32")
+	assert.Equal("No free addresses left in 10.6.6.1/30",
+		mustAllocateIP(t, "10.6.6.1/30", used, IPAM{}, "peer"))
+
+	ipam := IPAM{Exclusions: parseIPNets("10.6.6.0/24")}
+	assert.Equal("No free addresses left in 10.6.6.1/24",
+		mustAllocateIP(t, "10.6.6.1/24", nil, ipam, "peer"))
+
+	// Single address subnets only have the address of the link
+	assert.Equal("No assignable addresses in 10.6.6.1/32, the link has the only one",
+		mustAllocateIP(t, "10.6.6.1/32", nil, IPAM{}, "peer"))
+	assert.Equal("No assignable addresses in 2001::1/128, the link has the only one",
+		mustAllocateIP(t, "2001::1/128", nil, IPAM{}, "peer"))
+}
+
+func TestLastIP(t *testing.T) {
+	assert := assert.New(t)
+
+	ip, _ := ParseIPNet("10.6.6.1/24")
+	assert.Equal(net.ParseIP("10.6.6.255").To4(), lastIP(ip.IPNet))
+
+	ip, _ = ParseIPNet("2001::/120")
+	assert.Equal(net.ParseIP("2001::ff"), lastIP(ip.IPNet))
+}
+
+func TestNextIP(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(net.ParseIP("10.6.7.0").To4(), nextIP(net.ParseIP("10.6.6.255").To4()))
+	assert.Equal(net.ParseIP("0.0.0.0").To4(), nextIP(net.ParseIP("255.255.255.255").To4()))
+}
+
+func TestClientAddPeerAllocatedIPs(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = false
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	// Peers added without addresses get the first free ones
+	testpeer := basePeer()
+	testpeer.Enable = false
+	err = client.AddPeer(testlink.Name, testpeer, WithAllocatedIPs())
+	assert.Nil(err)
+
+	dbpeer, err := client.db.GetPeer(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Equal("10.6.6.2/32, 2001::1/128", joinIPNets(dbpeer.AllowedIPs))
+
+	// Peers with allowed IPs keep them
+	testpeer2 := secondPeer()
+	testpeer2.Enable = false
+	err = client.AddPeer(testlink.Name, testpeer2, WithAllocatedIPs())
+	assert.Nil(err)
+
+	dbpeer, err = client.db.GetPeer(testlink.Name, testpeer2.Name)
+	assert.Nil(err)
+	assert.Equal(testpeer2.AllowedIPs, dbpeer.AllowedIPs)
+}
+
+func TestClientAddPeerNoFreeIPs(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = false
+	ipv4, _ := ParseIPNet("10.6.6.1/32")
+	testlink.AddressIPv4 = ipv4
+	testlink.AddressIPv6 = nil
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer := basePeer()
+	testpeer.Enable = false
+	err = client.AddPeer(testlink.Name, testpeer, WithAllocatedIPs())
+	assert.NotNil(err)
+
+	// Without allocation the peer is added as it is
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	dbpeer, err := client.db.GetPeer(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Len(dbpeer.AllowedIPs, 0)
+}
+
+func TestClientAllocatePeerIPsReuse(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = false
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer1 := basePeer()
+	testpeer1.Name = "peer1"
+	testpeer1.Enable = false
+	err = client.AddPeer(testlink.Name, testpeer1, WithAllocatedIPs())
+	assert.Nil(err)
+
+	testpeer2 := basePeer()
+	testpeer2.Name = "peer2"
+	testpeer2.Enable = false
+	key, _ := ParseKey("CHG+ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=")
+	testpeer2.PublicKey = *key
+	err = client.AddPeer(testlink.Name, testpeer2, WithAllocatedIPs())
+	assert.Nil(err)
+
+	dbpeer, err := client.db.GetPeer(testlink.Name, testpeer2.Name)
+	assert.Nil(err)
+	assert.Equal("10.6.6.3/32, 2001::2/128", joinIPNets(dbpeer.AllowedIPs))
+
+	err = client.RemovePeer(testlink.Name, testpeer1.Name)
+	assert.Nil(err)
+
+	ips, err := client.AllocatePeerIPs(testlink.Name, "peer3")
+	assert.Nil(err)
+	assert.Equal("10.6.6.2/32, 2001::1/128", joinIPNets(ips))
+}
+
+func TestClientSetIPAM(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = false
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	ip, _ := ParseIP("10.6.6.2")
+	ipam := IPAM{
+		Reservations: []IPReservation{{IP: *ip, PeerName: "zoz-pc"}, {IP: *ip}},
+	}
+	err = client.SetIPAM(testlink.Name, ipam)
+	assert.NotNil(err)
+
+	ipam = IPAM{
+		Reservations: []IPReservation{{IP: *ip, PeerName: "zoz-pc"}},
+		Exclusions:   parseIPNets("10.6.6.0/28"),
+	}
+	err = client.SetIPAM(testlink.Name, ipam)
+	assert.Nil(err)
+
+	dbipam, err := client.GetIPAM(testlink.Name)
+	assert.Nil(err)
+	assert.Equal(ipam, *dbipam)
+
+	ips, err := client.AllocatePeerIPs(testlink.Name, "zoz-pc")
+	assert.Nil(err)
+	assert.Equal("10.6.6.2/32, 2001::1/128", joinIPNets(ips))
+
+	ips, err = client.AllocatePeerIPs(testlink.Name, "other")
+	assert.Nil(err)
+	assert.Equal("10.6.6.16/32, 2001::1/128", joinIPNets(ips))
+}
@@ -0,0 +1,180 @@
+package dswg
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics of the links and peers, labelled with their names.
+var (
+	peerReceiveDesc = prometheus.NewDesc("dswg_peer_receive_bytes_total",
+		"Bytes received from the peer since it was loaded.", []string{"link", "peer"}, nil)
+	peerTransmitDesc = prometheus.NewDesc("dswg_peer_transmit_bytes_total",
+		"Bytes sent to the peer since it was loaded.", []string{"link", "peer"}, nil)
+	peerHandshakeAgeDesc = prometheus.NewDesc("dswg_peer_last_handshake_age_seconds",
+		"Seconds since the last handshake with the peer, absent if it never connected.",
+		[]string{"link", "peer"}, nil)
+	peerEnabledDesc = prometheus.NewDesc("dswg_peer_enabled",
+		"Whether the peer is enabled in the database.", []string{"link", "peer"}, nil)
+	linkUpDesc = prometheus.NewDesc("dswg_link_up",
+		"Whether the link is loaded in the kernel and up.", []string{"link"}, nil)
+	linkPeersDesc = prometheus.NewDesc("dswg_link_peers",
+		"Number of peers of the link in the database, by state.", []string{"link", "state"}, nil)
+	linkKernelOnlyPeersDesc = prometheus.NewDesc("dswg_link_kernel_only_peers",
+		"Number of peers of the link loaded in the kernel but missing from the database.",
+		[]string{"link"}, nil)
+)
+
+// States counted by dswg_link_peers, so every state has a sample.
+var peerStates = []PeerState{PeerOnline, PeerStale, PeerNeverConnected, PeerNotLoaded}
+
+// Latency and errors of the operations of a client, shared by the
+// clients of its namespaces.
+type clientMetrics struct {
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+	// Errors reading the links and their status while collecting, the
+	// failing links being reported down
+	collectErrors prometheus.Counter
+}
+
+func newClientMetrics() *clientMetrics {
+	return &clientMetrics{
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "dswg_client_operation_duration_seconds",
+			Help: "Time taken by client operations, including the failed ones.",
+		}, []string{"operation"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dswg_client_operation_errors_total",
+			Help: "Number of client operations that failed.",
+		}, []string{"operation"}),
+		collectErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dswg_collect_errors_total",
+			Help: "Number of errors reading the links and their status while collecting the metrics.",
+		}),
+	}
+}
+
+// Records an operation started at start, which returned err.
+func (c *Client) observe(op string, start time.Time, err error) {
+	if c.metrics == nil {
+		return
+	}
+
+	c.metrics.duration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		c.metrics.errors.WithLabelValues(op).Inc()
+	}
+}
+
+// Collects the metrics of a client when they are scraped.
+type metricsCollector struct {
+	c *Client
+}
+
+// Returns a Prometheus collector reporting the traffic and state of every
+// link and peer of the client, read from the kernel at each scrape, and
+// the latency and errors of the client operations.
+func (c *Client) MetricsCollector() prometheus.Collector {
+	return &metricsCollector{c: c}
+}
+
+// Serves the metrics of MetricsCollector in the Prometheus formats, ex.
+//
+//	http.Handle("/metrics", client.MetricsHandler())
+func (c *Client) MetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c.MetricsCollector())
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+func (m *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		peerReceiveDesc, peerTransmitDesc, peerHandshakeAgeDesc, peerEnabledDesc,
+		linkUpDesc, linkPeersDesc, linkKernelOnlyPeersDesc,
+	} {
+		ch <- desc
+	}
+
+	if m.c.metrics != nil {
+		m.c.metrics.duration.Describe(ch)
+		m.c.metrics.errors.Describe(ch)
+		m.c.metrics.collectErrors.Describe(ch)
+	}
+}
+
+// Failures are counted by dswg_collect_errors_total rather than reported
+// as invalid metrics, which would fail the whole scrape.
+func (m *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	if m.c.metrics != nil {
+		// Collected last, counting the errors of this scrape
+		defer m.c.metrics.collectErrors.Collect(ch)
+		m.c.metrics.duration.Collect(ch)
+		m.c.metrics.errors.Collect(ch)
+	}
+
+	links, err := m.c.db.ListLinks()
+	if err != nil {
+		m.collectError()
+		return
+	}
+
+	for _, link := range links {
+		status, err := m.c.LinkStatus(link.Name)
+		if err != nil {
+			m.collectError()
+			ch <- prometheus.MustNewConstMetric(linkUpDesc, prometheus.GaugeValue, 0, link.Name)
+			continue
+		}
+		collectLinkStatus(ch, status, time.Now())
+	}
+}
+
+func (m *metricsCollector) collectError() {
+	if m.c.metrics != nil {
+		m.c.metrics.collectErrors.Inc()
+	}
+}
+
+func collectLinkStatus(ch chan<- prometheus.Metric, status *LinkStatus, now time.Time) {
+	ch <- prometheus.MustNewConstMetric(linkUpDesc, prometheus.GaugeValue, boolValue(status.Up), status.Name)
+
+	counts := make(map[PeerState]int)
+	kernelOnly := 0
+	for _, peer := range status.Peers {
+		if peer.KernelOnly {
+			kernelOnly++
+			continue
+		}
+		counts[peer.State]++
+
+		labels := []string{status.Name, peer.Name}
+		ch <- prometheus.MustNewConstMetric(peerEnabledDesc, prometheus.GaugeValue,
+			boolValue(peer.Enable), labels...)
+		ch <- prometheus.MustNewConstMetric(peerReceiveDesc, prometheus.CounterValue,
+			float64(peer.ReceiveBytes), labels...)
+		ch <- prometheus.MustNewConstMetric(peerTransmitDesc, prometheus.CounterValue,
+			float64(peer.TransmitBytes), labels...)
+		if !peer.LastHandshake.IsZero() {
+			ch <- prometheus.MustNewConstMetric(peerHandshakeAgeDesc, prometheus.GaugeValue,
+				now.Sub(peer.LastHandshake).Seconds(), labels...)
+		}
+	}
+
+	for _, state := range peerStates {
+		ch <- prometheus.MustNewConstMetric(linkPeersDesc, prometheus.GaugeValue,
+			float64(counts[state]), status.Name, string(state))
+	}
+	ch <- prometheus.MustNewConstMetric(linkKernelOnlyPeersDesc, prometheus.GaugeValue,
+		float64(kernelOnly), status.Name)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,131 @@
+package dswg
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Scrapes the metrics handler of the client, returning the samples.
+func scrapeMetrics(assert *assert.Assertions, client *Client) string {
+	recorder := httptest.NewRecorder()
+	client.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(200, recorder.Code)
+
+	body, _ := ioutil.ReadAll(recorder.Body)
+	return string(body)
+}
+
+func TestClientMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	kernel := NewFakeKernel()
+	client, _ := NewClientWithBackends(setupDB(), kernel, kernel)
+	defer client.Close()
+
+	testlink, testpeer := baseLink(), routedPeer()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+	disabled := secondPeer()
+	disabled.Enable = false
+	err = client.AddPeer(testlink.Name, disabled)
+	assert.Nil(err)
+
+	kernel.SetPeerStats(testlink.Name, testpeer.PublicKey.Key, FakePeerStats{
+		LastHandshake: time.Now().Add(-time.Minute),
+		ReceiveBytes:  1024,
+		TransmitBytes: 4096,
+	})
+	unknown, _ := wgtypes.GeneratePrivateKey()
+	kernel.ConfigureDevice(testlink.Name, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{PublicKey: unknown.PublicKey()}},
+	})
+
+	metrics := scrapeMetrics(assert, client)
+	for _, sample := range []string{
+		`dswg_link_up{link="wg-linko"} 1`,
+		`dswg_link_peers{link="wg-linko",state="online"} 1`,
+		`dswg_link_peers{link="wg-linko",state="not-loaded"} 1`,
+		`dswg_link_peers{link="wg-linko",state="stale"} 0`,
+		`dswg_link_kernel_only_peers{link="wg-linko"} 1`,
+		`dswg_peer_enabled{link="wg-linko",peer="zoz-pc"} 1`,
+		`dswg_peer_enabled{link="wg-linko",peer="second"} 0`,
+		`dswg_peer_receive_bytes_total{link="wg-linko",peer="zoz-pc"} 1024`,
+		`dswg_peer_transmit_bytes_total{link="wg-linko",peer="zoz-pc"} 4096`,
+		`dswg_client_operation_duration_seconds_count{operation="AddPeer"} 2`,
+		`dswg_client_operation_duration_seconds_count{operation="AddLink"} 1`,
+	} {
+		assert.Contains(metrics, sample+"\n")
+	}
+
+	// Peers are labelled by name, and the age of handshakes is only
+	// reported for peers that connected
+	assert.NotContains(metrics, testpeer.PublicKey.String())
+	assert.Contains(metrics, `dswg_peer_last_handshake_age_seconds{link="wg-linko",peer="zoz-pc"} 6`)
+	assert.NotContains(metrics, `dswg_peer_last_handshake_age_seconds{link="wg-linko",peer="second"}`)
+	assert.NotContains(metrics, "dswg_client_operation_errors_total{")
+}
+
+func TestClientMetricsErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	client, _, db := failingClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = false
+	client.AddLink(testlink)
+	db.fail = true
+	err := client.AddPeer(testlink.Name, routedPeer())
+	assert.NotNil(err)
+	_, err = client.Reconcile(context.Background(), ReconcileOptions{})
+	assert.Nil(err)
+
+	metrics := scrapeMetrics(assert, client)
+	assert.Contains(metrics, `dswg_client_operation_errors_total{operation="AddPeer"} 1`+"\n")
+	assert.Contains(metrics, `dswg_client_operation_duration_seconds_count{operation="Reconcile"} 1`+"\n")
+	assert.Contains(metrics, `dswg_link_up{link="wg-linko"} 0`+"\n")
+	assert.Contains(metrics, `dswg_link_peers{link="wg-linko",state="not-loaded"} 0`+"\n")
+}
+
+func TestClientMetricsCollectErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	kernel := NewFakeKernel()
+	db := setupDB()
+	client, _ := NewClientWithBackends(db, kernel, kernel)
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	// A link whose namespace can't be opened is reported down, without
+	// failing the scrape
+	broken := baseLink()
+	broken.Name = "wg-broken"
+	broken.ListenPort = 51821
+	broken.Namespace = "dswg-missing"
+	err = db.AddLink(broken)
+	assert.Nil(err)
+
+	metrics := scrapeMetrics(assert, client)
+	assert.Contains(metrics, `dswg_link_up{link="wg-linko"} 1`+"\n")
+	assert.Contains(metrics, `dswg_link_up{link="`+broken.Name+`"} 0`+"\n")
+	assert.NotContains(metrics, `dswg_link_peers{link="`+broken.Name+`"`)
+	assert.Contains(metrics, "dswg_collect_errors_total 1\n")
+
+	// Links that can't be listed are left out
+	db.Close()
+	metrics = scrapeMetrics(assert, client)
+	assert.NotContains(metrics, "dswg_link_up{")
+	assert.Contains(metrics, "dswg_collect_errors_total 2\n")
+	assert.Contains(metrics, `dswg_client_operation_duration_seconds_count{operation="AddLink"} 1`+"\n")
+}
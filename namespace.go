@@ -0,0 +1,211 @@
+package dswg
+
+import (
+	"path/filepath"
+	"runtime"
+	"sort"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// Creates a client that manages links from the given network namespace
+// instead of the current one. Links without a namespace of their own are
+// created in it, and it is where links moved to other namespaces keep
+// their wireguard sockets. The handle is duplicated, so the caller may
+// close it.
+func NewClientInNamespace(db DB, ns netns.NsHandle, opts ...ClientOption) (*Client, error) {
+	fd, err := syscall.Dup(int(ns))
+	if err != nil {
+		return nil, err
+	}
+	owned := netns.NsHandle(fd)
+
+	client, err := newClientAt(db, owned)
+	if err != nil {
+		owned.Close()
+		return nil, err
+	}
+	client.hooks = NewHookRunner()
+	client.namespaces = make(map[string]*Client)
+	client.metrics = newClientMetrics()
+
+	for _, opt := range opts {
+		opt(client)
+	}
+
+	if client.firewall == nil {
+		err = inNamespace(owned, func() error {
+			client.firewall = defaultFirewall()
+			return nil
+		})
+		if err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+// Same as NewClientInNamespace, with the namespace given by its path
+// (ex. /var/run/netns/vpn or /proc/1234/ns/net).
+func NewClientInNamespacePath(db DB, path string, opts ...ClientOption) (*Client, error) {
+	ns, err := netns.GetFromPath(path)
+	if err != nil {
+		return nil, err
+	}
+	defer ns.Close()
+
+	return NewClientInNamespace(db, ns, opts...)
+}
+
+// Builds a client whose netlink and wireguard handles operate in ns.
+// The client owns ns and closes it in Close.
+func newClientAt(db DB, ns netns.NsHandle) (*Client, error) {
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	// wgctrl has no way to pick a namespace, but its netlink sockets are
+	// opened in the namespace of the thread creating them
+	var wg *wgctrl.Client
+	err = inNamespace(ns, func() error {
+		var err error
+		wg, err = wgctrl.New()
+		return err
+	})
+	if err != nil {
+		handle.Delete()
+		return nil, err
+	}
+
+	return &Client{
+		db:    db,
+		wg:    wg,
+		ns:    handle,
+		netns: ns,
+	}, nil
+}
+
+// Returns the client operating in the namespace of a link, which is the
+// client itself for links without a namespace. Clients of other
+// namespaces share the database, hooks and firewall of c and are only
+// used for kernel operations.
+func (c *Client) linkClient(namespace string) (*Client, error) {
+	if len(namespace) == 0 {
+		return c, nil
+	}
+
+	if lc, ok := c.namespaces[namespace]; ok {
+		return lc, nil
+	}
+
+	ns, err := openNamespace(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	lc, err := newClientAt(c.db, ns)
+	if err != nil {
+		ns.Close()
+		return nil, err
+	}
+	lc.hooks = c.hooks
+	lc.firewall = c.firewall
+	lc.metrics = c.metrics
+
+	if c.namespaces == nil {
+		c.namespaces = make(map[string]*Client)
+	}
+	c.namespaces[namespace] = lc
+	return lc, nil
+}
+
+// Returns the link and the client of the namespace it lives in.
+func (c *Client) getLink(name string) (*Link, *Client, error) {
+	link, err := c.db.GetLink(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lc, err := c.linkClient(link.Namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return link, lc, nil
+}
+
+// Clients of the namespaces used by links, starting with c itself,
+// together with the links living in each of them.
+func (c *Client) namespaceLinks(links []Link) ([]*Client, [][]Link, error) {
+	byNamespace := map[string][]Link{"": nil}
+	for _, link := range links {
+		byNamespace[link.Namespace] = append(byNamespace[link.Namespace], link)
+	}
+
+	namespaces := make([]string, 0, len(byNamespace))
+	for namespace := range byNamespace {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	clients := make([]*Client, len(namespaces))
+	grouped := make([][]Link, len(namespaces))
+	for i, namespace := range namespaces {
+		lc, err := c.linkClient(namespace)
+		if err != nil {
+			return nil, nil, err
+		}
+		clients[i] = lc
+		grouped[i] = byNamespace[namespace]
+	}
+
+	return clients, grouped, nil
+}
+
+// Opens a namespace by path, or by name as created by `ip netns add`.
+func openNamespace(namespace string) (netns.NsHandle, error) {
+	if filepath.IsAbs(namespace) {
+		return netns.GetFromPath(namespace)
+	}
+	return netns.GetFromName(namespace)
+}
+
+// Runs fn on an OS thread switched to the namespace ns, so that sockets
+// and processes created by fn live in it. A zero or closed ns means the
+// current namespace.
+func inNamespace(ns netns.NsHandle, fn func() error) error {
+	if ns <= 0 {
+		return fn()
+	}
+
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+	defer origin.Close()
+
+	err = netns.Set(ns)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return err
+	}
+
+	defer func() {
+		// A thread stuck in ns must not be reused by other goroutines,
+		// so it stays locked and the runtime drops it once this
+		// goroutine exits
+		if netns.Set(origin) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+
+	return fn()
+}
@@ -0,0 +1,171 @@
+package dswg
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// Creates a new network namespace without switching the calling thread
+// to it.
+func setupNamespace(t *testing.T) netns.NsHandle {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	origin, err := netns.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer origin.Close()
+
+	ns, err := netns.New()
+	if err != nil {
+		t.Skip("Network namespaces are not supported:", err)
+	}
+
+	if err := netns.Set(origin); err != nil {
+		t.Fatal(err)
+	}
+
+	return ns
+}
+
+// Bridges are used as test links since they need no kernel module.
+func testLink(name string) *netlink.Bridge {
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = name
+	return &netlink.Bridge{LinkAttrs: attrs}
+}
+
+func TestInNamespace(t *testing.T) {
+	assert := assert.New(t)
+
+	ns := setupNamespace(t)
+	defer ns.Close()
+
+	origin, _ := netns.Get()
+	defer origin.Close()
+
+	err := inNamespace(ns, func() error {
+		current, err := netns.Get()
+		if err != nil {
+			return err
+		}
+		defer current.Close()
+
+		assert.True(current.Equal(ns))
+		return nil
+	})
+	assert.Nil(err)
+
+	// The thread is switched back
+	runtime.LockOSThread()
+	current, _ := netns.Get()
+	runtime.UnlockOSThread()
+	defer current.Close()
+	assert.True(current.Equal(origin))
+}
+
+func TestInNamespaceNone(t *testing.T) {
+	assert := assert.New(t)
+
+	called := false
+	err := inNamespace(netns.None(), func() error {
+		called = true
+		return nil
+	})
+	assert.Nil(err)
+	assert.True(called)
+}
+
+func TestNewClientInNamespace(t *testing.T) {
+	assert := assert.New(t)
+
+	ns := setupNamespace(t)
+	defer ns.Close()
+
+	client, err := NewClientInNamespace(setupDB(), ns, WithFirewall(&recordingFirewall{rules: make(map[string][]string)}))
+	if err != nil {
+		t.Skip("Couldn't create client:", err)
+	}
+	defer client.Close()
+
+	err = client.ns.LinkAdd(testLink("dswg-test"))
+	assert.Nil(err)
+
+	// The link only exists in the namespace of the client
+	_, err = client.ns.LinkByName("dswg-test")
+	assert.Nil(err)
+	_, err = netlink.LinkByName("dswg-test")
+	assert.NotNil(err)
+
+	// Operations of the client are measured like any other
+	client.Reconcile(context.Background(), ReconcileOptions{})
+	metrics := scrapeMetrics(assert, client)
+	assert.Contains(metrics, `dswg_client_operation_duration_seconds_count{operation="Reconcile"} 1`+"\n")
+}
+
+func TestClientLinkClient(t *testing.T) {
+	assert := assert.New(t)
+
+	ns := setupNamespace(t)
+	defer ns.Close()
+
+	client := &Client{db: setupDB(), metrics: newClientMetrics()}
+	defer client.Close()
+
+	lc, err := client.linkClient("")
+	assert.Nil(err)
+	assert.Equal(client, lc)
+
+	// The namespace is opened through the handle of the test
+	path := fmt.Sprintf("/proc/%v/fd/%v", os.Getpid(), int(ns))
+	lc, err = client.linkClient(path)
+	if err != nil {
+		t.Skip("Couldn't create namespace client:", err)
+	}
+	assert.NotEqual(client, lc)
+	assert.Equal(client.metrics, lc.metrics)
+
+	cached, err := client.linkClient(path)
+	assert.Nil(err)
+	assert.Equal(lc, cached)
+
+	err = lc.ns.LinkAdd(testLink("dswg-test"))
+	assert.Nil(err)
+	nsHandle, _ := netlink.NewHandleAt(ns)
+	defer nsHandle.Delete()
+	_, err = nsHandle.LinkByName("dswg-test")
+	assert.Nil(err)
+}
+
+func TestClientLinkClientNotExist(t *testing.T) {
+	assert := assert.New(t)
+
+	client := &Client{db: setupDB()}
+	defer client.Close()
+
+	_, err := client.linkClient("/nonexistent/netns")
+	assert.NotNil(err)
+}
+
+func TestClientGetLinkNamespace(t *testing.T) {
+	assert := assert.New(t)
+
+	client := &Client{db: setupDB()}
+	defer client.Close()
+
+	link := baseLink()
+	link.Namespace = "/nonexistent/netns"
+	err := client.db.AddLink(link)
+	assert.Nil(err)
+
+	_, _, err = client.getLink(link.Name)
+	assert.NotNil(err)
+}
@@ -0,0 +1,188 @@
+package dswg
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Configuration of the remote device of a peer, the counterpart of the
+// link on this host. It is what gets installed on the peer device.
+type RemoteConfig struct {
+	Interface RemoteInterface `json:"interface"`
+	Peer      RemotePeer      `json:"peer"`
+}
+
+type RemoteInterface struct {
+	PrivateKey *Key    `json:"private_key,omitempty"` // nil unless dswg generated it
+	Addresses  []IPNet `json:"addresses"`
+	DNS        []IP    `json:"dns,omitempty"`
+}
+
+// The link, as seen by the remote device.
+type RemotePeer struct {
+	PublicKey           Key     `json:"public_key"`
+	PresharedKey        *Key    `json:"preshared_key,omitempty"`
+	Endpoint            string  `json:"endpoint,omitempty"`
+	AllowedIPs          []IPNet `json:"allowed_ips"`
+	PersistentKeepalive int64   `json:"persistent_keepalive,omitempty"`
+}
+
+// Generates the configuration the remote device of the peer needs to
+// connect to the link. Links without a listen port use the one the kernel
+// picked, if they are loaded.
+func (c *Client) PeerConfig(linkName, peerName string) (*RemoteConfig, error) {
+	link, lc, err := c.getLink(linkName)
+	if err != nil {
+		return nil, err
+	}
+
+	peer, err := c.db.GetPeer(linkName, peerName)
+	if err != nil {
+		return nil, err
+	}
+
+	if link.ListenPort == 0 && lc.isLoaded(link.Name) {
+		device, err := lc.wg.Device(link.Name)
+		if err != nil {
+			return nil, err
+		}
+		link.ListenPort = device.ListenPort
+	}
+
+	return remoteConfig(*link, *peer), nil
+}
+
+// Builds the remote configuration of the peer.
+//   - Addresses are the peer allowed IPs inside the link subnets,
+//     or all of its allowed IPs if none is.
+//   - DNS servers are the peer ones, falling back to the link defaults.
+//   - Allowed IPs are the link default allowed IPs, falling back to
+//     the link subnets.
+//   - The endpoint is the link host and listen port, and is left out
+//     if the link has no host or no listen port.
+func remoteConfig(link Link, peer Peer) *RemoteConfig {
+	subnets := linkAddrs(link)
+	var addrs []IPNet
+	for _, ip := range peer.AllowedIPs {
+		for _, subnet := range subnets {
+			if subnetContains(subnet, ip.IPNet) {
+				addrs = append(addrs, ip)
+				break
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = peer.AllowedIPs
+	}
+
+	dns1, dns2 := peer.DNS1, peer.DNS2
+	if dns1 == nil && dns2 == nil {
+		dns1, dns2 = link.DefaultDNS1, link.DefaultDNS2
+	}
+	var dns []IP
+	for _, server := range []*IP{dns1, dns2} {
+		if server != nil {
+			dns = append(dns, *server)
+		}
+	}
+
+	allowedIPs := link.DefaultAllowedIPs
+	if len(allowedIPs) == 0 {
+		for _, subnet := range subnets {
+			masked := net.IPNet{IP: subnet.IP.Mask(subnet.Mask), Mask: subnet.Mask}
+			allowedIPs = append(allowedIPs, IPNet{masked})
+		}
+	}
+
+	var endpoint string
+	if len(link.Host) > 0 && link.ListenPort != 0 {
+		endpoint = net.JoinHostPort(link.Host, strconv.Itoa(link.ListenPort))
+	}
+
+	return &RemoteConfig{
+		Interface: RemoteInterface{
+			PrivateKey: peer.PrivateKey,
+			Addresses:  addrs,
+			DNS:        dns,
+		},
+		Peer: RemotePeer{
+			PublicKey:           Key{link.PrivateKey.PublicKey()},
+			PresharedKey:        peer.PresharedKey,
+			Endpoint:            endpoint,
+			AllowedIPs:          allowedIPs,
+			PersistentKeepalive: peer.PersistentKeepalive,
+		},
+	}
+}
+
+// Indicates whether the network ip is inside subnet.
+func subnetContains(subnet, ip net.IPNet) bool {
+	subnetOnes, subnetBits := subnet.Mask.Size()
+	ones, bits := ip.Mask.Size()
+	return subnetBits == bits && ones >= subnetOnes && subnet.Contains(ip.IP)
+}
+
+// Renders the configuration in the wg-quick(8) format.
+func (rc *RemoteConfig) WriteWgQuick(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintln(bw, "[Interface]")
+	if rc.Interface.PrivateKey != nil {
+		fmt.Fprintf(bw, "PrivateKey = %v\n", rc.Interface.PrivateKey)
+	} else {
+		fmt.Fprintln(bw, "# PrivateKey of this device is not known to dswg, add it here")
+	}
+	if len(rc.Interface.Addresses) > 0 {
+		fmt.Fprintf(bw, "Address = %v\n", joinIPNets(rc.Interface.Addresses))
+	}
+	if len(rc.Interface.DNS) > 0 {
+		dns := make([]string, len(rc.Interface.DNS))
+		for i, server := range rc.Interface.DNS {
+			dns[i] = server.String()
+		}
+		fmt.Fprintf(bw, "DNS = %v\n", strings.Join(dns, ", "))
+	}
+
+	fmt.Fprintln(bw)
+	fmt.Fprintln(bw, "[Peer]")
+	fmt.Fprintf(bw, "PublicKey = %v\n", rc.Peer.PublicKey)
+	if rc.Peer.PresharedKey != nil {
+		fmt.Fprintf(bw, "PresharedKey = %v\n", rc.Peer.PresharedKey)
+	}
+	if len(rc.Peer.AllowedIPs) > 0 {
+		fmt.Fprintf(bw, "AllowedIPs = %v\n", joinIPNets(rc.Peer.AllowedIPs))
+	}
+	if len(rc.Peer.Endpoint) > 0 {
+		fmt.Fprintf(bw, "Endpoint = %v\n", rc.Peer.Endpoint)
+	}
+	if rc.Peer.PersistentKeepalive != 0 {
+		fmt.Fprintf(bw, "PersistentKeepalive = %d\n", rc.Peer.PersistentKeepalive)
+	}
+
+	return bw.Flush()
+}
+
+// Renders the configuration in the wg-quick(8) format.
+func (rc *RemoteConfig) WgQuick() string {
+	var buf strings.Builder
+	rc.WriteWgQuick(&buf)
+	return buf.String()
+}
+
+// Renders the configuration as indented JSON.
+func (rc *RemoteConfig) JSON() ([]byte, error) {
+	return json.MarshalIndent(rc, "", "  ")
+}
+
+func joinIPNets(ips []IPNet) string {
+	strs := make([]string, len(ips))
+	for i, ip := range ips {
+		strs[i] = ip.String()
+	}
+	return strings.Join(strs, ", ")
+}
@@ -0,0 +1,180 @@
+package dswg
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestRemoteConfigValid(t *testing.T) {
+	assert := assert.New(t)
+
+	testlink := baseLink()
+	testpeer := basePeer()
+	testpeer.PersistentKeepalive = 25
+	addr1, _ := ParseIPNet("10.6.6.2/32")
+	addr2, _ := ParseIPNet("192.168.10.0/24")
+	testpeer.AllowedIPs = []IPNet{*addr1, *addr2}
+
+	rc := remoteConfig(testlink, testpeer)
+	assert.Nil(rc.Interface.PrivateKey)
+	assert.Equal([]IPNet{*addr1}, rc.Interface.Addresses)
+	assert.Equal([]IP{*testpeer.DNS1}, rc.Interface.DNS)
+	assert.Equal(testlink.PrivateKey.PublicKey(), rc.Peer.PublicKey.Key)
+	assert.Equal(testpeer.PresharedKey, rc.Peer.PresharedKey)
+	assert.Equal("vpn.example.com:9977", rc.Peer.Endpoint)
+	assert.Equal(testlink.DefaultAllowedIPs, rc.Peer.AllowedIPs)
+	assert.Equal(int64(25), rc.Peer.PersistentKeepalive)
+}
+
+func TestRemoteConfigFallbacks(t *testing.T) {
+	assert := assert.New(t)
+
+	testlink := baseLink()
+	testlink.DefaultAllowedIPs = nil
+	testlink.Host = ""
+	dns2, _ := ParseIP("1.0.0.1")
+	testlink.DefaultDNS2 = dns2
+
+	testpeer := basePeer()
+	testpeer.DNS1 = nil
+	addr, _ := ParseIPNet("192.168.10.2/32")
+	testpeer.AllowedIPs = []IPNet{*addr}
+
+	rc := remoteConfig(testlink, testpeer)
+	// Outside of the link subnets, all allowed IPs are used
+	assert.Equal([]IPNet{*addr}, rc.Interface.Addresses)
+	assert.Equal([]IP{*testlink.DefaultDNS1, *dns2}, rc.Interface.DNS)
+	assert.Equal("", rc.Peer.Endpoint)
+
+	assert.Equal("10.6.6.0/24, 2001::/32", joinIPNets(rc.Peer.AllowedIPs))
+}
+
+func TestRemoteConfigWgQuick(t *testing.T) {
+	assert := assert.New(t)
+
+	testlink := baseLink()
+	testpeer := basePeer()
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	testpeer.AllowedIPs = []IPNet{*addr}
+
+	conf := remoteConfig(testlink, testpeer).WgQuick()
+	assert.Equal(`[Interface]
+# PrivateKey of this device is not known to dswg, add it here
+Address = 10.6.6.2/32
+DNS = 1.1.1.1
+
+[Peer]
+PublicKey = `+testlink.PrivateKey.PublicKey().String()+`
+PresharedKey = ZOZ+ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=
+AllowedIPs = 10.6.6.1/24, 10.6.6.2/24
+Endpoint = vpn.example.com:9977
+`, conf)
+}
+
+func TestRemoteConfigJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	testlink := baseLink()
+	testpeer := basePeer()
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	testpeer.AllowedIPs = []IPNet{*addr}
+
+	rc := remoteConfig(testlink, testpeer)
+	data, err := rc.JSON()
+	assert.Nil(err)
+	assert.Contains(string(data), `"public_key": "`+testlink.PrivateKey.PublicKey().String()+`"`)
+	assert.Contains(string(data), `"addresses": [`)
+
+	var decoded RemoteConfig
+	err = json.Unmarshal(data, &decoded)
+	assert.Nil(err)
+	assert.Equal(rc.Peer.PublicKey, decoded.Peer.PublicKey)
+	assert.Equal(rc.Peer.PresharedKey, decoded.Peer.PresharedKey)
+	assert.Equal(rc.Peer.Endpoint, decoded.Peer.Endpoint)
+	assert.Equal(len(rc.Interface.Addresses), len(decoded.Interface.Addresses))
+	assert.Equal(rc.Interface.Addresses[0].String(), decoded.Interface.Addresses[0].String())
+}
+
+func TestClientPeerConfigNotExist(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.db.AddLink(testlink)
+	assert.Nil(err)
+
+	_, err = client.PeerConfig(testlink.Name, "no-peer")
+	assert.NotNil(err)
+
+	_, err = client.PeerConfig("no-link", "no-peer")
+	assert.NotNil(err)
+}
+
+func TestClientPeerConfigValid(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.db.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer := basePeer()
+	err = client.db.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	rc, err := client.PeerConfig(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Equal(remoteConfig(testlink, testpeer), rc)
+}
+
+func TestClientPeerConfigRandomPort(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.ListenPort = 0
+	err := client.db.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer := basePeer()
+	err = client.db.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	// The port isn't known until the link is loaded
+	rc, err := client.PeerConfig(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Equal("", rc.Peer.Endpoint)
+
+	err = client.ActivateLink(testlink.Name)
+	assert.Nil(err)
+	port := 51820
+	err = client.wg.ConfigureDevice(testlink.Name, wgtypes.Config{ListenPort: &port})
+	assert.Nil(err)
+
+	rc, err = client.PeerConfig(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Equal("vpn.example.com:51820", rc.Peer.Endpoint)
+}
+
+func TestRemoteConfigPrivateKey(t *testing.T) {
+	assert := assert.New(t)
+
+	testpeer := basePeer()
+	privateKey, _ := ParseKey("SBVTnnEBNe7ZKFGbkz96dvf9oq9evSkYrM/Hs7k6W18=")
+	testpeer.PrivateKey = privateKey
+	testpeer.PublicKey = Key{privateKey.PublicKey()}
+
+	rc := remoteConfig(baseLink(), testpeer)
+	assert.Equal(privateKey, rc.Interface.PrivateKey)
+	assert.Contains(rc.WgQuick(), "PrivateKey = SBVTnnEBNe7ZKFGbkz96dvf9oq9evSkYrM/Hs7k6W18=\n")
+	assert.NotContains(rc.WgQuick(), "not known to dswg")
+}
@@ -0,0 +1,663 @@
+package dswg
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// A single netlink, wgctrl, sysctl or firewall call the client performs
+// on the kernel.
+type Operation struct {
+	Backend string `json:"backend"` // "netlink", "wgctrl", "sysctl" or "firewall"
+	Call    string `json:"call"`
+	Link    string `json:"link"`
+	Args    string `json:"args,omitempty"`
+}
+
+func (op Operation) String() string {
+	str := fmt.Sprintf("%v %v %v", op.Backend, op.Call, op.Link)
+	if len(op.Args) > 0 {
+		str += " " + op.Args
+	}
+	return str
+}
+
+// Differences between the database and the kernel, and the
+// operations needed to converge the kernel to the database.
+type Plan struct {
+	Links      []LinkDiff  `json:"links"`
+	Operations []Operation `json:"operations"`
+	// Wireguard links in the kernel that the database doesn't manage,
+	// left untouched.
+	Unmanaged []string `json:"unmanaged,omitempty"`
+}
+
+func (p *Plan) add(diff LinkDiff) {
+	p.Links = append(p.Links, diff)
+	p.Operations = append(p.Operations, linkOperations(diff)...)
+}
+
+// Indicates whether the kernel is already in sync.
+func (p *Plan) Empty() bool {
+	return len(p.Links) == 0
+}
+
+// Renders the plan as human readable text, in the style of a diff:
+// "+" added, "-" removed and "~" changed.
+func (p *Plan) String() string {
+	var buf bytes.Buffer
+	if p.Empty() {
+		buf.WriteString("No changes, the kernel is in sync with the database.\n")
+		writeUnmanaged(&buf, p.Unmanaged)
+		return buf.String()
+	}
+
+	for _, link := range p.Links {
+		fmt.Fprintf(&buf, "%v link %v\n", diffSymbol(link.Action), link.Name)
+		writeFieldDiffs(&buf, "    ", link.Fields)
+		for _, peer := range link.Peers {
+			name := peer.Name
+			if len(name) == 0 {
+				name = "(unknown)"
+			}
+			fmt.Fprintf(&buf, "  %v peer %v [%v]\n",
+				diffSymbol(peer.Action), name, peer.PublicKey)
+			writeFieldDiffs(&buf, "      ", peer.Fields)
+		}
+	}
+
+	buf.WriteString("\nOperations:\n")
+	for _, op := range p.Operations {
+		fmt.Fprintf(&buf, "  %v\n", op)
+	}
+	writeUnmanaged(&buf, p.Unmanaged)
+
+	return buf.String()
+}
+
+// Renders the plan as indented JSON.
+func (p *Plan) JSON() ([]byte, error) {
+	return json.MarshalIndent(p, "", "  ")
+}
+
+func diffSymbol(action DiffAction) string {
+	switch action {
+	case DiffAdded:
+		return "+"
+	case DiffRemoved:
+		return "-"
+	default:
+		return "~"
+	}
+}
+
+func writeUnmanaged(buf *bytes.Buffer, names []string) {
+	if len(names) == 0 {
+		return
+	}
+	buf.WriteString("\nUnmanaged links, left untouched:\n")
+	for _, name := range names {
+		fmt.Fprintf(buf, "  %v\n", name)
+	}
+}
+
+func writeFieldDiffs(buf *bytes.Buffer, indent string, fields []FieldDiff) {
+	for _, field := range fields {
+		if len(field.Old) == 0 {
+			fmt.Fprintf(buf, "%v%v: %v\n", indent, field.Field, field.New)
+		} else {
+			fmt.Fprintf(buf, "%v%v: %v -> %v\n", indent, field.Field, field.Old, field.New)
+		}
+	}
+}
+
+// Lists the kernel operations that apply the link diff.
+func linkOperations(diff LinkDiff) []Operation {
+	netlinkOp := func(call, args string) Operation {
+		return Operation{Backend: "netlink", Call: call, Link: diff.Name, Args: args}
+	}
+	wgctrlOp := func(args string) Operation {
+		return Operation{Backend: "wgctrl", Call: "ConfigureDevice", Link: diff.Name, Args: args}
+	}
+
+	if diff.Action == DiffRemoved {
+		return []Operation{netlinkOp("LinkDel", "")}
+	}
+
+	var ops []Operation
+	if diff.Action == DiffAdded {
+		ops = append(ops, netlinkOp("LinkAdd", "type wireguard"))
+	}
+
+	var devFields []string
+	var linkUp *bool
+	var rules, forwarding *FieldDiff
+	for i, field := range diff.Fields {
+		switch field.Field {
+		case "name":
+			if diff.Action == DiffChanged {
+				ops = append(ops, Operation{
+					Backend: "netlink",
+					Call:    "LinkSetName",
+					Link:    field.Old,
+					Args:    field.New,
+				})
+			}
+		case "public_key", "listen_port", "fwmark":
+			devFields = append(devFields, field.Field+"="+field.New)
+		case "mtu":
+			if field.New != "0" {
+				ops = append(ops, netlinkOp("LinkSetMTU", field.New))
+			}
+		case "addresses":
+			old, new := splitList(field.Old), splitList(field.New)
+			for _, addr := range missingStrings(old, new) {
+				ops = append(ops, netlinkOp("AddrDel", addr))
+			}
+			for _, addr := range missingStrings(new, old) {
+				ops = append(ops, netlinkOp("AddrAdd", addr))
+			}
+		case "enable":
+			up := field.New == "true"
+			linkUp = &up
+		case "rules":
+			rules = &diff.Fields[i]
+		case "forwarding":
+			forwarding = &diff.Fields[i]
+		}
+	}
+	if len(devFields) > 0 {
+		ops = append(ops, wgctrlOp(strings.Join(devFields, " ")))
+	}
+
+	for _, peer := range diff.Peers {
+		configured := peer.Action == DiffAdded
+		var routes, staleRoutes []string
+		for _, field := range peer.Fields {
+			if field.Field == "routes" {
+				old, new := splitList(field.Old), splitList(field.New)
+				routes = missingStrings(new, old)
+				staleRoutes = missingStrings(old, new)
+			} else {
+				configured = true
+			}
+		}
+		if peer.Action == DiffRemoved {
+			ops = append(ops, wgctrlOp("remove peer="+peer.PublicKey))
+		} else if configured {
+			ops = append(ops, wgctrlOp("peer="+peer.PublicKey))
+		}
+		for _, route := range routes {
+			ops = append(ops, netlinkOp("RouteReplace", route))
+		}
+		for _, route := range staleRoutes {
+			ops = append(ops, netlinkOp("RouteDel", route))
+		}
+	}
+
+	if rules != nil {
+		old, new := splitList(rules.Old), splitList(rules.New)
+		for _, family := range missingStrings(new, old) {
+			ops = append(ops, netlinkOp("RuleAdd", family))
+		}
+		for _, family := range missingStrings(old, new) {
+			ops = append(ops, netlinkOp("RuleDel", family))
+		}
+	}
+
+	if forwarding != nil {
+		ops = append(ops, forwardingOperations(diff.Name, *forwarding)...)
+	}
+
+	if linkUp != nil {
+		if *linkUp {
+			ops = append(ops, netlinkOp("LinkSetUp", ""))
+		} else {
+			ops = append(ops, netlinkOp("LinkSetDown", ""))
+		}
+	}
+
+	return ops
+}
+
+// Lists the operations that apply a forwarding field diff, rendered by
+// formatForwarding: sysctls are written and NAT rules replaced.
+func forwardingOperations(link string, field FieldDiff) []Operation {
+	var ops []Operation
+	var oldNAT, newNAT []string
+	for _, item := range splitList(field.Old) {
+		if strings.HasPrefix(item, "nat ") {
+			oldNAT = append(oldNAT, strings.TrimPrefix(item, "nat "))
+		}
+	}
+	for _, item := range splitList(field.New) {
+		if strings.HasPrefix(item, "nat ") {
+			newNAT = append(newNAT, strings.TrimPrefix(item, "nat "))
+		}
+	}
+	for _, item := range missingStrings(splitList(field.New), splitList(field.Old)) {
+		if !strings.HasPrefix(item, "nat ") {
+			ops = append(ops, Operation{Backend: "sysctl", Call: "Write", Link: link, Args: item + "=1"})
+		}
+	}
+
+	switch {
+	case len(newNAT) > 0:
+		ops = append(ops, Operation{Backend: "firewall", Call: "AddMasquerade", Link: link,
+			Args: strings.Join(newNAT, ", ")})
+	case len(oldNAT) > 0:
+		ops = append(ops, Operation{Backend: "firewall", Call: "RemoveMasquerade", Link: link})
+	}
+	return ops
+}
+
+func splitList(list string) []string {
+	if len(list) == 0 {
+		return nil
+	}
+	return strings.Split(list, ", ")
+}
+
+// Returns the strings of a that are not in b.
+func missingStrings(a, b []string) []string {
+	present := make(map[string]bool)
+	for _, str := range b {
+		present[str] = true
+	}
+
+	var missing []string
+	for _, str := range a {
+		if !present[str] {
+			missing = append(missing, str)
+		}
+	}
+	return missing
+}
+
+// Computes what Reconcile would change with the default options,
+// without touching the kernel.
+func (c *Client) Plan() (*Plan, error) {
+	links, err := c.db.ListLinks()
+	if err != nil {
+		return nil, err
+	}
+
+	clients, grouped, err := c.namespaceLinks(links)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{}
+	for i, lc := range clients {
+		kernel, err := lc.kernelLinks()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, link := range grouped[i] {
+			peers, err := c.db.GetLinkPeers(link.Name)
+			if err != nil {
+				return nil, err
+			}
+
+			kl := kernel[link.Name]
+			delete(kernel, link.Name)
+			link, err := lc.plannedLink(link, peers, kl)
+			if err != nil {
+				return nil, err
+			}
+
+			diff, err := lc.diffForwarding(diffLink(&link, peers, kl), link, kl)
+			if err != nil {
+				return nil, err
+			}
+			if diff != nil {
+				plan.add(*diff)
+			}
+		}
+
+		plan.Unmanaged = append(plan.Unmanaged, sortedLinkNames(kernel)...)
+	}
+
+	return plan, nil
+}
+
+// Mirrors the mutating Client operations, but only reports the kernel
+// operations they would perform. Neither the kernel nor the database
+// are modified.
+type DryRun struct {
+	c *Client
+}
+
+func (c *Client) DryRun() *DryRun {
+	return &DryRun{c: c}
+}
+
+func (d *DryRun) AddLink(link Link) (*Plan, error) {
+	c := d.c
+	if ln, _ := c.db.GetLink(link.Name); ln != nil {
+		return nil, errorf(ErrDuplicateName, "Link name \"%v\" already exists in database", link.Name)
+	}
+
+	lc, err := c.linkClient(link.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if ln, _ := lc.ns.LinkByName(link.Name); ln != nil {
+		return nil, errorf(ErrDuplicateName,
+			"Link name already exists in the kernel, "+
+				"please delete it first using `ip link delete %v`", link.Name)
+	}
+
+	if err := validLink(link); err != nil {
+		return nil, err
+	}
+
+	return d.plan(diffLink(&link, nil, nil)), nil
+}
+
+func (d *DryRun) RemoveLink(name string) (*Plan, error) {
+	if _, err := d.c.db.GetLink(name); err != nil {
+		return nil, err
+	}
+
+	kl, err := d.kernelLink(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.plan(diffLink(nil, nil, kl)), nil
+}
+
+func (d *DryRun) ActivateLink(name string) (*Plan, error) {
+	link, err := d.c.db.GetLink(name)
+	if err != nil {
+		return nil, err
+	}
+
+	peers, err := d.c.db.GetLinkPeers(name)
+	if err != nil {
+		return nil, err
+	}
+
+	kl, err := d.kernelLink(name)
+	if err != nil {
+		return nil, err
+	}
+
+	link.Enable = true
+	planned, err := d.plannedLink(*link, peers, kl)
+	if err != nil {
+		return nil, err
+	}
+	return d.plan(diffLink(&planned, peers, kl)), nil
+}
+
+func (d *DryRun) DeactivateLink(name string) (*Plan, error) {
+	link, err := d.c.db.GetLink(name)
+	if err != nil {
+		return nil, err
+	}
+
+	kl, err := d.kernelLink(name)
+	if err != nil || kl == nil {
+		return d.plan(nil), err
+	}
+
+	// Deactivation only brings the link down
+	link.Enable = false
+	diff := diffLink(link, nil, kl)
+	if diff != nil {
+		diff.Peers = nil
+	}
+	return d.plan(onlyFields(diff, "enable")), nil
+}
+
+func (d *DryRun) UpdateLink(name string, link Link) (*Plan, error) {
+	if err := validLink(link); err != nil {
+		return nil, err
+	}
+
+	old, oldlc, err := d.c.getLink(name)
+	if err != nil {
+		return nil, err
+	}
+
+	lc, err := d.c.linkClient(link.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	peers, err := d.c.db.GetLinkPeers(name)
+	if err != nil {
+		return nil, err
+	}
+
+	// A link changing namespaces is deleted and created again
+	plan := &Plan{}
+	if old.Namespace != link.Namespace {
+		kl, err := loadedKernelLink(oldlc, name)
+		if err != nil {
+			return nil, err
+		}
+		if kl != nil {
+			plan.add(*diffLink(nil, nil, kl))
+		}
+	}
+
+	kl, err := loadedKernelLink(lc, name)
+	if err != nil {
+		return nil, err
+	}
+
+	link, err = lc.plannedLink(link, peers, kl)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unloaded links are only loaded when enabled, and updating a loaded
+	// link leaves its peers as they are
+	diff := diffLink(&link, peers, kl)
+	if diff != nil && kl != nil {
+		diff.Peers = nil
+		diff = onlyFields(diff)
+	}
+	if diff != nil {
+		plan.add(*diff)
+	}
+	return plan, nil
+}
+
+func (d *DryRun) AddPeer(linkName string, peer Peer, opts ...PeerOption) (*Plan, error) {
+	peer, err := d.c.preparePeer(linkName, peer, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return d.planPeers(linkName, peer)
+}
+
+func (d *DryRun) RemovePeer(linkName, peerName string) (*Plan, error) {
+	peer, err := d.c.db.GetPeer(linkName, peerName)
+	if err != nil {
+		return nil, err
+	}
+
+	peer.Enable = false
+	return d.planPeers(linkName, *peer)
+}
+
+func (d *DryRun) ActivatePeer(linkName, peerName string) (*Plan, error) {
+	if !d.c.isLinkLoaded(linkName) {
+		return nil, linkNotLoaded(linkName)
+	}
+
+	peer, err := d.c.db.GetPeer(linkName, peerName)
+	if err != nil {
+		return nil, err
+	}
+
+	peer.Enable = true
+	return d.planPeers(linkName, *peer)
+}
+
+func (d *DryRun) DeactivatePeer(linkName, peerName string) (*Plan, error) {
+	if !d.c.isLinkLoaded(linkName) {
+		return nil, linkNotLoaded(linkName)
+	}
+
+	peer, err := d.c.db.GetPeer(linkName, peerName)
+	if err != nil {
+		return nil, err
+	}
+
+	peer.Enable = false
+	return d.planPeers(linkName, *peer)
+}
+
+func (d *DryRun) UpdatePeer(linkName, peerName string, peer Peer) (*Plan, error) {
+	if err := validPeer(peer); err != nil {
+		return nil, err
+	}
+
+	old, err := d.c.db.GetPeer(linkName, peerName)
+	if err != nil {
+		return nil, err
+	}
+
+	if old.PublicKey == peer.PublicKey {
+		return d.planPeers(linkName, peer)
+	}
+
+	// The old public key is removed from the kernel
+	old.Enable = false
+	return d.planPeers(linkName, peer, *old)
+}
+
+// Plans the kernel changes of the given peers on a loaded link.
+// Peers of unloaded links never reach the kernel.
+func (d *DryRun) planPeers(linkName string, peers ...Peer) (*Plan, error) {
+	link, err := d.c.db.GetLink(linkName)
+	if err != nil {
+		return nil, err
+	}
+
+	kl, err := d.kernelLink(linkName)
+	if err != nil || kl == nil {
+		return d.plan(nil), err
+	}
+
+	names := make(map[string]string)
+	for _, peer := range peers {
+		names[peer.PublicKey.String()] = peer.Name
+	}
+
+	// The other peers of the link keep the routes they want
+	linkPeers, err := d.c.db.GetLinkPeers(linkName)
+	if err != nil {
+		return nil, err
+	}
+	for _, peer := range linkPeers {
+		if _, ok := names[peer.PublicKey.String()]; !ok {
+			peers = append(peers, peer)
+		}
+	}
+
+	planned, err := d.plannedLink(*link, peers, kl)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := diffLink(&planned, peers, kl)
+	if diff == nil {
+		return d.plan(nil), nil
+	}
+
+	// Keep the changes of these peers only
+	var peerDiffs []PeerDiff
+	for _, peerDiff := range diff.Peers {
+		if name, ok := names[peerDiff.PublicKey]; ok {
+			peerDiff.Name = name
+			peerDiffs = append(peerDiffs, peerDiff)
+		}
+	}
+	diff.Fields = nil
+	diff.Peers = peerDiffs
+	if len(peerDiffs) == 0 {
+		diff = nil
+	}
+
+	return d.plan(diff), nil
+}
+
+// Snapshot of the kernel link, nil if it is not loaded.
+func (d *DryRun) kernelLink(name string) (*kernelLink, error) {
+	_, lc, err := d.c.getLink(name)
+	if err != nil {
+		return nil, err
+	}
+	return loadedKernelLink(lc, name)
+}
+
+// Snapshot of the kernel link in the namespace of lc, nil if it is not
+// loaded there.
+func loadedKernelLink(lc *Client, name string) (*kernelLink, error) {
+	if !lc.isLoaded(name) {
+		return nil, nil
+	}
+
+	netInterface, err := lc.ns.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return lc.kernelLink(netInterface)
+}
+
+// Same as Client.plannedLink, in the namespace of the link.
+func (d *DryRun) plannedLink(link Link, peers []Peer, kl *kernelLink) (Link, error) {
+	lc, err := d.c.linkClient(link.Namespace)
+	if err != nil {
+		return link, err
+	}
+	return lc.plannedLink(link, peers, kl)
+}
+
+func (d *DryRun) plan(diff *LinkDiff) *Plan {
+	plan := &Plan{}
+	if diff != nil {
+		plan.add(*diff)
+	}
+	return plan
+}
+
+// Keeps the given fields of a changed link diff, and drops the diff
+// if nothing is left.
+func onlyFields(diff *LinkDiff, names ...string) *LinkDiff {
+	if diff == nil || diff.Action != DiffChanged {
+		return diff
+	}
+
+	if len(names) > 0 {
+		keep := make(map[string]bool)
+		for _, name := range names {
+			keep[name] = true
+		}
+
+		var fields []FieldDiff
+		for _, field := range diff.Fields {
+			if keep[field.Field] {
+				fields = append(fields, field)
+			}
+		}
+		diff.Fields = fields
+	}
+
+	if len(diff.Fields) == 0 && len(diff.Peers) == 0 {
+		return nil
+	}
+	return diff
+}
@@ -0,0 +1,117 @@
+package dswg
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkOperationsAdded(t *testing.T) {
+	assert := assert.New(t)
+
+	testlink := baseLink()
+	testpeer := basePeer()
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	testpeer.AllowedIPs = []IPNet{*addr}
+
+	diff := diffLink(&testlink, []Peer{testpeer}, nil)
+	ops := linkOperations(*diff)
+
+	calls := make([]string, len(ops))
+	for i, op := range ops {
+		calls[i] = op.Backend + " " + op.Call
+	}
+	assert.Equal([]string{
+		"netlink LinkAdd",
+		"netlink LinkSetMTU",
+		"netlink AddrAdd",
+		"netlink AddrAdd",
+		"wgctrl ConfigureDevice",
+		"wgctrl ConfigureDevice",
+		"netlink RouteReplace",
+		"netlink LinkSetUp",
+	}, calls)
+	assert.Equal("netlink RouteReplace wg-linko 10.6.6.2/32", ops[6].String())
+}
+
+func TestLinkOperationsRemoved(t *testing.T) {
+	assert := assert.New(t)
+
+	diff := LinkDiff{Name: "wg0", Action: DiffRemoved}
+	ops := linkOperations(diff)
+	assert.Equal([]Operation{{Backend: "netlink", Call: "LinkDel", Link: "wg0"}}, ops)
+}
+
+func TestLinkOperationsChanged(t *testing.T) {
+	assert := assert.New(t)
+
+	diff := LinkDiff{
+		Name:   "wg1",
+		Action: DiffChanged,
+		Fields: []FieldDiff{
+			{"name", "wg0", "wg1"},
+			{"enable", "true", "false"},
+			{"addresses", "10.0.0.1/24, 10.1.0.1/24", "10.0.0.1/24, 10.2.0.1/24"},
+		},
+		Peers: []PeerDiff{
+			{PublicKey: "key1", Action: DiffRemoved, Fields: []FieldDiff{
+				{"routes", "10.0.0.3/32", ""},
+			}},
+			{PublicKey: "key2", Action: DiffChanged, Fields: []FieldDiff{
+				{"routes", "10.0.0.4/32", "10.0.0.2/32"},
+			}},
+		},
+	}
+
+	ops := linkOperations(diff)
+	strs := make([]string, len(ops))
+	for i, op := range ops {
+		strs[i] = op.String()
+	}
+	assert.Equal([]string{
+		"netlink LinkSetName wg0 wg1",
+		"netlink AddrDel wg1 10.1.0.1/24",
+		"netlink AddrAdd wg1 10.2.0.1/24",
+		"wgctrl ConfigureDevice wg1 remove peer=key1",
+		"netlink RouteDel wg1 10.0.0.3/32",
+		"netlink RouteReplace wg1 10.0.0.2/32",
+		"netlink RouteDel wg1 10.0.0.4/32",
+		"netlink LinkSetDown wg1",
+	}, strs)
+}
+
+func TestPlanRender(t *testing.T) {
+	assert := assert.New(t)
+
+	plan := &Plan{}
+	assert.True(plan.Empty())
+	assert.True(strings.HasPrefix(plan.String(), "No changes"))
+
+	plan.add(LinkDiff{
+		Name:   "wg0",
+		Action: DiffChanged,
+		Fields: []FieldDiff{{"mtu", "1500", "1420"}},
+		Peers:  []PeerDiff{{Name: "zoz-pc", PublicKey: "key1", Action: DiffAdded}},
+	})
+	assert.False(plan.Empty())
+
+	text := plan.String()
+	assert.Contains(text, "~ link wg0\n")
+	assert.Contains(text, "    mtu: 1500 -> 1420\n")
+	assert.Contains(text, "  + peer zoz-pc [key1]\n")
+	assert.Contains(text, "  netlink LinkSetMTU wg0 1420\n")
+	assert.NotContains(text, "Unmanaged")
+
+	plan.Unmanaged = []string{"wg-quick0"}
+	assert.Contains(plan.String(), "Unmanaged links, left untouched:\n  wg-quick0\n")
+
+	data, err := plan.JSON()
+	assert.Nil(err)
+
+	var decoded Plan
+	err = json.Unmarshal(data, &decoded)
+	assert.Nil(err)
+	assert.Equal(*plan, decoded)
+}
@@ -0,0 +1,959 @@
+package dswg
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// The configs table holds a single row under this name.
+const postgresConfigName = "default"
+
+// A DB stored in PostgreSQL, so several hosts can share it. Queries are
+// written with ? placeholders and rebound for postgres. Unlike sqlite, it
+// rejects allowed IPs overlapping those of another peer of the link, not
+// only identical ones.
+type postgresDB struct {
+	conn  *sqlx.DB
+	tx    *sqlx.Tx // set in DB.Transaction
+	keys  *dbKeys  // shared by the copies of the database
+	actor string   // of the changes recorded in the audit log
+}
+
+// Returns the transaction of the database if it is in one, and its
+// connection otherwise.
+func (db *postgresDB) ext() sqlx.Ext {
+	if db.tx != nil {
+		return db.tx
+	}
+	return db.conn
+}
+
+func (db *postgresDB) begin() (dbTx, error) {
+	return beginTx(db.conn, db.tx)
+}
+
+// Opens the postgres database of the connection string, ex.
+// "postgres://dswg@db.example.com/dswg", and migrates it to the latest
+// schema. The user needs to be allowed to create the btree_gist extension
+// if it isn't created yet.
+func OpenPostgresDB(dsn string) (DB, error) {
+	return OpenPostgresDBWithKey(dsn, nil)
+}
+
+// Opens the database with the master key of the provider, like
+// OpenSqliteDBWithKey.
+func OpenPostgresDBWithKey(dsn string, provider KeyProvider) (DB, error) {
+	conn, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	err = migratePostgresDB(conn, postgresMigrations)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	keys, err := openDBKeys(conn, provider)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &postgresDB{conn: conn, keys: keys, actor: defaultActor()}, nil
+}
+
+const postgresVersionSchema = `
+CREATE TABLE IF NOT EXISTS schema_version
+(
+ version INTEGER NOT NULL
+)`
+
+// Brings the database to the latest schema version in a single
+// transaction, postgres being able to roll back schema changes. The
+// version table is locked so hosts opening the database together don't
+// migrate it twice.
+func migratePostgresDB(db *sqlx.DB, migrations []string) error {
+	_, err := db.Exec(postgresVersionSchema)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("LOCK TABLE schema_version IN EXCLUSIVE MODE")
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = tx.Get(&version, "SELECT version FROM schema_version")
+	if err == sql.ErrNoRows {
+		_, err = tx.Exec("INSERT INTO schema_version (version) VALUES (0)")
+	}
+	if err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return errorf(ErrSchemaTooNew,
+			"Database schema version %v is newer than %v, the latest this version of dswg supports",
+			version, len(migrations))
+	}
+	if version == len(migrations) {
+		return nil
+	}
+
+	for _, migration := range migrations[version:] {
+		_, err := tx.Exec(migration)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("UPDATE schema_version SET version = $1", len(migrations))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (db *postgresDB) AddLink(link Link) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	cipher, err := db.keys.load(tx)
+	if err != nil {
+		return err
+	}
+
+	stored, err := cipher.sealLink(link, 0)
+	if err != nil {
+		return err
+	}
+
+	const insertLinkStmt = `
+		INSERT INTO links (
+			name, enable, mtu, private_key,
+			port, fwmark, ipv4_cidr, ipv6_cidr,
+			default_dns1, default_dns2,
+			host, forward, namespace, route_table, rule_priority,
+			postup, postdown
+		) VALUES (
+			:name, :enable, :mtu, :stored_private_key,
+			:port, :fwmark, :ipv4_cidr, :ipv6_cidr,
+			:default_dns1, :default_dns2,
+			:host, :forward, :namespace, :route_table, :rule_priority,
+			?, ?)
+		RETURNING id`
+	query, args, err := sqlx.Named(insertLinkStmt, stored)
+	if err != nil {
+		return err
+	}
+
+	args = append(args, strings.Join(link.PostUp, "\n"), strings.Join(link.PostDown, "\n"))
+	var linkID int64
+	err = tx.Get(&linkID, tx.Rebind(query), args...)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	err = cipher.sealInsertedLink(tx, link, linkID)
+	if err != nil {
+		return err
+	}
+
+	err = insertLinkAllowedIPs(tx, linkID, link.DefaultAllowedIPs)
+	if err != nil {
+		return err
+	}
+
+	err = writeAudit(tx, db.actor, "AddLink", link.Name, "", nil, link)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertLinkAllowedIPs(tx dbTx, linkID int64, ips []IPNet) error {
+	const insertIPStmt = `
+		INSERT INTO link_allowed_ips
+		(ip_cidr, link_id, position) VALUES ($1, $2, $3)`
+	for i, ip := range ips {
+		_, err := tx.Exec(insertIPStmt, ip, linkID, i)
+		if err != nil {
+			return postgresError(err)
+		}
+	}
+	return nil
+}
+
+// Columns of links read by scanLink. inet values are read as text with
+// their prefix length, postgres leaves it out of host addresses.
+const postgresLinkColumns = `
+	id, name, enable, mtu, private_key, port,
+	fwmark, text(ipv4_cidr), text(ipv6_cidr), host(default_dns1),
+	host(default_dns2), host, forward, namespace,
+	route_table, rule_priority, postup, postdown`
+
+func (db *postgresDB) GetLink(name string) (*Link, error) {
+	_, link, err := db.getLink(db.ext(), name)
+	return link, err
+}
+
+// Returns the link with its ID, q being the database or a transaction.
+func (db *postgresDB) getLink(q sqlx.Queryer, name string) (int64, *Link, error) {
+	cipher, err := db.keys.load(q)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	row := q.QueryRowx("SELECT "+postgresLinkColumns+" FROM links WHERE name = $1", name)
+	linkID, link, err := cipher.scanLink(row)
+	if err == sql.ErrNoRows {
+		return 0, nil, linkNotFound(name)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	const selectIPsStmt = `
+		SELECT text(ip_cidr) FROM link_allowed_ips
+		WHERE link_id = $1
+		ORDER BY position`
+	err = sqlx.Select(q, &link.DefaultAllowedIPs, selectIPsStmt, linkID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return linkID, link, nil
+}
+
+// Lists the links ordered by name, compared byte by byte like sqlite
+// does, reading the default allowed IPs of all of them in a second query.
+func (db *postgresDB) ListLinks() ([]Link, error) {
+	cipher, err := db.keys.load(db.ext())
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.ext().Query("SELECT " + postgresLinkColumns + ` FROM links ORDER BY name COLLATE "C"`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []Link{}
+	index := make(map[int64]int)
+	for rows.Next() {
+		linkID, link, err := cipher.scanLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		index[linkID] = len(links)
+		links = append(links, *link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var ips []struct {
+		LinkID int64 `db:"link_id"`
+		IP     IPNet `db:"ip_cidr"`
+	}
+	const selectIPsStmt = `
+		SELECT link_id, text(ip_cidr) AS ip_cidr FROM link_allowed_ips
+		ORDER BY link_id, position`
+	err = sqlx.Select(db.ext(), &ips, selectIPsStmt)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		link := &links[index[ip.LinkID]]
+		link.DefaultAllowedIPs = append(link.DefaultAllowedIPs, ip.IP)
+	}
+
+	return links, nil
+}
+
+// Lists the peers matching the where clause like sqliteDB.queryPeers.
+func (db *postgresDB) queryPeers(q sqlx.Queryer, where string, args ...interface{}) ([]LinkPeer, error) {
+	query := `
+		SELECT
+			l.name AS link_name, p.id, p.name, p.enable,
+			p.public_key, p.private_key AS stored_private_key,
+			p.preshared_key AS stored_preshared_key, p.endpoint,
+			p.keepalive, host(p.dns1) AS dns1, host(p.dns2) AS dns2,
+			text(a.ip_cidr) AS ip_cidr
+		FROM peers p
+		JOIN links l ON l.id = p.link_id
+		LEFT JOIN peer_allowed_ips a ON a.peer_id = p.id
+		WHERE ` + where + `
+		ORDER BY l.name COLLATE "C", p.id, a.position`
+	cipher, err := db.keys.load(q)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.Queryx(db.ext().Rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return cipher.scanPeerRows(rows)
+}
+
+func (db *postgresDB) GetLinkPeers(name string) ([]Peer, error) {
+	linkID, err := postgresLinkID(name, db.ext())
+	if err != nil {
+		return nil, err
+	}
+
+	linkPeers, err := db.queryPeers(db.ext(), "p.link_id = ?", linkID)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]Peer, len(linkPeers))
+	for i := range linkPeers {
+		peers[i] = linkPeers[i].Peer
+	}
+
+	return peers, nil
+}
+
+func (db *postgresDB) ListPeers(filter PeerFilter) ([]LinkPeer, error) {
+	conds := []string{"TRUE"}
+	var args []interface{}
+	if len(filter.Link) > 0 {
+		if _, err := postgresLinkID(filter.Link, db.ext()); err != nil {
+			return nil, err
+		}
+		conds = append(conds, "l.name = ?")
+		args = append(args, filter.Link)
+	}
+	if filter.Enabled != nil {
+		conds = append(conds, "p.enable = ?")
+		args = append(args, *filter.Enabled)
+	}
+	if len(filter.NamePrefix) > 0 {
+		conds = append(conds, "strpos(p.name, ?) = 1")
+		args = append(args, filter.NamePrefix)
+	}
+	if filter.PublicKey != nil {
+		conds = append(conds, "p.public_key = ?")
+		args = append(args, *filter.PublicKey)
+	}
+	if filter.AllowedIP != nil {
+		conds = append(conds, `EXISTS (
+			SELECT 1 FROM peer_allowed_ips f
+			WHERE f.peer_id = p.id AND f.ip_cidr >>= CAST(? AS inet))`)
+		args = append(args, filter.AllowedIP.String())
+	}
+
+	return db.queryPeers(db.ext(), strings.Join(conds, " AND "), args...)
+}
+
+func (db *postgresDB) FindPeerByPublicKey(linkName string, key Key) (*Peer, error) {
+	linkID, err := postgresLinkID(linkName, db.ext())
+	if err != nil {
+		return nil, err
+	}
+
+	peers, err := db.queryPeers(db.ext(), "p.link_id = ? AND p.public_key = ?", linkID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(peers) == 0 {
+		return nil, peerKeyNotFound(linkName, key)
+	}
+	return &peers[0].Peer, nil
+}
+
+func (db *postgresDB) UpdateLink(name string, link Link) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	linkID, before, err := db.getLink(tx, name)
+	if err != nil {
+		return err
+	}
+
+	cipher, err := db.keys.load(tx)
+	if err != nil {
+		return err
+	}
+
+	stored, err := cipher.sealLink(link, linkID)
+	if err != nil {
+		return err
+	}
+
+	const updateStmt = `
+		UPDATE links
+		SET name = :name,
+			enable = :enable,
+			mtu = :mtu,
+			private_key = :stored_private_key,
+			port = :port,
+			fwmark = :fwmark,
+			ipv4_cidr = :ipv4_cidr,
+			ipv6_cidr = :ipv6_cidr,
+			default_dns1 = :default_dns1,
+			default_dns2 = :default_dns2,
+			host = :host,
+			forward = :forward,
+			namespace = :namespace,
+			route_table = :route_table,
+			rule_priority = :rule_priority,
+			postup = ?,
+			postdown = ?
+		WHERE
+			id = ?`
+	query, args, err := sqlx.Named(updateStmt, stored)
+	if err != nil {
+		return err
+	}
+
+	args = append(args, strings.Join(link.PostUp, "\n"), strings.Join(link.PostDown, "\n"), linkID)
+	_, err = tx.Exec(tx.Rebind(query), args...)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	_, err = tx.Exec("DELETE FROM link_allowed_ips WHERE link_id = $1", linkID)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	err = insertLinkAllowedIPs(tx, linkID, link.DefaultAllowedIPs)
+	if err != nil {
+		return err
+	}
+
+	err = writeAudit(tx, db.actor, "UpdateLink", name, "", before, link)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *postgresDB) RemoveLink(name string) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	linkID, before, err := db.getLink(tx, name)
+	if err != nil {
+		return err
+	}
+
+	// Deleting the link cascades to the rows referencing it
+	_, err = tx.Exec("DELETE FROM links WHERE id = $1", linkID)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	err = writeAudit(tx, db.actor, "RemoveLink", name, "", before, nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *postgresDB) AddPeer(linkName string, peer Peer) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	linkID, err := postgresLinkID(linkName, tx)
+	if err != nil {
+		return err
+	}
+
+	cipher, err := db.keys.load(tx)
+	if err != nil {
+		return err
+	}
+
+	stored, err := cipher.sealPeer(peer, 0)
+	if err != nil {
+		return err
+	}
+
+	// Last position is for the link ID
+	const insertPeerStmt = `
+		INSERT INTO peers (
+			name, enable, public_key, private_key,
+			preshared_key, endpoint,
+			keepalive, dns1, dns2, link_id
+		) VALUES (
+			:name, :enable, :public_key, :stored_private_key,
+			:stored_preshared_key, :endpoint,
+			:keepalive, :dns1, :dns2, ?)
+		RETURNING id`
+	query, args, err := sqlx.Named(insertPeerStmt, stored)
+	if err != nil {
+		return err
+	}
+
+	args = append(args, linkID)
+	var peerID int64
+	err = tx.Get(&peerID, tx.Rebind(query), args...)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	err = cipher.sealInsertedPeer(tx, peer, peerID)
+	if err != nil {
+		return err
+	}
+
+	err = insertPeerAllowedIPs(tx, linkID, peerID, peer.AllowedIPs)
+	if err != nil {
+		return err
+	}
+
+	err = writeAudit(tx, db.actor, "AddPeer", linkName, peer.Name, nil, peer)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertPeerAllowedIPs(tx dbTx, linkID, peerID int64, ips []IPNet) error {
+	const insertIPStmt = `
+		INSERT INTO peer_allowed_ips
+		(ip_cidr, peer_id, link_id, position) VALUES ($1, $2, $3, $4)`
+	for i, ip := range ips {
+		_, err := tx.Exec(insertIPStmt, ip, peerID, linkID, i)
+		if err != nil {
+			return postgresError(err)
+		}
+	}
+	return nil
+}
+
+func (db *postgresDB) GetPeer(linkName, peerName string) (*Peer, error) {
+	linkID, err := postgresLinkID(linkName, db.ext())
+	if err != nil {
+		return nil, err
+	}
+
+	return db.getPeer(db.ext(), linkID, peerName)
+}
+
+// Returns the peer of the link, q being the database or a transaction.
+func (db *postgresDB) getPeer(q sqlx.Queryer, linkID int64, peerName string) (*Peer, error) {
+	peers, err := db.queryPeers(q, "p.link_id = ? AND p.name = ?", linkID, peerName)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(peers) == 0 {
+		return nil, peerNotFound(peerName)
+	}
+	return &peers[0].Peer, nil
+}
+
+func (db *postgresDB) UpdatePeer(linkName, peerName string, peer Peer) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	linkID, err := postgresLinkID(linkName, tx)
+	if err != nil {
+		return err
+	}
+
+	peerID, err := postgresPeerID(linkID, peerName, tx)
+	if err != nil {
+		return err
+	}
+
+	before, err := db.getPeer(tx, linkID, peerName)
+	if err != nil {
+		return err
+	}
+
+	cipher, err := db.keys.load(tx)
+	if err != nil {
+		return err
+	}
+
+	stored, err := cipher.sealPeer(peer, peerID)
+	if err != nil {
+		return err
+	}
+
+	const updateStmt = `
+		UPDATE peers
+		SET name = :name,
+			enable = :enable,
+			public_key = :public_key,
+			private_key = :stored_private_key,
+			preshared_key = :stored_preshared_key,
+			endpoint = :endpoint,
+			keepalive = :keepalive,
+			dns1 = :dns1,
+			dns2 = :dns2
+		WHERE
+			id = ?`
+	query, args, err := sqlx.Named(updateStmt, stored)
+	if err != nil {
+		return err
+	}
+
+	args = append(args, peerID)
+	_, err = tx.Exec(tx.Rebind(query), args...)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	_, err = tx.Exec("DELETE FROM peer_allowed_ips WHERE peer_id = $1", peerID)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	err = insertPeerAllowedIPs(tx, linkID, peerID, peer.AllowedIPs)
+	if err != nil {
+		return err
+	}
+
+	err = writeAudit(tx, db.actor, "UpdatePeer", linkName, peerName, before, peer)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *postgresDB) RemovePeer(linkName, peerName string) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	linkID, err := postgresLinkID(linkName, tx)
+	if err != nil {
+		return err
+	}
+
+	before, err := db.getPeer(tx, linkID, peerName)
+	if err != nil {
+		return err
+	}
+
+	// Deleting the peer cascades to its allowed IPs
+	const deletePeerStmt = "DELETE FROM peers WHERE link_id = $1 AND name = $2"
+	_, err = tx.Exec(deletePeerStmt, linkID, peerName)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	err = writeAudit(tx, db.actor, "RemovePeer", linkName, peerName, before, nil)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *postgresDB) PurgePeerPrivateKey(linkName, peerName string) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	linkID, err := postgresLinkID(linkName, tx)
+	if err != nil {
+		return err
+	}
+
+	peerID, err := postgresPeerID(linkID, peerName, tx)
+	if err != nil {
+		return err
+	}
+
+	before, err := db.getPeer(tx, linkID, peerName)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE peers SET private_key = NULL WHERE id = $1", peerID)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	after := *before
+	after.PrivateKey = nil
+	err = writeAudit(tx, db.actor, "PurgePeerPrivateKey", linkName, peerName, before, after)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *postgresDB) GetIPAM(linkName string) (*IPAM, error) {
+	linkID, err := postgresLinkID(linkName, db.ext())
+	if err != nil {
+		return nil, err
+	}
+
+	return postgresIPAM(linkID, db.ext())
+}
+
+// Returns the IPAM configuration of the link like getIPAM.
+func postgresIPAM(linkID int64, q sqlx.Queryer) (*IPAM, error) {
+	var ipam IPAM
+	const selectReservationsStmt = `
+		SELECT host(ip) AS ip, peer_name FROM ipam_reservations
+		WHERE link_id = $1
+		ORDER BY ipam_reservations.ip`
+	err := sqlx.Select(q, &ipam.Reservations, selectReservationsStmt, linkID)
+	if err != nil {
+		return nil, err
+	}
+
+	const selectExclusionsStmt = `
+		SELECT text(ip_cidr) FROM ipam_exclusions
+		WHERE link_id = $1
+		ORDER BY ip_cidr`
+	err = sqlx.Select(q, &ipam.Exclusions, selectExclusionsStmt, linkID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ipam, nil
+}
+
+func (db *postgresDB) SetIPAM(linkName string, ipam IPAM) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	linkID, err := postgresLinkID(linkName, tx)
+	if err != nil {
+		return err
+	}
+
+	before, err := postgresIPAM(linkID, tx)
+	if err != nil {
+		return err
+	}
+
+	// Delete the old configuration
+	for _, stmt := range []string{
+		"DELETE FROM ipam_reservations WHERE link_id = $1",
+		"DELETE FROM ipam_exclusions WHERE link_id = $1",
+	} {
+		_, err := tx.Exec(stmt, linkID)
+		if err != nil {
+			return postgresError(err)
+		}
+	}
+
+	const insertReservationStmt = `
+		INSERT INTO ipam_reservations
+		(ip, peer_name, link_id) VALUES ($1, $2, $3)`
+	for _, r := range ipam.Reservations {
+		_, err := tx.Exec(insertReservationStmt, r.IP, r.PeerName, linkID)
+		if err != nil {
+			return postgresError(err)
+		}
+	}
+
+	const insertExclusionStmt = `
+		INSERT INTO ipam_exclusions
+		(ip_cidr, link_id) VALUES ($1, $2)`
+	for _, ip := range ipam.Exclusions {
+		_, err := tx.Exec(insertExclusionStmt, ip, linkID)
+		if err != nil {
+			return postgresError(err)
+		}
+	}
+
+	err = writeAudit(tx, db.actor, "SetIPAM", linkName, "", before, ipam)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *postgresDB) GetConfig() (*Config, error) {
+	return postgresConfig(db.ext())
+}
+
+// Returns the config like getConfig.
+func postgresConfig(q sqlx.Queryer) (*Config, error) {
+	const selectStmt = `
+		SELECT
+			enable, forward_ipv4, forward_ipv6,
+			nat_enable, COALESCE(nat_link, '') AS nat_link
+		FROM configs
+		WHERE name = $1`
+
+	var config Config
+	err := sqlx.Get(q, &config, selectStmt, postgresConfigName)
+	if err == sql.ErrNoRows {
+		config = defaultConfig()
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+func (db *postgresDB) SetConfig(config Config) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := postgresConfig(tx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM configs WHERE name = $1", postgresConfigName)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	// Last position is for the config name
+	const insertStmt = `
+		INSERT INTO configs (
+			enable, forward_ipv4, forward_ipv6,
+			nat_enable, nat_link, name
+		) VALUES (
+			:enable, :forward_ipv4, :forward_ipv6,
+			:nat_enable, NULLIF(:nat_link, ''), ?)`
+	query, args, err := sqlx.Named(insertStmt, &config)
+	if err != nil {
+		return err
+	}
+
+	args = append(args, postgresConfigName)
+	_, err = tx.Exec(tx.Rebind(query), args...)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	err = writeAudit(tx, db.actor, "SetConfig", "", "", before, config)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *postgresDB) Rekey(provider KeyProvider) error {
+	if db.tx != nil {
+		return fmt.Errorf("Can't rekey the database in a transaction")
+	}
+	return db.keys.rekey(db.conn, provider)
+}
+
+func (db *postgresDB) AuditLog(filter AuditFilter) ([]AuditEntry, error) {
+	return queryAuditLog(db.ext(), filter, "before_state::text AS before_state, after_state::text AS after_state")
+}
+
+func (db *postgresDB) WithActor(actor string) DB {
+	copied := *db
+	copied.actor = actor
+	return &copied
+}
+
+func (db *postgresDB) Export(w io.Writer, opts ExportOptions) error {
+	return exportDB(db, w, opts)
+}
+
+func (db *postgresDB) Import(r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	return importDB(db, r, opts)
+}
+
+func (db *postgresDB) Transaction(fn func(tx DB) error) error {
+	return runTransaction(db.conn, db.tx, func(tx *sqlx.Tx) error {
+		copied := *db
+		copied.tx = tx
+		return fn(&copied)
+	})
+}
+
+func (db *postgresDB) Close() error {
+	return db.conn.Close()
+}
+
+func postgresLinkID(name string, q sqlx.Queryer) (int64, error) {
+	var id int64
+	err := sqlx.Get(q, &id, "SELECT id FROM links WHERE name = $1", name)
+	if err == sql.ErrNoRows {
+		return 0, linkNotFound(name)
+	}
+	return id, err
+}
+
+func postgresPeerID(linkID int64, peerName string, q sqlx.Queryer) (int64, error) {
+	var id int64
+	err := sqlx.Get(q, &id, "SELECT id FROM peers WHERE link_id = $1 AND name = $2", linkID, peerName)
+	if err == sql.ErrNoRows {
+		return 0, peerNotFound(peerName)
+	}
+	return id, err
+}
+
+// Maps violations of the constraints of the schema onto the errors they
+// stand for, like sqliteError.
+func postgresError(err error) error {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return err
+	}
+
+	switch pqErr.Constraint {
+	case "links_name_key":
+		return errorf(ErrDuplicateName, "Link name already exists in database")
+	case "peers_name_key":
+		return errorf(ErrDuplicateName, "Peer name already exists in the link")
+	case "peers_public_key_key":
+		return errorf(ErrDuplicatePublicKey, "Peer public key already belongs to a peer of the link")
+	case "peer_allowed_ips_pkey", "peer_allowed_ips_overlap":
+		return errorf(ErrAllowedIPConflict, "Peer allowed IP overlaps an allowed IP of another peer of the link")
+	}
+	return err
+}
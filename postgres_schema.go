@@ -0,0 +1,159 @@
+package dswg
+
+// Migrations of the postgres schema, applied in order on open like
+// sqliteMigrations. The tables are those of the sqlite schema, with
+// addresses stored as inet so the database can tell overlapping allowed
+// IPs apart. inet is used rather than cidr since link addresses and
+// default allowed IPs are stored with their host bits.
+var postgresMigrations = []string{
+	postgresSchema,
+	postgresEncryptionSchema,
+	postgresAuditSchema,
+}
+
+const postgresSchema = `
+-- Exclusion constraints on the link_id of allowed IPs need the btree
+-- operators of bigint in gist indexes.
+CREATE EXTENSION IF NOT EXISTS btree_gist;
+
+CREATE TABLE configs
+(
+ id           BIGSERIAL NOT NULL ,
+ name         VARCHAR NOT NULL ,
+ enable       BOOLEAN NOT NULL ,
+ forward_ipv4 BOOLEAN NOT NULL ,
+ forward_ipv6 BOOLEAN NOT NULL ,
+ nat_enable   BOOLEAN NOT NULL ,
+ nat_link     VARCHAR NULL ,
+
+ PRIMARY KEY(id)
+);
+
+CREATE TABLE links
+(
+ id            BIGSERIAL NOT NULL ,
+ name          VARCHAR NOT NULL ,
+ enable        BOOLEAN NOT NULL ,
+ mtu           INTEGER NOT NULL ,
+ private_key   VARCHAR NOT NULL ,
+ port          INTEGER NOT NULL ,
+ fwmark        BIGINT NOT NULL ,
+ ipv4_cidr     INET NULL ,
+ ipv6_cidr     INET NULL ,
+ default_dns1  INET NULL ,
+ default_dns2  INET NULL ,
+ host          VARCHAR NOT NULL DEFAULT '' ,
+ postup        VARCHAR NOT NULL ,
+ postdown      VARCHAR NOT NULL ,
+ forward       BOOLEAN NOT NULL ,
+ namespace     VARCHAR NOT NULL DEFAULT '' ,
+ route_table   VARCHAR NOT NULL DEFAULT '' ,
+ rule_priority INTEGER NOT NULL DEFAULT 0 ,
+
+ PRIMARY KEY(id) ,
+ CONSTRAINT links_name_key UNIQUE(name)
+);
+
+CREATE TABLE link_allowed_ips
+(
+ ip_cidr  INET NOT NULL ,
+ link_id  BIGINT NOT NULL ,
+ position INTEGER NOT NULL ,
+
+ PRIMARY KEY(ip_cidr, link_id) ,
+ FOREIGN KEY(link_id) REFERENCES links(id) ON DELETE CASCADE
+);
+
+CREATE TABLE peers
+(
+ id            BIGSERIAL NOT NULL ,
+ link_id       BIGINT NOT NULL ,
+ name          VARCHAR NOT NULL ,
+ enable        BOOLEAN NOT NULL ,
+ public_key    VARCHAR NOT NULL ,
+ private_key   VARCHAR NULL ,
+ preshared_key VARCHAR NULL ,
+ endpoint      VARCHAR NULL ,
+ keepalive     BIGINT NOT NULL ,
+ dns1          INET NULL ,
+ dns2          INET NULL ,
+
+ PRIMARY KEY(id) ,
+ FOREIGN KEY(link_id) REFERENCES links(id) ON DELETE CASCADE ,
+ CONSTRAINT peers_name_key UNIQUE(name, link_id) ,
+ CONSTRAINT peers_public_key_key UNIQUE(public_key, link_id)
+);
+
+-- Allowed IPs of the peers of a link can't overlap, or the kernel would
+-- route the overlap to a single peer.
+CREATE TABLE peer_allowed_ips
+(
+ ip_cidr  INET NOT NULL ,
+ peer_id  BIGINT NOT NULL ,
+ link_id  BIGINT NOT NULL ,
+ position INTEGER NOT NULL ,
+
+ PRIMARY KEY(ip_cidr, peer_id) ,
+ FOREIGN KEY(peer_id) REFERENCES peers(id) ON DELETE CASCADE ,
+ FOREIGN KEY(link_id) REFERENCES links(id) ON DELETE CASCADE ,
+ CONSTRAINT peer_allowed_ips_overlap EXCLUDE USING gist
+	(link_id WITH =, peer_id WITH <>, ip_cidr inet_ops WITH &&)
+);
+
+CREATE TABLE ipam_reservations
+(
+ ip        INET NOT NULL ,
+ peer_name VARCHAR NOT NULL ,
+ link_id   BIGINT NOT NULL ,
+
+ PRIMARY KEY(ip, link_id) ,
+ FOREIGN KEY(link_id) REFERENCES links(id) ON DELETE CASCADE
+);
+
+CREATE TABLE ipam_exclusions
+(
+ ip_cidr INET NOT NULL ,
+ link_id BIGINT NOT NULL ,
+
+ PRIMARY KEY(ip_cidr, link_id) ,
+ FOREIGN KEY(link_id) REFERENCES links(id) ON DELETE CASCADE
+);`
+
+
+// Holds the data key encrypting the keys of the database, see
+// sqliteEncryptionSchema.
+const postgresEncryptionSchema = `
+CREATE TABLE encryption
+(
+ id       BIGSERIAL NOT NULL ,
+ data_key VARCHAR NOT NULL ,
+
+ PRIMARY KEY(id)
+);`
+
+// Entries are never changed nor deleted, see sqliteAuditSchema.
+const postgresAuditSchema = `
+CREATE TABLE audit_log
+(
+ id           BIGSERIAL NOT NULL ,
+ changed_at   TIMESTAMPTZ NOT NULL ,
+ actor        VARCHAR NOT NULL ,
+ operation    VARCHAR NOT NULL ,
+ link         VARCHAR NOT NULL ,
+ peer         VARCHAR NOT NULL ,
+ before_state JSONB NULL ,
+ after_state  JSONB NULL ,
+
+ PRIMARY KEY(id)
+);
+
+CREATE INDEX audit_log_link ON audit_log (link, peer);
+
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+ RAISE EXCEPTION 'Audit log entries can''t be changed or deleted';
+END
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+ FOR EACH ROW EXECUTE PROCEDURE audit_log_append_only();`
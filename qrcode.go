@@ -0,0 +1,111 @@
+package dswg
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// QR code of the wg-quick(8) rendering of a peer configuration, the format
+// mobile wireguard apps scan. It encodes the private and preshared keys of
+// the configuration, if it has them.
+type QRCode struct {
+	qr *qrcode.QRCode
+}
+
+// Generates the QR code of the configuration the remote device of the
+// peer needs to connect to the link, see PeerConfig.
+func (c *Client) PeerQRCode(linkName, peerName string) (*QRCode, error) {
+	rc, err := c.PeerConfig(linkName, peerName)
+	if err != nil {
+		return nil, err
+	}
+
+	return rc.QRCode()
+}
+
+// Encodes the configuration as a QR code.
+func (rc *RemoteConfig) QRCode() (*QRCode, error) {
+	var buf bytes.Buffer
+	err := rc.WriteWgQuick(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	qr, err := qrcode.New(buf.String(), qrcode.Medium)
+	if err != nil {
+		return nil, err
+	}
+	return &QRCode{qr: qr}, nil
+}
+
+// Renders the QR code as a size x size pixels PNG.
+func (q *QRCode) PNG(size int) ([]byte, error) {
+	return q.qr.PNG(size)
+}
+
+// Writes the QR code as a size x size pixels PNG to w.
+func (q *QRCode) WritePNG(w io.Writer, size int) error {
+	return q.qr.Write(size, w)
+}
+
+// Renders the QR code with UTF-8 block characters, two modules per
+// character vertically, to be printed in a terminal. Dark modules are
+// blank, so it is meant for light text on a dark background.
+func (q *QRCode) Terminal() string {
+	return renderBlocks(q.qr.Bitmap())
+}
+
+// Renders the configuration as a size x size pixels PNG QR code.
+func (rc *RemoteConfig) QRCodePNG(size int) ([]byte, error) {
+	qr, err := rc.QRCode()
+	if err != nil {
+		return nil, err
+	}
+
+	return qr.PNG(size)
+}
+
+// Writes the configuration as a size x size pixels PNG QR code to w.
+func (rc *RemoteConfig) WriteQRCodePNG(w io.Writer, size int) error {
+	qr, err := rc.QRCode()
+	if err != nil {
+		return err
+	}
+
+	return qr.WritePNG(w, size)
+}
+
+// Renders the configuration as a terminal QR code, see QRCode.Terminal.
+func (rc *RemoteConfig) QRCodeTerminal() (string, error) {
+	qr, err := rc.QRCode()
+	if err != nil {
+		return "", err
+	}
+
+	return qr.Terminal(), nil
+}
+
+func renderBlocks(bitmap [][]bool) string {
+	var sb strings.Builder
+	for y := 0; y < len(bitmap); y += 2 {
+		for x := range bitmap[y] {
+			top := !bitmap[y][x]
+			bottom := y+1 < len(bitmap) && !bitmap[y+1][x]
+			switch {
+			case top && bottom:
+				sb.WriteString("█")
+			case top:
+				sb.WriteString("▀")
+			case bottom:
+				sb.WriteString("▄")
+			default:
+				sb.WriteString(" ")
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
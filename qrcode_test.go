@@ -0,0 +1,89 @@
+package dswg
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQRCodePNG(t *testing.T) {
+	assert := assert.New(t)
+
+	rc := remoteConfig(baseLink(), basePeer())
+	data, err := rc.QRCodePNG(256)
+	assert.Nil(err)
+
+	img, err := png.Decode(bytes.NewReader(data))
+	assert.Nil(err)
+	assert.Equal(256, img.Bounds().Dx())
+	assert.Equal(256, img.Bounds().Dy())
+
+	var buf bytes.Buffer
+	err = rc.WriteQRCodePNG(&buf, 256)
+	assert.Nil(err)
+	assert.Equal(data, buf.Bytes())
+}
+
+func TestQRCodeTerminal(t *testing.T) {
+	assert := assert.New(t)
+
+	rc := remoteConfig(baseLink(), basePeer())
+	text, err := rc.QRCodeTerminal()
+	assert.Nil(err)
+
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	width := len([]rune(lines[0]))
+	assert.Equal((width+1)/2, len(lines))
+	for _, line := range lines {
+		assert.Equal(width, len([]rune(line)))
+	}
+	// The quiet zone around the code is light
+	assert.Equal(strings.Repeat("█", width), lines[0])
+}
+
+func TestRenderBlocks(t *testing.T) {
+	assert := assert.New(t)
+
+	bitmap := [][]bool{
+		{false, true, false, true},
+		{false, false, true, true},
+		{true, false, false, true},
+	}
+	assert.Equal("█▄▀ \n ▀▀ \n", renderBlocks(bitmap))
+}
+
+func TestClientPeerQRCode(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testpeer := basePeer()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	qr, err := client.PeerQRCode(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+
+	rc, err := client.PeerConfig(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	text, err := rc.QRCodeTerminal()
+	assert.Nil(err)
+	assert.Equal(text, qr.Terminal())
+
+	data, err := qr.PNG(128)
+	assert.Nil(err)
+	img, err := png.Decode(bytes.NewReader(data))
+	assert.Nil(err)
+	assert.Equal(128, img.Bounds().Dx())
+
+	_, err = client.PeerQRCode(testlink.Name, "no-peer")
+	assert.True(errors.Is(err, ErrPeerNotFound))
+}
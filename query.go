@@ -0,0 +1,56 @@
+package dswg
+
+import (
+	"net"
+)
+
+// Selects the peers listed by ListPeers, zero fields match every peer.
+type PeerFilter struct {
+	Link       string // name of the link of the peers
+	Enabled    *bool
+	NamePrefix string
+	AllowedIP  net.IP // an address one of the peer allowed IPs contains
+	PublicKey  *Key
+}
+
+// A peer together with the name of its link.
+type LinkPeer struct {
+	Link string
+	Peer
+}
+
+// Lists the links in the database, ordered by name.
+func (c *Client) ListLinks() ([]Link, error) {
+	return c.db.ListLinks()
+}
+
+// Lists the peers of every link matching the filter, ordered by link
+// name. Filtering on a link that doesn't exist is an ErrLinkNotFound.
+func (c *Client) ListPeers(filter PeerFilter) ([]LinkPeer, error) {
+	return c.db.ListPeers(filter)
+}
+
+// Returns the peer of the link with the public key, or an
+// ErrPeerNotFound.
+func (c *Client) FindPeerByPublicKey(linkName string, key Key) (*Peer, error) {
+	return c.db.FindPeerByPublicKey(linkName, key)
+}
+
+// Keeps the peers with an allowed IP containing ip, all of them if ip
+// is nil.
+func filterAllowedIP(peers []LinkPeer, ip net.IP) []LinkPeer {
+	if ip == nil {
+		return peers
+	}
+
+	filtered := []LinkPeer{}
+	for _, peer := range peers {
+		for _, allowedIP := range peer.AllowedIPs {
+			if allowedIP.Contains(ip) {
+				filtered = append(filtered, peer)
+				break
+			}
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,50 @@
+package dswg
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientListPeers(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+	testpeer1, testpeer2 := routedPeer(), secondPeer()
+	testpeer2.Enable = false
+	for _, peer := range []Peer{testpeer1, testpeer2} {
+		err := client.AddPeer(testlink.Name, peer)
+		assert.Nil(err)
+	}
+
+	links, err := client.ListLinks()
+	assert.Nil(err)
+	assert.Len(links, 1)
+	assert.Equal(testlink.Name, links[0].Name)
+
+	enabled := true
+	peers, err := client.ListPeers(PeerFilter{Link: testlink.Name, Enabled: &enabled})
+	assert.Nil(err)
+	assert.Len(peers, 1)
+	assert.Equal(testlink.Name, peers[0].Link)
+	assert.Equal(testpeer1.Name, peers[0].Name)
+
+	ip, _ := ParseIP("10.6.6.3")
+	peers, err = client.ListPeers(PeerFilter{AllowedIP: ip.IP})
+	assert.Nil(err)
+	assert.Len(peers, 1)
+	assert.Equal(testpeer2.Name, peers[0].Name)
+
+	peer, err := client.FindPeerByPublicKey(testlink.Name, testpeer2.PublicKey)
+	assert.Nil(err)
+	assert.Equal(testpeer2.Name, peer.Name)
+
+	_, err = client.FindPeerByPublicKey("wg-none", testpeer2.PublicKey)
+	assert.True(errors.Is(err, ErrLinkNotFound))
+}
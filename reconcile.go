@@ -0,0 +1,771 @@
+package dswg
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+type DiffAction string
+
+const (
+	DiffAdded   DiffAction = "added"
+	DiffRemoved DiffAction = "removed"
+	DiffChanged DiffAction = "changed"
+)
+
+// Difference of a single field between the database and the kernel.
+// Old is the kernel value and New is the database value.
+type FieldDiff struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+type PeerDiff struct {
+	Name      string      `json:"name,omitempty"` // empty if unknown to the database
+	PublicKey string      `json:"public_key"`
+	Action    DiffAction  `json:"action"`
+	Fields    []FieldDiff `json:"fields,omitempty"`
+}
+
+type LinkDiff struct {
+	Name   string      `json:"name"`
+	Action DiffAction  `json:"action"`
+	Fields []FieldDiff `json:"fields,omitempty"`
+	Peers  []PeerDiff  `json:"peers,omitempty"`
+}
+
+// Changes applied by Client.Reconcile, links in sync are omitted.
+type ReconcileReport = Plan
+
+type ReconcileOptions struct {
+	// Deletes the wireguard links the database doesn't manage, instead of
+	// only reporting them in ReconcileReport.Unmanaged.
+	PruneUnmanaged bool
+}
+
+// Snapshot of a wireguard link loaded in the kernel.
+type kernelLink struct {
+	netInterface netlink.Link
+	device       *wgtypes.Device
+	addrs        []net.IPNet
+	routes       []linkRoute
+	owned        []linkRoute            // routes added by dswg
+	rules        map[int][]netlink.Rule // policy routing rules, by family
+}
+
+// Converges the kernel state to the database.
+// Every link and peer in the database is compared with the kernel and
+// only the differing parts are applied: links are created, deleted,
+// brought up or down, and their keys, ports, addresses, MTU, peers,
+// routes, policy routing rules and forwarding are fixed. Wireguard links unknown to the database, in the
+// client namespace and in every namespace used by links, are left alone,
+// since they may be managed by wg-quick or waiting for ImportLink, unless
+// opts.PruneUnmanaged is set.
+func (c *Client) Reconcile(ctx context.Context, opts ReconcileOptions) (*ReconcileReport, error) {
+	start := time.Now()
+	report, err := c.reconcile(ctx, opts)
+	c.observe("Reconcile", start, err)
+	return report, err
+}
+
+func (c *Client) reconcile(ctx context.Context, opts ReconcileOptions) (*ReconcileReport, error) {
+	links, err := c.db.ListLinks()
+	if err != nil {
+		return nil, err
+	}
+
+	clients, grouped, err := c.namespaceLinks(links)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReconcileReport{}
+	for i, lc := range clients {
+		err := c.reconcileNamespace(ctx, lc, grouped[i], opts, report)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// Reconciles the links living in the namespace of lc.
+func (c *Client) reconcileNamespace(ctx context.Context, lc *Client, links []Link, opts ReconcileOptions, report *ReconcileReport) error {
+	kernel, err := lc.kernelLinks()
+	if err != nil {
+		return err
+	}
+
+	for _, link := range links {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		peers, err := c.db.GetLinkPeers(link.Name)
+		if err != nil {
+			return err
+		}
+
+		kl := kernel[link.Name]
+		delete(kernel, link.Name)
+		link, err := lc.plannedLink(link, peers, kl)
+		if err != nil {
+			return err
+		}
+
+		diff, err := lc.diffForwarding(diffLink(&link, peers, kl), link, kl)
+		if err != nil {
+			return err
+		}
+		if diff == nil {
+			continue
+		}
+
+		err = c.applyLinkDiff(lc, link, peers, kl, *diff)
+		if err != nil {
+			return err
+		}
+		report.add(*diff)
+	}
+
+	// Remaining kernel links are not managed by the database
+	for _, name := range sortedLinkNames(kernel) {
+		if !opts.PruneUnmanaged {
+			report.Unmanaged = append(report.Unmanaged, name)
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		kl := kernel[name]
+		err := lc.ns.LinkDel(kl.netInterface)
+		if err != nil {
+			return err
+		}
+		report.add(*diffLink(nil, nil, kl))
+	}
+
+	return nil
+}
+
+// Applies the diff of a link living in the namespace of lc. Bringing the
+// link up or down is undone if a later step fails, like in the Client
+// operations.
+func (c *Client) applyLinkDiff(lc *Client, link Link, peers []Peer, kl *kernelLink, diff LinkDiff) error {
+	return runSteps("Reconcile", func(tx *transaction) error {
+		return c.applyLinkSteps(tx, lc, link, peers, kl, diff)
+	})
+}
+
+func (c *Client) applyLinkSteps(tx *transaction, lc *Client, link Link, peers []Peer, kl *kernelLink, diff LinkDiff) error {
+	if diff.Action == DiffAdded {
+		return c.activateLink(tx, lc, nil, link, peers)
+	}
+
+	netInterface := kl.netInterface
+	rulesChanged := false
+	for _, field := range diff.Fields {
+		var err error
+		switch field.Field {
+		case "public_key", "listen_port", "fwmark":
+			// Rules keyed on the old fwmark are added again below
+			if field.Field == "fwmark" {
+				rulesChanged = true
+				err = lc.removeMarkRules(kl.device.FirewallMark)
+				if err != nil {
+					return err
+				}
+			}
+			devConfig := wgtypes.Config{
+				PrivateKey:   &link.PrivateKey.Key,
+				ListenPort:   &link.ListenPort,
+				FirewallMark: &link.FirewallMark,
+			}
+			err = lc.wg.ConfigureDevice(link.Name, devConfig)
+		case "mtu":
+			err = lc.ns.LinkSetMTU(netInterface, link.MTU)
+		case "addresses":
+			err = lc.syncLinkAddrs(netInterface, link, kl.addrs)
+		case "rules":
+			rulesChanged = true
+		case "forwarding":
+			if link.Enable {
+				err = lc.setupForwarding(link)
+			} else {
+				err = lc.teardownForwarding(link)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	byKey := make(map[string]Peer)
+	for _, peer := range peers {
+		byKey[peer.PublicKey.String()] = peer
+	}
+
+	for _, peerDiff := range diff.Peers {
+		var err error
+		switch peerDiff.Action {
+		case DiffRemoved:
+			key, _ := wgtypes.ParseKey(peerDiff.PublicKey)
+			devConfig := wgtypes.Config{
+				Peers: []wgtypes.PeerConfig{{PublicKey: key, Remove: true}},
+			}
+			err = lc.wg.ConfigureDevice(link.Name, devConfig)
+		default:
+			peer := byKey[peerDiff.PublicKey]
+			devConfig := wgtypes.Config{
+				Peers: []wgtypes.PeerConfig{peerConfig(peer)},
+			}
+			err = lc.wg.ConfigureDevice(link.Name, devConfig)
+			if err == nil {
+				var dsts []net.IPNet
+				for _, route := range missingRoutes(peerRoutes(link, peer), kl.routes) {
+					dsts = append(dsts, route.dst)
+				}
+				err = lc.addRoutes(netInterface, link, dsts)
+			}
+		}
+		if stale := staleRouteDiff(peerDiff); err == nil && len(stale) > 0 {
+			err = lc.removeRoutesFunc(netInterface, link, func(route linkRoute) bool {
+				return stale[route.String()]
+			})
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if rulesChanged {
+		err := lc.syncRules(netInterface, link)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Bring the link up or down last, so hooks see the final state
+	for _, field := range diff.Fields {
+		if field.Field != "enable" {
+			continue
+		}
+
+		if !link.Enable {
+			return lc.deactivateLink(tx, link, peers)
+		}
+
+		err := tx.do("bring link "+link.Name+" up", func() error {
+			return lc.ns.LinkSetUp(netInterface)
+		}, func() error {
+			return lc.ns.LinkSetDown(netInterface)
+		})
+		if err != nil {
+			return err
+		}
+
+		err = tx.do("run PostUp of link "+link.Name, func() error {
+			return lc.runHooks(link.Name, link.PostUp)
+		}, func() error {
+			return lc.runHooks(link.Name, link.PostDown)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Deletes kernel addresses the link doesn't have and adds the missing ones.
+func (c *Client) syncLinkAddrs(netInterface netlink.Link, link Link, current []net.IPNet) error {
+	wanted := linkAddrs(link)
+	for _, ip := range missingIPNets(current, wanted) {
+		err := c.ns.AddrDel(netInterface, &netlink.Addr{IPNet: &ip})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, ip := range missingIPNets(wanted, current) {
+		err := c.ns.AddrAdd(netInterface, &netlink.Addr{IPNet: &ip})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Takes a snapshot of all the wireguard links in the kernel, keyed by name.
+func (c *Client) kernelLinks() (map[string]*kernelLink, error) {
+	netInterfaces, err := c.ns.LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	links := make(map[string]*kernelLink)
+	for _, netInterface := range netInterfaces {
+		if netInterface.Type() != "wireguard" {
+			continue
+		}
+
+		kl, err := c.kernelLink(netInterface)
+		if err != nil {
+			return nil, err
+		}
+		links[netInterface.Attrs().Name] = kl
+	}
+
+	return links, nil
+}
+
+// Returns the names of the kernel links, sorted.
+func sortedLinkNames(kernel map[string]*kernelLink) []string {
+	names := make([]string, 0, len(kernel))
+	for name := range kernel {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (c *Client) kernelLink(netInterface netlink.Link) (*kernelLink, error) {
+	device, err := c.wg.Device(netInterface.Attrs().Name)
+	if err != nil {
+		return nil, err
+	}
+
+	addrList, err := c.ns.AddrList(netInterface, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, err
+	}
+
+	routeList, err := c.linkRoutes(netInterface)
+	if err != nil {
+		return nil, err
+	}
+
+	kl := &kernelLink{
+		netInterface: netInterface,
+		device:       device,
+		rules:        make(map[int][]netlink.Rule),
+	}
+	if device.FirewallMark != 0 {
+		for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+			rules, err := c.ns.RuleList(family)
+			if err != nil {
+				return nil, err
+			}
+			kl.rules[family] = rules
+		}
+	}
+	for _, addr := range addrList {
+		if addr.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		kl.addrs = append(kl.addrs, *addr.IPNet)
+	}
+	for _, route := range routeList {
+		if route.Dst == nil {
+			continue
+		}
+		lr := linkRoute{dst: *route.Dst, table: route.Table}
+		kl.routes = append(kl.routes, lr)
+		if route.Protocol == RouteProtocol {
+			kl.owned = append(kl.owned, lr)
+		}
+	}
+
+	return kl, nil
+}
+
+// Computes the changes needed to converge the kernel link to the
+// database link and its peers. A nil link means the kernel link should
+// not exist, and a nil kernel link means it is not loaded.
+// Returns nil when both are in sync.
+func diffLink(link *Link, peers []Peer, kl *kernelLink) *LinkDiff {
+	switch {
+	case link == nil && kl == nil:
+		return nil
+	case link == nil:
+		return &LinkDiff{
+			Name:   kl.netInterface.Attrs().Name,
+			Action: DiffRemoved,
+		}
+	case kl == nil:
+		if !link.Enable {
+			return nil
+		}
+		diff := &LinkDiff{
+			Name:   link.Name,
+			Action: DiffAdded,
+			Fields: diffFields(nil, linkFields(*link)),
+		}
+		for _, peer := range peers {
+			if peer.Enable {
+				diff.Peers = append(diff.Peers, PeerDiff{
+					Name:      peer.Name,
+					PublicKey: peer.PublicKey.String(),
+					Action:    DiffAdded,
+					Fields:    diffFields(nil, peerFields(*link, peer)),
+				})
+			}
+		}
+		return diff
+	}
+
+	diff := &LinkDiff{
+		Name:   link.Name,
+		Action: DiffChanged,
+		Fields: diffFields(kernelLinkFields(*link, kl), linkFields(*link)),
+	}
+	diff.Fields = append(diff.Fields, diffFields(
+		[]fieldValue{{"rules", formatFamilies(kernelRuleFamilies(*link, kl))}},
+		[]fieldValue{{"rules", formatFamilies(ruleFamilies(*link, peers))}})...)
+
+	kernelPeers := make(map[string]wgtypes.Peer)
+	for _, wgpeer := range kl.device.Peers {
+		kernelPeers[wgpeer.PublicKey.String()] = wgpeer
+	}
+
+	var wanted []linkRoute
+	for _, peer := range peers {
+		if peer.Enable {
+			wanted = append(wanted, peerRoutes(*link, peer)...)
+		}
+	}
+
+	names := make(map[string]string)
+	for _, peer := range peers {
+		key := peer.PublicKey.String()
+		names[key] = peer.Name
+		if !peer.Enable {
+			continue
+		}
+
+		wgpeer, ok := kernelPeers[key]
+		delete(kernelPeers, key)
+		if !ok {
+			diff.Peers = append(diff.Peers, PeerDiff{
+				Name:      peer.Name,
+				PublicKey: key,
+				Action:    DiffAdded,
+				Fields:    diffFields(nil, peerFields(*link, peer)),
+			})
+			continue
+		}
+
+		fields := diffFields(kernelPeerFields(*link, peer, wgpeer, kl, wanted), peerFields(*link, peer))
+		if len(fields) > 0 {
+			diff.Peers = append(diff.Peers, PeerDiff{
+				Name:      peer.Name,
+				PublicKey: key,
+				Action:    DiffChanged,
+				Fields:    fields,
+			})
+		}
+	}
+
+	// Peers left in the kernel are either disabled or unknown
+	removed := make([]string, 0, len(kernelPeers))
+	for key := range kernelPeers {
+		removed = append(removed, key)
+	}
+	sort.Strings(removed)
+	for _, key := range removed {
+		peerDiff := PeerDiff{
+			Name:      names[key],
+			PublicKey: key,
+			Action:    DiffRemoved,
+		}
+		stale := staleRoutes(kl, kernelPeers[key].AllowedIPs, wanted)
+		if len(stale) > 0 {
+			peerDiff.Fields = []FieldDiff{{Field: "routes", Old: formatRoutes(stale)}}
+		}
+		diff.Peers = append(diff.Peers, peerDiff)
+	}
+
+	if len(diff.Fields) == 0 && len(diff.Peers) == 0 {
+		return nil
+	}
+	return diff
+}
+
+// Adds the forwarding of the loaded link to its diff, see linkForwarding.
+// Links that aren't loaded get theirs when activated.
+func (c *Client) diffForwarding(diff *LinkDiff, link Link, kl *kernelLink) (*LinkDiff, error) {
+	if kl == nil {
+		return diff, nil
+	}
+
+	current, wanted, err := c.linkForwarding(link)
+	if err != nil || current == wanted {
+		return diff, err
+	}
+
+	if diff == nil {
+		diff = &LinkDiff{Name: link.Name, Action: DiffChanged}
+	}
+	diff.Fields = append(diff.Fields, FieldDiff{Field: "forwarding", Old: current, New: wanted})
+	return diff, nil
+}
+
+// Returns the address families syncRules adds the policy routing rules of
+// the link for: those of the default routes enabled peers route in the
+// link table, while the link is up.
+func ruleFamilies(link Link, peers []Peer) []int {
+	if table, _ := parseTable(link.Table); !link.Enable || table >= 0 || link.FirewallMark == 0 {
+		return nil
+	}
+
+	wanted := make(map[int]bool)
+	for _, peer := range peers {
+		if !peer.Enable {
+			continue
+		}
+		for _, route := range peerRoutes(link, peer) {
+			if isDefaultRoute(route.dst) {
+				wanted[routeFamily(route.dst.IP)] = true
+			}
+		}
+	}
+
+	var families []int
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		if wanted[family] {
+			families = append(families, family)
+		}
+	}
+	return families
+}
+
+// Returns the address families the kernel has every policy routing rule
+// of the link for.
+func kernelRuleFamilies(link Link, kl *kernelLink) []int {
+	if link.FirewallMark == 0 {
+		return nil
+	}
+
+	var families []int
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		present := true
+		for _, rule := range policyRules(link, family) {
+			present = present && containsRule(kl.rules[family], rule)
+		}
+		if present {
+			families = append(families, family)
+		}
+	}
+	return families
+}
+
+func containsRule(rules []netlink.Rule, rule netlink.Rule) bool {
+	for _, r := range rules {
+		if sameRule(r, rule) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatFamilies(families []int) string {
+	strs := make([]string, len(families))
+	for i, family := range families {
+		if family == netlink.FAMILY_V4 {
+			strs[i] = "ipv4"
+		} else {
+			strs[i] = "ipv6"
+		}
+	}
+	return strings.Join(strs, ", ")
+}
+
+// Ordered field names and values, compared pairwise by diffFields.
+type fieldValue struct {
+	name  string
+	value string
+}
+
+func diffFields(old, new []fieldValue) []FieldDiff {
+	var fields []FieldDiff
+	for i := range new {
+		var oldValue string
+		if old != nil {
+			oldValue = old[i].value
+		}
+		if oldValue != new[i].value {
+			fields = append(fields, FieldDiff{
+				Field: new[i].name,
+				Old:   oldValue,
+				New:   new[i].value,
+			})
+		}
+	}
+	return fields
+}
+
+func linkFields(link Link) []fieldValue {
+	return []fieldValue{
+		{"name", link.Name},
+		{"enable", strconv.FormatBool(link.Enable)},
+		{"public_key", link.PrivateKey.PublicKey().String()},
+		{"listen_port", strconv.Itoa(link.ListenPort)},
+		{"fwmark", strconv.Itoa(link.FirewallMark)},
+		{"mtu", strconv.Itoa(link.MTU)},
+		{"addresses", formatIPNets(linkAddrs(link), false)},
+	}
+}
+
+// Kernel values of the link fields. Values the database leaves to the
+// kernel (a random listen port or the default MTU) are reported as the database value.
+func kernelLinkFields(link Link, kl *kernelLink) []fieldValue {
+	attrs := kl.netInterface.Attrs()
+	listenPort := kl.device.ListenPort
+	if link.ListenPort == 0 {
+		listenPort = 0
+	}
+	mtu := attrs.MTU
+	if link.MTU == 0 {
+		mtu = 0
+	}
+	return []fieldValue{
+		{"name", attrs.Name},
+		{"enable", strconv.FormatBool(attrs.Flags&net.FlagUp != 0)},
+		{"public_key", kl.device.PublicKey.String()},
+		{"listen_port", strconv.Itoa(listenPort)},
+		{"fwmark", strconv.Itoa(kl.device.FirewallMark)},
+		{"mtu", strconv.Itoa(mtu)},
+		{"addresses", formatIPNets(kl.addrs, false)},
+	}
+}
+
+// The kernel endpoint is not compared, since it changes
+// whenever the remote peer roams.
+func peerFields(link Link, peer Peer) []fieldValue {
+	return []fieldValue{
+		{"preshared_key", formatSecret(peer.PresharedKey)},
+		{"keepalive", peerKeepalive(peer).String()},
+		{"allowed_ips", formatIPNets(peerAllowedIPs(peer), true)},
+		{"routes", formatRoutes(peerRoutes(link, peer))},
+	}
+}
+
+// Routes dswg added for allowed IPs the kernel peer no longer has in the
+// database are reported too, unless another peer of the link wants them.
+func kernelPeerFields(link Link, peer Peer, wgpeer wgtypes.Peer, kl *kernelLink, wanted []linkRoute) []fieldValue {
+	preshared := formatSecret(nil)
+	if wgpeer.PresharedKey != (wgtypes.Key{}) {
+		preshared = formatSecret(&Key{wgpeer.PresharedKey})
+		if peer.PresharedKey == nil || peer.PresharedKey.Key != wgpeer.PresharedKey {
+			preshared += " (differs)"
+		}
+	}
+
+	// Only report the routes of the peer allowed IPs
+	routes := peerRoutes(link, peer)
+	routes = missingRoutes(routes, missingRoutes(routes, kl.routes))
+	routes = append(routes, staleRoutes(kl, wgpeer.AllowedIPs, wanted)...)
+	return []fieldValue{
+		{"preshared_key", preshared},
+		{"keepalive", wgpeer.PersistentKeepaliveInterval.String()},
+		{"allowed_ips", formatIPNets(wgpeer.AllowedIPs, true)},
+		{"routes", formatRoutes(routes)},
+	}
+}
+
+// Returns the routes a peer diff drops, reported by diffLink as routes
+// in the kernel but not in the database.
+func staleRouteDiff(peerDiff PeerDiff) map[string]bool {
+	stale := make(map[string]bool)
+	for _, field := range peerDiff.Fields {
+		if field.Field != "routes" {
+			continue
+		}
+		for _, str := range missingStrings(splitList(field.Old), splitList(field.New)) {
+			stale[str] = true
+		}
+	}
+	return stale
+}
+
+// Returns the routes dswg added for the given allowed IPs of a kernel peer
+// that are not wanted by any enabled peer.
+func staleRoutes(kl *kernelLink, allowedIPs []net.IPNet, wanted []linkRoute) []linkRoute {
+	present := make(map[string]bool)
+	for _, ip := range allowedIPs {
+		present[canonicalIPNet(ip)] = true
+	}
+
+	var owned []linkRoute
+	for _, route := range kl.owned {
+		if present[canonicalIPNet(route.dst)] {
+			owned = append(owned, route)
+		}
+	}
+	return missingRoutes(owned, wanted)
+}
+
+func linkAddrs(link Link) []net.IPNet {
+	var addrs []net.IPNet
+	if link.AddressIPv4 != nil {
+		addrs = append(addrs, link.AddressIPv4.IPNet)
+	}
+	if link.AddressIPv6 != nil {
+		addrs = append(addrs, link.AddressIPv6.IPNet)
+	}
+	return addrs
+}
+
+// Returns the networks of a that are not in b, by their canonical form.
+func missingIPNets(a, b []net.IPNet) []net.IPNet {
+	present := make(map[string]bool)
+	for _, ip := range b {
+		present[canonicalIPNet(ip)] = true
+	}
+
+	var missing []net.IPNet
+	for _, ip := range a {
+		if !present[canonicalIPNet(ip)] {
+			missing = append(missing, ip)
+		}
+	}
+	return missing
+}
+
+// Masks the host bits, the way the kernel stores allowed IPs and routes.
+func canonicalIPNet(ip net.IPNet) string {
+	masked := net.IPNet{IP: ip.IP.Mask(ip.Mask), Mask: ip.Mask}
+	return masked.String()
+}
+
+func formatIPNets(ips []net.IPNet, canonical bool) string {
+	strs := make([]string, len(ips))
+	for i, ip := range ips {
+		if canonical {
+			strs[i] = canonicalIPNet(ip)
+		} else {
+			strs[i] = ip.String()
+		}
+	}
+	sort.Strings(strs)
+	return strings.Join(strs, ", ")
+}
+
+// Secrets are never rendered, only whether they are set.
+func formatSecret(key *Key) string {
+	if key == nil {
+		return "(none)"
+	}
+	return "(hidden)"
+}
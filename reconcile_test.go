@@ -0,0 +1,216 @@
+package dswg
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Builds the kernel snapshot of a link that is in sync with the database.
+func syncedKernelLink(link Link, peers []Peer) *kernelLink {
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = link.Name
+	attrs.MTU = link.MTU
+	if link.Enable {
+		attrs.Flags = net.FlagUp
+	}
+
+	kl := &kernelLink{
+		netInterface: &netlink.GenericLink{LinkAttrs: attrs, LinkType: "wireguard"},
+		device: &wgtypes.Device{
+			Name:         link.Name,
+			PrivateKey:   link.PrivateKey.Key,
+			PublicKey:    link.PrivateKey.PublicKey(),
+			ListenPort:   link.ListenPort,
+			FirewallMark: link.FirewallMark,
+		},
+		addrs: linkAddrs(link),
+	}
+
+	for _, peer := range peers {
+		if !peer.Enable {
+			continue
+		}
+		var preshared wgtypes.Key
+		if peer.PresharedKey != nil {
+			preshared = peer.PresharedKey.Key
+		}
+		kl.device.Peers = append(kl.device.Peers, wgtypes.Peer{
+			PublicKey:                   peer.PublicKey.Key,
+			PresharedKey:                preshared,
+			PersistentKeepaliveInterval: peerKeepalive(peer),
+			AllowedIPs:                  peerAllowedIPs(peer),
+		})
+		kl.routes = append(kl.routes, peerRoutes(link, peer)...)
+		kl.owned = append(kl.owned, peerRoutes(link, peer)...)
+	}
+
+	return kl
+}
+
+func TestDiffLinkInSync(t *testing.T) {
+	assert := assert.New(t)
+
+	testlink := baseLink()
+	testpeer := basePeer()
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	testpeer.AllowedIPs = []IPNet{*addr}
+	peers := []Peer{testpeer}
+
+	diff := diffLink(&testlink, peers, syncedKernelLink(testlink, peers))
+	assert.Nil(diff)
+}
+
+func TestDiffLinkNotLoaded(t *testing.T) {
+	assert := assert.New(t)
+
+	testlink := baseLink()
+	testlink.Enable = true
+	peers := []Peer{basePeer()}
+
+	diff := diffLink(&testlink, peers, nil)
+	assert.NotNil(diff)
+	assert.Equal(DiffAdded, diff.Action)
+	assert.Equal(1, len(diff.Peers))
+	assert.Equal(DiffAdded, diff.Peers[0].Action)
+
+	testlink.Enable = false
+	diff = diffLink(&testlink, peers, nil)
+	assert.Nil(diff)
+}
+
+func TestDiffLinkNotInDB(t *testing.T) {
+	assert := assert.New(t)
+
+	testlink := baseLink()
+	diff := diffLink(nil, nil, syncedKernelLink(testlink, nil))
+	assert.NotNil(diff)
+	assert.Equal(DiffRemoved, diff.Action)
+	assert.Equal(testlink.Name, diff.Name)
+}
+
+func TestDiffLinkFieldsChanged(t *testing.T) {
+	assert := assert.New(t)
+
+	testlink := baseLink()
+	kl := syncedKernelLink(testlink, nil)
+	kl.netInterface.Attrs().MTU = 1500
+	kl.netInterface.Attrs().Flags = 0
+	kl.addrs = nil
+
+	diff := diffLink(&testlink, nil, kl)
+	assert.NotNil(diff)
+	assert.Equal(DiffChanged, diff.Action)
+
+	fields := make(map[string]FieldDiff)
+	for _, field := range diff.Fields {
+		fields[field.Field] = field
+	}
+	assert.Equal(3, len(fields))
+	assert.Equal(FieldDiff{"mtu", "1500", "1420"}, fields["mtu"])
+	assert.Equal(FieldDiff{"enable", "false", "true"}, fields["enable"])
+	assert.Equal("", fields["addresses"].Old)
+}
+
+func TestDiffLinkPeers(t *testing.T) {
+	assert := assert.New(t)
+
+	testlink := baseLink()
+
+	peer1 := basePeer()
+	peer1.Name = "peer1"
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	peer1.AllowedIPs = []IPNet{*addr}
+
+	peer2 := basePeer()
+	peer2.Name = "peer2"
+	randkey, _ := ParseKey("RND2ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=")
+	peer2.PublicKey = *randkey
+
+	peer3 := basePeer()
+	peer3.Name = "peer3"
+	randkey, _ = ParseKey("RND3ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=")
+	peer3.PublicKey = *randkey
+
+	kl := syncedKernelLink(testlink, []Peer{peer1, peer3})
+	// Drop the route of peer1
+	kl.routes = nil
+	kl.owned = nil
+
+	peer3.Enable = false
+	diff := diffLink(&testlink, []Peer{peer1, peer2, peer3}, kl)
+	assert.NotNil(diff)
+	assert.Equal(0, len(diff.Fields))
+	assert.Equal(3, len(diff.Peers))
+
+	peers := make(map[string]PeerDiff)
+	for _, peer := range diff.Peers {
+		peers[peer.Name] = peer
+	}
+	assert.Equal(DiffChanged, peers["peer1"].Action)
+	assert.Equal([]FieldDiff{{"routes", "", "10.6.6.2/32"}}, peers["peer1"].Fields)
+	assert.Equal(DiffAdded, peers["peer2"].Action)
+	assert.Equal(DiffRemoved, peers["peer3"].Action)
+}
+
+func TestDiffLinkStaleRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	testlink := baseLink()
+
+	peer1 := basePeer()
+	peer1.Name = "peer1"
+	addr1, _ := ParseIPNet("10.6.6.2/32")
+	addr2, _ := ParseIPNet("10.6.6.3/32")
+	peer1.AllowedIPs = []IPNet{*addr1, *addr2}
+
+	peer2 := basePeer()
+	peer2.Name = "peer2"
+	randkey, _ := ParseKey("RND2ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=")
+	peer2.PublicKey = *randkey
+	addr3, _ := ParseIPNet("10.6.6.4/32")
+	peer2.AllowedIPs = []IPNet{*addr3}
+
+	kl := syncedKernelLink(testlink, []Peer{peer1, peer2})
+
+	// Routes not added by dswg are never stale
+	kl.owned = missingRoutes(kl.owned, []linkRoute{{addr3.IPNet, mainRouteTable}})
+
+	// One allowed IP of peer1 moved to peer2, which is disabled
+	peer1.AllowedIPs = []IPNet{*addr1}
+	peer2.AllowedIPs = []IPNet{*addr2, *addr3}
+	peer2.Enable = false
+	diff := diffLink(&testlink, []Peer{peer1, peer2}, kl)
+	assert.NotNil(diff)
+
+	peers := make(map[string]PeerDiff)
+	for _, peer := range diff.Peers {
+		peers[peer.Name] = peer
+	}
+	assert.Equal(DiffChanged, peers["peer1"].Action)
+	assert.Contains(peers["peer1"].Fields, FieldDiff{"routes", "10.6.6.2/32, 10.6.6.3/32", "10.6.6.2/32"})
+	assert.Equal(DiffRemoved, peers["peer2"].Action)
+	assert.Len(peers["peer2"].Fields, 0)
+
+	// Once peer2 is enabled it wants the route
+	peer2.Enable = true
+	diff = diffLink(&testlink, []Peer{peer1, peer2}, kl)
+	for _, peer := range diff.Peers {
+		if peer.Name == "peer1" {
+			assert.Equal([]FieldDiff{{"allowed_ips", "10.6.6.2/32, 10.6.6.3/32", "10.6.6.2/32"}}, peer.Fields)
+		}
+	}
+}
+
+func TestCanonicalIPNet(t *testing.T) {
+	assert := assert.New(t)
+
+	ip, _ := ParseIPNet("10.6.6.1/24")
+	assert.Equal("10.6.6.0/24", canonicalIPNet(ip.IPNet))
+
+	ip, _ = ParseIPNet("2001:0000::1/32")
+	assert.Equal("2001::/32", canonicalIPNet(ip.IPNet))
+}
@@ -0,0 +1,597 @@
+package dswg
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Protocol of the routes dswg adds, so they can be told apart from
+// routes added by others, ex. `ip route show proto 116`.
+// Values up to 255 are free for routing daemons, see /etc/iproute2/rt_protos.
+const RouteProtocol = 116
+
+// Values of Link.Table besides routing table numbers.
+const (
+	// Routes allowed IPs in the main table, except default routes which
+	// are policy routed like wg-quick(8) does, see policyRules.
+	TableAuto = "auto"
+	// Leaves routing to the user, ex. in PostUp commands.
+	TableOff = "off"
+)
+
+// First routing table and fwmark picked for links with Table auto and no
+// FirewallMark, the same as wg-quick(8), see pickLinkMark.
+const DefaultPolicyTable = 51820
+
+// Priority of the first policy routing rule of a link when its
+// RulePriority is 0, the second rule gets the next priority. These are
+// the priorities wg-quick(8) rules get on a host without other rules.
+const DefaultRulePriority = 32764
+
+const (
+	// Routing table used by routes that don't name one.
+	mainRouteTable = syscall.RT_TABLE_MAIN
+	// Priority of the rule looking up the main table.
+	mainRulePriority = 32766
+)
+
+// A destination routed through a link, in a routing table.
+type linkRoute struct {
+	dst   net.IPNet
+	table int
+}
+
+// Formats the route the way ip-route(8) does, the main table is implied.
+func (r linkRoute) String() string {
+	str := canonicalIPNet(r.dst)
+	if r.table != mainRouteTable {
+		str += " table " + strconv.Itoa(r.table)
+	}
+	return str
+}
+
+func parseLinkRoute(str string) (linkRoute, error) {
+	route := linkRoute{table: mainRouteTable}
+	fields := strings.Fields(str)
+	switch {
+	case len(fields) == 3 && fields[1] == "table":
+		table, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return route, err
+		}
+		route.table = table
+	case len(fields) != 1:
+		return route, fmt.Errorf("Invalid route %v", str)
+	}
+
+	dst, err := ParseIPNet(fields[0])
+	if err != nil {
+		return route, err
+	}
+	route.dst = dst.IPNet
+	return route, nil
+}
+
+func formatRoutes(routes []linkRoute) string {
+	strs := make([]string, len(routes))
+	for i, route := range routes {
+		strs[i] = route.String()
+	}
+	sort.Strings(strs)
+	return strings.Join(strs, ", ")
+}
+
+// Returns the routes of a that are not in b.
+func missingRoutes(a, b []linkRoute) []linkRoute {
+	present := make(map[string]bool)
+	for _, route := range b {
+		present[route.String()] = true
+	}
+
+	var missing []linkRoute
+	for _, route := range a {
+		if !present[route.String()] {
+			missing = append(missing, route)
+		}
+	}
+	return missing
+}
+
+// Returns the routing table number of a Link.Table value, 0 for off and
+// -1 for auto.
+func parseTable(table string) (int, error) {
+	switch table {
+	case "", TableAuto:
+		return -1, nil
+	case TableOff:
+		return 0, nil
+	}
+
+	number, err := strconv.ParseUint(table, 10, 32)
+	if err != nil || number == 0 {
+		return 0, fmt.Errorf("Link table must be %v, %v or a routing table number, got %q",
+			TableAuto, TableOff, table)
+	}
+	return int(number), nil
+}
+
+// Indicates whether the fwmark of the link is picked by dswg: links with
+// Table auto and no FirewallMark get a free table as fwmark while they
+// route default routes, and none otherwise.
+func autoMarked(link Link) bool {
+	table, _ := parseTable(link.Table)
+	return table < 0 && link.FirewallMark == 0
+}
+
+func isDefaultRoute(dst net.IPNet) bool {
+	ones, _ := dst.Mask.Size()
+	return ones == 0
+}
+
+// Indicates whether an enabled peer routes a default route.
+func routesDefault(peers []Peer) bool {
+	for _, peer := range peers {
+		if !peer.Enable {
+			continue
+		}
+		for _, ip := range peerAllowedIPs(peer) {
+			if isDefaultRoute(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the routing table the destination is routed in through the
+// link, 0 if it is not routed. Default routes of links with Table auto
+// go in the table of the link fwmark, see markedLink.
+func routeTable(link Link, dst net.IPNet) int {
+	table, _ := parseTable(link.Table)
+	if table >= 0 {
+		return table
+	}
+
+	if isDefaultRoute(dst) {
+		return link.FirewallMark
+	}
+	return mainRouteTable
+}
+
+// Returns the link with the fwmark dswg picked for it filled in, read from
+// the kernel link named name.
+func (c *Client) markedLink(name string, link Link) (Link, error) {
+	if !autoMarked(link) {
+		return link, nil
+	}
+
+	device, err := c.wg.Device(name)
+	if err != nil {
+		return link, err
+	}
+	link.FirewallMark = device.FirewallMark
+	return link, nil
+}
+
+// Gives the kernel link named name a free table as fwmark, unless it has
+// one already.
+func (c *Client) pickLinkMark(name string) error {
+	device, err := c.wg.Device(name)
+	if err != nil || device.FirewallMark != 0 {
+		return err
+	}
+
+	mark, err := c.freePolicyTable()
+	if err != nil {
+		return err
+	}
+	return c.setLinkMark(name, mark)
+}
+
+func (c *Client) setLinkMark(name string, mark int) error {
+	return c.wg.ConfigureDevice(name, wgtypes.Config{FirewallMark: &mark})
+}
+
+// Returns the first table from DefaultPolicyTable without routes, like
+// wg-quick(8) does, that no wireguard link uses as fwmark either, since
+// the tables of links that are down are empty.
+func (c *Client) freePolicyTable() (int, error) {
+	used := make(map[int]bool)
+
+	// Filtering on table 0 lists every table
+	routes, err := c.ns.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return 0, err
+	}
+	for _, route := range routes {
+		used[route.Table] = true
+	}
+
+	netInterfaces, err := c.ns.LinkList()
+	if err != nil {
+		return 0, err
+	}
+	for _, netInterface := range netInterfaces {
+		if netInterface.Type() != "wireguard" {
+			continue
+		}
+		device, err := c.wg.Device(netInterface.Attrs().Name)
+		if err != nil {
+			return 0, err
+		}
+		used[device.FirewallMark] = true
+	}
+
+	table := DefaultPolicyTable
+	for used[table] {
+		table++
+	}
+	return table, nil
+}
+
+// Returns the link with the fwmark diffLink compares with the kernel link
+// kl, nil if it is not loaded: the fwmark addRoutes picks for the default
+// routes of the link, or none if it routes none. Links that are down keep
+// their fwmark, since the kernel flushed their routes.
+func (c *Client) plannedLink(link Link, peers []Peer, kl *kernelLink) (Link, error) {
+	if !autoMarked(link) {
+		return link, nil
+	}
+
+	switch {
+	case kl != nil && !link.Enable:
+		link.FirewallMark = kl.device.FirewallMark
+	case !routesDefault(peers):
+	case kl != nil && kl.device.FirewallMark != 0:
+		link.FirewallMark = kl.device.FirewallMark
+	default:
+		mark, err := c.freePolicyTable()
+		if err != nil {
+			return link, err
+		}
+		link.FirewallMark = mark
+	}
+	return link, nil
+}
+
+// Returns the routes of the peer allowed IPs through the link.
+func peerRoutes(link Link, peer Peer) []linkRoute {
+	var routes []linkRoute
+	for _, ip := range peerAllowedIPs(peer) {
+		if table := routeTable(link, ip); table != 0 {
+			routes = append(routes, linkRoute{dst: ip, table: table})
+		}
+	}
+	return routes
+}
+
+// Routes the given destinations through the link, in the tables picked by
+// Link.Table. Existing routes to them are replaced, so routing a
+// destination twice is not an error.
+func (c *Client) addRoutes(netInterface netlink.Link, link Link, dsts []net.IPNet) error {
+	marked, err := c.routedLink(netInterface, link, dsts)
+	if err != nil {
+		return err
+	}
+
+	for _, ip := range dsts {
+		table := routeTable(marked, ip)
+		if table == 0 {
+			continue
+		}
+
+		route := &netlink.Route{
+			LinkIndex: netInterface.Attrs().Index,
+			Scope:     netlink.SCOPE_LINK,
+			Dst:       &ip,
+			Protocol:  RouteProtocol,
+			Table:     table,
+		}
+
+		err := c.ns.RouteReplace(route)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.syncRules(netInterface, link)
+}
+
+// Returns the link with the fwmark its routes to the given destinations
+// use, picking one if they include a default route.
+func (c *Client) routedLink(netInterface netlink.Link, link Link, dsts []net.IPNet) (Link, error) {
+	name := netInterface.Attrs().Name
+	if autoMarked(link) {
+		for _, ip := range dsts {
+			if !isDefaultRoute(ip) {
+				continue
+			}
+			err := c.pickLinkMark(name)
+			if err != nil {
+				return link, err
+			}
+			break
+		}
+	}
+
+	return c.markedLink(name, link)
+}
+
+// Deletes the routes dswg added to the link for the given destinations,
+// in any table. Destinations that aren't routed, or routed by others,
+// are skipped.
+func (c *Client) removeRoutes(netInterface netlink.Link, link Link, dsts []net.IPNet) error {
+	remove := make(map[string]bool)
+	for _, ip := range dsts {
+		remove[canonicalIPNet(ip)] = true
+	}
+
+	return c.removeRoutesFunc(netInterface, link, func(route linkRoute) bool {
+		return remove[canonicalIPNet(route.dst)]
+	})
+}
+
+// Deletes the routes dswg added to the link that match.
+func (c *Client) removeRoutesFunc(netInterface netlink.Link, link Link, match func(linkRoute) bool) error {
+	routes, err := c.ownedRoutes(netInterface)
+	if err != nil {
+		return err
+	}
+
+	for _, route := range routes {
+		if !match(linkRoute{dst: *route.Dst, table: route.Table}) {
+			continue
+		}
+
+		err := c.ns.RouteDel(&route)
+		if err != nil && err != syscall.ESRCH {
+			return err
+		}
+	}
+
+	return c.syncRules(netInterface, link)
+}
+
+// Lists the routes of the link in every table.
+func (c *Client) linkRoutes(netInterface netlink.Link) ([]netlink.Route, error) {
+	filter := &netlink.Route{LinkIndex: netInterface.Attrs().Index}
+	return c.ns.RouteListFiltered(netlink.FAMILY_ALL, filter,
+		netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE)
+}
+
+// Lists the routes dswg added to the link.
+func (c *Client) ownedRoutes(netInterface netlink.Link) ([]netlink.Route, error) {
+	routeList, err := c.linkRoutes(netInterface)
+	if err != nil {
+		return nil, err
+	}
+
+	var routes []netlink.Route
+	for _, route := range routeList {
+		if route.Protocol == RouteProtocol && route.Dst != nil {
+			routes = append(routes, route)
+		}
+	}
+	return routes, nil
+}
+
+// Routes the allowed IPs of the enabled peers of the link, ex. after the
+// link was brought down and the kernel flushed its routes.
+func (c *Client) routeLinkPeers(link Link, peers []Peer) error {
+	netInterface, err := c.ns.LinkByName(link.Name)
+	if err != nil {
+		return err
+	}
+
+	var dsts []net.IPNet
+	for _, peer := range peers {
+		if peer.Enable {
+			dsts = append(dsts, peerAllowedIPs(peer)...)
+		}
+	}
+
+	return c.addRoutes(netInterface, link, dsts)
+}
+
+// Policy routing rules of a link with Table auto, for the given address
+// family. Like wg-quick(8), traffic not marked by the link goes to the
+// link table, which holds the default routes, unless a route more
+// specific than a default route in the main table matches:
+//
+//	32764: from all lookup main suppress_prefixlength 0
+//	32765: not from all fwmark 0xca6c lookup 51820
+func policyRules(link Link, family int) []netlink.Rule {
+	priority := link.RulePriority
+	if priority == 0 {
+		priority = DefaultRulePriority
+	}
+	mark := link.FirewallMark
+
+	suppress := netlink.NewRule()
+	suppress.Family = family
+	suppress.Priority = priority
+	suppress.Table = mainRouteTable
+	suppress.SuppressPrefixlen = 0
+
+	unmarked := netlink.NewRule()
+	unmarked.Family = family
+	unmarked.Priority = priority + 1
+	unmarked.Table = mark
+	unmarked.Mark = mark
+	unmarked.Invert = true
+
+	return []netlink.Rule{*suppress, *unmarked}
+}
+
+// Adds the policy routing rules of the link for the address families it
+// routes default routes of in the link table, and deletes the others.
+// The fwmark dswg picked for the link is dropped once it routes no
+// default routes.
+func (c *Client) syncRules(netInterface netlink.Link, link Link) error {
+	name := netInterface.Attrs().Name
+	marked, err := c.markedLink(name, link)
+	if err != nil {
+		return err
+	}
+	mark := marked.FirewallMark
+
+	wanted := make(map[int]bool)
+	if table, _ := parseTable(link.Table); table < 0 && mark != 0 {
+		routes, err := c.ownedRoutes(netInterface)
+		if err != nil {
+			return err
+		}
+
+		for _, route := range routes {
+			if isDefaultRoute(*route.Dst) && route.Table == mark {
+				wanted[routeFamily(route.Dst.IP)] = true
+			}
+		}
+	}
+
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		var err error
+		if wanted[family] {
+			err = c.addRules(policyRules(marked, family))
+		} else {
+			err = c.deleteMarkRules(family, mark)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// Links that are down had their routes flushed by the kernel, and
+	// route them again in the same table once up
+	if autoMarked(link) && mark != 0 && len(wanted) == 0 && c.isUp(name) {
+		return c.setLinkMark(name, 0)
+	}
+	return nil
+}
+
+// Deletes the policy routing rules of the link.
+func (c *Client) removeRules(link Link) error {
+	marked, err := c.markedLink(link.Name, link)
+	if err != nil {
+		return err
+	}
+	return c.removeMarkRules(marked.FirewallMark)
+}
+
+// Deletes the policy routing rules keyed on the fwmark, in both families.
+func (c *Client) removeMarkRules(mark int) error {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		err := c.deleteMarkRules(family, mark)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds the rules that don't exist yet.
+func (c *Client) addRules(rules []netlink.Rule) error {
+	for _, rule := range rules {
+		existing, err := c.hasRule(rule)
+		if err != nil {
+			return err
+		}
+		if existing {
+			continue
+		}
+
+		err = c.ns.RuleAdd(&rule)
+		if err != nil && err != syscall.EEXIST {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletes the rules policyRules made for the fwmark, whatever priority
+// they were given. The rule looking up the main table is kept while other
+// links with the same priority need it.
+func (c *Client) deleteMarkRules(family, mark int) error {
+	if mark == 0 {
+		return nil
+	}
+
+	rules, err := c.ns.RuleList(family)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		if !rule.Invert || rule.Mark != mark || rule.Table != mark {
+			continue
+		}
+
+		link := Link{FirewallMark: mark, RulePriority: rule.Priority - 1}
+		owned := policyRules(link, family)
+		if sharedSuppressRule(rules, rule) {
+			owned = owned[1:]
+		}
+		for _, r := range owned {
+			existing, err := c.hasRule(r)
+			if err != nil {
+				return err
+			}
+			if !existing {
+				continue
+			}
+
+			err = c.ns.RuleDel(&r)
+			if err != nil && err != syscall.ENOENT {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Indicates whether the rule of another fwmark follows the same rule
+// looking up the main table as the given fwmark rule.
+func sharedSuppressRule(rules []netlink.Rule, markRule netlink.Rule) bool {
+	for _, rule := range rules {
+		if rule.Invert && rule.Priority == markRule.Priority && rule.Mark != markRule.Mark {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) hasRule(rule netlink.Rule) (bool, error) {
+	rules, err := c.ns.RuleList(rule.Family)
+	if err != nil {
+		return false, err
+	}
+
+	for _, r := range rules {
+		if sameRule(r, rule) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Compares the rule fields set by policyRules. Families are not
+// compared, since netlink doesn't report them.
+func sameRule(a, b netlink.Rule) bool {
+	return a.Priority == b.Priority && a.Table == b.Table &&
+		a.Mark == b.Mark && a.Invert == b.Invert &&
+		a.SuppressPrefixlen == b.SuppressPrefixlen
+}
+
+func routeFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}
@@ -0,0 +1,585 @@
+package dswg
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Returns the routes of the link in every table, mapping them to their
+// protocols.
+func kernelRoutes(client Client, name string) map[string]int {
+	netInterface, _ := client.ns.LinkByName(name)
+	routes, _ := client.linkRoutes(netInterface)
+	protocols := make(map[string]int)
+	for _, route := range routes {
+		protocols[linkRoute{*route.Dst, route.Table}.String()] = route.Protocol
+	}
+	return protocols
+}
+
+func routedPeer() Peer {
+	peer := basePeer()
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	peer.AllowedIPs = []IPNet{*addr}
+	return peer
+}
+
+func TestClientReactivatePeer(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer := routedPeer()
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+	assert.Equal(map[string]int{"10.6.6.2/32": RouteProtocol}, kernelRoutes(client, testlink.Name))
+
+	// Activating an active peer replaces its routes
+	err = client.ActivatePeer(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+
+	err = client.DeactivatePeer(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Len(kernelRoutes(client, testlink.Name), 0)
+
+	err = client.ActivatePeer(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Equal(map[string]int{"10.6.6.2/32": RouteProtocol}, kernelRoutes(client, testlink.Name))
+}
+
+func TestClientRemovePeerRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer := routedPeer()
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	// Routes added by others are left alone
+	netInterface, _ := client.ns.LinkByName(testlink.Name)
+	dst, _ := ParseIPNet("10.9.9.0/24")
+	client.ns.RouteAdd(&netlink.Route{LinkIndex: netInterface.Attrs().Index, Dst: &dst.IPNet})
+
+	err = client.RemovePeer(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Equal(map[string]int{"10.9.9.0/24": 0}, kernelRoutes(client, testlink.Name))
+}
+
+func TestClientUpdatePeerRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer := routedPeer()
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	addr, _ := ParseIPNet("10.6.6.3/32")
+	testpeer.AllowedIPs = []IPNet{*addr}
+	err = client.UpdatePeer(testlink.Name, testpeer.Name, testpeer)
+	assert.Nil(err)
+	assert.Equal(map[string]int{"10.6.6.3/32": RouteProtocol}, kernelRoutes(client, testlink.Name))
+}
+
+func TestClientUpdateLinkKeepsRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	err = client.AddPeer(testlink.Name, routedPeer())
+	assert.Nil(err)
+
+	testlink.MTU = 1400
+	err = client.UpdateLink(testlink.Name, testlink)
+	assert.Nil(err)
+	assert.Equal(map[string]int{"10.6.6.2/32": RouteProtocol}, kernelRoutes(client, testlink.Name))
+}
+
+func TestClientReconcileStaleRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer := routedPeer()
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	// The peer is disabled behind the back of the client
+	testpeer.Enable = false
+	client.db.UpdatePeer(testlink.Name, testpeer.Name, testpeer)
+
+	plan, err := client.Plan()
+	assert.Nil(err)
+	assert.Contains(plan.String(), "netlink RouteDel wg-linko 10.6.6.2/32")
+
+	_, err = client.Reconcile(context.Background(), ReconcileOptions{})
+	assert.Nil(err)
+	assert.Len(kernelRoutes(client, testlink.Name), 0)
+
+	plan, err = client.Plan()
+	assert.Nil(err)
+	assert.True(plan.Empty(), plan.String())
+}
+
+func TestParseTable(t *testing.T) {
+	assert := assert.New(t)
+
+	for table, number := range map[string]int{"": -1, "auto": -1, "off": 0, "100": 100} {
+		parsed, err := parseTable(table)
+		assert.Nil(err)
+		assert.Equal(number, parsed)
+	}
+
+	for _, table := range []string{"0", "-1", "main", "4294967296"} {
+		_, err := parseTable(table)
+		assert.NotNil(err, table)
+	}
+}
+
+func TestParseLinkRoute(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, str := range []string{"10.6.6.0/24", "0.0.0.0/0 table 51820", "::/0 table 100"} {
+		route, err := parseLinkRoute(str)
+		assert.Nil(err)
+		assert.Equal(str, route.String())
+	}
+
+	_, err := parseLinkRoute("10.6.6.0/24 via 10.0.0.1")
+	assert.NotNil(err)
+}
+
+// Returns a link without fwmark and a peer routing everything through it.
+func fullTunnel() (Link, Peer) {
+	link := baseLink()
+	link.FirewallMark = 0
+
+	peer := basePeer()
+	addr1, _ := ParseIPNet("10.6.6.2/32")
+	addr2, _ := ParseIPNet("0.0.0.0/0")
+	peer.AllowedIPs = []IPNet{*addr1, *addr2}
+	return link, peer
+}
+
+func TestClientTableAuto(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink, testpeer := fullTunnel()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	// The fwmark is only picked with the first default route
+	device, _ := client.wg.Device(testlink.Name)
+	assert.Equal(0, device.FirewallMark)
+
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+	assert.Equal(map[string]int{
+		"10.6.6.2/32":           RouteProtocol,
+		"0.0.0.0/0 table 51820": RouteProtocol,
+	}, kernelRoutes(client, testlink.Name))
+	device, _ = client.wg.Device(testlink.Name)
+	assert.Equal(DefaultPolicyTable, device.FirewallMark)
+
+	rules, _ := client.ns.RuleList(netlink.FAMILY_V4)
+	assert.Len(rules, 2)
+	marked := testlink
+	marked.FirewallMark = DefaultPolicyTable
+	for _, rule := range policyRules(marked, netlink.FAMILY_V4) {
+		assert.Contains(rules, rule)
+	}
+	rules, _ = client.ns.RuleList(netlink.FAMILY_V6)
+	assert.Len(rules, 0)
+
+	plan, err := client.Plan()
+	assert.Nil(err)
+	assert.True(plan.Empty(), plan.String())
+
+	// Rules and the fwmark go away with the last default route
+	err = client.DeactivatePeer(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Len(kernelRoutes(client, testlink.Name), 0)
+	rules, _ = client.ns.RuleList(netlink.FAMILY_ALL)
+	assert.Len(rules, 0)
+	device, _ = client.wg.Device(testlink.Name)
+	assert.Equal(0, device.FirewallMark)
+
+	plan, err = client.Plan()
+	assert.Nil(err)
+	assert.True(plan.Empty(), plan.String())
+}
+
+func TestClientTableAutoTwoLinks(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	link1, peer1 := fullTunnel()
+	err := client.AddLink(link1)
+	assert.Nil(err)
+	err = client.AddPeer(link1.Name, peer1)
+	assert.Nil(err)
+
+	link2, peer2 := fullTunnel()
+	link2.Name = "wg-linko2"
+	link2.ListenPort++
+	addr, _ := ParseIPNet("10.7.7.1/24")
+	link2.AddressIPv4 = addr
+	link2.AddressIPv6 = nil
+	key, _ := wgtypes.GeneratePrivateKey()
+	peer2.PublicKey = Key{key.PublicKey()}
+	addr1, _ := ParseIPNet("10.7.7.2/32")
+	addr2, _ := ParseIPNet("0.0.0.0/0")
+	peer2.AllowedIPs = []IPNet{*addr1, *addr2}
+	err = client.AddLink(link2)
+	assert.Nil(err)
+	err = client.AddPeer(link2.Name, peer2)
+	assert.Nil(err)
+
+	// Each link routes its default route in its own table
+	device1, _ := client.wg.Device(link1.Name)
+	device2, _ := client.wg.Device(link2.Name)
+	assert.Equal(DefaultPolicyTable, device1.FirewallMark)
+	assert.Equal(DefaultPolicyTable+1, device2.FirewallMark)
+	assert.Equal(map[string]int{
+		"10.6.6.2/32":           RouteProtocol,
+		"0.0.0.0/0 table 51820": RouteProtocol,
+	}, kernelRoutes(client, link1.Name))
+	assert.Equal(map[string]int{
+		"10.7.7.2/32":           RouteProtocol,
+		"0.0.0.0/0 table 51821": RouteProtocol,
+	}, kernelRoutes(client, link2.Name))
+
+	plan, err := client.Plan()
+	assert.Nil(err)
+	assert.True(plan.Empty(), plan.String())
+
+	// Deactivating a link leaves the rules of the other one
+	err = client.DeactivateLink(link1.Name)
+	assert.Nil(err)
+	rules, _ := client.ns.RuleList(netlink.FAMILY_V4)
+	assert.Len(rules, 2)
+	for _, rule := range rules {
+		assert.NotEqual(DefaultPolicyTable, rule.Mark)
+	}
+	assert.Equal(map[string]int{
+		"10.7.7.2/32":           RouteProtocol,
+		"0.0.0.0/0 table 51821": RouteProtocol,
+	}, kernelRoutes(client, link2.Name))
+
+	// The down link keeps its table
+	err = client.ActivateLink(link1.Name)
+	assert.Nil(err)
+	assert.Equal(map[string]int{
+		"10.6.6.2/32":           RouteProtocol,
+		"0.0.0.0/0 table 51820": RouteProtocol,
+	}, kernelRoutes(client, link1.Name))
+	// Both links share the rule looking up the main table
+	rules, _ = client.ns.RuleList(netlink.FAMILY_V4)
+	assert.Len(rules, 3)
+
+	err = client.RemoveLink(link2.Name)
+	assert.Nil(err)
+	rules, _ = client.ns.RuleList(netlink.FAMILY_V4)
+	assert.Len(rules, 2)
+	marked := link1
+	marked.FirewallMark = DefaultPolicyTable
+	for _, rule := range policyRules(marked, netlink.FAMILY_V4) {
+		assert.Contains(rules, rule)
+	}
+
+	plan, err = client.Plan()
+	assert.Nil(err)
+	assert.True(plan.Empty(), plan.String())
+}
+
+func TestClientTableAutoNoDefaultRoute(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink, testpeer := fullTunnel()
+	testpeer.AllowedIPs = testpeer.AllowedIPs[:1]
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	device, _ := client.wg.Device(testlink.Name)
+	assert.Equal(0, device.FirewallMark)
+	rules, _ := client.ns.RuleList(netlink.FAMILY_ALL)
+	assert.Len(rules, 0)
+
+	plan, err := client.Plan()
+	assert.Nil(err)
+	assert.True(plan.Empty(), plan.String())
+}
+
+func TestClientTableNumber(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink, testpeer := fullTunnel()
+	testlink.Table = "100"
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+	assert.Equal(map[string]int{
+		"10.6.6.2/32 table 100": RouteProtocol,
+		"0.0.0.0/0 table 100":   RouteProtocol,
+	}, kernelRoutes(client, testlink.Name))
+
+	// The fwmark is left alone and routing the table is up to the user
+	device, _ := client.wg.Device(testlink.Name)
+	assert.Equal(0, device.FirewallMark)
+	rules, _ := client.ns.RuleList(netlink.FAMILY_ALL)
+	assert.Len(rules, 0)
+}
+
+func TestClientTableOff(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink, testpeer := fullTunnel()
+	testlink.Table = TableOff
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+	assert.Len(kernelRoutes(client, testlink.Name), 0)
+
+	plan, err := client.Plan()
+	assert.Nil(err)
+	assert.True(plan.Empty(), plan.String())
+}
+
+func TestClientDeactivateLinkRules(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink, testpeer := fullTunnel()
+	testlink.RulePriority = 1000
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	rules, _ := client.ns.RuleList(netlink.FAMILY_V4)
+	priorities := make([]int, len(rules))
+	for i, rule := range rules {
+		priorities[i] = rule.Priority
+	}
+	assert.ElementsMatch([]int{1000, 1001}, priorities)
+
+	err = client.DeactivateLink(testlink.Name)
+	assert.Nil(err)
+	assert.Len(kernelRoutes(client, testlink.Name), 0)
+	rules, _ = client.ns.RuleList(netlink.FAMILY_ALL)
+	assert.Len(rules, 0)
+
+	err = client.ActivateLink(testlink.Name)
+	assert.Nil(err)
+	rules, _ = client.ns.RuleList(netlink.FAMILY_ALL)
+	assert.Len(rules, 2)
+
+	err = client.RemoveLink(testlink.Name)
+	assert.Nil(err)
+	rules, _ = client.ns.RuleList(netlink.FAMILY_ALL)
+	assert.Len(rules, 0)
+}
+
+func TestClientUpdateLinkTable(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink, testpeer := fullTunnel()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	testlink.Table = "100"
+	err = client.UpdateLink(testlink.Name, testlink)
+	assert.Nil(err)
+	assert.Equal(map[string]int{
+		"10.6.6.2/32 table 100": RouteProtocol,
+		"0.0.0.0/0 table 100":   RouteProtocol,
+	}, kernelRoutes(client, testlink.Name))
+	rules, _ := client.ns.RuleList(netlink.FAMILY_ALL)
+	assert.Len(rules, 0)
+}
+
+func TestClientReconcileTable(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink, testpeer := fullTunnel()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	// The table is changed behind the back of the client
+	testlink.Table = "100"
+	client.db.UpdateLink(testlink.Name, testlink)
+
+	plan, err := client.Plan()
+	assert.Nil(err)
+	text := plan.String()
+	assert.Contains(text, "netlink RouteReplace wg-linko 0.0.0.0/0 table 100")
+	assert.Contains(text, "netlink RouteDel wg-linko 0.0.0.0/0 table 51820")
+
+	_, err = client.Reconcile(context.Background(), ReconcileOptions{})
+	assert.Nil(err)
+	assert.Equal(map[string]int{
+		"10.6.6.2/32 table 100": RouteProtocol,
+		"0.0.0.0/0 table 100":   RouteProtocol,
+	}, kernelRoutes(client, testlink.Name))
+	rules, _ := client.ns.RuleList(netlink.FAMILY_ALL)
+	assert.Len(rules, 0)
+}
+
+func TestClientReconcileRules(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink, testpeer := fullTunnel()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	// The rules are deleted behind the back of the client
+	marked := testlink
+	marked.FirewallMark = DefaultPolicyTable
+	for _, rule := range policyRules(marked, netlink.FAMILY_V4) {
+		err := client.ns.RuleDel(&rule)
+		assert.Nil(err)
+	}
+
+	plan, err := client.Plan()
+	assert.Nil(err)
+	assert.Equal([]FieldDiff{{"rules", "", "ipv4"}}, plan.Links[0].Fields)
+	assert.Contains(plan.String(), "netlink RuleAdd wg-linko ipv4")
+
+	_, err = client.Reconcile(context.Background(), ReconcileOptions{})
+	assert.Nil(err)
+	rules, _ := client.ns.RuleList(netlink.FAMILY_V4)
+	assert.Len(rules, 2)
+	for _, rule := range policyRules(marked, netlink.FAMILY_V4) {
+		assert.Contains(rules, rule)
+	}
+
+	plan, err = client.Plan()
+	assert.Nil(err)
+	assert.True(plan.Empty(), plan.String())
+}
+
+func TestValidLinkTable(t *testing.T) {
+	assert := assert.New(t)
+
+	testlink := baseLink()
+	testlink.Table = "main"
+	assert.NotNil(validLink(testlink))
+
+	testlink.Table = "100"
+	testlink.RulePriority = mainRulePriority - 1
+	assert.NotNil(validLink(testlink))
+
+	testlink.RulePriority = mainRulePriority - 2
+	assert.Nil(validLink(testlink))
+}
+
+func TestPolicyRulesKernel(t *testing.T) {
+	assert := assert.New(t)
+
+	ns := setupNamespace(t)
+	defer ns.Close()
+
+	handle, err := netlink.NewHandleAt(ns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kernel := NewFakeKernel()
+	client, _ := NewClientWithBackends(setupDB(), handle, kernel)
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.RulePriority = 1000
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		rules := policyRules(testlink, family)
+		err = client.addRules(rules)
+		assert.Nil(err)
+		err = client.addRules(rules)
+		assert.Nil(err)
+
+		for _, rule := range rules {
+			existing, err := client.hasRule(rule)
+			assert.Nil(err)
+			assert.True(existing)
+		}
+	}
+
+	err = client.removeRules(testlink)
+	assert.Nil(err)
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		for _, rule := range policyRules(testlink, family) {
+			existing, _ := client.hasRule(rule)
+			assert.False(existing)
+		}
+	}
+}
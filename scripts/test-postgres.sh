@@ -0,0 +1,44 @@
+#!/bin/bash
+
+# Runs the tests against a throwaway PostgreSQL server, so the postgres
+# tests run instead of being skipped (see postgres_test.go). Arguments are
+# passed to `go test`, ex. `scripts/test-postgres.sh -v -p=1`.
+# Needs the PostgreSQL server binaries and the btree_gist extension,
+# ex. `apt-get install postgresql postgresql-contrib`.
+
+set -e
+
+DIR="$( cd "$( dirname "${BASH_SOURCE[0]}" )" >/dev/null 2>&1 && pwd )"
+PORT=${DSWG_TEST_POSTGRES_PORT:-55432}
+GO=${GO:-go}
+
+BINDIR=$(pg_config --bindir 2>/dev/null || true)
+if [ ! -x "$BINDIR/initdb" ]; then
+    BINDIR=$(ls -d /usr/lib/postgresql/*/bin 2>/dev/null | sort -V | tail -n 1)
+fi
+if [ ! -x "$BINDIR/initdb" ]; then
+    echo "PostgreSQL server binaries not found" >&2
+    exit 1
+fi
+
+# The server refuses to run as root, the tests need root for the kernel
+DATA=$(mktemp -d)
+RUNAS=()
+if [ "$(id -u)" = 0 ]; then
+    chown postgres "$DATA"
+    RUNAS=(sudo -u postgres)
+fi
+
+stop() {
+    "${RUNAS[@]}" "$BINDIR/pg_ctl" -D "$DATA" -m immediate stop >/dev/null 2>&1 || true
+    rm -rf "$DATA"
+}
+trap stop EXIT
+
+"${RUNAS[@]}" "$BINDIR/initdb" -D "$DATA" -U dswg --auth=trust >/dev/null
+"${RUNAS[@]}" "$BINDIR/pg_ctl" -D "$DATA" -w -l "$DATA/server.log" \
+    -o "-p $PORT -k $DATA -c listen_addresses=localhost" start >/dev/null
+"$BINDIR/createdb" -h localhost -p "$PORT" -U dswg dswg_test
+
+cd "$DIR/.."
+DSWG_TEST_POSTGRES="postgres://dswg@localhost:$PORT/dswg_test?sslmode=disable" "$GO" test "$@" ./...
@@ -3,3 +3,6 @@
 sudo apt-get -y update
 sudo apt-get -y install golang
 sudo apt-get -y install wireguard
+
+# Server of the postgres tests, started by test-postgres.sh
+sudo apt-get -y install postgresql postgresql-contrib
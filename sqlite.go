@@ -2,19 +2,55 @@ package dswg
 
 import (
 	"fmt"
+	"io"
 	"strings"
 	"database/sql"
 	"github.com/jmoiron/sqlx"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
+// The configs table holds a single row under this name.
+const sqliteConfigName = "default"
+
 type sqliteDB struct {
-	conn *sqlx.DB
+	conn   *sqlx.DB
+	tx     *sqlx.Tx   // set in DB.Transaction
+	keys   *dbKeys    // shared by the copies of the database
+	actor  string     // of the changes recorded in the audit log
+}
+
+// Returns the transaction of the database if it is in one, and its
+// connection otherwise.
+func (db *sqliteDB) ext() sqlx.Ext {
+	if db.tx != nil {
+		return db.tx
+	}
+	return db.conn
+}
+
+func (db *sqliteDB) begin() (dbTx, error) {
+	return beginTx(db.conn, db.tx)
 }
 
 func (db *sqliteDB) AddLink(link Link) error {
-	tx, err := db.conn.Beginx()
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+
+	cipher, err := db.keys.load(tx)
 	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	stored, err := cipher.sealLink(link, 0)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
 		return err
 	}
 
@@ -27,13 +63,15 @@ func (db *sqliteDB) AddLink(link Link) error {
 			name, enable, mtu, private_key,
 			port, fwmark, ipv4_cidr, ipv6_cidr,
 			default_dns1, default_dns2,
-			forward, postup, postdown
+			host, forward, namespace, route_table, rule_priority,
+			postup, postdown
 		) VALUES (
-			:name, :enable, :mtu, :private_key,
+			:name, :enable, :mtu, :stored_private_key,
 			:port, :fwmark, :ipv4_cidr, :ipv6_cidr,
 			:default_dns1, :default_dns2,
-			:forward, ?, ?)`
-	query, args, err := sqlx.Named(insertLinkStmt, &link)
+			:host, :forward, :namespace, :route_table, :rule_priority,
+			?, ?)`
+	query, args, err := sqlx.Named(insertLinkStmt, stored)
 	if err != nil {
 		return err
 	}
@@ -44,11 +82,22 @@ func (db *sqliteDB) AddLink(link Link) error {
 		if rollbackErr := tx.Rollback(); rollbackErr != nil {
 			return rollbackErr
 		}
-		return err
+		return sqliteError(err)
 	}
 
 	linkID, err := getLinkID(link.Name, tx)
 	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	err = cipher.sealInsertedLink(tx, link, linkID)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
 		return err
 	}
 
@@ -61,103 +110,324 @@ func (db *sqliteDB) AddLink(link Link) error {
 			if rollbackErr := tx.Rollback(); rollbackErr != nil {
 				return rollbackErr
 			}
-			return err
+			return sqliteError(err)
 		}
 	}
 
+	err = writeAudit(tx, db.actor, "AddLink", link.Name, "", nil, link)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
 	return tx.Commit()
 }
 
-func (db *sqliteDB) GetLink(name string) (*Link, error) {
-	const selectStmt = `
-		SELECT
-			name, enable, mtu, private_key, port,
-			fwmark, ipv4_cidr, ipv6_cidr, default_dns1,
-			default_dns2, forward, postup, postdown
-		FROM links
-		WHERE name = ?`
-	row := db.conn.QueryRow(selectStmt, name)
-	
+// Columns of links read by scanLink.
+const linkColumns = `
+	id, name, enable, mtu, private_key, port,
+	fwmark, ipv4_cidr, ipv6_cidr, default_dns1,
+	default_dns2, host, forward, namespace,
+	route_table, rule_priority, postup, postdown`
+
+// A *sql.Row or *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Scans the linkColumns of a row, returning the link with its ID.
+// Default allowed IPs are not part of the row.
+func (c *keyCipher) scanLink(row rowScanner) (int64, *Link, error) {
+	var id int64
 	var link Link
+	var privateKey sql.NullString
 	var postup, postdown string
 	err := row.Scan(
+		&id,
 		&link.Name,
 		&link.Enable,
 		&link.MTU,
-		&link.PrivateKey,
+		&privateKey,
 		&link.ListenPort,
 		&link.FirewallMark,
 		&link.AddressIPv4,
 		&link.AddressIPv6,
 		&link.DefaultDNS1,
 		&link.DefaultDNS2,
+		&link.Host,
 		&link.Forward,
+		&link.Namespace,
+		&link.Table,
+		&link.RulePriority,
 		&postup,
 		&postdown,
 	)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	key, err := c.open(privateKey, keyAD("links", "private_key", id))
+	if err != nil {
+		return 0, nil, err
+	}
+	link.PrivateKey = *key
+
+	link.PostUp = strings.Split(postup, "\n")
+	link.PostDown = strings.Split(postdown, "\n")
+	return id, &link, nil
+}
+
+func (db *sqliteDB) GetLink(name string) (*Link, error) {
+	_, link, err := db.getLink(db.ext(), name)
+	return link, err
+}
+
+// Returns the link with its ID, q being the database or a transaction.
+func (db *sqliteDB) getLink(q sqlx.Queryer, name string) (int64, *Link, error) {
+	cipher, err := db.keys.load(q)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	row := q.QueryRowx("SELECT " + linkColumns + " FROM links WHERE name = ?", name)
+	linkID, link, err := cipher.scanLink(row)
 	if err != nil {
 		switch err {
 		case sql.ErrNoRows:
-			return nil, fmt.Errorf("Link \"%v\" does not exist in database", name)
+			return 0, nil, linkNotFound(name)
 		default:
-			return nil, err
+			return 0, nil, err
 		}
 	}
 
-	link.PostUp = strings.Split(postup, "\n")
-	link.PostDown = strings.Split(postdown, "\n")
+	const selectIPsStmt = `
+		SELECT ip_cidr FROM link_allowed_ips
+		WHERE link_id = ?`
+	err = sqlx.Select(q, &link.DefaultAllowedIPs, selectIPsStmt, linkID)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return linkID, link, nil
+}
+
+// Lists the links ordered by name, reading the default allowed IPs of
+// all of them in a second query.
+func (db *sqliteDB) ListLinks() ([]Link, error) {
+	cipher, err := db.keys.load(db.ext())
+	if err != nil {
+		return nil, err
+	}
 
-	linkID, err := getLinkID(name, db.conn)
+	rows, err := db.ext().Query("SELECT " + linkColumns + " FROM links ORDER BY name")
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
+	links := []Link{}
+	index := make(map[int64]int)
+	for rows.Next() {
+		linkID, link, err := cipher.scanLink(rows)
+		if err != nil {
+			return nil, err
+		}
+		index[linkID] = len(links)
+		links = append(links, *link)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var ips []struct {
+		LinkID int64 `db:"link_id"`
+		IP     IPNet `db:"ip_cidr"`
+	}
 	const selectIPsStmt = `
-		SELECT ip_cidr FROM link_allowed_ips
-		WHERE link_id = ?`
-	err = db.conn.Select(&link.DefaultAllowedIPs, selectIPsStmt, linkID)
+		SELECT link_id, ip_cidr FROM link_allowed_ips
+		ORDER BY rowid`
+	err = sqlx.Select(db.ext(), &ips, selectIPsStmt)
 	if err != nil {
 		return nil, err
 	}
 
-	return &link, nil
+	for _, ip := range ips {
+		link := &links[index[ip.LinkID]]
+		link.DefaultAllowedIPs = append(link.DefaultAllowedIPs, ip.IP)
+	}
+
+	return links, nil
 }
 
-func (db *sqliteDB) GetLinkPeers(name string) ([]Peer, error) {
-	linkID, err := getLinkID(name, db.conn)
+// A row of the peer queries of the databases, one per allowed IP of the
+// peer.
+type peerRow struct {
+	LinkName  string `db:"link_name"`
+	ID        int64  `db:"id"`
+	storedPeer
+	AllowedIP sql.NullString `db:"ip_cidr"`
+}
+
+// Lists the peers matching the where clause, the peers table being p and
+// the links table l, together with their allowed IPs in a single query.
+// Peers are ordered by link name, then by the order they were added in.
+func (db *sqliteDB) queryPeers(q sqlx.Queryer, where string, args ...interface{}) ([]LinkPeer, error) {
+	query := `
+		SELECT
+			l.name AS link_name, p.id, p.name, p.enable,
+			p.public_key, p.private_key AS stored_private_key,
+			p.preshared_key AS stored_preshared_key, p.endpoint,
+			p.keepalive, p.dns1, p.dns2, a.ip_cidr
+		FROM peers p
+		JOIN links l ON l.id = p.link_id
+		LEFT JOIN peer_allowed_ips a ON a.peer_id = p.id
+		WHERE ` + where + `
+		ORDER BY l.name, p.id, a.rowid`
+	cipher, err := db.keys.load(q)
 	if err != nil {
 		return nil, err
 	}
 
-	var peerNames []string
-	const selectPeerNamesStmt = `
-		SELECT name FROM peers
-		WHERE link_id = ?`
-	err = db.conn.Select(&peerNames, selectPeerNamesStmt, linkID)
+	rows, err := q.Queryx(query, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	return cipher.scanPeerRows(rows)
+}
 
-	peers := make([]Peer, len(peerNames))
-	for i, peerName := range peerNames {
-		peer, err := db.GetPeer(name, peerName)
+// Scans peerRows ordered by peer, grouping the allowed IPs of each peer.
+func (c *keyCipher) scanPeerRows(rows *sqlx.Rows) ([]LinkPeer, error) {
+	peers := []LinkPeer{}
+	var lastID int64
+	for rows.Next() {
+		var row peerRow
+		err := rows.StructScan(&row)
 		if err != nil {
 			return nil, err
 		}
-		peers[i] = *peer
+
+		if len(peers) == 0 || row.ID != lastID {
+			peer, err := c.openPeer(row.storedPeer, row.ID)
+			if err != nil {
+				return nil, err
+			}
+			peers = append(peers, LinkPeer{Link: row.LinkName, Peer: *peer})
+			lastID = row.ID
+		}
+
+		if row.AllowedIP.Valid {
+			var ip IPNet
+			err := ip.Scan(row.AllowedIP.String)
+			if err != nil {
+				return nil, err
+			}
+			peer := &peers[len(peers)-1].Peer
+			peer.AllowedIPs = append(peer.AllowedIPs, ip)
+		}
+	}
+
+	return peers, rows.Err()
+}
+
+func (db *sqliteDB) GetLinkPeers(name string) ([]Peer, error) {
+	linkID, err := getLinkID(name, db.ext())
+	if err != nil {
+		return nil, err
+	}
+
+	linkPeers, err := db.queryPeers(db.ext(), "p.link_id = ?", linkID)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := make([]Peer, len(linkPeers))
+	for i := range linkPeers {
+		peers[i] = linkPeers[i].Peer
 	}
 
 	return peers, nil
 }
 
+func (db *sqliteDB) ListPeers(filter PeerFilter) ([]LinkPeer, error) {
+	conds := []string{"1 = 1"}
+	var args []interface{}
+	if len(filter.Link) > 0 {
+		if _, err := getLinkID(filter.Link, db.ext()); err != nil {
+			return nil, err
+		}
+		conds = append(conds, "l.name = ?")
+		args = append(args, filter.Link)
+	}
+	if filter.Enabled != nil {
+		conds = append(conds, "p.enable = ?")
+		args = append(args, *filter.Enabled)
+	}
+	if len(filter.NamePrefix) > 0 {
+		conds = append(conds, "instr(p.name, ?) = 1")
+		args = append(args, filter.NamePrefix)
+	}
+	if filter.PublicKey != nil {
+		conds = append(conds, "p.public_key = ?")
+		args = append(args, *filter.PublicKey)
+	}
+
+	peers, err := db.queryPeers(db.ext(), strings.Join(conds, " AND "), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// Allowed IPs are stored as text, so they are matched here
+	return filterAllowedIP(peers, filter.AllowedIP), nil
+}
+
+func (db *sqliteDB) FindPeerByPublicKey(linkName string, key Key) (*Peer, error) {
+	linkID, err := getLinkID(linkName, db.ext())
+	if err != nil {
+		return nil, err
+	}
+
+	peers, err := db.queryPeers(db.ext(), "p.link_id = ? AND p.public_key = ?", linkID, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(peers) == 0 {
+		return nil, peerKeyNotFound(linkName, key)
+	}
+	return &peers[0].Peer, nil
+}
+
 func (db *sqliteDB) UpdateLink(name string, link Link) error {
-	tx, err := db.conn.Beginx()
+	tx, err := db.begin()
 	if err != nil {
 		return err
 	}
 
-	linkID, err := getLinkID(name, tx)
+	linkID, before, err := db.getLink(tx, name)
 	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	cipher, err := db.keys.load(tx)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	stored, err := cipher.sealLink(link, linkID)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
 		return err
 	}
 
@@ -170,20 +440,24 @@ func (db *sqliteDB) UpdateLink(name string, link Link) error {
 		SET name = :name,
 			enable = :enable,
 			mtu = :mtu,
-			private_key = :private_key,
+			private_key = :stored_private_key,
 			port = :port,
 			fwmark = :fwmark,
 			ipv4_cidr = :ipv4_cidr,
 			ipv6_cidr = :ipv6_cidr,
 			default_dns1 = :default_dns1,
 			default_dns2 = :default_dns2,
+			host = :host,
 			forward = :forward,
+			namespace = :namespace,
+			route_table = :route_table,
+			rule_priority = :rule_priority,
 			postup = ?,
 			postdown = ?
 		WHERE
 			id = ?`
 
-	query, args, err := sqlx.Named(updateStmt, &link)
+	query, args, err := sqlx.Named(updateStmt, stored)
 	if err != nil {
 		return err
 	}
@@ -194,7 +468,7 @@ func (db *sqliteDB) UpdateLink(name string, link Link) error {
 		if rollbackErr := tx.Rollback(); rollbackErr != nil {
 			return rollbackErr
 		}
-		return err
+		return sqliteError(err)
 	}
 
 	// delete old allowed ips
@@ -206,7 +480,7 @@ func (db *sqliteDB) UpdateLink(name string, link Link) error {
 		if rollbackErr := tx.Rollback(); rollbackErr != nil {
 			return rollbackErr
 		}
-		return err
+		return sqliteError(err)
 	}
 
 	// insert new allowed ips
@@ -219,27 +493,46 @@ func (db *sqliteDB) UpdateLink(name string, link Link) error {
 			if rollbackErr := tx.Rollback(); rollbackErr != nil {
 				return rollbackErr
 			}
-			return err
+			return sqliteError(err)
 		}
 	}
 
+	err = writeAudit(tx, db.actor, "UpdateLink", name, "", before, link)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
 	return tx.Commit()
 }
 
 func (db *sqliteDB) RemoveLink(name string) error {
-	tx, err := db.conn.Beginx()
+	tx, err := db.begin()
 	if err != nil {
 		return err
 	}
 
-	linkID, err := getLinkID(name, tx)
+	linkID, before, err := db.getLink(tx, name)
 	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
 		return err
 	}
 
 	// This should cascade the delete to all associated entities
 	const deleteLinkStmt = "DELETE FROM links WHERE id = ?"
 	_, err = tx.Exec(deleteLinkStmt, linkID)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return sqliteError(err)
+	}
+
+	err = writeAudit(tx, db.actor, "RemoveLink", name, "", before, nil)
 	if err != nil {
 		if rollbackErr := tx.Rollback(); rollbackErr != nil {
 			return rollbackErr
@@ -247,31 +540,50 @@ func (db *sqliteDB) RemoveLink(name string) error {
 		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
 func (db *sqliteDB) AddPeer(linkName string, peer Peer) error {
-	tx, err := db.conn.Beginx()
+	tx, err := db.begin()
 	if err != nil {
 		return err
 	}
 
 	linkID, err := getLinkID(linkName, tx)
 	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	cipher, err := db.keys.load(tx)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	stored, err := cipher.sealPeer(peer, 0)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
 		return err
 	}
 
 	// Last position is for the link ID
 	const insertPeerStmt = `
 		INSERT INTO peers (
-			name, enable, public_key,
+			name, enable, public_key, private_key,
 			preshared_key, endpoint,
 			keepalive, dns1, dns2, link_id
 		) VALUES (
-			:name, :enable, :public_key,
-			:preshared_key, :endpoint,
+			:name, :enable, :public_key, :stored_private_key,
+			:stored_preshared_key, :endpoint,
 			:keepalive, :dns1, :dns2, ?)`
-	query, args, err := sqlx.Named(insertPeerStmt, &peer)
+	query, args, err := sqlx.Named(insertPeerStmt, stored)
 	if err != nil {
 		return err
 	}
@@ -282,11 +594,22 @@ func (db *sqliteDB) AddPeer(linkName string, peer Peer) error {
 		if rollbackErr := tx.Rollback(); rollbackErr != nil {
 			return rollbackErr
 		}
-		return err
+		return sqliteError(err)
 	}
 
 	peerID, err := getPeerID(linkID, peer.Name, tx)
 	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	err = cipher.sealInsertedPeer(tx, peer, peerID)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
 		return err
 	}
 
@@ -299,67 +622,86 @@ func (db *sqliteDB) AddPeer(linkName string, peer Peer) error {
 			if rollbackErr := tx.Rollback(); rollbackErr != nil {
 				return rollbackErr
 			}
-			return err
+			return sqliteError(err)
 		}
 	}
 
+	err = writeAudit(tx, db.actor, "AddPeer", linkName, peer.Name, nil, peer)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
 	return tx.Commit()
 }
 
 func (db *sqliteDB) GetPeer(linkName, peerName string) (*Peer, error) {
-	linkID, err := getLinkID(linkName, db.conn)
+	linkID, err := getLinkID(linkName, db.ext())
 	if err != nil {
 		return nil, err
 	}
 
-	const selectPeerStmt = `
-		SELECT
-			name, enable, public_key,
-			preshared_key, endpoint,
-			keepalive, dns1, dns2
-		FROM peers
-		WHERE link_id = ? AND name = ?`
-
-	var peer Peer
-	err = db.conn.Get(&peer, selectPeerStmt, linkID, peerName)
-	if err != nil {
-		switch err {
-		case sql.ErrNoRows:
-			return nil, fmt.Errorf("Peer \"%v\" does not exist in database", peerName)
-		default:
-			return nil, err
-		}
-	}
+	return db.getPeer(db.ext(), linkID, peerName)
+}
 
-	peerID, err := getPeerID(linkID, peerName, db.conn)
+// Returns the peer of the link, q being the database or a transaction.
+func (db *sqliteDB) getPeer(q sqlx.Queryer, linkID int64, peerName string) (*Peer, error) {
+	peers, err := db.queryPeers(q, "p.link_id = ? AND p.name = ?", linkID, peerName)
 	if err != nil {
 		return nil, err
 	}
 
-	const selectIPsStmt = `
-		SELECT ip_cidr FROM peer_allowed_ips
-		WHERE peer_id = ?`
-	err = db.conn.Select(&peer.AllowedIPs, selectIPsStmt, peerID)
-	if err != nil {
-		return nil, err
+	if len(peers) == 0 {
+		return nil, peerNotFound(peerName)
 	}
-
-	return &peer, nil
+	return &peers[0].Peer, nil
 }
 
 func (db *sqliteDB) UpdatePeer(linkName, peerName string, peer Peer) error {
-	tx, err := db.conn.Beginx()
+	tx, err := db.begin()
 	if err != nil {
 		return err
 	}
 
 	linkID, err := getLinkID(linkName, tx)
 	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
 		return err
 	}
 
 	peerID, err := getPeerID(linkID, peerName, tx)
 	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	before, err := db.getPeer(tx, linkID, peerName)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	cipher, err := db.keys.load(tx)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	stored, err := cipher.sealPeer(peer, peerID)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
 		return err
 	}
 
@@ -368,7 +710,8 @@ func (db *sqliteDB) UpdatePeer(linkName, peerName string, peer Peer) error {
 		SET name = :name,
 			enable = :enable,
 			public_key = :public_key,
-			preshared_key = :preshared_key,
+			private_key = :stored_private_key,
+			preshared_key = :stored_preshared_key,
 			endpoint = :endpoint,
 			keepalive = :keepalive,
 			dns1 = :dns1,
@@ -376,7 +719,7 @@ func (db *sqliteDB) UpdatePeer(linkName, peerName string, peer Peer) error {
 		WHERE
 			id = ?`
 
-	query, args, err := sqlx.Named(updateStmt, &peer)
+	query, args, err := sqlx.Named(updateStmt, stored)
 	if err != nil {
 		return err
 	}
@@ -387,7 +730,7 @@ func (db *sqliteDB) UpdatePeer(linkName, peerName string, peer Peer) error {
 		if rollbackErr := tx.Rollback(); rollbackErr != nil {
 			return rollbackErr
 		}
-		return err
+		return sqliteError(err)
 	}
 
 	// Delete old allowed ips
@@ -399,7 +742,7 @@ func (db *sqliteDB) UpdatePeer(linkName, peerName string, peer Peer) error {
 		if rollbackErr := tx.Rollback(); rollbackErr != nil {
 			return rollbackErr
 		}
-		return err
+		return sqliteError(err)
 	}
 
 	// Insert new allowed ips
@@ -412,31 +755,94 @@ func (db *sqliteDB) UpdatePeer(linkName, peerName string, peer Peer) error {
 			if rollbackErr := tx.Rollback(); rollbackErr != nil {
 				return rollbackErr
 			}
-			return err
+			return sqliteError(err)
 		}
 	}
 
+	err = writeAudit(tx, db.actor, "UpdatePeer", linkName, peerName, before, peer)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
 	return tx.Commit()
 }
 
 func (db *sqliteDB) RemovePeer(linkName, peerName string) error {
-	tx, err := db.conn.Beginx()
+	tx, err := db.begin()
 	if err != nil {
 		return err
 	}
 
 	linkID, err := getLinkID(linkName, tx)
 	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
 		return err
 	}
 	peerID, err := getPeerID(linkID, peerName, tx)
 	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	before, err := db.getPeer(tx, linkID, peerName)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
 		return err
 	}
 
 	// This should cascade the delete to all associated IPs
 	const deletePeerStmt = "DELETE FROM peers WHERE link_id = ? AND id = ?"
 	_, err = tx.Exec(deletePeerStmt, linkID, peerID)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return sqliteError(err)
+	}
+
+	err = writeAudit(tx, db.actor, "RemovePeer", linkName, peerName, before, nil)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *sqliteDB) PurgePeerPrivateKey(linkName, peerName string) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+
+	linkID, err := getLinkID(linkName, tx)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	peerID, err := getPeerID(linkID, peerName, tx)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	before, err := db.getPeer(tx, linkID, peerName)
 	if err != nil {
 		if rollbackErr := tx.Rollback(); rollbackErr != nil {
 			return rollbackErr
@@ -444,7 +850,246 @@ func (db *sqliteDB) RemovePeer(linkName, peerName string) error {
 		return err
 	}
 
-	return nil
+	const purgeStmt = "UPDATE peers SET private_key = NULL WHERE id = ?"
+	_, err = tx.Exec(purgeStmt, peerID)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return sqliteError(err)
+	}
+
+	after := *before
+	after.PrivateKey = nil
+	err = writeAudit(tx, db.actor, "PurgePeerPrivateKey", linkName, peerName, before, after)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *sqliteDB) GetIPAM(linkName string) (*IPAM, error) {
+	linkID, err := getLinkID(linkName, db.ext())
+	if err != nil {
+		return nil, err
+	}
+
+	return getIPAM(linkID, db.ext())
+}
+
+// Returns the IPAM configuration of the link, q being the database or a
+// transaction.
+func getIPAM(linkID int64, q sqlx.Queryer) (*IPAM, error) {
+	var ipam IPAM
+	const selectReservationsStmt = `
+		SELECT ip, peer_name FROM ipam_reservations
+		WHERE link_id = ?`
+	err := sqlx.Select(q, &ipam.Reservations, selectReservationsStmt, linkID)
+	if err != nil {
+		return nil, err
+	}
+
+	const selectExclusionsStmt = `
+		SELECT ip_cidr FROM ipam_exclusions
+		WHERE link_id = ?`
+	err = sqlx.Select(q, &ipam.Exclusions, selectExclusionsStmt, linkID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ipam, nil
+}
+
+func (db *sqliteDB) SetIPAM(linkName string, ipam IPAM) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+
+	linkID, err := getLinkID(linkName, tx)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	before, err := getIPAM(linkID, tx)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	// Delete the old configuration
+	for _, stmt := range []string{
+		"DELETE FROM ipam_reservations WHERE link_id = ?",
+		"DELETE FROM ipam_exclusions WHERE link_id = ?",
+	} {
+		_, err := tx.Exec(stmt, linkID)
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				return rollbackErr
+			}
+			return sqliteError(err)
+		}
+	}
+
+	const insertReservationStmt = `
+		INSERT INTO ipam_reservations
+		(ip, peer_name, link_id) VALUES (?,?,?)`
+	for _, r := range ipam.Reservations {
+		_, err := tx.Exec(insertReservationStmt, r.IP, r.PeerName, linkID)
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				return rollbackErr
+			}
+			return sqliteError(err)
+		}
+	}
+
+	const insertExclusionStmt = `
+		INSERT INTO ipam_exclusions
+		(ip_cidr, link_id) VALUES (?,?)`
+	for _, ip := range ipam.Exclusions {
+		_, err := tx.Exec(insertExclusionStmt, ip, linkID)
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				return rollbackErr
+			}
+			return sqliteError(err)
+		}
+	}
+
+	err = writeAudit(tx, db.actor, "SetIPAM", linkName, "", before, ipam)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *sqliteDB) GetConfig() (*Config, error) {
+	return getConfig(db.ext())
+}
+
+// Returns the config, q being the database or a transaction.
+func getConfig(q sqlx.Queryer) (*Config, error) {
+	const selectStmt = `
+		SELECT
+			enable, forward_ipv4, forward_ipv6,
+			nat_enable, COALESCE(nat_link, '') AS nat_link
+		FROM configs
+		WHERE name = ?`
+
+	var config Config
+	err := sqlx.Get(q, &config, selectStmt, sqliteConfigName)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			config = defaultConfig()
+		default:
+			return nil, err
+		}
+	}
+
+	return &config, nil
+}
+
+func (db *sqliteDB) SetConfig(config Config) error {
+	tx, err := db.begin()
+	if err != nil {
+		return err
+	}
+
+	before, err := getConfig(tx)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM configs WHERE name = ?", sqliteConfigName)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return sqliteError(err)
+	}
+
+	// Last position is for the config name
+	const insertStmt = `
+		INSERT INTO configs (
+			enable, forward_ipv4, forward_ipv6,
+			nat_enable, nat_link, name
+		) VALUES (
+			:enable, :forward_ipv4, :forward_ipv6,
+			:nat_enable, NULLIF(:nat_link, ''), ?)`
+	query, args, err := sqlx.Named(insertStmt, &config)
+	if err != nil {
+		return err
+	}
+
+	args = append(args, sqliteConfigName)
+	_, err = tx.Exec(query, args...)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return sqliteError(err)
+	}
+
+	err = writeAudit(tx, db.actor, "SetConfig", "", "", before, config)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return rollbackErr
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *sqliteDB) Rekey(provider KeyProvider) error {
+	if db.tx != nil {
+		return fmt.Errorf("Can't rekey the database in a transaction")
+	}
+	return db.keys.rekey(db.conn, provider)
+}
+
+func (db *sqliteDB) AuditLog(filter AuditFilter) ([]AuditEntry, error) {
+	return queryAuditLog(db.ext(), filter, "before_state, after_state")
+}
+
+func (db *sqliteDB) WithActor(actor string) DB {
+	copied := *db
+	copied.actor = actor
+	return &copied
+}
+
+func (db *sqliteDB) Export(w io.Writer, opts ExportOptions) error {
+	return exportDB(db, w, opts)
+}
+
+func (db *sqliteDB) Import(r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	return importDB(db, r, opts)
+}
+
+func (db *sqliteDB) Transaction(fn func(tx DB) error) error {
+	return runTransaction(db.conn, db.tx, func(tx *sqlx.Tx) error {
+		copied := *db
+		copied.tx = tx
+		return fn(&copied)
+	})
 }
 
 func (db *sqliteDB) Close() error {
@@ -456,6 +1101,9 @@ func getLinkID(name string, q sqlx.Queryer) (int64, error) {
 
 	var id int64
 	err := sqlx.Get(q, &id, selectStmt, name)
+	if err == sql.ErrNoRows {
+		return 0, linkNotFound(name)
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -468,6 +1116,9 @@ func getPeerID(linkID int64, peerName string, q sqlx.Queryer) (int64, error) {
 
 	var id int64
 	err := sqlx.Get(q, &id, selectStmt, linkID, peerName)
+	if err == sql.ErrNoRows {
+		return 0, peerNotFound(peerName)
+	}
 	if err != nil {
 		return 0, err
 	}
@@ -475,31 +1126,80 @@ func getPeerID(linkID int64, peerName string, q sqlx.Queryer) (int64, error) {
 	return id, nil
 }
 
+// Maps violations of the unique constraints of the schema onto the errors
+// they stand for.
+func sqliteError(err error) error {
+	sqliteErr, ok := err.(sqlite3.Error)
+	if !ok || sqliteErr.Code != sqlite3.ErrConstraint {
+		return err
+	}
+
+	// ex. UNIQUE constraint failed: peers.public_key, peers.link_id
+	msg := sqliteErr.Error()
+	switch {
+	case strings.Contains(msg, " links.name"):
+		return errorf(ErrDuplicateName, "Link name already exists in database")
+	case strings.Contains(msg, " peers.name"):
+		return errorf(ErrDuplicateName, "Peer name already exists in the link")
+	case strings.Contains(msg, " peers.public_key"):
+		return errorf(ErrDuplicatePublicKey, "Peer public key already belongs to a peer of the link")
+	case strings.Contains(msg, " peer_allowed_ips.ip_cidr"):
+		return errorf(ErrAllowedIPConflict, "Peer allowed IP already belongs to a peer of the link")
+	}
+	return err
+}
+
 func OpenSqliteDB(dbPath string) (DB, error) {
+	return OpenSqliteDBWithKey(dbPath, nil)
+}
+
+// Opens the database with the master key of the provider, which encrypts
+// the private and preshared keys it stores. The keys of a database opened
+// with a master key for the first time are encrypted, a nil provider opens
+// databases storing them in plain.
+func OpenSqliteDBWithKey(dbPath string, provider KeyProvider) (DB, error) {
 	conn, err := buildSqliteDB(dbPath)
 	if err != nil {
 		return nil, err
 	}
+
+	keys, err := openDBKeys(conn, provider)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 	
 	db := &sqliteDB{
 		conn: conn,
+		keys: keys,
+		actor: defaultActor(),
 	}
 	return db, nil
 }
 
 func buildSqliteDB(dbPath string) (*sqlx.DB, error) {
-	db, err := sqlx.Open("sqlite3", dbPath)
+	db, err := sqlx.Open("sqlite3", sqliteDSN(dbPath))
 	if err != nil {
 		return nil, err
 	}
 
-	stmts := strings.Split(sqliteSchema, ";")
-	for _, stmt := range stmts {
-		_, err := db.Exec(stmt)
-		if err != nil {
-			return nil, err
-		}
+	err = migrateSqliteDB(db, sqliteMigrations)
+	if err != nil {
+		db.Close()
+		return nil, err
 	}
-	
+
 	return db, nil
-}
\ No newline at end of file
+}
+
+// Foreign keys are a setting of each sqlite connection, so they are
+// turned on in the data source name every connection of the pool is
+// opened with. Deletes rely on them to delete the rows referencing the
+// deleted rows.
+func sqliteDSN(dbPath string) string {
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
+	}
+	return dbPath + sep + "_foreign_keys=1"
+}
@@ -0,0 +1,230 @@
+package dswg
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// A change to the sqlite schema, see sqliteMigrations.
+type sqliteMigration struct {
+	description string
+	migrate     func(tx *sql.Tx) error
+}
+
+const sqliteVersionSchema = `
+CREATE TABLE IF NOT EXISTS [schema_version]
+(
+ [version]		INTEGER NOT NULL
+)`
+
+// Brings the database to the latest schema version, each migration in its
+// own transaction. Databases of a newer version are refused, since this
+// version of dswg can't tell how to use them.
+func migrateSqliteDB(db *sqlx.DB, migrations []sqliteMigration) (err error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Migrations rebuilding a table drop it, which would delete the rows
+	// referencing it if foreign keys were on. Foreign keys are checked
+	// before each migration commits instead, and turned back on before
+	// the connection returns to the pool, even if a migration failed.
+	_, err = conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, onErr := conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+		if err == nil {
+			err = onErr
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, sqliteVersionSchema)
+	if err != nil {
+		return err
+	}
+
+	for {
+		done, err := runNextMigration(ctx, conn, migrations)
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// Runs the migration following the version of the database, reading the
+// version in the same transaction in case another process migrates the
+// database too. Returns true if the database is up to date.
+func runNextMigration(ctx context.Context, conn *sql.Conn, migrations []sqliteMigration) (bool, error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	version, err := sqliteSchemaVersion(tx)
+	if err != nil {
+		return false, err
+	}
+	if version > len(migrations) {
+		return false, errorf(ErrSchemaTooNew,
+			"Database schema version %v is newer than %v, the latest this version of dswg supports",
+			version, len(migrations))
+	}
+	if version == len(migrations) {
+		return true, nil
+	}
+
+	migration := migrations[version]
+	err = migration.migrate(tx)
+	if err == nil {
+		err = checkForeignKeys(tx)
+	}
+	if err != nil {
+		return false, fmt.Errorf("Couldn't migrate database to version %v, %v: %v",
+			version+1, migration.description, err)
+	}
+
+	_, err = tx.Exec("UPDATE schema_version SET version = ?", version+1)
+	if err != nil {
+		return false, err
+	}
+	return false, tx.Commit()
+}
+
+// Returns the number of migrations applied to the database.
+func sqliteSchemaVersion(tx *sql.Tx) (int, error) {
+	var version int
+	err := tx.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	if err == sql.ErrNoRows {
+		_, err = tx.Exec("INSERT INTO schema_version (version) VALUES (0)")
+	}
+	return version, err
+}
+
+// Fails if a row references a row that doesn't exist.
+func checkForeignKeys(tx *sql.Tx) error {
+	rows, err := tx.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		var table string
+		var rowid sql.NullInt64
+		var parent string
+		var fkid int
+		err := rows.Scan(&table, &rowid, &parent, &fkid)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("Row %v of table %v references a missing row of table %v",
+			rowid.Int64, table, parent)
+	}
+	return rows.Err()
+}
+
+// Returns a migration running the statements of the schema.
+func execMigration(schema string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		stmts := strings.Split(schema, ";")
+		for _, stmt := range stmts {
+			_, err := tx.Exec(stmt)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Returns a migration running each statement whole, ex. statements
+// creating triggers, which have a ; in them.
+func execStatements(stmts ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			_, err := tx.Exec(stmt)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Returns a migration adding the column to the table, unless it has it.
+func addColumn(table, column, definition string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		columns, err := tableColumns(tx, table)
+		if err != nil {
+			return err
+		}
+		if _, ok := columns[column]; ok {
+			return nil
+		}
+
+		_, err = tx.Exec(fmt.Sprintf("ALTER TABLE [%v] ADD COLUMN [%v] %v", table, column, definition))
+		return err
+	}
+}
+
+// Returns a migration running the migrations in order.
+func inOrder(migrations ...func(tx *sql.Tx) error) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, migrate := range migrations {
+			err := migrate(tx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Returns whether each column of the table is NOT NULL, by name.
+func tableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info([%v])", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk)
+		if err != nil {
+			return nil, err
+		}
+		columns[name] = notNull == 1
+	}
+	return columns, rows.Err()
+}
+
+// Rebuilds the peers table with a nullable endpoint, so peers without one
+// can be stored, ex. peers of imported links.
+func nullablePeerEndpoint(tx *sql.Tx) error {
+	columns, err := tableColumns(tx, "peers")
+	if err != nil {
+		return err
+	}
+	if !columns["endpoint"] {
+		return nil
+	}
+
+	return execMigration(sqliteNullableEndpointPeers)(tx)
+}
@@ -0,0 +1,326 @@
+package dswg
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+// Rows of a link with a peer, in the tables of the first schema.
+const testBaselineRows = `
+INSERT INTO links VALUES(1, 'wg-linko', 1, 1420, '4AQ6d+dvykkl4j6VG03e7VcciDbgn5mBEJFXMjn1pnU=',
+	9977, 42069, '10.6.6.1/24', '2001::/32', '1.1.1.1', NULL, 'echo up %i', 'true', 0);
+INSERT INTO link_allowed_ips VALUES('10.6.6.0/24', 1);
+INSERT INTO peers VALUES(1, 1, 'zoz-pc', 1, 'ZOZ+ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=', NULL,
+	'192.168.0.1:42064', 25000000000, '1.1.1.1', NULL);
+INSERT INTO peer_allowed_ips VALUES('10.6.6.2/32', 1, 1);`
+
+// The schema databases had before schema_version was added, with rows of
+// a link, a peer without endpoint and an IPAM reservation.
+const testUnversionedDB = `
+PRAGMA foreign_keys = ON;
+
+CREATE TABLE [configs] ([id] INTEGER NOT NULL, [name] VARCHAR NOT NULL, [enable] INTEGER NOT NULL,
+	[forward_ipv4] INTEGER NOT NULL, [forward_ipv6] INTEGER NOT NULL, [nat_enable] INTEGER NOT NULL,
+	[nat_link] VARCHAR NULL, PRIMARY KEY([id]));
+
+CREATE TABLE [links] ([id] INTEGER NOT NULL, [name] VARCHAR NOT NULL, [enable] INTEGER NOT NULL,
+	[mtu] INTEGER NOT NULL, [private_key] VARCHAR NOT NULL, [port] INTEGER NOT NULL,
+	[fwmark] INTEGER NOT NULL, [ipv4_cidr] VARCHAR NULL, [ipv6_cidr] VARCHAR NULL,
+	[default_dns1] VARCHAR NULL, [default_dns2] VARCHAR NULL, [host] VARCHAR NOT NULL DEFAULT '',
+	[postup] VARCHAR NOT NULL, [postdown] VARCHAR NOT NULL, [forward] INTEGER NOT NULL,
+	[namespace] VARCHAR NOT NULL DEFAULT '', [route_table] VARCHAR NOT NULL DEFAULT '',
+	[rule_priority] INTEGER NOT NULL DEFAULT 0, PRIMARY KEY([id]), UNIQUE(name));
+
+CREATE TABLE [link_allowed_ips] ([ip_cidr] VARCHAR NOT NULL, [link_id] INTEGER NOT NULL,
+	PRIMARY KEY([ip_cidr], [link_id]),
+	FOREIGN KEY([link_id]) REFERENCES [links]([id]) ON DELETE CASCADE);
+
+CREATE TABLE [peers] ([id] INTEGER NOT NULL, [link_id] INTEGER NOT NULL, [name] VARCHAR NOT NULL,
+	[enable] INTEGER NOT NULL, [public_key] VARCHAR NOT NULL, [private_key] VARCHAR NULL,
+	[preshared_key] VARCHAR NULL, [endpoint] VARCHAR NULL, [keepalive] INTEGER NOT NULL,
+	[dns1] VARCHAR NULL, [dns2] VARCHAR NULL, PRIMARY KEY([id]),
+	FOREIGN KEY([link_id]) REFERENCES [links]([id]) ON DELETE CASCADE,
+	UNIQUE([name], [link_id]), UNIQUE([public_key], [link_id]));
+
+CREATE TABLE [peer_allowed_ips] ([ip_cidr] VARCHAR NOT NULL, [peer_id] INTEGER NOT NULL,
+	[link_id] INTEGER NOT NULL, PRIMARY KEY([ip_cidr], [peer_id]),
+	FOREIGN KEY([peer_id]) REFERENCES [peers]([id]) ON DELETE CASCADE,
+	FOREIGN KEY([link_id]) REFERENCES [links]([id]) ON DELETE CASCADE,
+	UNIQUE([ip_cidr], [link_id]));
+
+CREATE TABLE [ipam_reservations] ([ip] VARCHAR NOT NULL, [peer_name] VARCHAR NOT NULL,
+	[link_id] INTEGER NOT NULL, PRIMARY KEY([ip], [link_id]),
+	FOREIGN KEY([link_id]) REFERENCES [links]([id]) ON DELETE CASCADE);
+
+CREATE TABLE [ipam_exclusions] ([ip_cidr] VARCHAR NOT NULL, [link_id] INTEGER NOT NULL,
+	PRIMARY KEY([ip_cidr], [link_id]),
+	FOREIGN KEY([link_id]) REFERENCES [links]([id]) ON DELETE CASCADE);
+
+INSERT INTO links VALUES(1, 'wg-linko', 1, 1420, '4AQ6d+dvykkl4j6VG03e7VcciDbgn5mBEJFXMjn1pnU=',
+	9977, 42069, '10.6.6.1/24', NULL, NULL, NULL, 'vpn.example.com', '', '', 1, 'blue', '100', 0);
+INSERT INTO peers VALUES(1, 1, 'zoz-pc', 1, 'ZOZ+ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=',
+	'4AQ6d+dvykkl4j6VG03e7VcciDbgn5mBEJFXMjn1pnU=', NULL, NULL, 0, NULL, NULL);
+INSERT INTO peer_allowed_ips VALUES('10.6.6.2/32', 1, 1);
+INSERT INTO ipam_reservations VALUES('10.6.6.9', 'zoz-phone', 1);`
+
+// Creates a database file in a temporary directory, from the statements.
+func setupFixtureDB(t *testing.T, schema string) (string, func()) {
+	dir, err := ioutil.TempDir("", "dswg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "db.sqlite")
+
+	db, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, stmt := range strings.Split(schema, ";") {
+		_, err := db.Exec(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func fixtureSchemaVersion(t *testing.T, path string) int {
+	db, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var version int
+	err = db.Get(&version, "SELECT version FROM schema_version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+// Returns the columns of every table, to compare migrated schemas with the
+// schema of new databases.
+func fixtureColumns(t *testing.T, path string) map[string]map[string]bool {
+	db, err := sqlx.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var tables []string
+	err = db.Select(&tables, "SELECT name FROM sqlite_master WHERE type = 'table'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	schema := make(map[string]map[string]bool)
+	for _, table := range tables {
+		schema[table], err = tableColumns(tx, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return schema
+}
+
+func TestMigrateNewDB(t *testing.T) {
+	assert := assert.New(t)
+
+	path, cleanup := setupFixtureDB(t, "")
+	defer cleanup()
+
+	db, err := OpenSqliteDB(path)
+	assert.Nil(err)
+	db.Close()
+	assert.Equal(len(sqliteMigrations), fixtureSchemaVersion(t, path))
+
+	// Opening an up to date database changes nothing
+	db, err = OpenSqliteDB(path)
+	assert.Nil(err)
+	db.Close()
+	assert.Equal(len(sqliteMigrations), fixtureSchemaVersion(t, path))
+}
+
+func TestMigrateBaselineDB(t *testing.T) {
+	assert := assert.New(t)
+
+	path, cleanup := setupFixtureDB(t, sqliteBaseSchema+";"+testBaselineRows)
+	defer cleanup()
+	fresh, cleanupFresh := setupFixtureDB(t, "")
+	defer cleanupFresh()
+
+	db, err := OpenSqliteDB(path)
+	assert.Nil(err)
+	defer db.Close()
+
+	link, err := db.GetLink("wg-linko")
+	assert.Nil(err)
+	assert.Equal(42069, link.FirewallMark)
+	assert.Equal("10.6.6.0/24", link.DefaultAllowedIPs[0].String())
+	assert.Equal("", link.Host)
+	assert.Equal("", link.Namespace)
+
+	peer, err := db.GetPeer("wg-linko", "zoz-pc")
+	assert.Nil(err)
+	assert.Equal("192.168.0.1:42064", peer.Endpoint.String())
+	assert.Equal("10.6.6.2/32", peer.AllowedIPs[0].String())
+	assert.Nil(peer.PrivateKey)
+	// Keepalives were stored in nanoseconds
+	assert.Equal(int64(25), peer.PersistentKeepalive)
+
+	// Peers without endpoint can be stored once the column is nullable
+	testpeer := secondPeer()
+	testpeer.Endpoint = nil
+	err = db.AddPeer("wg-linko", testpeer)
+	assert.Nil(err)
+
+	// Removing the link still removes its peers
+	err = db.RemoveLink("wg-linko")
+	assert.Nil(err)
+	peers, err := db.ListPeers(PeerFilter{})
+	assert.Nil(err)
+	assert.Len(peers, 0)
+
+	freshDB, err := OpenSqliteDB(fresh)
+	assert.Nil(err)
+	freshDB.Close()
+	assert.Equal(len(sqliteMigrations), fixtureSchemaVersion(t, path))
+	assert.Equal(fixtureColumns(t, fresh), fixtureColumns(t, path))
+}
+
+func TestMigrateUnversionedDB(t *testing.T) {
+	assert := assert.New(t)
+
+	path, cleanup := setupFixtureDB(t, testUnversionedDB)
+	defer cleanup()
+	fresh, cleanupFresh := setupFixtureDB(t, "")
+	defer cleanupFresh()
+
+	db, err := OpenSqliteDB(path)
+	assert.Nil(err)
+	defer db.Close()
+
+	link, err := db.GetLink("wg-linko")
+	assert.Nil(err)
+	assert.Equal("vpn.example.com", link.Host)
+	assert.Equal("blue", link.Namespace)
+	assert.Equal("100", link.Table)
+
+	peer, err := db.GetPeer("wg-linko", "zoz-pc")
+	assert.Nil(err)
+	assert.Nil(peer.Endpoint)
+	assert.NotNil(peer.PrivateKey)
+	assert.Equal("10.6.6.2/32", peer.AllowedIPs[0].String())
+
+	ipam, err := db.GetIPAM("wg-linko")
+	assert.Nil(err)
+	assert.Len(ipam.Reservations, 1)
+
+	freshDB, err := OpenSqliteDB(fresh)
+	assert.Nil(err)
+	freshDB.Close()
+	assert.Equal(len(sqliteMigrations), fixtureSchemaVersion(t, path))
+	assert.Equal(fixtureColumns(t, fresh), fixtureColumns(t, path))
+}
+
+func TestMigrateKeepaliveSeconds(t *testing.T) {
+	assert := assert.New(t)
+
+	// The endpoint of the peer is nullable already, so the peers table
+	// isn't rebuilt, but its keepalive is still in nanoseconds
+	schema := strings.Replace(testUnversionedDB, "NULL, NULL, 0, NULL, NULL", "NULL, NULL, 25000000000, NULL, NULL", 1)
+	path, cleanup := setupFixtureDB(t, schema)
+	defer cleanup()
+
+	db, err := OpenSqliteDB(path)
+	assert.Nil(err)
+	peer, err := db.GetPeer("wg-linko", "zoz-pc")
+	assert.Nil(err)
+	assert.Equal(int64(25), peer.PersistentKeepalive)
+	db.Close()
+
+	// Migrating the database again, as if it had no version, keeps the
+	// keepalive in seconds
+	fixture, err := sqlx.Open("sqlite3", path)
+	assert.Nil(err)
+	_, err = fixture.Exec("DROP TABLE schema_version")
+	assert.Nil(err)
+	fixture.Close()
+
+	db, err = OpenSqliteDB(path)
+	assert.Nil(err)
+	defer db.Close()
+	peer, err = db.GetPeer("wg-linko", "zoz-pc")
+	assert.Nil(err)
+	assert.Equal(int64(25), peer.PersistentKeepalive)
+}
+
+func TestMigrateSchemaTooNew(t *testing.T) {
+	assert := assert.New(t)
+
+	path, cleanup := setupFixtureDB(t, sqliteVersionSchema+";"+
+		"INSERT INTO schema_version VALUES(1000)")
+	defer cleanup()
+
+	_, err := OpenSqliteDB(path)
+	assert.True(errors.Is(err, ErrSchemaTooNew))
+	assert.Contains(err.Error(), "version 1000")
+	assert.Equal(1000, fixtureSchemaVersion(t, path))
+}
+
+func TestMigrateFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	path, cleanup := setupFixtureDB(t, "")
+	defer cleanup()
+
+	migrations := []sqliteMigration{
+		{"create tables", execMigration("CREATE TABLE [first] ([id] INTEGER NOT NULL)")},
+		{"break", func(tx *sql.Tx) error {
+			_, err := tx.Exec("CREATE TABLE [second] ([id] INTEGER NOT NULL)")
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec("ALTER TABLE [missing] ADD COLUMN [name] VARCHAR NULL")
+			return err
+		}},
+	}
+
+	db, err := sqlx.Open("sqlite3", sqliteDSN(path))
+	assert.Nil(err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	err = migrateSqliteDB(db, migrations)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "Couldn't migrate database to version 2, break")
+
+	// The migration connection goes back to the pool with foreign keys on
+	var foreignKeys int
+	err = db.Get(&foreignKeys, "PRAGMA foreign_keys")
+	assert.Nil(err)
+	assert.Equal(1, foreignKeys)
+
+	// The first migration is kept, the failing one is rolled back
+	assert.Equal(1, fixtureSchemaVersion(t, path))
+	columns := fixtureColumns(t, path)
+	assert.Contains(columns, "first")
+	assert.NotContains(columns, "second")
+}
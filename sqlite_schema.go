@@ -1,9 +1,30 @@
 package dswg
 
+// Migrations of the sqlite schema, applied in order on open. The version of
+// a database is the number of migrations applied to it. Released
+// migrations must not be edited, changes to the schema go in a new one.
+//
+// Databases created before schema_version was added have no version, and
+// are brought to the latest one by running every migration, which is why
+// the migrations skip the changes the database already has.
+var sqliteMigrations = []sqliteMigration{
+	{"create tables", execMigration(sqliteBaseSchema)},
+	{"make peer endpoints nullable", nullablePeerEndpoint},
+	{"add links host", addColumn("links", "host", "VARCHAR NOT NULL DEFAULT ''")},
+	{"add peers private key", addColumn("peers", "private_key", "VARCHAR NULL")},
+	{"create ipam tables", execMigration(sqliteIPAMSchema)},
+	{"add links namespace", addColumn("links", "namespace", "VARCHAR NOT NULL DEFAULT ''")},
+	{"add links routing table", inOrder(
+		addColumn("links", "route_table", "VARCHAR NOT NULL DEFAULT ''"),
+		addColumn("links", "rule_priority", "INTEGER NOT NULL DEFAULT 0"),
+	)},
+	{"create encryption table", execMigration(sqliteEncryptionSchema)},
+	{"create audit log", execStatements(sqliteAuditSchema, sqliteAuditIndex,
+		sqliteAuditUpdateTrigger, sqliteAuditDeleteTrigger)},
+	{"store peer keepalives in seconds", execMigration(sqliteKeepaliveSeconds)},
+}
 
-const sqliteSchema = `
-PRAGMA foreign_keys = ON;
-
+const sqliteBaseSchema = `
 CREATE TABLE IF NOT EXISTS [configs]
 (
  [id]           INTEGER NOT NULL ,
@@ -80,4 +101,104 @@ CREATE TABLE IF NOT EXISTS [peer_allowed_ips]
  FOREIGN KEY([peer_id]) REFERENCES [peers]([id]) ON DELETE CASCADE,
  FOREIGN KEY([link_id]) REFERENCES [links]([id]) ON DELETE CASCADE,
  UNIQUE([ip_cidr], [link_id])
-);`
\ No newline at end of file
+);`
+
+// The peers table of sqliteBaseSchema with a nullable endpoint, sqlite
+// can't alter the constraints of a column.
+const sqliteNullableEndpointPeers = `
+CREATE TABLE [peers_new]
+(
+ [id]				INTEGER NOT NULL ,
+ [link_id]       	INTEGER NOT NULL ,
+ [name]             VARCHAR NOT NULL ,
+ [enable]           INTEGER NOT NULL ,
+ [public_key]       VARCHAR NOT NULL ,
+ [preshared_key]    VARCHAR NULL ,
+ [endpoint]         VARCHAR NULL ,
+ [keepalive]        INTEGER NOT NULL ,
+ [dns1]             VARCHAR NULL ,
+ [dns2]             VARCHAR NULL ,
+
+
+ PRIMARY KEY([id]) ,
+ FOREIGN KEY([link_id]) REFERENCES [links]([id]) ON DELETE CASCADE,
+ UNIQUE([name], [link_id]),
+ UNIQUE([public_key], [link_id])
+);
+
+INSERT INTO peers_new SELECT id, link_id, name, enable, public_key,
+	preshared_key, endpoint, keepalive, dns1, dns2 FROM peers;
+
+DROP TABLE peers;
+
+ALTER TABLE peers_new RENAME TO peers;`
+
+// Keepalives were stored in nanoseconds, always whole seconds of at least
+// 1000000000, while keepalives in seconds fit in 16 bits. Keepalives
+// already in seconds are left alone, since databases without a version
+// run every migration again.
+const sqliteKeepaliveSeconds = `
+UPDATE peers SET keepalive = keepalive / 1000000000 WHERE keepalive >= 1000000000`
+
+const sqliteIPAMSchema = `
+CREATE TABLE IF NOT EXISTS [ipam_reservations]
+(
+ [ip]				VARCHAR NOT NULL ,
+ [peer_name]		VARCHAR NOT NULL ,
+ [link_id]			INTEGER NOT NULL ,
+
+ PRIMARY KEY([ip], [link_id]) ,
+ FOREIGN KEY([link_id]) REFERENCES [links]([id]) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS [ipam_exclusions]
+(
+ [ip_cidr]			VARCHAR NOT NULL ,
+ [link_id]			INTEGER NOT NULL ,
+
+ PRIMARY KEY([ip_cidr], [link_id]) ,
+ FOREIGN KEY([link_id]) REFERENCES [links]([id]) ON DELETE CASCADE
+);`
+
+
+// Holds the data key encrypting the keys of the database, itself encrypted
+// by the master key, if the database has one.
+const sqliteEncryptionSchema = `
+CREATE TABLE IF NOT EXISTS [encryption]
+(
+ [id]				INTEGER NOT NULL ,
+ [data_key]			VARCHAR NOT NULL ,
+
+ PRIMARY KEY([id])
+);`
+
+// Entries are never changed nor deleted, see AuditEntry.
+const sqliteAuditSchema = `
+CREATE TABLE IF NOT EXISTS [audit_log]
+(
+ [id]				INTEGER NOT NULL ,
+ [changed_at]		VARCHAR NOT NULL ,
+ [actor]			VARCHAR NOT NULL ,
+ [operation]		VARCHAR NOT NULL ,
+ [link]				VARCHAR NOT NULL ,
+ [peer]				VARCHAR NOT NULL ,
+ [before_state]		VARCHAR NULL ,
+ [after_state]		VARCHAR NULL ,
+
+ PRIMARY KEY([id])
+)`
+
+const sqliteAuditIndex = `
+CREATE INDEX IF NOT EXISTS [audit_log_link] ON [audit_log] ([link], [peer])`
+
+const sqliteAuditUpdateTrigger = `
+CREATE TRIGGER IF NOT EXISTS [audit_log_no_update] BEFORE UPDATE ON [audit_log]
+BEGIN
+ SELECT RAISE(ABORT, 'Audit log entries can''t be changed');
+END`
+
+const sqliteAuditDeleteTrigger = `
+CREATE TRIGGER IF NOT EXISTS [audit_log_no_delete] BEFORE DELETE ON [audit_log]
+BEGIN
+ SELECT RAISE(ABORT, 'Audit log entries can''t be deleted');
+END`
@@ -1,6 +1,11 @@
 package dswg
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"github.com/stretchr/testify/assert"
 )
@@ -45,7 +50,7 @@ func TestDBAddLinkDuplicate(t *testing.T) {
 	assert.Nil(err)
 
 	err = db.AddLink(testlink)
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrDuplicateName))
 }
 
 func TestDBAddLinkDuplicatePeerIPs(t *testing.T) {
@@ -74,7 +79,7 @@ func TestDBAddLinkDuplicatePeerIPs(t *testing.T) {
 	testpeer2.PublicKey = *randkey
 	testpeer2.AllowedIPs = []IPNet{*addr}
 	err = db.AddPeer(testlink.Name, testpeer2)
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrAllowedIPConflict))
 }
 
 func TestDBGetLinkValid(t *testing.T) {
@@ -101,10 +106,42 @@ func TestDBGetLinkNotExist(t *testing.T) {
 	defer db.Close()
 
 	link, err := db.GetLink("linko")
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrLinkNotFound))
 	assert.Nil(link)
 }
 
+func TestDBListLinksValid(t *testing.T) {
+	assert := assert.New(t)
+
+	db := setupDB()
+	defer db.Close()
+
+	testlink1 := baseLink()
+	testlink1.Name = "link2"
+	testlink2 := baseLink()
+	testlink2.Name = "link1"
+
+	err := db.AddLink(testlink1)
+	assert.Nil(err)
+	err = db.AddLink(testlink2)
+	assert.Nil(err)
+
+	dblinks, err := db.ListLinks()
+	assert.Nil(err)
+	assert.Equal([]Link{testlink2, testlink1}, dblinks)
+}
+
+func TestDBListLinksEmpty(t *testing.T) {
+	assert := assert.New(t)
+
+	db := setupDB()
+	defer db.Close()
+
+	dblinks, err := db.ListLinks()
+	assert.Nil(err)
+	assert.Equal(0, len(dblinks))
+}
+
 func TestDBGetLinkPeersValid(t *testing.T) {
 	assert := assert.New(t)
 
@@ -149,10 +186,119 @@ func TestDBGetLinkPeersNotExist(t *testing.T) {
 	defer db.Close()
 
 	peers, err := db.GetLinkPeers("linko")
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrLinkNotFound))
 	assert.Nil(peers)
 }
 
+// Adds two links with two peers each, the peers of link1 being enabled.
+func setupListPeers(db DB) {
+	keys := []string{
+		"RND1ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=",
+		"RND2ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=",
+		"RND3ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=",
+	}
+	for i, linkName := range []string{"link2", "link1"} {
+		testlink := baseLink()
+		testlink.Name = linkName
+		db.AddLink(testlink)
+
+		for j, peerName := range []string{"phone", "laptop"} {
+			testpeer := basePeer()
+			testpeer.Name = peerName
+			testpeer.Enable = linkName == "link1"
+			key, _ := ParseKey(keys[i+j])
+			testpeer.PublicKey = *key
+			addr1, _ := ParseIPNet(fmt.Sprintf("10.6.%v.%v/32", i, j+2))
+			addr2, _ := ParseIPNet(fmt.Sprintf("10.7.%v.0/24", j))
+			testpeer.AllowedIPs = []IPNet{*addr1, *addr2}
+			db.AddPeer(linkName, testpeer)
+		}
+	}
+}
+
+func TestDBListPeers(t *testing.T) {
+	assert := assert.New(t)
+
+	db := setupDB()
+	defer db.Close()
+	setupListPeers(db)
+
+	names := func(peers []LinkPeer) []string {
+		var names []string
+		for _, peer := range peers {
+			names = append(names, peer.Link+"/"+peer.Name)
+		}
+		return names
+	}
+
+	// Peers of a link keep the order they were added in
+	peers, err := db.ListPeers(PeerFilter{})
+	assert.Nil(err)
+	assert.Equal([]string{"link1/phone", "link1/laptop", "link2/phone", "link2/laptop"}, names(peers))
+	assert.Equal("10.6.1.2/32", peers[0].AllowedIPs[0].String())
+	assert.Equal("10.7.0.0/24", peers[0].AllowedIPs[1].String())
+
+	peers, err = db.ListPeers(PeerFilter{Link: "link2"})
+	assert.Nil(err)
+	assert.Equal([]string{"link2/phone", "link2/laptop"}, names(peers))
+
+	enabled := false
+	peers, err = db.ListPeers(PeerFilter{Enabled: &enabled})
+	assert.Nil(err)
+	assert.Equal([]string{"link2/phone", "link2/laptop"}, names(peers))
+
+	peers, err = db.ListPeers(PeerFilter{NamePrefix: "lap"})
+	assert.Nil(err)
+	assert.Equal([]string{"link1/laptop", "link2/laptop"}, names(peers))
+
+	ip, _ := ParseIP("10.7.1.42")
+	peers, err = db.ListPeers(PeerFilter{Link: "link1", AllowedIP: ip.IP})
+	assert.Nil(err)
+	assert.Equal([]string{"link1/laptop"}, names(peers))
+	assert.Len(peers[0].AllowedIPs, 2)
+
+	key, _ := ParseKey("RND2ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=")
+	peers, err = db.ListPeers(PeerFilter{PublicKey: key})
+	assert.Nil(err)
+	assert.Equal([]string{"link1/phone", "link2/laptop"}, names(peers))
+
+	// Prefixes are matched literally
+	peers, err = db.ListPeers(PeerFilter{NamePrefix: "%"})
+	assert.Nil(err)
+	assert.Len(peers, 0)
+}
+
+func TestDBListPeersLinkNotExist(t *testing.T) {
+	assert := assert.New(t)
+
+	db := setupDB()
+	defer db.Close()
+
+	_, err := db.ListPeers(PeerFilter{Link: "linko"})
+	assert.True(errors.Is(err, ErrLinkNotFound))
+}
+
+func TestDBFindPeerByPublicKey(t *testing.T) {
+	assert := assert.New(t)
+
+	db := setupDB()
+	defer db.Close()
+	setupListPeers(db)
+
+	key, _ := ParseKey("RND2ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=")
+	peer, err := db.FindPeerByPublicKey("link2", *key)
+	assert.Nil(err)
+	assert.Equal("laptop", peer.Name)
+	assert.Len(peer.AllowedIPs, 2)
+
+	key, _ = ParseKey("RND3ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=")
+	_, err = db.FindPeerByPublicKey("link2", *key)
+	assert.True(errors.Is(err, ErrPeerNotFound))
+
+	_, err = db.FindPeerByPublicKey("linko", *key)
+	assert.True(errors.Is(err, ErrLinkNotFound))
+}
+
 func TestDBUpdateLinkValid(t *testing.T) {
 	assert := assert.New(t)
 
@@ -175,6 +321,43 @@ func TestDBUpdateLinkValid(t *testing.T) {
 	assert.Equal(testlink, *dblink)
 }
 
+func TestDBUpdateLinkNamespace(t *testing.T) {
+	assert := assert.New(t)
+
+	db := setupDB()
+	defer db.Close()
+
+	testlink := baseLink()
+	err := db.AddLink(testlink)
+	assert.Nil(err)
+
+	testlink.Namespace = "vpn"
+	err = db.UpdateLink(testlink.Name, testlink)
+	assert.Nil(err)
+	dblink, err := db.GetLink(testlink.Name)
+	assert.Nil(err)
+	assert.Equal("vpn", dblink.Namespace)
+}
+
+func TestDBUpdateLinkTable(t *testing.T) {
+	assert := assert.New(t)
+
+	db := setupDB()
+	defer db.Close()
+
+	testlink := baseLink()
+	err := db.AddLink(testlink)
+	assert.Nil(err)
+
+	testlink.Table = "100"
+	testlink.RulePriority = 1000
+	err = db.UpdateLink(testlink.Name, testlink)
+	assert.Nil(err)
+	dblink, err := db.GetLink(testlink.Name)
+	assert.Nil(err)
+	assert.Equal(testlink, *dblink)
+}
+
 func TestDBUpdateLinkNotExist(t *testing.T) {
 	assert := assert.New(t)
 
@@ -184,7 +367,7 @@ func TestDBUpdateLinkNotExist(t *testing.T) {
 	testlink := baseLink()
 
 	err := db.UpdateLink("testo-linko1", testlink)
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrLinkNotFound))
 }
 
 func TestDBUpdateLinkDuplicateName(t *testing.T) {
@@ -204,7 +387,7 @@ func TestDBUpdateLinkDuplicateName(t *testing.T) {
 	assert.Nil(err)
 
 	err = db.UpdateLink("testo-linko1", testlink2)
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrDuplicateName))
 
 	// Assert that the invalid DB transaction did not apply
 	dblink1, err := db.GetLink("testo-linko1")
@@ -233,6 +416,33 @@ func TestDBRemoveLinkValid(t *testing.T) {
 	assert.Nil(dblink)
 }
 
+func TestDBRemoveLinkCommitted(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "dswg")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db.sqlite")
+
+	db, err := OpenSqliteDB(path)
+	assert.Nil(err)
+	defer db.Close()
+
+	testlink := baseLink()
+	err = db.AddLink(testlink)
+	assert.Nil(err)
+	err = db.RemoveLink(testlink.Name)
+	assert.Nil(err)
+
+	// The removal is visible to other connections
+	other, err := OpenSqliteDB(path)
+	assert.Nil(err)
+	defer other.Close()
+	dblink, err := other.GetLink(testlink.Name)
+	assert.NotNil(err)
+	assert.Nil(dblink)
+}
+
 func TestDBRemoveLinkNotExist(t *testing.T) {
 	assert := assert.New(t)
 
@@ -240,7 +450,7 @@ func TestDBRemoveLinkNotExist(t *testing.T) {
 	defer db.Close()
 
 	err := db.RemoveLink("non-existo")
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrLinkNotFound))
 }
 
 func TestDBAddPeerValid(t *testing.T) {
@@ -262,6 +472,26 @@ func TestDBAddPeerValid(t *testing.T) {
 	assert.Equal(testpeer, *dbpeer)
 }
 
+func TestDBAddPeerNoEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	db := setupDB()
+	defer db.Close()
+
+	testlink := baseLink()
+	err := db.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer := basePeer()
+	testpeer.Endpoint = nil
+	err = db.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	dbpeer, err := db.GetPeer(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Equal(testpeer, *dbpeer)
+}
+
 func TestDBAddPeerDuplicateName(t *testing.T) {
 	assert := assert.New(t)
 
@@ -281,7 +511,7 @@ func TestDBAddPeerDuplicateName(t *testing.T) {
 	testpeer.PublicKey = *randkey
 
 	err = db.AddPeer(testlink.Name, testpeer)
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrDuplicateName))
 }
 
 func TestDBAddPeerDuplicateKey(t *testing.T) {
@@ -302,7 +532,7 @@ func TestDBAddPeerDuplicateKey(t *testing.T) {
 	testpeer.Name = "RANDO-NAME"
 
 	err = db.AddPeer(testlink.Name, testpeer)
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrDuplicatePublicKey))
 }
 
 func TestDBAddPeerNonExistingLink(t *testing.T) {
@@ -314,7 +544,7 @@ func TestDBAddPeerNonExistingLink(t *testing.T) {
 	testpeer := basePeer()
 	
 	err := db.AddPeer("wg0", testpeer)
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrLinkNotFound))
 }
 
 func TestDBGetPeerNotExist(t *testing.T) {
@@ -328,7 +558,7 @@ func TestDBGetPeerNotExist(t *testing.T) {
 	assert.Nil(err)
 	
 	dbpeer, err := db.GetPeer(testlink.Name, "peer0")
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrPeerNotFound))
 	assert.Nil(dbpeer)
 }
 
@@ -366,7 +596,7 @@ func TestDBUpdatePeerNotExist(t *testing.T) {
 	assert.Nil(err)
 
 	err = db.UpdatePeer(testlink.Name, "peero-1", basePeer())
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrPeerNotFound))
 }
 
 func TestDBUpdatePeerDuplicateName(t *testing.T) {
@@ -391,6 +621,11 @@ func TestDBUpdatePeerDuplicateName(t *testing.T) {
 	err = db.AddPeer(testlink.Name, testpeer2)
 	assert.Nil(err)
 
+	renamed := testpeer1
+	renamed.Name = testpeer2.Name
+	err = db.UpdatePeer(testlink.Name, "peero-1", renamed)
+	assert.True(errors.Is(err, ErrDuplicateName))
+
 	err = db.UpdatePeer(testlink.Name, "peero-1", testpeer2)
 	assert.NotNil(err)
 	
@@ -425,6 +660,73 @@ func TestDBRemovePeerValid(t *testing.T) {
 	assert.Nil(dbpeer)
 }
 
+func TestDBRemovePeerCommitted(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "dswg")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db.sqlite")
+
+	db, err := OpenSqliteDB(path)
+	assert.Nil(err)
+	defer db.Close()
+
+	testlink := baseLink()
+	testpeer := basePeer()
+	err = db.AddLink(testlink)
+	assert.Nil(err)
+	err = db.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+	err = db.RemovePeer(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+
+	// The removal is visible to other connections
+	other, err := OpenSqliteDB(path)
+	assert.Nil(err)
+	defer other.Close()
+	dbpeer, err := other.GetPeer(testlink.Name, testpeer.Name)
+	assert.NotNil(err)
+	assert.Nil(dbpeer)
+}
+
+func TestDBRemovePeerFreshConnection(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "dswg")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "db.sqlite")
+
+	db, err := OpenSqliteDB(path)
+	assert.Nil(err)
+	defer db.Close()
+
+	testlink := baseLink()
+	testpeer := basePeer()
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	testpeer.AllowedIPs = []IPNet{*addr}
+	err = db.AddLink(testlink)
+	assert.Nil(err)
+	err = db.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	// Every statement gets a connection other than the migration one
+	conn := db.(*sqliteDB).conn
+	conn.SetMaxIdleConns(0)
+	err = db.RemovePeer(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+
+	var count int
+	err = conn.Get(&count, "SELECT COUNT(*) FROM peer_allowed_ips")
+	assert.Nil(err)
+	assert.Equal(0, count)
+
+	// The allowed IPs of the removed peer are free again
+	err = db.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+}
+
 func TestDBRemovePeerNotExist(t *testing.T) {
 	assert := assert.New(t)
 
@@ -436,7 +738,7 @@ func TestDBRemovePeerNotExist(t *testing.T) {
 	assert.Nil(err)
 
 	err = db.RemovePeer(testlink.Name, "peer-0")
-	assert.NotNil(err)
+	assert.True(errors.Is(err, ErrPeerNotFound))
 }
 
 func TestDBRemovePeerLinkNotExist(t *testing.T) {
@@ -446,5 +748,141 @@ func TestDBRemovePeerLinkNotExist(t *testing.T) {
 	defer db.Close()
 
 	err := db.RemovePeer("link-0", "peer-0")
-	assert.NotNil(err)
-}
\ No newline at end of file
+	assert.True(errors.Is(err, ErrLinkNotFound))
+}
+func TestDBAddPeerPrivateKey(t *testing.T) {
+	assert := assert.New(t)
+
+	db := setupDB()
+	defer db.Close()
+
+	testlink := baseLink()
+	err := db.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer := basePeer()
+	privateKey, _ := ParseKey("SBVTnnEBNe7ZKFGbkz96dvf9oq9evSkYrM/Hs7k6W18=")
+	testpeer.PrivateKey = privateKey
+	testpeer.PublicKey = Key{privateKey.PublicKey()}
+	err = db.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	dbpeer, err := db.GetPeer(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Equal(testpeer, *dbpeer)
+
+	err = db.PurgePeerPrivateKey(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+
+	dbpeer, err = db.GetPeer(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Nil(dbpeer.PrivateKey)
+	assert.Equal(testpeer.PublicKey, dbpeer.PublicKey)
+}
+
+func TestDBPurgePeerPrivateKeyNotExist(t *testing.T) {
+	assert := assert.New(t)
+
+	db := setupDB()
+	defer db.Close()
+
+	testlink := baseLink()
+	err := db.AddLink(testlink)
+	assert.Nil(err)
+
+	err = db.PurgePeerPrivateKey(testlink.Name, "peer-0")
+	assert.True(errors.Is(err, ErrPeerNotFound))
+
+	err = db.PurgePeerPrivateKey("link-0", "peer-0")
+	assert.True(errors.Is(err, ErrLinkNotFound))
+}
+
+func TestDBSetIPAMValid(t *testing.T) {
+	assert := assert.New(t)
+
+	db := setupDB()
+	defer db.Close()
+
+	testlink := baseLink()
+	err := db.AddLink(testlink)
+	assert.Nil(err)
+
+	ipam, err := db.GetIPAM(testlink.Name)
+	assert.Nil(err)
+	assert.Equal(IPAM{}, *ipam)
+
+	ip, _ := ParseIP("10.6.6.2")
+	excluded, _ := ParseIPNet("10.6.6.128/25")
+	testipam := IPAM{
+		Reservations: []IPReservation{{IP: *ip, PeerName: "zoz-pc"}},
+		Exclusions: []IPNet{*excluded},
+	}
+	err = db.SetIPAM(testlink.Name, testipam)
+	assert.Nil(err)
+
+	ipam, err = db.GetIPAM(testlink.Name)
+	assert.Nil(err)
+	assert.Equal(testipam, *ipam)
+
+	// Setting replaces the old configuration
+	err = db.SetIPAM(testlink.Name, IPAM{})
+	assert.Nil(err)
+
+	ipam, err = db.GetIPAM(testlink.Name)
+	assert.Nil(err)
+	assert.Equal(IPAM{}, *ipam)
+}
+
+func TestDBSetIPAMLinkNotExist(t *testing.T) {
+	assert := assert.New(t)
+
+	db := setupDB()
+	defer db.Close()
+
+	err := db.SetIPAM("link-0", IPAM{})
+	assert.True(errors.Is(err, ErrLinkNotFound))
+
+	_, err = db.GetIPAM("link-0")
+	assert.True(errors.Is(err, ErrLinkNotFound))
+}
+
+func TestDBGetConfigDefault(t *testing.T) {
+	assert := assert.New(t)
+
+	db := setupDB()
+	defer db.Close()
+
+	config, err := db.GetConfig()
+	assert.Nil(err)
+	assert.Equal(defaultConfig(), *config)
+}
+
+func TestDBSetConfigValid(t *testing.T) {
+	assert := assert.New(t)
+
+	db := setupDB()
+	defer db.Close()
+
+	testconfig := Config{
+		Enable: true,
+		ForwardIPv4: true,
+		NATEnable: true,
+		NATLink: "eth0",
+	}
+	err := db.SetConfig(testconfig)
+	assert.Nil(err)
+
+	config, err := db.GetConfig()
+	assert.Nil(err)
+	assert.Equal(testconfig, *config)
+
+	// Setting replaces the stored config
+	testconfig.NATEnable = false
+	testconfig.NATLink = ""
+	err = db.SetConfig(testconfig)
+	assert.Nil(err)
+
+	config, err = db.GetConfig()
+	assert.Nil(err)
+	assert.Equal(testconfig, *config)
+}
@@ -0,0 +1,172 @@
+package dswg
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Peers are online if their last handshake is more recent than this.
+// Wireguard renews sessions every 2 minutes while traffic flows, and
+// drops them after 3 minutes without a handshake.
+const PeerOnlineTimeout = 3 * time.Minute
+
+// Connection state of a peer, derived from its last handshake.
+type PeerState string
+
+const (
+	PeerOnline         PeerState = "online"
+	PeerStale          PeerState = "stale" // no handshake within PeerOnlineTimeout
+	PeerNeverConnected PeerState = "never-connected"
+	PeerNotLoaded      PeerState = "not-loaded" // disabled, or its link is down
+)
+
+// A peer of the database merged with the state the kernel reports for it.
+type PeerStatus struct {
+	Name          string    `json:"name,omitempty"` // empty if unknown to the database
+	PublicKey     Key       `json:"public_key"`
+	Enable        bool      `json:"enable"`
+	State         PeerState `json:"state"`
+	LastHandshake time.Time `json:"last_handshake"` // zero if it never connected
+	ReceiveBytes  int64     `json:"rx_bytes"`
+	TransmitBytes int64     `json:"tx_bytes"`
+	// Endpoint the kernel sends to, which is where the peer last
+	// connected from if it roamed away from the configured endpoint.
+	// Peers without a configured endpoint never roam.
+	Endpoint *UDPAddr `json:"endpoint,omitempty"`
+	Roamed   bool     `json:"roamed,omitempty"`
+	// Set for peers configured in the kernel but not in the database,
+	// which the next Reconcile removes.
+	KernelOnly bool `json:"kernel_only,omitempty"`
+}
+
+type LinkStatus struct {
+	Name       string       `json:"name"`
+	Loaded     bool         `json:"loaded"` // the wireguard link exists in the kernel
+	Up         bool         `json:"up"`
+	PublicKey  Key          `json:"public_key"`
+	ListenPort int          `json:"listen_port"`
+	Peers      []PeerStatus `json:"peers"` // peers of the database first, in order
+}
+
+// Returns the status of the link and its peers, as reported by the kernel.
+func (c *Client) LinkStatus(name string) (*LinkStatus, error) {
+	link, lc, err := c.getLink(name)
+	if err != nil {
+		return nil, err
+	}
+
+	peers, err := c.db.GetLinkPeers(name)
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := lc.wg.Device(name)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return linkStatus(*link, peers, device, lc.isUp(name), time.Now()), nil
+}
+
+// Returns the status of a peer of the link, as reported by the kernel.
+func (c *Client) PeerStatus(linkName, peerName string) (*PeerStatus, error) {
+	link, lc, err := c.getLink(linkName)
+	if err != nil {
+		return nil, err
+	}
+
+	peer, err := c.db.GetPeer(linkName, peerName)
+	if err != nil {
+		return nil, err
+	}
+
+	device, err := lc.wg.Device(linkName)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	status := linkStatus(*link, []Peer{*peer}, device, lc.isUp(linkName), time.Now())
+	return &status.Peers[0], nil
+}
+
+// Merges the link and peers of the database with the device of the
+// kernel, nil if the link isn't loaded.
+func linkStatus(link Link, peers []Peer, device *wgtypes.Device, up bool, now time.Time) *LinkStatus {
+	status := &LinkStatus{
+		Name:       link.Name,
+		Loaded:     device != nil,
+		Up:         device != nil && up,
+		PublicKey:  Key{link.PrivateKey.PublicKey()},
+		ListenPort: link.ListenPort,
+		Peers:      []PeerStatus{},
+	}
+
+	var kernelPeers []wgtypes.Peer
+	if device != nil {
+		status.PublicKey = Key{device.PublicKey}
+		status.ListenPort = device.ListenPort
+		kernelPeers = device.Peers
+	}
+
+	known := make(map[wgtypes.Key]bool)
+	for _, peer := range peers {
+		known[peer.PublicKey.Key] = true
+
+		var kernelPeer *wgtypes.Peer
+		if i := findWGPeer(kernelPeers, peer.PublicKey.Key); i >= 0 {
+			kernelPeer = &kernelPeers[i]
+		}
+		status.Peers = append(status.Peers, peerStatus(&peer, kernelPeer, now))
+	}
+
+	for i := range kernelPeers {
+		if !known[kernelPeers[i].PublicKey] {
+			status.Peers = append(status.Peers, peerStatus(nil, &kernelPeers[i], now))
+		}
+	}
+
+	return status
+}
+
+// Merges a peer of the database with the peer of the kernel, either of
+// them being nil if the other is missing.
+func peerStatus(peer *Peer, kernelPeer *wgtypes.Peer, now time.Time) PeerStatus {
+	status := PeerStatus{State: PeerNotLoaded}
+	if peer != nil {
+		status.Name = peer.Name
+		status.PublicKey = peer.PublicKey
+		status.Enable = peer.Enable
+	} else {
+		status.PublicKey = Key{kernelPeer.PublicKey}
+		status.KernelOnly = true
+	}
+
+	if kernelPeer == nil {
+		return status
+	}
+
+	status.LastHandshake = kernelPeer.LastHandshakeTime
+	status.ReceiveBytes = kernelPeer.ReceiveBytes
+	status.TransmitBytes = kernelPeer.TransmitBytes
+	switch {
+	case kernelPeer.LastHandshakeTime.IsZero():
+		status.State = PeerNeverConnected
+	case now.Sub(kernelPeer.LastHandshakeTime) < PeerOnlineTimeout:
+		status.State = PeerOnline
+	default:
+		status.State = PeerStale
+	}
+
+	if kernelPeer.Endpoint != nil {
+		status.Endpoint = &UDPAddr{*kernelPeer.Endpoint}
+		status.Roamed = peer != nil && peer.Endpoint != nil && !sameEndpoint(peer.Endpoint, kernelPeer.Endpoint)
+	}
+	return status
+}
+
+func sameEndpoint(configured *UDPAddr, current *net.UDPAddr) bool {
+	return configured.IP.Equal(current.IP) && configured.Port == current.Port
+}
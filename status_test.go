@@ -0,0 +1,160 @@
+package dswg
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestClientLinkStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	kernel := NewFakeKernel()
+	client, _ := NewClientWithBackends(setupDB(), kernel, kernel)
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	online, stale := routedPeer(), secondPeer()
+	never := secondPeer()
+	never.Name = "never"
+	addr, _ := ParseIPNet("10.6.6.4/32")
+	never.AllowedIPs = []IPNet{*addr}
+	disabled := secondPeer()
+	disabled.Name = "disabled"
+	disabled.Enable = false
+	disabled.AllowedIPs = nil
+	for _, peer := range []Peer{online, stale, never, disabled} {
+		err := client.AddPeer(testlink.Name, peer)
+		assert.Nil(err)
+	}
+
+	roamed := &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51820}
+	now := time.Now()
+	kernel.SetPeerStats(testlink.Name, online.PublicKey.Key, FakePeerStats{
+		LastHandshake: now.Add(-30 * time.Second),
+		Endpoint:      roamed,
+		ReceiveBytes:  1024,
+		TransmitBytes: 2048,
+	})
+	kernel.SetPeerStats(testlink.Name, stale.PublicKey.Key, FakePeerStats{
+		LastHandshake: now.Add(-10 * time.Minute),
+	})
+
+	// A peer added to the kernel behind dswg's back
+	unknown, _ := wgtypes.GeneratePrivateKey()
+	kernel.ConfigureDevice(testlink.Name, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{PublicKey: unknown.PublicKey()}},
+	})
+
+	status, err := client.LinkStatus(testlink.Name)
+	assert.Nil(err)
+	assert.True(status.Loaded)
+	assert.True(status.Up)
+	assert.Equal(testlink.ListenPort, status.ListenPort)
+	assert.Equal(testlink.PrivateKey.PublicKey(), status.PublicKey.Key)
+
+	var states []PeerState
+	for _, peer := range status.Peers {
+		states = append(states, peer.State)
+	}
+	assert.Equal([]PeerState{PeerOnline, PeerStale, PeerNeverConnected, PeerNotLoaded, PeerNeverConnected}, states)
+
+	peer := status.Peers[0]
+	assert.Equal(online.Name, peer.Name)
+	assert.Equal(int64(1024), peer.ReceiveBytes)
+	assert.Equal(int64(2048), peer.TransmitBytes)
+	assert.Equal("203.0.113.7:51820", peer.Endpoint.String())
+	assert.True(peer.Roamed)
+	assert.False(peer.KernelOnly)
+
+	assert.False(status.Peers[1].Roamed)
+	assert.False(status.Peers[3].Enable)
+	assert.True(status.Peers[2].LastHandshake.IsZero())
+
+	peer = status.Peers[4]
+	assert.Equal("", peer.Name)
+	assert.Equal(unknown.PublicKey(), peer.PublicKey.Key)
+	assert.True(peer.KernelOnly)
+}
+
+func TestClientLinkStatusNotLoaded(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = false
+	client.AddLink(testlink)
+	client.AddPeer(testlink.Name, routedPeer())
+
+	status, err := client.LinkStatus(testlink.Name)
+	assert.Nil(err)
+	assert.False(status.Loaded)
+	assert.False(status.Up)
+	assert.Equal(testlink.PrivateKey.PublicKey(), status.PublicKey.Key)
+	assert.Len(status.Peers, 1)
+	assert.Equal(PeerNotLoaded, status.Peers[0].State)
+
+	_, err = client.LinkStatus("wg-none")
+	assert.True(errors.Is(err, ErrLinkNotFound))
+}
+
+func TestClientPeerStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	kernel := NewFakeKernel()
+	client, _ := NewClientWithBackends(setupDB(), kernel, kernel)
+	defer client.Close()
+
+	testlink, testpeer := baseLink(), routedPeer()
+	client.AddLink(testlink)
+	client.AddPeer(testlink.Name, testpeer)
+	kernel.SetPeerStats(testlink.Name, testpeer.PublicKey.Key, FakePeerStats{
+		LastHandshake: time.Now().Add(-time.Minute),
+		ReceiveBytes:  10,
+	})
+
+	status, err := client.PeerStatus(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Equal(testpeer.Name, status.Name)
+	assert.Equal(PeerOnline, status.State)
+	assert.Equal(int64(10), status.ReceiveBytes)
+	assert.Equal(testpeer.Endpoint.String(), status.Endpoint.String())
+	assert.False(status.Roamed)
+
+	_, err = client.PeerStatus(testlink.Name, "none")
+	assert.True(errors.Is(err, ErrPeerNotFound))
+}
+
+func TestClientPeerStatusNoEndpoint(t *testing.T) {
+	assert := assert.New(t)
+
+	kernel := NewFakeKernel()
+	client, _ := NewClientWithBackends(setupDB(), kernel, kernel)
+	defer client.Close()
+
+	testlink, testpeer := baseLink(), routedPeer()
+	testpeer.Endpoint = nil
+	client.AddLink(testlink)
+	client.AddPeer(testlink.Name, testpeer)
+
+	// The kernel learns the endpoint of the peer when it connects
+	kernel.SetPeerStats(testlink.Name, testpeer.PublicKey.Key, FakePeerStats{
+		LastHandshake: time.Now().Add(-time.Minute),
+		Endpoint:      &net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51820},
+	})
+
+	status, err := client.PeerStatus(testlink.Name, testpeer.Name)
+	assert.Nil(err)
+	assert.Equal(PeerOnline, status.State)
+	assert.Equal("203.0.113.7:51820", status.Endpoint.String())
+	assert.False(status.Roamed)
+}
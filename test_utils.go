@@ -22,8 +22,9 @@ func baseLink() Link {
 		AddressIPv4: ipv4,
 		AddressIPv6: ipv6,
 		DefaultDNS1: dns1,
-		PostDown: []string{"cmd1", "cmd2"},
-		PostUp: []string{"cmd3"},
+		Host: "vpn.example.com",
+		PostDown: []string{"echo down %i", "true"},
+		PostUp: []string{"echo up %i"},
 		DefaultAllowedIPs: []IPNet{*addr1, *addr2},
 		Forward: false,
 	}
@@ -44,6 +45,7 @@ func basePeer() Peer {
 }
 
 func baseClient() Client {
-	client, _ := NewClient(setupDB())
+	kernel := NewFakeKernel()
+	client, _ := NewClientWithBackends(setupDB(), kernel, kernel)
 	return *client
 }
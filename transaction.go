@@ -0,0 +1,174 @@
+package dswg
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Error of a Client operation that failed at one of its steps. The kernel
+// changes made by the steps before it are rolled back, and the database
+// is left untouched, since it is only written by the last step.
+type StepError struct {
+	Op   string // Client method, ex. "ActivateLink"
+	Step string // ex. "add peer zoz-pc", empty if no step failed
+	Err  error
+	// Set when undoing the previous steps failed as well, leaving the
+	// kernel out of sync with the database until the next Reconcile.
+	RollbackErr error
+}
+
+func (e *StepError) Error() string {
+	msg := e.Op + " failed"
+	if len(e.Step) > 0 {
+		msg += " to " + e.Step
+	}
+	msg += ": " + e.Err.Error()
+
+	if e.RollbackErr != nil {
+		return msg + ", rollback failed: " + e.RollbackErr.Error()
+	}
+	return msg + ", rolled back"
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// The kernel steps taken by a Client operation, undone in reverse order
+// if the operation fails.
+type transaction struct {
+	op    string
+	undos []undoStep
+}
+
+type undoStep struct {
+	step string
+	undo func() error
+}
+
+// Runs fn as a single operation, rolling back the steps it took when it
+// returns an error. Errors returned before any step was taken are passed
+// through as they are.
+func (c *Client) transact(op string, fn func(tx *transaction) error) error {
+	start := time.Now()
+	err := runSteps(op, fn)
+	c.observe(op, start, err)
+	return err
+}
+
+// Same as transact, without recording the operation, ex. for the steps
+// Reconcile takes for each link.
+func runSteps(op string, fn func(tx *transaction) error) error {
+	tx := &transaction{op: op}
+	err := fn(tx)
+	if err != nil {
+		err = tx.rollback(err)
+	}
+	return err
+}
+
+// Runs a step of the operation, undo reverts it once it succeeded. Steps
+// that don't change the kernel have no undo.
+func (tx *transaction) do(step string, do, undo func() error) error {
+	err := do()
+	if err != nil {
+		return &StepError{Op: tx.op, Step: step, Err: err}
+	}
+
+	if undo != nil {
+		tx.onRollback(step, undo)
+	}
+	return nil
+}
+
+// Registers undo to run on rollback, ex. before a step that can fail
+// halfway through.
+func (tx *transaction) onRollback(step string, undo func() error) {
+	tx.undos = append(tx.undos, undoStep{step: step, undo: undo})
+}
+
+// Undoes every step taken, even if some fail to be undone, and returns
+// err as a StepError reporting the result.
+func (tx *transaction) rollback(err error) error {
+	stepErr, ok := err.(*StepError)
+	if !ok {
+		if len(tx.undos) == 0 {
+			return err
+		}
+		stepErr = &StepError{Op: tx.op, Err: err}
+	}
+
+	var failed []string
+	for i := len(tx.undos) - 1; i >= 0; i-- {
+		undo := tx.undos[i]
+		if err := undo.undo(); err != nil {
+			failed = append(failed, fmt.Sprintf("undo %v: %v", undo.step, err))
+		}
+	}
+	tx.undos = nil
+
+	if len(failed) > 0 {
+		stepErr.RollbackErr = errors.New(strings.Join(failed, "; "))
+	}
+	return stepErr
+}
+
+// Returns the peer of the kernel device, nil if it isn't loaded.
+func (c *Client) kernelPeer(linkName string, key wgtypes.Key) (*wgtypes.Peer, error) {
+	device, err := c.wg.Device(linkName)
+	if err != nil {
+		return nil, err
+	}
+
+	i := findWGPeer(device.Peers, key)
+	if i < 0 {
+		return nil, nil
+	}
+	return &device.Peers[i], nil
+}
+
+// Puts the kernel peer back the way it was, removing it if it wasn't
+// loaded.
+func (c *Client) restorePeer(linkName string, key wgtypes.Key, old *wgtypes.Peer) error {
+	config := wgtypes.PeerConfig{PublicKey: key, Remove: true}
+	if old != nil {
+		config = wgtypes.PeerConfig{
+			PublicKey:                   old.PublicKey,
+			PresharedKey:                &old.PresharedKey,
+			Endpoint:                    old.Endpoint,
+			PersistentKeepaliveInterval: &old.PersistentKeepaliveInterval,
+			ReplaceAllowedIPs:           true,
+			AllowedIPs:                  old.AllowedIPs,
+		}
+	}
+
+	return c.wg.ConfigureDevice(linkName, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{config},
+	})
+}
+
+// Adds the routes back, ex. after they were deleted by a step that is
+// rolled back.
+func (c *Client) restoreRoutes(netInterface netlink.Link, link Link, routes []netlink.Route) error {
+	for _, route := range routes {
+		// The fwmark dropped with the default routes is taken back
+		if autoMarked(link) && isDefaultRoute(*route.Dst) {
+			err := c.setLinkMark(netInterface.Attrs().Name, route.Table)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := c.ns.RouteReplace(&route)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.syncRules(netInterface, link)
+}
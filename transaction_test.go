@@ -0,0 +1,429 @@
+package dswg
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// A FakeKernel failing some calls, to test rollbacks.
+type failingKernel struct {
+	*FakeKernel
+	failPeer    *wgtypes.Key // ConfigureDevice fails adding this peer
+	failLinkDel bool
+}
+
+func (k *failingKernel) ConfigureDevice(name string, cfg wgtypes.Config) error {
+	for _, peer := range cfg.Peers {
+		if k.failPeer != nil && peer.PublicKey == *k.failPeer && !peer.Remove {
+			return syscall.EIO
+		}
+	}
+	return k.FakeKernel.ConfigureDevice(name, cfg)
+}
+
+func (k *failingKernel) LinkDel(link netlink.Link) error {
+	if k.failLinkDel {
+		return syscall.EBUSY
+	}
+	return k.FakeKernel.LinkDel(link)
+}
+
+// A database failing the writes made after the kernel is configured.
+type failingDB struct {
+	DB
+	fail bool
+}
+
+var errDBWrite = errors.New("Database is locked")
+
+func (db *failingDB) AddPeer(linkName string, peer Peer) error {
+	if db.fail {
+		return errDBWrite
+	}
+	return db.DB.AddPeer(linkName, peer)
+}
+
+func (db *failingDB) UpdateLink(name string, link Link) error {
+	if db.fail {
+		return errDBWrite
+	}
+	return db.DB.UpdateLink(name, link)
+}
+
+func (db *failingDB) RemoveLink(name string) error {
+	if db.fail {
+		return errDBWrite
+	}
+	return db.DB.RemoveLink(name)
+}
+
+func (db *failingDB) Transaction(fn func(tx DB) error) error {
+	return db.DB.Transaction(func(tx DB) error {
+		return fn(&failingDB{DB: tx, fail: db.fail})
+	})
+}
+
+func failingClient() (*Client, *failingKernel, *failingDB) {
+	kernel := &failingKernel{FakeKernel: NewFakeKernel()}
+	db := &failingDB{DB: setupDB()}
+	client, _ := NewClientWithBackends(db, kernel, kernel)
+	return client, kernel, db
+}
+
+func secondPeer() Peer {
+	peer := routedPeer()
+	peer.Name = "second"
+	key, _ := wgtypes.GeneratePrivateKey()
+	peer.PublicKey = Key{key.PublicKey()}
+	peer.PresharedKey = nil
+	addr, _ := ParseIPNet("10.6.6.3/32")
+	peer.AllowedIPs = []IPNet{*addr}
+	return peer
+}
+
+func TestStepError(t *testing.T) {
+	assert := assert.New(t)
+
+	err := &StepError{Op: "ActivateLink", Step: "add peer zoz-pc", Err: syscall.EIO}
+	assert.Equal("ActivateLink failed to add peer zoz-pc: input/output error, rolled back", err.Error())
+	assert.True(errors.Is(err, syscall.EIO))
+
+	err.RollbackErr = errors.New("undo create link wg-linko: device or resource busy")
+	assert.Equal("ActivateLink failed to add peer zoz-pc: input/output error, "+
+		"rollback failed: undo create link wg-linko: device or resource busy", err.Error())
+}
+
+func TestTransactionRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	var undone []string
+	tx := &transaction{op: "Test"}
+	for _, step := range []string{"first", "second"} {
+		step := step
+		err := tx.do(step, func() error { return nil }, func() error {
+			undone = append(undone, step)
+			return nil
+		})
+		assert.Nil(err)
+	}
+
+	err := tx.do("third", func() error { return syscall.EIO }, func() error {
+		undone = append(undone, "third")
+		return nil
+	})
+	err = tx.rollback(err)
+
+	// Steps are undone in reverse, except the one that failed
+	assert.Equal([]string{"second", "first"}, undone)
+	stepErr, ok := err.(*StepError)
+	assert.True(ok)
+	assert.Equal("third", stepErr.Step)
+	assert.Nil(stepErr.RollbackErr)
+}
+
+func TestTransactionNoSteps(t *testing.T) {
+	assert := assert.New(t)
+
+	// Errors before any step are not wrapped
+	tx := &transaction{op: "Test"}
+	err := tx.rollback(syscall.ENOENT)
+	assert.Equal(syscall.ENOENT, err)
+}
+
+func TestClientActivateLinkRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	client, kernel, _ := failingClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = false
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer1, testpeer2 := routedPeer(), secondPeer()
+	for _, peer := range []Peer{testpeer1, testpeer2} {
+		err := client.AddPeer(testlink.Name, peer)
+		assert.Nil(err)
+	}
+
+	kernel.failPeer = &testpeer2.PublicKey.Key
+	err = client.ActivateLink(testlink.Name)
+	stepErr, ok := err.(*StepError)
+	assert.True(ok)
+	assert.Equal("ActivateLink", stepErr.Op)
+	assert.Equal("add peer second", stepErr.Step)
+	assert.Equal(syscall.EIO, stepErr.Err)
+	assert.Nil(stepErr.RollbackErr)
+
+	// The link created for the activation is deleted
+	netInterface, _ := client.ns.LinkByName(testlink.Name)
+	assert.Nil(netInterface)
+
+	dblink, err := client.db.GetLink(testlink.Name)
+	assert.Nil(err)
+	assert.False(dblink.Enable)
+}
+
+func TestClientActivateLinkRollbackFails(t *testing.T) {
+	assert := assert.New(t)
+
+	client, kernel, _ := failingClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = false
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	testpeer := routedPeer()
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	kernel.failPeer = &testpeer.PublicKey.Key
+	kernel.failLinkDel = true
+	err = client.ActivateLink(testlink.Name)
+	stepErr, ok := err.(*StepError)
+	assert.True(ok)
+	assert.Equal("add peer zoz-pc", stepErr.Step)
+	assert.NotNil(stepErr.RollbackErr)
+	assert.Contains(stepErr.RollbackErr.Error(), "undo create link wg-linko")
+}
+
+func TestClientAddLinkActivationFails(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.PostUp = []string{"exit 1"}
+	err := client.AddLink(testlink)
+	stepErr, ok := err.(*StepError)
+	assert.True(ok)
+	assert.Equal("run PostUp of link wg-linko", stepErr.Step)
+
+	// Neither the kernel nor the database keep the link
+	netInterface, _ := client.ns.LinkByName(testlink.Name)
+	assert.Nil(netInterface)
+	_, err = client.db.GetLink(testlink.Name)
+	assert.NotNil(err)
+}
+
+func TestClientDeactivateLinkRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.PostDown = []string{"exit 1"}
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+	err = client.AddPeer(testlink.Name, routedPeer())
+	assert.Nil(err)
+
+	err = client.DeactivateLink(testlink.Name)
+	stepErr, ok := err.(*StepError)
+	assert.True(ok)
+	assert.Equal("run PostDown of link wg-linko", stepErr.Step)
+	assert.Nil(stepErr.RollbackErr)
+
+	// The link is brought back up with its routes
+	netInterface, _ := client.ns.LinkByName(testlink.Name)
+	assert.Equal(net.FlagUp, netInterface.Attrs().Flags&net.FlagUp)
+	assert.Equal(map[string]int{"10.6.6.2/32": RouteProtocol}, kernelRoutes(client, testlink.Name))
+
+	dblink, _ := client.db.GetLink(testlink.Name)
+	assert.True(dblink.Enable)
+}
+
+func TestClientReconcileDeactivateRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	client := baseClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.PostDown = []string{"exit 1"}
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+	err = client.AddPeer(testlink.Name, routedPeer())
+	assert.Nil(err)
+
+	disabled := testlink
+	disabled.Enable = false
+	err = client.db.UpdateLink(testlink.Name, disabled)
+	assert.Nil(err)
+
+	_, err = client.Reconcile(context.Background(), ReconcileOptions{})
+	stepErr, ok := err.(*StepError)
+	assert.True(ok)
+	assert.Equal("Reconcile", stepErr.Op)
+	assert.Equal("run PostDown of link wg-linko", stepErr.Step)
+	assert.Nil(stepErr.RollbackErr)
+
+	// The link is brought back up with its routes
+	netInterface, _ := client.ns.LinkByName(testlink.Name)
+	assert.Equal(net.FlagUp, netInterface.Attrs().Flags&net.FlagUp)
+	assert.Equal(map[string]int{"10.6.6.2/32": RouteProtocol}, kernelRoutes(client, testlink.Name))
+}
+
+func TestClientUpdateLinkRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	client, _, db := failingClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+	err = client.AddPeer(testlink.Name, routedPeer())
+	assert.Nil(err)
+
+	db.fail = true
+	updated := testlink
+	updated.Name = "wg-renamed"
+	updated.ListenPort = 9988
+	err = client.UpdateLink(testlink.Name, updated)
+	stepErr, ok := err.(*StepError)
+	assert.True(ok)
+	assert.Equal("update link wg-linko in database", stepErr.Step)
+	assert.Equal(errDBWrite, stepErr.Err)
+	assert.Nil(stepErr.RollbackErr)
+
+	// The kernel link is configured as it was
+	netInterface, err := client.ns.LinkByName(testlink.Name)
+	assert.Nil(err)
+	assert.Equal(net.FlagUp, netInterface.Attrs().Flags&net.FlagUp)
+	device, _ := client.wg.Device(testlink.Name)
+	assert.Equal(testlink.ListenPort, device.ListenPort)
+	assert.Len(device.Peers, 1)
+	assert.Equal(map[string]int{"10.6.6.2/32": RouteProtocol}, kernelRoutes(*client, testlink.Name))
+}
+
+func TestClientRemoveLinkRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	client, _, db := failingClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+	testpeer := routedPeer()
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	db.fail = true
+	err = client.RemoveLink(testlink.Name)
+	stepErr, ok := err.(*StepError)
+	assert.True(ok)
+	assert.Equal("remove link wg-linko from database", stepErr.Step)
+	assert.Nil(stepErr.RollbackErr)
+
+	// The deleted link is loaded again, up, with its peer
+	netInterface, err := client.ns.LinkByName(testlink.Name)
+	assert.Nil(err)
+	assert.Equal(net.FlagUp, netInterface.Attrs().Flags&net.FlagUp)
+	device, _ := client.wg.Device(testlink.Name)
+	assert.Equal(testlink.PrivateKey.Key, device.PrivateKey)
+	assert.Len(device.Peers, 1)
+	assert.Equal(testpeer.PublicKey.Key, device.Peers[0].PublicKey)
+	assert.Equal(map[string]int{"10.6.6.2/32": RouteProtocol}, kernelRoutes(*client, testlink.Name))
+
+	plan, err := client.Plan()
+	assert.Nil(err)
+	assert.True(plan.Empty(), plan.String())
+}
+
+func TestClientAddPeerRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	client, _, db := failingClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	db.fail = true
+	err = client.AddPeer(testlink.Name, routedPeer())
+	stepErr, ok := err.(*StepError)
+	assert.True(ok)
+	assert.Equal("add peer zoz-pc to database", stepErr.Step)
+	assert.True(errors.Is(err, errDBWrite))
+
+	device, _ := client.wg.Device(testlink.Name)
+	assert.Len(device.Peers, 0)
+	assert.Len(kernelRoutes(*client, testlink.Name), 0)
+}
+
+func TestClientUpdatePeerRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	client, kernel, _ := failingClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+	testpeer := routedPeer()
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	// The new key fails to load, so the old one is loaded back
+	updated := secondPeer()
+	updated.Name = testpeer.Name
+	kernel.failPeer = &updated.PublicKey.Key
+	err = client.UpdatePeer(testlink.Name, testpeer.Name, updated)
+	stepErr, ok := err.(*StepError)
+	assert.True(ok)
+	assert.Equal("add peer zoz-pc", stepErr.Step)
+	assert.Nil(stepErr.RollbackErr)
+
+	device, _ := client.wg.Device(testlink.Name)
+	assert.Len(device.Peers, 1)
+	assert.Equal(testpeer.PublicKey.Key, device.Peers[0].PublicKey)
+	assert.Equal("10.6.6.2/32", device.Peers[0].AllowedIPs[0].String())
+	assert.Equal(map[string]int{"10.6.6.2/32": RouteProtocol}, kernelRoutes(*client, testlink.Name))
+
+	dbpeer, _ := client.db.GetPeer(testlink.Name, testpeer.Name)
+	assert.Equal(testpeer.PublicKey, dbpeer.PublicKey)
+}
+
+func TestClientImportLinkRollback(t *testing.T) {
+	assert := assert.New(t)
+
+	client, _, db := failingClient()
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.ns.LinkAdd(testlink)
+	assert.Nil(err)
+	err = client.setLinkSystemConfig(testlink.Name, testlink)
+	assert.Nil(err)
+	err = client.wg.ConfigureDevice(testlink.Name, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{peerConfig(routedPeer())},
+	})
+	assert.Nil(err)
+
+	// The link is added, but not its peer
+	db.fail = true
+	err = client.ImportLink(testlink.Name)
+	assert.Equal(errDBWrite, err)
+
+	_, err = db.GetLink(testlink.Name)
+	assert.True(errors.Is(err, ErrLinkNotFound))
+
+	db.fail = false
+	err = client.ImportLink(testlink.Name)
+	assert.Nil(err)
+}
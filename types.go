@@ -72,6 +72,19 @@ func (ip IPNet) Value() (driver.Value, error) {
 	return driver.Value(ip.String()), nil
 }
 
+func (ip IPNet) MarshalText() ([]byte, error) {
+	return []byte(ip.String()), nil
+}
+
+func (ip *IPNet) UnmarshalText(text []byte) error {
+	parsed, err := ParseIPNet(string(text))
+	if err != nil {
+		return err
+	}
+	*ip = *parsed
+	return nil
+}
+
 type Key struct {
 	wgtypes.Key
 }
@@ -107,6 +120,19 @@ func (k Key) Value() (driver.Value, error) {
 	return driver.Value(k.String()), nil
 }
 
+func (k Key) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *Key) UnmarshalText(text []byte) error {
+	parsed, err := ParseKey(string(text))
+	if err != nil {
+		return err
+	}
+	*k = *parsed
+	return nil
+}
+
 type UDPAddr struct {
 	net.UDPAddr
 }
@@ -141,6 +167,19 @@ func (udp UDPAddr) Value() (driver.Value, error) {
 	return driver.Value(udp.String()), nil
 }
 
+func (udp UDPAddr) MarshalText() ([]byte, error) {
+	return []byte(udp.String()), nil
+}
+
+func (udp *UDPAddr) UnmarshalText(text []byte) error {
+	parsed, err := ParseUDP(string(text))
+	if err != nil {
+		return err
+	}
+	*udp = *parsed
+	return nil
+}
+
 type Link struct {
 	Name				string	`db:"name"`
 	MTU					int		`db:"mtu"`
@@ -153,9 +192,13 @@ type Link struct {
 	DefaultAllowedIPs	[]IPNet
 	DefaultDNS1			*IP		`db:"default_dns1"`
 	DefaultDNS2			*IP		`db:"default_dns2"`
+	Host				string	`db:"host"` // public host name or IP peers connect to
 	PostUp				[]string
 	PostDown			[]string
 	Forward				bool	`db:"forward"`
+	Namespace			string	`db:"namespace"` // network namespace name or path, empty for the client's
+	Table				string	`db:"route_table"` // "auto" (or empty), "off", or a routing table number
+	RulePriority		int		`db:"rule_priority"` // of the policy routing rules, 0 for DefaultRulePriority
 }
 
 func (link Link) Attrs() *netlink.LinkAttrs {
@@ -174,10 +217,11 @@ type Peer struct {
 	Name				string		`db:"name"`
 	Enable				bool		`db:"enable"`
 	PublicKey			Key			`db:"public_key"`
+	PrivateKey			*Key		`db:"private_key"` // only known if dswg generated it
 	PresharedKey		*Key		`db:"preshared_key"`
 	Endpoint			*UDPAddr	`db:"endpoint"`
 	AllowedIPs			[]IPNet
-	PersistentKeepalive	int64		`db:"keepalive"`
+	PersistentKeepalive	int64		`db:"keepalive"` // seconds
 	DNS1				*IP			`db:"dns1"`
 	DNS2				*IP			`db:"dns2"`
 }
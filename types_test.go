@@ -1,19 +1,18 @@
 package dswg
 
 import (
-	"net"
-	"testing"
-	"github.com/vishvananda/netlink"
 	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"net"
+	"testing"
 )
 
-
 func TestParseIPValid(t *testing.T) {
 	assert := assert.New(t)
-	
+
 	ip, err := ParseIP("10.66.94.20")
-	
+
 	assert.Nil(err)
 	assert.Equal(byte(10), ip.IP[12])
 	assert.Equal(byte(66), ip.IP[13])
@@ -25,7 +24,7 @@ func TestParseIPInvalid(t *testing.T) {
 	assert := assert.New(t)
 
 	_, err := ParseIP("x")
-	
+
 	assert.NotNil(err)
 }
 
@@ -34,7 +33,7 @@ func TestIPScanValid(t *testing.T) {
 
 	ip := IP{}
 	err := ip.Scan("::1")
-	
+
 	assert.Nil(err)
 	assert.Equal(ip.IP, net.ParseIP("::1"))
 }
@@ -44,7 +43,7 @@ func TestIPScanInvalid(t *testing.T) {
 
 	ip := IP{}
 	err := ip.Scan("10..2")
-	
+
 	assert.NotNil(err)
 }
 
@@ -53,17 +52,17 @@ func TestIPValue(t *testing.T) {
 
 	ip, err := ParseIP("10.66.94.20")
 	assert.Nil(err)
-	
-	value, err := ip.Value() 
+
+	value, err := ip.Value()
 	assert.Nil(err)
 	assert.Equal(value.(string), "10.66.94.20")
 }
 
 func TestParseIPNetValid(t *testing.T) {
 	assert := assert.New(t)
-	
+
 	ip, err := ParseIPNet("10.66.94.20/24")
-	
+
 	assert.Nil(err)
 	assert.Equal(byte(10), ip.IPNet.IP[12])
 	assert.Equal(byte(66), ip.IPNet.IP[13])
@@ -80,7 +79,7 @@ func TestParseIPNetInvalid(t *testing.T) {
 	assert := assert.New(t)
 
 	_, err := ParseIPNet("x")
-	
+
 	assert.NotNil(err)
 }
 
@@ -89,7 +88,7 @@ func TestIPNetScanValid(t *testing.T) {
 
 	ip := IPNet{}
 	err := ip.Scan("::1/128")
-	
+
 	expected, _ := netlink.ParseIPNet("::1/128")
 
 	assert.Nil(err)
@@ -101,7 +100,7 @@ func TestIPNetScanInvalid(t *testing.T) {
 
 	ip := IPNet{}
 	err := ip.Scan("::1") // not / at the end for mask
-	
+
 	assert.NotNil(err)
 }
 
@@ -110,15 +109,15 @@ func TestIPNetValue(t *testing.T) {
 
 	ip, err := ParseIPNet("::1/128")
 	assert.Nil(err)
-	
-	value, err := ip.Value() 
+
+	value, err := ip.Value()
 	assert.Nil(err)
 	assert.Equal(value.(string), "::1/128")
 }
 
 func TestParseKeyValid(t *testing.T) {
 	assert := assert.New(t)
-	
+
 	key, err := ParseKey("GK3G63/XzfzGbpeMVAKgurB8hH+R3GXtwNv15owGoXc=")
 	expectedPrivateKey := "69+X6VtL071Q1D0SJgiOjZdUraMeZIPpyQFBHuznKgY="
 
@@ -130,7 +129,7 @@ func TestParseKeyInvalid(t *testing.T) {
 	assert := assert.New(t)
 
 	_, err := ParseKey("x")
-	
+
 	assert.NotNil(err)
 }
 
@@ -152,7 +151,7 @@ func TestKeyScanInvalid(t *testing.T) {
 
 	key := Key{}
 	err := key.Scan("x")
-	
+
 	assert.NotNil(err)
 }
 
@@ -161,16 +160,15 @@ func TestKeyValue(t *testing.T) {
 
 	key, err := ParseKey("GK3G63/XzfzGbpeMVAKgurB8hH+R3GXtwNv15owGoXc=")
 	assert.Nil(err)
-	
-	value, err := key.Value() 
+
+	value, err := key.Value()
 	assert.Nil(err)
 	assert.Equal(value.(string), "GK3G63/XzfzGbpeMVAKgurB8hH+R3GXtwNv15owGoXc=")
 }
 
-
 func TestParseUDPAddrValid(t *testing.T) {
 	assert := assert.New(t)
-	
+
 	udp, err := ParseUDP("192.168.0.200:42069")
 
 	assert.Nil(err)
@@ -195,7 +193,7 @@ func TestUDPAddrScanValid(t *testing.T) {
 	udp := UDPAddr{}
 	err := udp.Scan("192.168.0.69:89")
 	assert.Nil(err)
-	
+
 	udpExpected, err := net.ResolveUDPAddr("udp", "192.168.0.69:89")
 
 	assert.Equal(udp.UDPAddr, *udpExpected)
@@ -214,8 +212,58 @@ func TestUDPAddrValue(t *testing.T) {
 
 	udp, err := ParseUDP("10.66.0.1:420")
 	assert.Nil(err)
-	
-	value, err := udp.Value() 
+
+	value, err := udp.Value()
 	assert.Nil(err)
 	assert.Equal(value.(string), "10.66.0.1:420")
-}
\ No newline at end of file
+}
+func TestIPNetMarshalText(t *testing.T) {
+	assert := assert.New(t)
+
+	ip, _ := ParseIPNet("10.6.6.1/24")
+	text, err := ip.MarshalText()
+	assert.Nil(err)
+	assert.Equal("10.6.6.1/24", string(text))
+
+	var decoded IPNet
+	err = decoded.UnmarshalText(text)
+	assert.Nil(err)
+	assert.Equal(*ip, decoded)
+
+	err = decoded.UnmarshalText([]byte("x"))
+	assert.NotNil(err)
+}
+
+func TestKeyMarshalText(t *testing.T) {
+	assert := assert.New(t)
+
+	key, _ := ParseKey("GK3G63/XzfzGbpeMVAKgurB8hH+R3GXtwNv15owGoXc=")
+	text, err := key.MarshalText()
+	assert.Nil(err)
+	assert.Equal("GK3G63/XzfzGbpeMVAKgurB8hH+R3GXtwNv15owGoXc=", string(text))
+
+	var decoded Key
+	err = decoded.UnmarshalText(text)
+	assert.Nil(err)
+	assert.Equal(*key, decoded)
+
+	err = decoded.UnmarshalText([]byte("x"))
+	assert.NotNil(err)
+}
+
+func TestUDPAddrMarshalText(t *testing.T) {
+	assert := assert.New(t)
+
+	udp, _ := ParseUDP("10.66.0.1:420")
+	text, err := udp.MarshalText()
+	assert.Nil(err)
+	assert.Equal("10.66.0.1:420", string(text))
+
+	var decoded UDPAddr
+	err = decoded.UnmarshalText(text)
+	assert.Nil(err)
+	assert.Equal(*udp, decoded)
+
+	err = decoded.UnmarshalText([]byte("10.66.0.1"))
+	assert.NotNil(err)
+}
@@ -0,0 +1,312 @@
+package dswg
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// A LinkManager that runs wireguard links as wireguard-go devices on TUN
+// interfaces, for hosts that can't load the wireguard kernel module.
+// Every device listens on a UAPI socket in /var/run/wireguard, which is
+// how wgctrl configures it, and other links are passed to the wrapped
+// LinkManager. Devices live as long as the process, and are stopped by
+// Delete. They follow the state of their interface when it is set up or
+// down through the manager, not when others do it.
+type UserspaceLinkManager struct {
+	LinkManager
+
+	mu      sync.Mutex
+	devices map[string]*userspaceDevice
+}
+
+type userspaceDevice struct {
+	device *device.Device
+	tun    tun.Device
+	uapi   net.Listener
+}
+
+// Wraps links so that wireguard links are created in userspace.
+func NewUserspaceLinkManager(links LinkManager) *UserspaceLinkManager {
+	return &UserspaceLinkManager{
+		LinkManager: links,
+		devices:     make(map[string]*userspaceDevice),
+	}
+}
+
+// Run wireguard links in userspace with wireguard-go instead of the
+// kernel module, see UserspaceLinkManager.
+func WithUserspace() ClientOption {
+	return func(c *Client) {
+		c.ns = NewUserspaceLinkManager(c.ns)
+	}
+}
+
+func (m *UserspaceLinkManager) LinkAdd(link netlink.Link) error {
+	if link.Type() != "wireguard" {
+		return m.LinkManager.LinkAdd(link)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name := link.Attrs().Name
+	if existing, _ := m.LinkManager.LinkByName(name); existing != nil {
+		return syscall.EEXIST
+	}
+
+	mtu := link.Attrs().MTU
+	if mtu <= 0 {
+		mtu = device.DefaultMTU
+	}
+
+	nativeTun, err := tun.CreateTUN(name, mtu)
+	if err != nil {
+		return err
+	}
+	tunDevice := newUserspaceTUN(nativeTun)
+
+	logger := device.NewLogger(device.LogLevelError, fmt.Sprintf("(%v) ", name))
+	dev := device.NewDevice(tunDevice, logger)
+
+	uapi, err := listenUAPI(name, dev)
+	if err != nil {
+		dev.Close()
+		return err
+	}
+
+	m.devices[name] = &userspaceDevice{device: dev, tun: tunDevice, uapi: uapi}
+	return nil
+}
+
+// Opens the UAPI socket of the device and serves wgctrl requests on it.
+func listenUAPI(name string, dev *device.Device) (net.Listener, error) {
+	file, err := ipc.UAPIOpen(name)
+	if err != nil {
+		return nil, err
+	}
+
+	uapi, err := ipc.UAPIListen(name, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	go func() {
+		for {
+			conn, err := uapi.Accept()
+			if err != nil {
+				return
+			}
+			go dev.IpcHandle(conn)
+		}
+	}()
+
+	return uapi, nil
+}
+
+func (m *UserspaceLinkManager) LinkDel(link netlink.Link) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name, ok := m.userspaceName(link)
+	if !ok {
+		return m.LinkManager.LinkDel(link)
+	}
+
+	// The TUN interface goes away with the device
+	m.stop(name)
+	return nil
+}
+
+// Brings the wireguard-go device up with its interface.
+func (m *UserspaceLinkManager) LinkSetUp(link netlink.Link) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := m.LinkManager.LinkSetUp(link)
+	if err != nil {
+		return err
+	}
+
+	if name, ok := m.userspaceName(link); ok {
+		m.devices[name].device.Up()
+	}
+	return nil
+}
+
+// Brings the wireguard-go device down with its interface.
+func (m *UserspaceLinkManager) LinkSetDown(link netlink.Link) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := m.LinkManager.LinkSetDown(link)
+	if err != nil {
+		return err
+	}
+
+	if name, ok := m.userspaceName(link); ok {
+		m.devices[name].device.Down()
+	}
+	return nil
+}
+
+func (m *UserspaceLinkManager) stop(name string) {
+	dev := m.devices[name]
+	dev.uapi.Close()
+	dev.device.Close()
+	delete(m.devices, name)
+}
+
+// Returns the name of the link if it is a userspace device.
+// The lock must be held.
+func (m *UserspaceLinkManager) userspaceName(link netlink.Link) (string, bool) {
+	name := link.Attrs().Name
+	if link.Attrs().Index > 0 {
+		if l, err := m.LinkManager.LinkByName(name); err != nil || l.Attrs().Index != link.Attrs().Index {
+			return "", false
+		}
+	}
+
+	_, ok := m.devices[name]
+	return name, ok
+}
+
+// Userspace devices are reported as wireguard links.
+func (m *UserspaceLinkManager) LinkByName(name string) (netlink.Link, error) {
+	link, err := m.LinkManager.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.wrap(link), nil
+}
+
+func (m *UserspaceLinkManager) LinkList() ([]netlink.Link, error) {
+	links, err := m.LinkManager.LinkList()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range links {
+		links[i] = m.wrap(links[i])
+	}
+	return links, nil
+}
+
+func (m *UserspaceLinkManager) wrap(link netlink.Link) netlink.Link {
+	if _, ok := m.devices[link.Attrs().Name]; !ok {
+		return link
+	}
+	return &netlink.GenericLink{LinkAttrs: *link.Attrs(), LinkType: "wireguard"}
+}
+
+// Renaming a userspace device moves its UAPI socket to the new name.
+func (m *UserspaceLinkManager) LinkSetName(link netlink.Link, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	old, ok := m.userspaceName(link)
+	if !ok || old == name {
+		return m.LinkManager.LinkSetName(link, name)
+	}
+
+	err := m.LinkManager.LinkSetName(link, name)
+	if err != nil {
+		return err
+	}
+
+	dev := m.devices[old]
+	uapi, err := listenUAPI(name, dev.device)
+	if err != nil {
+		m.LinkManager.LinkSetName(link, old)
+		return err
+	}
+
+	// wireguard-go caches the interface name, refreshed by Name
+	dev.tun.Name()
+
+	dev.uapi.Close()
+	dev.uapi = uapi
+	delete(m.devices, old)
+	m.devices[name] = dev
+	return nil
+}
+
+func (m *UserspaceLinkManager) LinkSetNsFd(link netlink.Link, fd int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.userspaceName(link); ok {
+		return errors.New("Userspace links can't be moved to other namespaces")
+	}
+	return m.LinkManager.LinkSetNsFd(link, fd)
+}
+
+// Stops every userspace device, then releases the wrapped LinkManager.
+func (m *UserspaceLinkManager) Delete() {
+	m.mu.Lock()
+	for name := range m.devices {
+		m.stop(name)
+	}
+	m.mu.Unlock()
+
+	m.LinkManager.Delete()
+}
+
+// A TUN device that only passes MTU updates on to wireguard-go. Handling
+// up and down events in wireguard-go races with Device.Close, which can
+// then wait forever on the event reader, so UserspaceLinkManager changes
+// the device state itself, holding its lock.
+type userspaceTUN struct {
+	tun.Device
+	events    chan tun.Event
+	done      chan struct{} // closed by Close
+	closeOnce sync.Once
+}
+
+func newUserspaceTUN(device tun.Device) *userspaceTUN {
+	t := &userspaceTUN{
+		Device: device,
+		events: make(chan tun.Event),
+		done:   make(chan struct{}),
+	}
+	go t.forwardEvents()
+	return t
+}
+
+// Forwards MTU updates until the TUN device is closed. Updates nobody
+// reads anymore once it is closed are dropped, so the events of the
+// TUN device are drained until it closes them.
+func (t *userspaceTUN) forwardEvents() {
+	defer close(t.events)
+	for event := range t.Device.Events() {
+		if event&tun.EventMTUUpdate == 0 {
+			continue
+		}
+		select {
+		case t.events <- tun.EventMTUUpdate:
+		case <-t.done:
+		}
+	}
+}
+
+func (t *userspaceTUN) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	return t.Device.Close()
+}
+
+func (t *userspaceTUN) Events() chan tun.Event {
+	return t.events
+}
@@ -0,0 +1,264 @@
+package dswg
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Set in test processes re-executed inside a fresh network namespace.
+const testNamespaceEnv = "DSWG_TEST_NAMESPACE"
+
+// Runs the test again in a child process living in a fresh network
+// namespace, so TUN devices and wireguard-go sockets never touch the
+// host network. Returns true in the child, where the test runs.
+func inFreshNamespace(t *testing.T) bool {
+	if os.Getenv(testNamespaceEnv) == "1" {
+		return true
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("Creating network namespaces requires root")
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skip("TUN devices are not supported:", err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run", "^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), testNamespaceEnv+"=1")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNET}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	return false
+}
+
+func userspaceClient(t *testing.T) *Client {
+	client, err := NewClient(setupDB(), WithUserspace(), WithFirewall(&recordingFirewall{rules: make(map[string][]string)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestUserspaceActivateLink(t *testing.T) {
+	if !inFreshNamespace(t) {
+		return
+	}
+	assert := assert.New(t)
+
+	client := userspaceClient(t)
+	defer client.Close()
+
+	testlink := baseLink()
+	testlink.Enable = false
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	err = client.ActivateLink(testlink.Name)
+	assert.Nil(err)
+
+	// The kernel only sees a TUN interface
+	tunInterface, err := netlink.LinkByName(testlink.Name)
+	assert.Nil(err)
+	assert.Equal("tuntap", tunInterface.Type())
+
+	netInterface, err := client.ns.LinkByName(testlink.Name)
+	assert.Nil(err)
+	assert.Equal("wireguard", netInterface.Type())
+	assert.Equal(testlink.MTU, netInterface.Attrs().MTU)
+	assert.Equal(net.FlagUp, netInterface.Attrs().Flags&net.FlagUp)
+
+	device, err := client.wg.Device(testlink.Name)
+	assert.Nil(err)
+	assert.Equal(wgtypes.Userspace, device.Type)
+	assert.Equal(testlink.PrivateKey.Key, device.PrivateKey)
+	assert.Equal(testlink.ListenPort, device.ListenPort)
+	assert.Equal(testlink.FirewallMark, device.FirewallMark)
+
+	addrs, err := client.ns.AddrList(netInterface, netlink.FAMILY_V4)
+	assert.Nil(err)
+	assert.Len(addrs, 1)
+	assert.Equal(testlink.AddressIPv4.String(), addrs[0].IPNet.String())
+
+	testpeer := basePeer()
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	testpeer.AllowedIPs = []IPNet{*addr}
+	err = client.AddPeer(testlink.Name, testpeer)
+	assert.Nil(err)
+
+	device, err = client.wg.Device(testlink.Name)
+	assert.Nil(err)
+	assert.Len(device.Peers, 1)
+	assert.Equal(testpeer.PublicKey.Key, device.Peers[0].PublicKey)
+
+	routes, err := client.ns.RouteList(netInterface, netlink.FAMILY_V4)
+	assert.Nil(err)
+	assert.Contains(routeDsts(routes), "10.6.6.2/32")
+
+	// The rest of the client treats the device as a kernel link
+	plan, err := client.Plan()
+	assert.Nil(err)
+	assert.True(plan.Empty(), plan.String())
+}
+
+func TestUserspaceRenameLink(t *testing.T) {
+	if !inFreshNamespace(t) {
+		return
+	}
+	assert := assert.New(t)
+
+	client := userspaceClient(t)
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	oldName := testlink.Name
+	testlink.Name = "wg-renamed"
+	err = client.UpdateLink(oldName, testlink)
+	assert.Nil(err)
+
+	_, err = client.wg.Device(oldName)
+	assert.NotNil(err)
+	device, err := client.wg.Device(testlink.Name)
+	assert.Nil(err)
+	assert.Equal(testlink.PrivateKey.Key, device.PrivateKey)
+}
+
+func TestUserspaceRemoveLink(t *testing.T) {
+	if !inFreshNamespace(t) {
+		return
+	}
+	assert := assert.New(t)
+
+	client := userspaceClient(t)
+	defer client.Close()
+
+	testlink := baseLink()
+	err := client.AddLink(testlink)
+	assert.Nil(err)
+
+	err = client.RemoveLink(testlink.Name)
+	assert.Nil(err)
+
+	_, err = netlink.LinkByName(testlink.Name)
+	assert.NotNil(err)
+	_, err = client.wg.Device(testlink.Name)
+	assert.NotNil(err)
+}
+
+func TestUserspaceHandshake(t *testing.T) {
+	if !inFreshNamespace(t) {
+		return
+	}
+	assert := assert.New(t)
+
+	lo, _ := netlink.LinkByName("lo")
+	netlink.LinkSetUp(lo)
+
+	client := userspaceClient(t)
+	defer client.Close()
+
+	// Two links on the same host, each being the peer of the other
+	link1, link2 := baseLink(), baseLink()
+	link2.Name = "wg-linko2"
+	link2.ListenPort = 9978
+	link2.PrivateKey = mustGenerateKey(t)
+	link2.AddressIPv4, _ = ParseIPNet("10.7.7.1/24")
+	link2.AddressIPv6 = nil
+	for _, link := range []Link{link1, link2} {
+		err := client.AddLink(link)
+		assert.Nil(err)
+	}
+
+	peer1, peer2 := basePeer(), basePeer()
+	peer1.PublicKey = Key{link2.PrivateKey.PublicKey()}
+	peer1.Endpoint, _ = ParseUDP("127.0.0.1:9978")
+	addr1, _ := ParseIPNet("10.6.6.1/32")
+	addr2, _ := ParseIPNet("10.7.7.1/32")
+	peer1.AllowedIPs = []IPNet{*addr2}
+	peer1.PersistentKeepalive = 1
+	peer2.PublicKey = Key{link1.PrivateKey.PublicKey()}
+	peer2.Endpoint, _ = ParseUDP("127.0.0.1:9977")
+	peer2.AllowedIPs = []IPNet{*addr1}
+	// The keepalive of peer1 starts the handshake once it is added
+	err := client.AddPeer(link2.Name, peer2)
+	assert.Nil(err)
+	err = client.AddPeer(link1.Name, peer1)
+	assert.Nil(err)
+
+	var handshake time.Time
+	for i := 0; i < 50 && handshake.IsZero(); i++ {
+		time.Sleep(100 * time.Millisecond)
+		device, err := client.wg.Device(link2.Name)
+		if err == nil && len(device.Peers) == 1 {
+			handshake = device.Peers[0].LastHandshakeTime
+		}
+	}
+	assert.False(handshake.IsZero())
+}
+
+func mustGenerateKey(t *testing.T) Key {
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Key{key}
+}
+
+func routeDsts(routes []netlink.Route) []string {
+	var dsts []string
+	for _, route := range routes {
+		if route.Dst != nil {
+			dsts = append(dsts, route.Dst.String())
+		}
+	}
+	return dsts
+}
+
+// A TUN device whose events are sent by the test.
+type eventsTUN struct {
+	tun.Device
+	events chan tun.Event
+}
+
+func (t *eventsTUN) Events() chan tun.Event {
+	return t.events
+}
+
+func (t *eventsTUN) Close() error {
+	return nil
+}
+
+func TestUserspaceTUNCloseUnblocksEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	device := &eventsTUN{events: make(chan tun.Event)}
+	tunDevice := newUserspaceTUN(device)
+
+	// Nobody reads the update once the device is closed
+	device.events <- tun.EventMTUUpdate
+	err := tunDevice.Close()
+	assert.Nil(err)
+
+	select {
+	case device.events <- tun.EventMTUUpdate:
+	case <-time.After(time.Second):
+		t.Fatal("Events are not drained after the device is closed")
+	}
+
+	close(device.events)
+	_, ok := <-tunDevice.Events()
+	assert.False(ok)
+}
@@ -0,0 +1,314 @@
+package dswg
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Keys wg-quick understands but dswg can't represent.
+var unsupportedWgQuickKeys = map[string]bool{
+	"saveconfig": true,
+	"preup":      true,
+	"predown":    true,
+}
+
+// Parses a wg-quick(8) configuration into a link and its peers.
+// wg-quick names the interface after the configuration file, so the
+// link name is given separately. The link and all its peers are enabled.
+// Peers are named by a "# Name = ..." comment in their section, and are
+// otherwise named peer1, peer2, ... in the order they appear.
+func ParseWgQuick(name string, r io.Reader) (*Link, []Peer, error) {
+	link := &Link{Name: name, Enable: true}
+	var peers []Peer
+	var peer *Peer
+	var dns []*IP
+	hasPrivateKey := false
+	section := ""
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		if peer != nil {
+			if peerName, ok := parseNameComment(line); ok {
+				peer.Name = peerName
+				continue
+			}
+		}
+
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if len(line) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+			case "peer":
+				peers = append(peers, Peer{
+					Name:   fmt.Sprintf("peer%d", len(peers)+1),
+					Enable: true,
+				})
+				peer = &peers[len(peers)-1]
+			default:
+				return nil, nil, fmt.Errorf("Line %d: unknown section %v", lineNum, line)
+			}
+			continue
+		}
+
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, nil, fmt.Errorf("Line %d: expected `Key = Value`", lineNum)
+		}
+		key := strings.TrimSpace(line[:i])
+		value := strings.TrimSpace(line[i+1:])
+
+		var err error
+		switch section {
+		case "interface":
+			if strings.EqualFold(key, "PrivateKey") {
+				hasPrivateKey = true
+			}
+			err = parseInterfaceKey(link, &dns, key, value)
+		case "peer":
+			err = parsePeerKey(peer, key, value)
+		default:
+			err = fmt.Errorf("%v is outside of any section", key)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Line %d: %v", lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if !hasPrivateKey {
+		return nil, nil, fmt.Errorf("Interface PrivateKey is missing")
+	}
+
+	switch len(dns) {
+	case 0:
+	case 1:
+		link.DefaultDNS1 = dns[0]
+	case 2:
+		link.DefaultDNS1, link.DefaultDNS2 = dns[0], dns[1]
+	default:
+		return nil, nil, fmt.Errorf("Only two DNS servers are supported, got %d", len(dns))
+	}
+
+	for i := range peers {
+		if peers[i].PublicKey == (Key{}) {
+			return nil, nil, fmt.Errorf("Peer %v PublicKey is missing", peers[i].Name)
+		}
+	}
+
+	return link, peers, nil
+}
+
+func parseInterfaceKey(link *Link, dns *[]*IP, key, value string) error {
+	var err error
+	switch strings.ToLower(key) {
+	case "address":
+		for _, addr := range splitCommaList(value) {
+			ip, err := ParseIPNet(addr)
+			if err != nil {
+				return err
+			}
+			if ip.IP.To4() != nil {
+				if link.AddressIPv4 != nil {
+					return fmt.Errorf("Only one IPv4 Address is supported")
+				}
+				link.AddressIPv4 = ip
+			} else {
+				if link.AddressIPv6 != nil {
+					return fmt.Errorf("Only one IPv6 Address is supported")
+				}
+				link.AddressIPv6 = ip
+			}
+		}
+	case "listenport":
+		link.ListenPort, err = strconv.Atoi(value)
+	case "privatekey":
+		var key *Key
+		key, err = ParseKey(value)
+		if err == nil {
+			link.PrivateKey = *key
+		}
+	case "mtu":
+		link.MTU, err = strconv.Atoi(value)
+	case "fwmark":
+		if value != "off" {
+			var mark int64
+			mark, err = strconv.ParseInt(value, 0, 32)
+			link.FirewallMark = int(mark)
+		}
+	case "table":
+		if _, err = parseTable(value); err == nil {
+			link.Table = strings.ToLower(value)
+		}
+	case "dns":
+		for _, server := range splitCommaList(value) {
+			ip, err := ParseIP(server)
+			if err != nil {
+				return fmt.Errorf("DNS search domains are not supported: %v", server)
+			}
+			*dns = append(*dns, ip)
+		}
+	case "postup":
+		link.PostUp = append(link.PostUp, value)
+	case "postdown":
+		link.PostDown = append(link.PostDown, value)
+	default:
+		return unknownWgQuickKey("Interface", key)
+	}
+	return err
+}
+
+func parsePeerKey(peer *Peer, key, value string) error {
+	var err error
+	switch strings.ToLower(key) {
+	case "publickey":
+		var key *Key
+		key, err = ParseKey(value)
+		if err == nil {
+			peer.PublicKey = *key
+		}
+	case "presharedkey":
+		peer.PresharedKey, err = ParseKey(value)
+	case "allowedips":
+		for _, allowed := range splitCommaList(value) {
+			ip, err := ParseIPNet(allowed)
+			if err != nil {
+				return err
+			}
+			peer.AllowedIPs = append(peer.AllowedIPs, *ip)
+		}
+	case "endpoint":
+		peer.Endpoint, err = ParseUDP(value)
+	case "persistentkeepalive":
+		if value != "off" {
+			peer.PersistentKeepalive, err = strconv.ParseInt(value, 10, 64)
+		}
+	default:
+		return unknownWgQuickKey("Peer", key)
+	}
+	return err
+}
+
+func unknownWgQuickKey(section, key string) error {
+	if unsupportedWgQuickKeys[strings.ToLower(key)] {
+		return fmt.Errorf("%v key %v is not supported by dswg", section, key)
+	}
+	return fmt.Errorf("Unknown %v key %v", section, key)
+}
+
+// Parses a "# Name = ..." comment line.
+func parseNameComment(line string) (string, bool) {
+	if !strings.HasPrefix(line, "#") {
+		return "", false
+	}
+
+	line = strings.TrimSpace(line[1:])
+	i := strings.IndexByte(line, '=')
+	if i < 0 || !strings.EqualFold(strings.TrimSpace(line[:i]), "Name") {
+		return "", false
+	}
+
+	name := strings.TrimSpace(line[i+1:])
+	return name, len(name) > 0
+}
+
+func splitCommaList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Renders the link and its enabled peers as a wg-quick(8) configuration.
+// Zero values (ex. a random listen port) are left out, and peer names
+// are kept in "# Name = ..." comments.
+func WriteWgQuick(w io.Writer, link Link, peers []Peer) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintln(bw, "[Interface]")
+	var addrs []string
+	if link.AddressIPv4 != nil {
+		addrs = append(addrs, link.AddressIPv4.String())
+	}
+	if link.AddressIPv6 != nil {
+		addrs = append(addrs, link.AddressIPv6.String())
+	}
+	if len(addrs) > 0 {
+		fmt.Fprintf(bw, "Address = %v\n", strings.Join(addrs, ", "))
+	}
+	if link.ListenPort != 0 {
+		fmt.Fprintf(bw, "ListenPort = %d\n", link.ListenPort)
+	}
+	fmt.Fprintf(bw, "PrivateKey = %v\n", link.PrivateKey)
+	if link.MTU != 0 {
+		fmt.Fprintf(bw, "MTU = %d\n", link.MTU)
+	}
+	if link.FirewallMark != 0 {
+		fmt.Fprintf(bw, "FwMark = %d\n", link.FirewallMark)
+	}
+	if len(link.Table) > 0 && link.Table != TableAuto {
+		fmt.Fprintf(bw, "Table = %v\n", link.Table)
+	}
+	var dns []string
+	for _, server := range []*IP{link.DefaultDNS1, link.DefaultDNS2} {
+		if server != nil {
+			dns = append(dns, server.String())
+		}
+	}
+	if len(dns) > 0 {
+		fmt.Fprintf(bw, "DNS = %v\n", strings.Join(dns, ", "))
+	}
+	for _, cmd := range link.PostUp {
+		if len(cmd) > 0 {
+			fmt.Fprintf(bw, "PostUp = %v\n", cmd)
+		}
+	}
+	for _, cmd := range link.PostDown {
+		if len(cmd) > 0 {
+			fmt.Fprintf(bw, "PostDown = %v\n", cmd)
+		}
+	}
+
+	for _, peer := range peers {
+		if !peer.Enable {
+			continue
+		}
+
+		fmt.Fprintln(bw)
+		fmt.Fprintln(bw, "[Peer]")
+		if len(peer.Name) > 0 {
+			fmt.Fprintf(bw, "# Name = %v\n", peer.Name)
+		}
+		fmt.Fprintf(bw, "PublicKey = %v\n", peer.PublicKey)
+		if peer.PresharedKey != nil {
+			fmt.Fprintf(bw, "PresharedKey = %v\n", peer.PresharedKey)
+		}
+		if len(peer.AllowedIPs) > 0 {
+			fmt.Fprintf(bw, "AllowedIPs = %v\n", joinIPNets(peer.AllowedIPs))
+		}
+		if peer.Endpoint != nil {
+			fmt.Fprintf(bw, "Endpoint = %v\n", peer.Endpoint)
+		}
+		if peer.PersistentKeepalive != 0 {
+			fmt.Fprintf(bw, "PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+		}
+	}
+
+	return bw.Flush()
+}
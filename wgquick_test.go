@@ -0,0 +1,166 @@
+package dswg
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testWgQuickConf = `
+[Interface]
+# Comments are ignored
+Address = 10.6.6.1/24, 2001::/32
+ListenPort = 9977
+PrivateKey = 4AQ6d+dvykkl4j6VG03e7VcciDbgn5mBEJFXMjn1pnU=
+MTU = 1420
+FwMark = 0xa455
+DNS = 1.1.1.1
+PostUp = iptables -A FORWARD -i %i -j ACCEPT # allow forwarding
+PostDown = iptables -D FORWARD -i %i -j ACCEPT
+
+[Peer]
+# Name = zoz-pc
+PublicKey = ZOZ+ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=
+PresharedKey = ZOZ+ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=
+AllowedIPs = 10.6.6.2/32
+AllowedIPs = 10.6.7.0/24
+Endpoint = 192.168.0.1:42064
+PersistentKeepalive = 25
+
+[peer]
+publickey = RND1ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=
+`
+
+func TestParseWgQuickValid(t *testing.T) {
+	assert := assert.New(t)
+
+	link, peers, err := ParseWgQuick("wg-linko", strings.NewReader(testWgQuickConf))
+	assert.Nil(err)
+
+	testlink := baseLink()
+	testlink.DefaultAllowedIPs = nil
+	testlink.Host = ""
+	testlink.PostUp = []string{"iptables -A FORWARD -i %i -j ACCEPT"}
+	testlink.PostDown = []string{"iptables -D FORWARD -i %i -j ACCEPT"}
+	assert.Equal(testlink, *link)
+
+	testpeer := basePeer()
+	testpeer.DNS1 = nil
+	testpeer.PersistentKeepalive = 25
+	addr1, _ := ParseIPNet("10.6.6.2/32")
+	addr2, _ := ParseIPNet("10.6.7.0/24")
+	testpeer.AllowedIPs = []IPNet{*addr1, *addr2}
+
+	key, _ := ParseKey("RND1ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=")
+	assert.Equal([]Peer{
+		testpeer,
+		{Name: "peer2", Enable: true, PublicKey: *key},
+	}, peers)
+}
+
+func TestWgQuickRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	testlink := baseLink()
+	testlink.DefaultAllowedIPs = nil
+	testlink.Host = ""
+	dns2, _ := ParseIP("1.0.0.1")
+	testlink.DefaultDNS2 = dns2
+	testlink.Table = "1234"
+
+	testpeer1 := basePeer()
+	testpeer1.Name = "peer1"
+	testpeer1.DNS1 = nil
+	testpeer1.PersistentKeepalive = 25
+	addr, _ := ParseIPNet("10.6.6.2/32")
+	testpeer1.AllowedIPs = []IPNet{*addr}
+
+	testpeer2 := basePeer()
+	testpeer2.Name = "peer2"
+	testpeer2.DNS1 = nil
+	testpeer2.PresharedKey = nil
+	testpeer2.Endpoint = nil
+	randkey, _ := ParseKey("RND2ngJZ2jf+sREdOi/b0D8rTGMbcjgSA854Jn2KbzQ=")
+	testpeer2.PublicKey = *randkey
+
+	var buf bytes.Buffer
+	err := WriteWgQuick(&buf, testlink, []Peer{testpeer1, testpeer2})
+	assert.Nil(err)
+
+	link, peers, err := ParseWgQuick(testlink.Name, &buf)
+	assert.Nil(err)
+	assert.Equal(testlink, *link)
+	assert.Equal([]Peer{testpeer1, testpeer2}, peers)
+}
+
+func TestWriteWgQuickSkipsDisabledPeers(t *testing.T) {
+	assert := assert.New(t)
+
+	testpeer := basePeer()
+	testpeer.Enable = false
+
+	var buf bytes.Buffer
+	err := WriteWgQuick(&buf, baseLink(), []Peer{testpeer})
+	assert.Nil(err)
+	assert.NotContains(buf.String(), "[Peer]")
+}
+
+func TestWriteWgQuickOmitsZeroValues(t *testing.T) {
+	assert := assert.New(t)
+
+	testlink := baseLink()
+	testlink.ListenPort = 0
+	testlink.MTU = 0
+	testlink.FirewallMark = 0
+
+	var buf bytes.Buffer
+	err := WriteWgQuick(&buf, testlink, nil)
+	assert.Nil(err)
+	assert.NotContains(buf.String(), "ListenPort")
+	assert.NotContains(buf.String(), "MTU")
+	assert.NotContains(buf.String(), "FwMark")
+}
+
+func TestParseWgQuickUnsupportedKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, key := range []string{"SaveConfig = true", "PreUp = true", "PreDown = true"} {
+		conf := "[Interface]\n" + key + "\n"
+		_, _, err := ParseWgQuick("wg0", strings.NewReader(conf))
+		assert.NotNil(err)
+		assert.Contains(err.Error(), "not supported")
+		assert.Contains(err.Error(), "Line 2")
+	}
+}
+
+func TestParseWgQuickInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	confs := []string{
+		// Unknown key
+		"[Interface]\nPrivateKey = 4AQ6d+dvykkl4j6VG03e7VcciDbgn5mBEJFXMjn1pnU=\nFoo = bar\n",
+		// Unknown section
+		"[Foo]\n",
+		// Key outside of a section
+		"PrivateKey = 4AQ6d+dvykkl4j6VG03e7VcciDbgn5mBEJFXMjn1pnU=\n",
+		// Missing private key
+		"[Interface]\nAddress = 10.0.0.1/24\n",
+		// Missing peer public key
+		"[Interface]\nPrivateKey = 4AQ6d+dvykkl4j6VG03e7VcciDbgn5mBEJFXMjn1pnU=\n[Peer]\nAllowedIPs = 10.0.0.2/32\n",
+		// Two IPv4 addresses
+		"[Interface]\nAddress = 10.0.0.1/24, 10.1.0.1/24\n",
+		// DNS search domain
+		"[Interface]\nDNS = 1.1.1.1, example.com\n",
+		// Missing value separator
+		"[Interface]\nPrivateKey\n",
+		// Table that is neither a number, auto nor off
+		"[Interface]\nTable = main\n",
+	}
+
+	for _, conf := range confs {
+		_, _, err := ParseWgQuick("wg0", strings.NewReader(conf))
+		assert.NotNil(err, conf)
+	}
+}